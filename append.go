@@ -0,0 +1,74 @@
+package rbtree
+
+import "sync/atomic"
+
+// appendStreak is how many inserts in a row must create a new largest key
+// before inserts try the append path.
+const appendStreak = 16
+
+// appender keeps the state of the append path. Time-ordered keys always
+// land right of the largest node, so once a run of them is seen an insert
+// links its key there directly instead of lock coupling down from the
+// root.
+type appender[K any, V any] struct {
+	// tail is the node holding the largest key, or nil if that is not
+	// known. It is set by the insert that linked the node, before that
+	// insert releases the node's parent, and cleared by moved, so a delete
+	// clears it before the node can be recycled.
+	tail   atomic.Pointer[RBTreeNode[K, V]]
+	streak atomic.Int32 // inserts in a row that created a new largest key
+}
+
+// appendAt locks the tail for an insert of key if the inserts are running
+// in order and key goes right of it. ok is false if the insert has to
+// locate its place from the root.
+func (t *RBTree[K, V]) appendAt(key K, d *opDesc[K]) (n *RBTreeNode[K, V], ok bool, err error) {
+	a := &t.appends
+	if a.streak.Load() < appendStreak {
+		return nil, false, nil
+	}
+	if n = a.tail.Load(); n == nil || !n.lock() {
+		return nil, false, nil
+	}
+	// a locked tail that is not retired keeps the largest key: a larger
+	// one is linked below it, and a delete retires it
+	if n.retired.Load() || n.right.Load() != nil || a.tail.Load() != n {
+		n.unlock()
+		return nil, false, nil
+	}
+	if t.guard {
+		defer func() {
+			if r := recover(); r != nil {
+				n.unlock()
+				n, ok, err = nil, false, t.recovered(r)
+			}
+		}()
+	}
+	if t.compare(key, n.key) <= 0 {
+		n.unlock()
+		return nil, false, nil
+	}
+	d.attempt()
+	t.visit(OpInsert, 0)
+	d.visit()
+	d.hold(n.key)
+	d.enter(PhaseApply)
+	t.perturb(chaosLocked)
+	return n, true, nil
+}
+
+// appended counts a key linked below n. largest tells whether n held the
+// largest key, so the new node x does now. n must still be locked.
+func (t *RBTree[K, V]) appended(x *RBTreeNode[K, V], largest bool) {
+	a := &t.appends
+	if !largest {
+		if a.streak.Load() != 0 {
+			a.streak.Store(0)
+		}
+		return
+	}
+	a.tail.Store(x)
+	if a.streak.Load() < appendStreak {
+		a.streak.Add(1)
+	}
+}
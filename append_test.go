@@ -0,0 +1,96 @@
+package rbtree_test
+
+import (
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iku50/rbtree-go"
+)
+
+func TestAppendPath(t *testing.T) {
+	tree := rbtree.New[int, int](rbtree.WithGetSampling(1))
+	for k := 0; k < 1000; k++ {
+		tree.Insert(k, k)
+	}
+	assert.Nil(t, tree.Check())
+	s := tree.Stats()
+	assert.Equal(t, uint64(1000), s.InsertSamples)
+	assert.Greater(t, s.AppendRate(), 0.95)
+	assert.Less(t, s.FixupStepsPerInsert(), 2.0)
+	assert.NotZero(t, s.MaxInsertFixupSteps)
+
+	// deleting the largest key, or a smaller one, leaves the path usable
+	tree.Delete(999)
+	tree.Delete(500)
+	for k := 999; k < 1100; k++ {
+		tree.Insert(k, k)
+	}
+	tree.Insert(500, 500)
+	assert.Equal(t, 10, tree.DeleteRange(1090, 1100))
+	for k := 1090; k < 1200; k++ {
+		tree.Insert(k, k)
+	}
+	left, right := tree.Split(600)
+	left.Delete(599)
+	left.Insert(599, 599)
+	right.Insert(1200, 1200)
+	assert.Nil(t, tree.Join(left))
+	assert.Nil(t, tree.Join(right))
+	for k := 1201; k < 1300; k++ {
+		tree.Insert(k, k)
+	}
+	assert.Nil(t, tree.Check())
+	assert.Equal(t, 1300, tree.Len())
+	for k := 0; k < 1300; k++ {
+		assert.Equal(t, k, *tree.Get(k))
+	}
+
+	prev := tree.Stats()
+	for _, k := range rand.Perm(1000) {
+		tree.Insert(-1-k, k)
+	}
+	s = tree.Stats().Delta(prev)
+	assert.Equal(t, uint64(1000), s.InsertSamples)
+	assert.Zero(t, s.InsertAppends)
+	assert.Nil(t, tree.Check())
+}
+
+func TestAppendPathConcurrent(t *testing.T) {
+	tree := rbtree.New[int, int](rbtree.WithSingleProcFallback(false), rbtree.WithGetSampling(1))
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				k := int(next.Add(1))
+				tree.Insert(k, k)
+				if i%50 == 0 {
+					// deletes of what may be the largest key race with
+					// the appends
+					tree.Delete(k)
+					tree.Insert(k, k)
+				}
+				assert.Equal(t, k, *tree.Get(k))
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Nil(t, tree.Check())
+	assert.Greater(t, tree.Stats().InsertAppends, uint64(0))
+	prev := 0
+	n := 0
+	tree.Range(func(k, v int) bool {
+		assert.Less(t, prev, k)
+		assert.Equal(t, k, v)
+		prev = k
+		n++
+		return true
+	})
+	assert.Equal(t, 8000, n)
+}
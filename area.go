@@ -0,0 +1,168 @@
+package rbtree
+
+// The functions in this file decide the shape of the locking protocol:
+// which nodes each step of an operation locks, which ancestors a delete
+// fixup marks, and when a step has to wait for other fixups. They only
+// read the nodes they are given and take no locks, so they can be tested
+// on trees built by hand. The localArea methods in rbtree.go carry out
+// what they decide with compare-and-swap.
+
+// nodeSet is a small duplicate-free list of nodes, the shape of an area
+// before it is locked.
+type nodeSet[K any, V any] struct {
+	nodes [areaSize]*RBTreeNode[K, V]
+	n     int
+}
+
+func (s *nodeSet[K, V]) add(n *RBTreeNode[K, V]) {
+	if n == nil || s.n == len(s.nodes) {
+		return
+	}
+	for _, m := range s.nodes[:s.n] {
+		if m == n {
+			return
+		}
+	}
+	s.nodes[s.n] = n
+	s.n++
+}
+
+// insertSet lists the nodes an insert fixup at x reads or writes: x and
+// its children, its parent and sibling, the grandparent, the uncle and the
+// grandparent's parent, whose child pointer a rotation at the grandparent
+// replaces.
+func insertSet[K any, V any](x *RBTreeNode[K, V]) nodeSet[K, V] {
+	var s nodeSet[K, V]
+	s.add(x)
+	s.add(x.left.Load())
+	s.add(x.right.Load())
+	p := x.parent.Load()
+	if p == nil {
+		return s
+	}
+	s.add(p)
+	s.add(x.sibling())
+	g := p.parent.Load()
+	if g == nil {
+		return s
+	}
+	s.add(g)
+	s.add(p.sibling())
+	s.add(g.parent.Load())
+	return s
+}
+
+// deleteSet lists the nodes a delete fixup at n reads or writes: n, its
+// parent and grandparent, the sibling and both nephews, and the children
+// of the inner nephew and of its inner child, which rotations at a red or
+// black sibling bring into reach.
+func deleteSet[K any, V any](n *RBTreeNode[K, V]) nodeSet[K, V] {
+	var s nodeSet[K, V]
+	s.add(n)
+	p := n.parent.Load()
+	if p == nil {
+		return s
+	}
+	s.add(p)
+	s.add(p.parent.Load())
+	d := n.dir()
+	sib := p.child(opposite(d))
+	if sib == nil {
+		return s
+	}
+	s.add(sib)
+	s.add(sib.child(opposite(d)))
+	inner := sib.child(d)
+	if inner == nil {
+		return s
+	}
+	s.add(inner)
+	s.add(inner.left.Load())
+	s.add(inner.right.Load())
+	if ii := inner.child(d); ii != nil {
+		s.add(ii.left.Load())
+		s.add(ii.right.Load())
+	}
+	return s
+}
+
+// removalSet lists what unlinking s takes: a leaf needs the fixup area
+// around it in case it is black, otherwise s, its parent and its child.
+func removalSet[K any, V any](s *RBTreeNode[K, V]) nodeSet[K, V] {
+	l, r := s.left.Load(), s.right.Load()
+	if l == nil && r == nil {
+		return deleteSet(s)
+	}
+	var set nodeSet[K, V]
+	set.add(s)
+	set.add(s.parent.Load())
+	set.add(l)
+	set.add(r)
+	return set
+}
+
+// sizeSet lists the nodes fixSize locks to carry x's size to its parent.
+func sizeSet[K any, V any](x *RBTreeNode[K, V]) nodeSet[K, V] {
+	var s nodeSet[K, V]
+	s.add(x)
+	s.add(x.parent.Load())
+	return s
+}
+
+// insertWaits reports whether an insert fixup at x has to wait for other
+// fixups. The cases assume a black grandparent, so a violation one level
+// up is resolved first. And x, its parent and grandparent, the nodes the
+// fixup may rotate, must not owe blacks: rotating them would move the debt
+// onto paths that do not lack the black.
+func insertWaits[K any, V any](x *RBTreeNode[K, V]) bool {
+	if p := x.parent.Load(); p.isRed() && p.parent.Load().isRed() {
+		return true
+	}
+	for i := 0; i < 3 && x != nil; i++ {
+		if x.extra > 0 {
+			return true
+		}
+		x = x.parent.Load()
+	}
+	return false
+}
+
+// deleteWaits reports whether a delete step at a black node has to wait
+// for other fixups, given the nodes of its locked area. A node other than
+// skip or merge that owes blacks to pending delete fixups must settle
+// first. And the step waits for the insert that is resolving a red node
+// with a red parent in the area, as its cases assume the colors are valid
+// everywhere but at the step's own node.
+func deleteWaits[K any, V any](area []*RBTreeNode[K, V], skip, merge *RBTreeNode[K, V]) bool {
+	in := func(n *RBTreeNode[K, V]) bool {
+		for _, m := range area {
+			if m == n {
+				return true
+			}
+		}
+		return false
+	}
+	for _, n := range area {
+		if n == nil {
+			continue
+		}
+		if n != skip && n != merge && n.extra > 0 {
+			return true
+		}
+		if p := n.parent.Load(); n.isRed() && in(p) && p.isRed() {
+			return true
+		}
+	}
+	return false
+}
+
+// markSet lists the ancestors a delete fixup at n marks, markDepth of
+// them from n's parent up, so that two fixups moving up the tree keep their
+// distance.
+func markSet[K any, V any](n *RBTreeNode[K, V]) nodeSet[K, V] {
+	var s nodeSet[K, V]
+	for d := n.parent.Load(); s.n < markDepth && d != nil; d = d.parent.Load() {
+		s.add(d)
+	}
+	return s
+}
@@ -0,0 +1,187 @@
+package rbtree
+
+import (
+	"math/rand/v2"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// nodeState is the part of a node the rebalancing steps write.
+type nodeState struct {
+	c                   color
+	left, right, parent *RBTreeNode[int, int]
+	size, reported      int
+	extra               int32
+}
+
+func states(n *RBTreeNode[int, int], into map[*RBTreeNode[int, int]]nodeState) map[*RBTreeNode[int, int]]nodeState {
+	if n != nil {
+		into[n] = nodeState{n.c, n.left.Load(), n.right.Load(), n.parent.Load(), n.size, n.reported, n.extra}
+		states(n.left.Load(), into)
+		states(n.right.Load(), into)
+	}
+	return into
+}
+
+// checkStep runs step on a clone of tree at each node pick accepts and
+// asserts that it changes no node outside the set computed beforehand.
+func checkStep(t *testing.T, tree *RBTree[int, int], pick func(n *RBTreeNode[int, int]) bool,
+	set func(*RBTreeNode[int, int]) nodeSet[int, int], step func(c *RBTree[int, int], n *RBTreeNode[int, int])) int {
+	checked := 0
+	for _, key := range treeKeys(tree) {
+		c := shapeClone(tree)
+		n := c.root.Load()
+		for n.key != key {
+			if key < n.key {
+				n = n.left.Load()
+			} else {
+				n = n.right.Load()
+			}
+		}
+		if !pick(n) {
+			continue
+		}
+		s := set(n)
+		in := map[*RBTreeNode[int, int]]bool{}
+		for _, m := range s.nodes[:s.n] {
+			in[m] = true
+		}
+		before := states(c.root.Load(), map[*RBTreeNode[int, int]]nodeState{})
+		step(c, n)
+		after := states(c.root.Load(), map[*RBTreeNode[int, int]]nodeState{})
+		for m, st := range before {
+			if after[m] != st && !in[m] {
+				t.Errorf("step at %d changed %d outside its set", key, m.key)
+			}
+		}
+		checked++
+	}
+	return checked
+}
+
+// shapeClone copies tree with its shape and colors, which Clone does not
+// keep.
+func shapeClone(tree *RBTree[int, int]) *RBTree[int, int] {
+	tree.gate.Lock()
+	s := tree.frozenCopy()
+	tree.gate.Unlock()
+	c := newTree[int, int](tree.compare, tree.opts)
+	c.adopt(s)
+	return c
+}
+
+func treeKeys(tree *RBTree[int, int]) []int {
+	var keys []int
+	tree.Range(func(key, _ int) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+func randomTree(n int) *RBTree[int, int] {
+	tree := New[int, int]()
+	for _, k := range rand.Perm(n) {
+		tree.Insert(k, k)
+	}
+	return tree
+}
+
+func TestInsertSetCoversStep(t *testing.T) {
+	checked := 0
+	for round := 0; round < 20; round++ {
+		checked += checkStep(t, randomTree(100), func(x *RBTreeNode[int, int]) bool {
+			return x.isBlack() && x.parent.Load().isRed()
+		}, insertSet, func(c *RBTree[int, int], x *RBTreeNode[int, int]) {
+			x.c = red // the violation an insert below x leaves
+			c.insertStep(x)
+		})
+	}
+	assert.Positive(t, checked)
+}
+
+func TestDeleteSetCoversStep(t *testing.T) {
+	checked := 0
+	for round := 0; round < 20; round++ {
+		checked += checkStep(t, randomTree(100), func(n *RBTreeNode[int, int]) bool {
+			return n.isBlack() && n.parent.Load() != nil
+		}, deleteSet, func(c *RBTree[int, int], n *RBTreeNode[int, int]) {
+			// n gives up a black, as fixDelete does before a step
+			if n = c.deleteStep(n); n != nil {
+				n.extra++
+			}
+		})
+	}
+	assert.Positive(t, checked)
+}
+
+func TestRemovalSetCoversUnlink(t *testing.T) {
+	checked := 0
+	for round := 0; round < 20; round++ {
+		checked += checkStep(t, randomTree(100), func(s *RBTreeNode[int, int]) bool {
+			return s.left.Load() == nil || s.right.Load() == nil
+		}, removalSet, func(c *RBTree[int, int], s *RBTreeNode[int, int]) {
+			c.unlink(s)
+		})
+	}
+	assert.Positive(t, checked)
+}
+
+func TestSizeSet(t *testing.T) {
+	tree := randomTree(10)
+	r := tree.root.Load()
+	s := sizeSet(r)
+	assert.Equal(t, []*RBTreeNode[int, int]{r}, s.nodes[:s.n])
+	l := r.left.Load()
+	s = sizeSet(l)
+	assert.Equal(t, []*RBTreeNode[int, int]{l, r}, s.nodes[:s.n])
+}
+
+func TestMarkSet(t *testing.T) {
+	tree := randomTree(1000)
+	n := tree.root.Load()
+	var path []*RBTreeNode[int, int]
+	for n.left.Load() != nil {
+		path = append(path, n)
+		n = n.left.Load()
+	}
+	s := markSet(n)
+	want := path[max(0, len(path)-markDepth):]
+	assert.Len(t, want, markDepth)
+	for i, d := range s.nodes[:s.n] {
+		assert.Same(t, want[len(want)-1-i], d, "ancestor %d", i)
+	}
+	s = markSet(tree.root.Load())
+	assert.Zero(t, s.n)
+}
+
+func TestWaits(t *testing.T) {
+	tree := randomTree(1000)
+	r := tree.root.Load()
+	l, rr := r.left.Load(), r.right.Load()
+	x := l.left.Load()
+	below := x.left.Load().left.Load()
+	area := []*RBTreeNode[int, int]{r, l, rr, x}
+	r.c, l.c, x.c = black, black, black
+
+	assert.False(t, insertWaits(x))
+	assert.False(t, deleteWaits(area, nil, nil))
+
+	// a debt in the area, unless it is the step's own or its sibling's
+	l.extra = 1
+	assert.True(t, insertWaits(x))
+	assert.True(t, deleteWaits(area, nil, nil))
+	assert.False(t, deleteWaits(area, l, rr))
+	assert.False(t, deleteWaits(area, rr, l))
+	l.extra, r.extra = 0, 1
+	assert.True(t, insertWaits(x))
+	assert.False(t, insertWaits(below), "a debt more than two levels up")
+	r.extra = 0
+
+	// a red-red pair being resolved
+	l.c, x.c = red, red
+	assert.True(t, deleteWaits(area, nil, nil))
+	assert.False(t, deleteWaits(area[:2], nil, nil), "the pair's lower node is outside the area")
+	assert.True(t, insertWaits(x.left.Load()))
+}
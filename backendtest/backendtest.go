@@ -0,0 +1,345 @@
+// Package backendtest is a conformance suite for ordered map backends. It
+// checks that a backend answers like the concurrent red-black tree of
+// package rbtree, so code can move between backends without surprises:
+//
+//	func TestConformance(t *testing.T) {
+//		backendtest.Run(t, func() backendtest.Map { return mybackend.New[int, int]() })
+//	}
+//
+// The suite drives a map from one goroutine at a time. A backend that is
+// safe for concurrent use should test that on its own.
+package backendtest
+
+import (
+	"math/rand/v2"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Map is the part of a backend the suite checks, with int keys and values.
+// The methods have the semantics of the methods of the same names of
+// rbtree.RBTree, which implements Map.
+type Map interface {
+	Insert(key, value int)
+	Get(key int) *int
+	Delete(key int) *int
+	Len() int
+	Min() (int, *int)
+	Max() (int, *int)
+	Floor(key int) (int, *int)
+	Ceiling(key int) (int, *int)
+	Predecessor(key int) (int, *int)
+	Successor(key int) (int, *int)
+	Range(f func(key, value int) bool)
+	RangeDescending(f func(key, value int) bool)
+	Rank(key int) int
+	Select(i int) (key, value int, ok bool)
+	DeleteRange(lo, hi int) int
+}
+
+// Factory returns a new empty Map on every call.
+type Factory func() Map
+
+// Run runs the suite against the maps made by factory, each check in a
+// subtest of its own.
+func Run(t *testing.T, factory Factory) {
+	t.Run("Empty", func(t *testing.T) { testEmpty(t, factory()) })
+	t.Run("InsertGet", func(t *testing.T) { testInsertGet(t, factory()) })
+	t.Run("Delete", func(t *testing.T) { testDelete(t, factory()) })
+	t.Run("Order", func(t *testing.T) { testOrder(t, factory()) })
+	t.Run("Neighbors", func(t *testing.T) { testNeighbors(t, factory()) })
+	t.Run("RankSelect", func(t *testing.T) { testRankSelect(t, factory()) })
+	t.Run("DeleteRange", func(t *testing.T) { testDeleteRange(t, factory()) })
+	t.Run("Random", func(t *testing.T) { testRandom(t, factory()) })
+}
+
+func testEmpty(t *testing.T, m Map) {
+	assert.Equal(t, 0, m.Len())
+	assert.Nil(t, m.Get(1))
+	assert.Nil(t, m.Delete(1))
+	for name, lookup := range map[string]func() (int, *int){
+		"Min":         m.Min,
+		"Max":         m.Max,
+		"Floor":       func() (int, *int) { return m.Floor(1) },
+		"Ceiling":     func() (int, *int) { return m.Ceiling(1) },
+		"Predecessor": func() (int, *int) { return m.Predecessor(1) },
+		"Successor":   func() (int, *int) { return m.Successor(1) },
+	} {
+		_, v := lookup()
+		assert.Nil(t, v, name)
+	}
+	m.Range(func(key, value int) bool {
+		t.Errorf("Range visited %d on an empty map", key)
+		return true
+	})
+	m.RangeDescending(func(key, value int) bool {
+		t.Errorf("RangeDescending visited %d on an empty map", key)
+		return true
+	})
+	assert.Equal(t, 0, m.Rank(1))
+	_, _, ok := m.Select(0)
+	assert.False(t, ok)
+	assert.Equal(t, 0, m.DeleteRange(0, 10))
+}
+
+func testInsertGet(t *testing.T, m Map) {
+	for k := 0; k < 100; k++ {
+		m.Insert(k*3, k)
+	}
+	assert.Equal(t, 100, m.Len())
+	for k := 0; k < 300; k++ {
+		v := m.Get(k)
+		if k%3 != 0 {
+			assert.Nil(t, v, k)
+			continue
+		}
+		if assert.NotNil(t, v, k) {
+			assert.Equal(t, k/3, *v, k)
+		}
+	}
+	// inserting a present key replaces its value
+	m.Insert(30, -1)
+	assert.Equal(t, 100, m.Len())
+	assert.Equal(t, -1, *m.Get(30))
+	assert.Equal(t, 1, *m.Get(3))
+
+	m.Insert(-5, 5)
+	assert.Equal(t, 5, *m.Get(-5))
+	k, v := m.Min()
+	assert.Equal(t, -5, k)
+	assert.Equal(t, 5, *v)
+	k, v = m.Max()
+	assert.Equal(t, 297, k)
+	assert.Equal(t, 99, *v)
+}
+
+func testDelete(t *testing.T, m Map) {
+	for k := 0; k < 100; k++ {
+		m.Insert(k, k+1000)
+	}
+	for k := 0; k < 100; k += 2 {
+		v := m.Delete(k)
+		if assert.NotNil(t, v, k) {
+			assert.Equal(t, k+1000, *v)
+		}
+	}
+	assert.Nil(t, m.Delete(0), "deleting twice")
+	assert.Nil(t, m.Delete(1000), "deleting an absent key")
+	assert.Equal(t, 50, m.Len())
+	for k := 0; k < 100; k++ {
+		assert.Equal(t, k%2 == 1, m.Get(k) != nil, k)
+	}
+	for k := 1; k < 100; k += 2 {
+		m.Delete(k)
+	}
+	testEmpty(t, m)
+	m.Insert(7, 7)
+	assert.Equal(t, 7, *m.Get(7))
+	assert.Equal(t, 1, m.Len())
+}
+
+func testOrder(t *testing.T, m Map) {
+	want := rand.Perm(200)
+	for _, k := range want {
+		m.Insert(k-100, k)
+	}
+	var keys []int
+	m.Range(func(key, value int) bool {
+		assert.Equal(t, key+100, value)
+		keys = append(keys, key)
+		return true
+	})
+	assert.True(t, slices.IsSorted(keys), "Range out of order")
+	assert.Len(t, keys, 200)
+
+	var down []int
+	m.RangeDescending(func(key, value int) bool {
+		down = append(down, key)
+		return true
+	})
+	slices.Reverse(down)
+	assert.Equal(t, keys, down, "RangeDescending is not Range reversed")
+
+	// both stop as soon as f returns false
+	n := 0
+	m.Range(func(key, value int) bool {
+		n++
+		return n < 10
+	})
+	assert.Equal(t, 10, n)
+	n = 0
+	m.RangeDescending(func(key, value int) bool {
+		n++
+		return false
+	})
+	assert.Equal(t, 1, n)
+}
+
+func testNeighbors(t *testing.T, m Map) {
+	for k := 10; k <= 50; k += 10 {
+		m.Insert(k, -k)
+	}
+	type lookup struct {
+		f    func(int) (int, *int)
+		name string
+	}
+	for _, c := range []struct {
+		lookup
+		key, want int
+		found     bool
+	}{
+		{lookup{m.Floor, "Floor"}, 30, 30, true},
+		{lookup{m.Floor, "Floor"}, 35, 30, true},
+		{lookup{m.Floor, "Floor"}, 60, 50, true},
+		{lookup{m.Floor, "Floor"}, 9, 0, false},
+		{lookup{m.Ceiling, "Ceiling"}, 30, 30, true},
+		{lookup{m.Ceiling, "Ceiling"}, 35, 40, true},
+		{lookup{m.Ceiling, "Ceiling"}, 0, 10, true},
+		{lookup{m.Ceiling, "Ceiling"}, 51, 0, false},
+		{lookup{m.Predecessor, "Predecessor"}, 30, 20, true},
+		{lookup{m.Predecessor, "Predecessor"}, 35, 30, true},
+		{lookup{m.Predecessor, "Predecessor"}, 10, 0, false},
+		{lookup{m.Successor, "Successor"}, 30, 40, true},
+		{lookup{m.Successor, "Successor"}, 35, 40, true},
+		{lookup{m.Successor, "Successor"}, 50, 0, false},
+	} {
+		k, v := c.f(c.key)
+		if !c.found {
+			assert.Nil(t, v, "%s(%d)", c.name, c.key)
+			continue
+		}
+		if assert.NotNil(t, v, "%s(%d)", c.name, c.key) {
+			assert.Equal(t, c.want, k, "%s(%d)", c.name, c.key)
+			assert.Equal(t, -c.want, *v, "%s(%d)", c.name, c.key)
+		}
+	}
+}
+
+func testRankSelect(t *testing.T, m Map) {
+	for _, k := range rand.Perm(100) {
+		m.Insert(k*2, k)
+	}
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, i, m.Rank(i*2), "Rank(%d)", i*2)
+		assert.Equal(t, i+1, m.Rank(i*2+1), "Rank(%d)", i*2+1)
+		k, v, ok := m.Select(i)
+		assert.True(t, ok, "Select(%d)", i)
+		assert.Equal(t, i*2, k, "Select(%d)", i)
+		assert.Equal(t, i, v, "Select(%d)", i)
+	}
+	assert.Equal(t, 0, m.Rank(-1))
+	_, _, ok := m.Select(100)
+	assert.False(t, ok)
+	_, _, ok = m.Select(-1)
+	assert.False(t, ok)
+
+	m.Delete(0)
+	assert.Equal(t, 0, m.Rank(2))
+	k, _, _ := m.Select(0)
+	assert.Equal(t, 2, k)
+}
+
+func testDeleteRange(t *testing.T, m Map) {
+	for k := 0; k < 100; k++ {
+		m.Insert(k, k)
+	}
+	assert.Equal(t, 10, m.DeleteRange(20, 30))
+	assert.Equal(t, 0, m.DeleteRange(20, 30))
+	assert.Equal(t, 0, m.DeleteRange(50, 50), "an empty range")
+	assert.Equal(t, 0, m.DeleteRange(60, 40), "a reversed range")
+	assert.Equal(t, 90, m.Len())
+	assert.Nil(t, m.Get(20))
+	assert.Nil(t, m.Get(29))
+	assert.NotNil(t, m.Get(19))
+	assert.NotNil(t, m.Get(30))
+	k, _ := m.Successor(19)
+	assert.Equal(t, 30, k)
+	assert.Equal(t, 20, m.Rank(30))
+
+	assert.Equal(t, 85, m.DeleteRange(-10, 95))
+	assert.Equal(t, 5, m.DeleteRange(0, 1000))
+	testEmpty(t, m)
+}
+
+// testRandom runs random operations against a plain map and compares the
+// answers after every one.
+func testRandom(t *testing.T, m Map) {
+	model := make(map[int]int)
+	sorted := func() []int {
+		keys := make([]int, 0, len(model))
+		for k := range model {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		return keys
+	}
+	r := rand.New(rand.NewPCG(1, 2))
+	for op := 0; op < 5000 && !t.Failed(); op++ {
+		key, value := r.IntN(500), r.Int()
+		switch r.IntN(10) {
+		case 0, 1, 2, 3:
+			m.Insert(key, value)
+			model[key] = value
+		case 4, 5:
+			v := m.Delete(key)
+			want, ok := model[key]
+			delete(model, key)
+			assert.Equal(t, ok, v != nil, "op %d: Delete(%d)", op, key)
+			if ok && v != nil {
+				assert.Equal(t, want, *v, "op %d: Delete(%d)", op, key)
+			}
+		case 6:
+			hi := key + r.IntN(20)
+			n := 0
+			for k := range model {
+				if key <= k && k < hi {
+					delete(model, k)
+					n++
+				}
+			}
+			assert.Equal(t, n, m.DeleteRange(key, hi), "op %d: DeleteRange(%d, %d)", op, key, hi)
+		case 7:
+			keys := sorted()
+			i, _ := slices.BinarySearch(keys, key)
+			assert.Equal(t, i, m.Rank(key), "op %d: Rank(%d)", op, key)
+			if len(keys) > 0 {
+				j := key % len(keys)
+				k, v, ok := m.Select(j)
+				assert.True(t, ok, "op %d: Select(%d)", op, j)
+				assert.Equal(t, keys[j], k, "op %d: Select(%d)", op, j)
+				assert.Equal(t, model[keys[j]], v, "op %d: Select(%d)", op, j)
+			}
+		case 8:
+			keys := sorted()
+			i, found := slices.BinarySearch(keys, key)
+			k, v := m.Successor(key)
+			if found {
+				i++
+			}
+			if i < len(keys) {
+				if assert.NotNil(t, v, "op %d: Successor(%d)", op, key) {
+					assert.Equal(t, keys[i], k, "op %d: Successor(%d)", op, key)
+				}
+			} else {
+				assert.Nil(t, v, "op %d: Successor(%d)", op, key)
+			}
+		default:
+			v := m.Get(key)
+			want, ok := model[key]
+			assert.Equal(t, ok, v != nil, "op %d: Get(%d)", op, key)
+			if ok && v != nil {
+				assert.Equal(t, want, *v, "op %d: Get(%d)", op, key)
+			}
+		}
+		assert.Equal(t, len(model), m.Len(), "op %d: Len", op)
+	}
+	var keys []int
+	m.Range(func(key, value int) bool {
+		keys = append(keys, key)
+		assert.Equal(t, model[key], value, "Range at %d", key)
+		return true
+	})
+	assert.Equal(t, sorted(), keys)
+}
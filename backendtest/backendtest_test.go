@@ -0,0 +1,24 @@
+package backendtest_test
+
+import (
+	"testing"
+
+	"github.com/iku50/rbtree-go"
+	"github.com/iku50/rbtree-go/backendtest"
+)
+
+func TestRBTree(t *testing.T) {
+	for name, opts := range map[string][]rbtree.Option{
+		"default":  nil,
+		"ordered":  {rbtree.WithOrderStatistics()},
+		"hints":    {rbtree.WithHintCache()},
+		"pool":     {rbtree.WithNodePool()},
+		"stable":   {rbtree.WithStableValuePointers()},
+		"serial":   {rbtree.WithSerializedWrites()},
+		"recovery": {rbtree.WithPanicRecovery()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			backendtest.Run(t, func() backendtest.Map { return rbtree.New[int, int](opts...) })
+		})
+	}
+}
@@ -0,0 +1,550 @@
+package rbtree
+
+import (
+	"context"
+	"math/bits"
+	"runtime"
+	"slices"
+)
+
+// KV is a key with its value, an element of a batch.
+type KV[K any, V any] struct {
+	Key   K
+	Value V
+}
+
+// InsertBatch sets the value of every key in pairs, as if Insert were
+// called for each pair in turn: of two pairs with the same key the later
+// one wins. The batch is sorted first.
+//
+// A batch that is large next to the tree is merged with the tree's keys
+// and the result bulk loaded in a single pass, with writers paused for the
+// whole pass; readers keep seeing the old tree until it is installed. A
+// smaller batch goes down the tree once, splitting where its keys part, so
+// each node on the way is locked once for all the keys below it. The
+// rebalancing and size fixups run after the descent, steps that share an
+// area once for all of them.
+//
+// A merge moves every key into a new node, so value pointers obtained
+// before it go stale unless the tree was built WithStableValuePointers.
+func (t *RBTree[K, V]) InsertBatch(pairs []KV[K, V]) {
+	t.insertAll(t.sortBatch(pairs))
+}
+
+// DeleteBatch removes every key in keys and returns how many were present.
+// Like InsertBatch it merges when the batch is large next to the tree and
+// deletes key by key otherwise.
+func (t *RBTree[K, V]) DeleteBatch(keys []K) int {
+	batch := slices.Clone(keys)
+	slices.SortFunc(batch, t.compare)
+	batch = slices.CompactFunc(batch, func(a, b K) bool { return t.compare(a, b) == 0 })
+	if len(batch) == 0 {
+		return 0
+	}
+	removed := 0
+	now := t.now()
+	if t.mergePays(len(batch)) && t.rebuild(func(nodes []*RBTreeNode[K, V]) []*RBTreeNode[K, V] {
+		out := make([]*RBTreeNode[K, V], 0, len(nodes))
+		j := 0
+		for _, n := range nodes {
+			for j < len(batch) && t.compare(batch[j], n.key) < 0 {
+				j++
+			}
+			if j < len(batch) && t.compare(batch[j], n.key) == 0 {
+				if !t.expired(n, now) {
+					removed++
+				}
+				t.record(EventDelete, n.key, *n.valuePtr())
+				continue
+			}
+			out = append(out, t.carry(n, nil))
+		}
+		return out
+	}) {
+		return removed
+	}
+	defer t.endWrite(t.beginWrite())
+	ctx := context.Background()
+	for _, key := range batch {
+		var (
+			v       *V
+			expired bool
+		)
+		_ = t.retry(ctx, func() error {
+			var err error
+			v, expired, err = t.delete(key, nil, nil)
+			return err
+		})
+		if v != nil && !expired {
+			removed++
+		}
+	}
+	return removed
+}
+
+// Merge inserts every key of other into t, as InsertBatch does. Values
+// from other win over the ones t holds. other is read from a snapshot, so
+// it may keep changing meanwhile. Keys of other that have expired are
+// left out, the others are merged without their deadlines.
+func (t *RBTree[K, V]) Merge(other *RBTree[K, V]) {
+	if other == t {
+		return
+	}
+	t.insertAll(t.mergeBatch(other))
+}
+
+// insertAll inserts a sorted batch of distinct keys, in one pass unless
+// progress is reported.
+func (t *RBTree[K, V]) insertAll(batch []KV[K, V]) {
+	if t.progress != nil {
+		t.insertChunks(context.Background(), batch)
+		return
+	}
+	t.insertSorted(batch)
+}
+
+// mergeBatch returns the sorted batch of other's live keys.
+func (t *RBTree[K, V]) mergeBatch(other *RBTree[K, V]) []KV[K, V] {
+	s := other.Snapshot()
+	pairs := make([]KV[K, V], 0, s.Len())
+	s.walk(s.root, other.now(), func(key K, value V) bool {
+		pairs = append(pairs, KV[K, V]{key, value})
+		return true
+	})
+	// other may order keys differently, so the batch is sorted again
+	return t.sortBatch(pairs)
+}
+
+// batchCheckpoint is how many keys the Ctx batch operations handle
+// between two looks at their context.
+const batchCheckpoint = 1024
+
+// BatchSummary tells how far a batch operation given a context got.
+type BatchSummary[K any] struct {
+	Applied  int  // keys written or removed
+	Complete bool // the operation ran to its end
+	// Resume is where an operation that stopped early can be picked up:
+	// the keys before it were handled, the ones from it on were not
+	// touched. It is the zero key when Complete is set.
+	Resume K
+}
+
+// InsertBatchCtx is InsertBatch applied in chunks of sorted keys, with a
+// look at ctx before each. Once ctx is done it stops with ctx's error,
+// leaving the chunks before applied and the rest untouched, as the summary
+// reports. Each chunk is an InsertBatch of its own, so a large batch is
+// merged into the tree piece by piece rather than in one pass.
+func (t *RBTree[K, V]) InsertBatchCtx(ctx context.Context, pairs []KV[K, V]) (BatchSummary[K], error) {
+	return t.insertChunks(ctx, t.sortBatch(pairs))
+}
+
+// MergeCtx is Merge with the checkpoints of InsertBatchCtx.
+func (t *RBTree[K, V]) MergeCtx(ctx context.Context, other *RBTree[K, V]) (BatchSummary[K], error) {
+	if other == t {
+		return BatchSummary[K]{Complete: true}, nil
+	}
+	return t.insertChunks(ctx, t.mergeBatch(other))
+}
+
+// insertChunks inserts a sorted batch of distinct keys one chunk at a time
+// until ctx is done.
+func (t *RBTree[K, V]) insertChunks(ctx context.Context, batch []KV[K, V]) (BatchSummary[K], error) {
+	var sum BatchSummary[K]
+	for len(batch) > 0 {
+		if err := ctx.Err(); err != nil {
+			sum.Resume = batch[0].Key
+			return sum, err
+		}
+		n := min(len(batch), batchCheckpoint)
+		t.insertSorted(batch[:n])
+		sum.Applied += n
+		batch = batch[n:]
+		if t.progress != nil {
+			t.progress(sum.Applied, sum.Applied+len(batch))
+		}
+	}
+	sum.Complete = true
+	return sum, nil
+}
+
+// sortBatch returns a sorted copy of pairs holding the last pair of each
+// key.
+func (t *RBTree[K, V]) sortBatch(pairs []KV[K, V]) []KV[K, V] {
+	batch := slices.Clone(pairs)
+	slices.SortStableFunc(batch, func(a, b KV[K, V]) int { return t.compare(a.Key, b.Key) })
+	out := batch[:0]
+	for _, kv := range batch {
+		if t.checkKey(kv.Key) != nil {
+			continue
+		}
+		if len(out) > 0 && t.compare(out[len(out)-1].Key, kv.Key) == 0 {
+			out[len(out)-1] = kv
+			continue
+		}
+		out = append(out, kv)
+	}
+	return out
+}
+
+// insertSorted inserts a sorted batch of distinct keys.
+func (t *RBTree[K, V]) insertSorted(batch []KV[K, V]) {
+	if len(batch) == 0 {
+		return
+	}
+	if t.mergePays(len(batch)) && t.rebuild(func(nodes []*RBTreeNode[K, V]) []*RBTreeNode[K, V] {
+		out := make([]*RBTreeNode[K, V], 0, len(nodes)+len(batch))
+		i, j := 0, 0
+		for i < len(nodes) || j < len(batch) {
+			c := -1
+			if i == len(nodes) {
+				c = 1
+			} else if j < len(batch) {
+				c = t.compare(nodes[i].key, batch[j].Key)
+			}
+			switch {
+			case c < 0:
+				out = append(out, t.carry(nodes[i], nil))
+				i++
+			case c > 0:
+				out = append(out, t.newNode(batch[j].Key, batch[j].Value, nil))
+				t.record(EventStore, batch[j].Key, batch[j].Value)
+				j++
+			default:
+				out = append(out, t.carry(nodes[i], &batch[j].Value))
+				t.record(EventStore, batch[j].Key, batch[j].Value)
+				i++
+				j++
+			}
+		}
+		return out
+	}) {
+		return
+	}
+	defer t.endWrite(t.beginWrite())
+	var b batchInsert[K, V]
+	for attempt := 0; len(batch) > 0; {
+		r := t.root.Load()
+		if r == nil {
+			// the first key makes the root, the others go below it
+			kv := batch[0]
+			set := func(V, bool) (V, bool) { return kv.Value, true }
+			_, _, created, err := t.insert(kv.Key, set, 0, nil)
+			if pe, ok := err.(*PanicError); ok {
+				b.panicked = pe.Value
+				break
+			}
+			if err != nil {
+				t.pause(attempt)
+				attempt++
+				continue
+			}
+			batch = batch[1:]
+			if created {
+				t.count.Add(1)
+			}
+			continue
+		}
+		if !r.lock() {
+			t.pause(attempt)
+			attempt++
+			continue
+		}
+		if t.root.Load() != r {
+			r.unlock()
+			continue
+		}
+		r.size += len(batch)
+		r.reported += len(batch)
+		if err := t.insertBelow(r, batch, false, 0, &b); err == ErrCorrupted {
+			t.markCorrupted()
+		}
+		break
+	}
+	t.count.Add(int64(b.created))
+	t.fixInserts(b.red)
+	if t.ordered {
+		t.fixSizes(b.present)
+	}
+	if b.panicked != nil {
+		// let through once nothing is locked and the tree is balanced
+		panic(b.panicked)
+	}
+}
+
+// batchInsert collects what an insert batch leaves to do after its descent.
+type batchInsert[K any, V any] struct {
+	created  int
+	red      []*RBTreeNode[K, V]   // new nodes linked below a red parent
+	present  [][]*RBTreeNode[K, V] // by level, nodes whose key was in the batch
+	panicked any                   // what the comparator or the tracer panicked with
+}
+
+// abandon takes back the count of keys that were counted into n as new
+// but are not linked below it, as they were present or left out after a
+// panic. fixSizes carries the difference up.
+func (b *batchInsert[K, V]) abandon(n *RBTreeNode[K, V], keys, level int) {
+	n.size -= keys
+	for len(b.present) <= level {
+		b.present = append(b.present, nil)
+	}
+	b.present[level] = append(b.present[level], n)
+}
+
+// insertBelow inserts batch, whose keys all belong below the locked node
+// n, into n's subtree. n's size already counts every key of batch as new.
+// The keys that go on to a child are counted into it, under both locks,
+// before n is released; a key found present takes its count back at n,
+// where fixSizes carries that up later. fresh tells that n was created
+// for the batch, for its key, which then is not in the tree already.
+//
+// n's children are locked before n is released, and a new node is linked
+// where there is no child. Each key is logged while its node is held, so
+// that a delete of it cannot be logged first. Child locks are waited for
+// rather than given up, as the keys already applied cannot be taken back.
+// Like all of the batch's locks they are taken from the top down, which
+// other operations either do too or wait for holding nothing, so the wait
+// always ends.
+//
+// WithPanicRecovery a panic of the comparator or the tracer at n leaves
+// batch out: n is released, the keys are taken back from the sizes and
+// the panic is kept in b, and the callers release the children they still
+// hold in the same way.
+func (t *RBTree[K, V]) insertBelow(n *RBTreeNode[K, V], batch []KV[K, V], fresh bool, level int, b *batchInsert[K, V]) error {
+	i, found, ok := t.part(n, batch, level, b)
+	if !ok {
+		b.abandon(n, len(batch)-b2i(fresh), level)
+		n.unlock()
+		return errPanicked
+	}
+	groups := [2][]KV[K, V]{batch[:i], batch[i:]}
+	if found {
+		groups[1] = batch[i+1:]
+		if !fresh {
+			*n.valuePtr() = batch[i].Value
+			n.deadline = 0
+			n.seq = t.tombGen.Load()
+			t.record(EventStore, n.key, batch[i].Value)
+			b.abandon(n, 1, level)
+		}
+	}
+	var next [2]*RBTreeNode[K, V]
+	var created [2]bool
+	for side, keys := range groups {
+		if len(keys) == 0 {
+			continue
+		}
+		if level+1 >= t.maxDepth() {
+			if next[0] != nil {
+				next[0].unlock()
+			}
+			n.unlock()
+			return ErrCorrupted
+		}
+		slot := &n.left
+		if side == 1 {
+			slot = &n.right
+		}
+		c := slot.Load()
+		if c == nil {
+			// the middle key makes the new child, the others go below it
+			mid := keys[len(keys)/2]
+			c = t.newNode(mid.Key, mid.Value, n)
+			c.size, c.reported = len(keys), len(keys)
+			c.flag.Store(true)
+			slot.Store(c)
+			t.record(EventStore, mid.Key, mid.Value)
+			created[side] = true
+			b.created++
+			if n.isRed() {
+				b.red = append(b.red, c)
+			}
+		} else {
+			for attempt := 0; !c.lock(); attempt++ {
+				t.pause(attempt)
+			}
+			c.size += len(keys)
+			c.reported += len(keys)
+		}
+		next[side] = c
+	}
+	n.unlock()
+	var err error
+	for side, c := range next {
+		if c == nil {
+			continue
+		}
+		if err != nil {
+			if err == errPanicked {
+				b.abandon(c, len(groups[side])-b2i(created[side]), level+1)
+			}
+			c.unlock()
+			continue
+		}
+		err = t.insertBelow(c, groups[side], created[side], level+1, b)
+	}
+	return err
+}
+
+// part visits n, which is locked, and finds where batch parts at its key.
+// ok is false if the comparator or the tracer panicked WithPanicRecovery,
+// with the panic kept in b.
+func (t *RBTree[K, V]) part(n *RBTreeNode[K, V], batch []KV[K, V], level int, b *batchInsert[K, V]) (i int, found, ok bool) {
+	if t.guard {
+		defer func() {
+			if r := recover(); r != nil {
+				t.stats.panics.Add(1)
+				b.panicked = r
+				i, found, ok = 0, false, false
+			}
+		}()
+	}
+	t.visit(OpInsert, level)
+	i, found = slices.BinarySearchFunc(batch, n.key, func(kv KV[K, V], key K) int {
+		return t.compare(kv.Key, key)
+	})
+	return i, found, true
+}
+
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// fixInserts runs the insert fixups of the nodes in xs. A fixup that has
+// to wait is put back rather than waited for, as another one in xs may be
+// what it waits for.
+func (t *RBTree[K, V]) fixInserts(xs []*RBTreeNode[K, V]) {
+	for attempt := 0; len(xs) > 0; {
+		progress := false
+		rest := xs[:0]
+		for _, x := range xs {
+			if x.retired.Load() {
+				continue
+			}
+			next, ok := t.tryInsertStep(x, nil)
+			if !ok {
+				rest = append(rest, x)
+				continue
+			}
+			progress = true
+			if next != nil {
+				rest = append(rest, next)
+			}
+		}
+		xs = rest
+		if progress {
+			attempt = 0
+		} else {
+			t.pause(attempt)
+			attempt++
+		}
+	}
+}
+
+// fixSizes runs the size fixups of the nodes in grown, deepest level
+// first, so that fixups whose ways up meet are merged into one from there.
+// grown[d] lists the nodes that were d levels deep when their size
+// changed; a level that rotations have changed since only merges less.
+func (t *RBTree[K, V]) fixSizes(grown [][]*RBTreeNode[K, V]) {
+	queued := make(map[*RBTreeNode[K, V]]bool)
+	for d := len(grown) - 1; d >= 0; d-- {
+		for _, x := range grown[d] {
+			delete(queued, x)
+			for attempt := 0; !x.retired.Load(); attempt++ {
+				p, ok := t.trySizeStep(x, nil)
+				if !ok {
+					t.pause(attempt)
+					continue
+				}
+				// a fixup already queued at p has not run yet and carries
+				// this one
+				if p != nil && d > 0 && !queued[p] {
+					queued[p] = true
+					grown[d-1] = append(grown[d-1], p)
+				}
+				break
+			}
+		}
+	}
+}
+
+// mergePays reports whether merging a batch of m keys into the tree, which
+// costs a pass over all of its nodes, is cheaper than m separate descents.
+func (t *RBTree[K, V]) mergePays(m int) bool {
+	n := t.Len()
+	return m*bits.Len(uint(n)) >= n
+}
+
+// rebuild pauses writers, passes the tree's nodes in key order to merge
+// and installs a balanced tree of the unlinked nodes it returns. The old
+// nodes are left as they are for the readers still on them. It reports
+// false, leaving the tree unchanged, if the tree is too deep to walk.
+func (t *RBTree[K, V]) rebuild(merge func(nodes []*RBTreeNode[K, V]) []*RBTreeNode[K, V]) bool {
+	t.gate.Lock()
+	defer t.gate.Unlock()
+	nodes := make([]*RBTreeNode[K, V], 0, t.Len())
+	var walk func(n *RBTreeNode[K, V], depth int) bool
+	walk = func(n *RBTreeNode[K, V], depth int) bool {
+		if n == nil {
+			return true
+		}
+		if depth <= 0 {
+			return false
+		}
+		if !walk(n.left.Load(), depth-1) {
+			return false
+		}
+		nodes = append(nodes, n)
+		return walk(n.right.Load(), depth-1)
+	}
+	if !walk(t.root.Load(), t.maxDepth()) {
+		t.markCorrupted()
+		return false
+	}
+	merged := merge(nodes)
+	t.moved()
+	root := balanced(len(merged), func(i int, parent *RBTreeNode[K, V]) *RBTreeNode[K, V] {
+		merged[i].parent.Store(parent)
+		return merged[i]
+	})
+	t.root.Store(root)
+	t.count.Store(int64(len(merged)))
+	return true
+}
+
+// carry returns an unlinked copy of n for a rebuild, with value in place
+// of n's and no deadline if value is not nil. A boxed value stays in its
+// box, so that its pointers stay valid. n is locked while the box is
+// written, which waits out the readers on it.
+func (t *RBTree[K, V]) carry(n *RBTreeNode[K, V], value *V) *RBTreeNode[K, V] {
+	c := t.allocNode()
+	c.c = red
+	c.key = n.key
+	c.deadline = n.deadline
+	c.seq = n.seq
+	if value != nil {
+		// a stored value is permanent, like one from Insert
+		c.deadline = 0
+		c.seq = t.tombGen.Load()
+	}
+	c.size = 1
+	c.reported = 1
+	if n.box == nil {
+		c.value = n.value
+		if value != nil {
+			c.value = *value
+		}
+		return c
+	}
+	c.box = n.box
+	if value != nil {
+		for !n.lock() {
+			runtime.Gosched()
+		}
+		*c.box = *value
+		n.unlock()
+	}
+	return c
+}
@@ -0,0 +1,230 @@
+package rbtree_test
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iku50/rbtree-go"
+)
+
+func TestInsertBatch(t *testing.T) {
+	for _, size := range []int{0, 10, 1000, 20000} {
+		tree := rbtree.New[int, string]()
+		for i := 0; i < size; i++ {
+			tree.Insert(i*2, "old")
+		}
+		var pairs []rbtree.KV[int, string]
+		for _, i := range rand.Perm(200) {
+			pairs = append(pairs, rbtree.KV[int, string]{Key: i, Value: fmt.Sprint(i)})
+		}
+		pairs = append(pairs, rbtree.KV[int, string]{Key: 4, Value: "last"})
+		tree.InsertBatch(pairs)
+		assert.Nil(t, tree.Check(), "size %d", size)
+		assert.Equal(t, max(size, 100)+100, tree.Len())
+		for i := 0; i < 200; i++ {
+			assert.Equal(t, i, tree.Rank(i))
+		}
+		assert.Equal(t, "last", *tree.Get(4))
+		assert.Equal(t, "5", *tree.Get(5))
+		if size >= 1000 {
+			assert.Equal(t, "old", *tree.Get(1998))
+		}
+	}
+}
+
+func TestDeleteBatch(t *testing.T) {
+	for _, size := range []int{10, 1000} {
+		tree := rbtree.New[int, int]()
+		for i := 0; i < size; i++ {
+			tree.Insert(i, i)
+		}
+		assert.Equal(t, 5, tree.DeleteBatch([]int{3, 1, 3, 5, 7, 9, -1}))
+		assert.Nil(t, tree.Check())
+		assert.Equal(t, size-5, tree.Len())
+		assert.Nil(t, tree.Get(3))
+		assert.Equal(t, 4, *tree.Get(4))
+	}
+	tree := rbtree.New[int, int]()
+	assert.Equal(t, 0, tree.DeleteBatch(nil))
+}
+
+func TestBatchStableValuePointers(t *testing.T) {
+	tree := rbtree.New[int, int](rbtree.WithStableValuePointers())
+	tree.Insert(1, 1)
+	tree.Insert(2, 2)
+	p := tree.Get(1)
+	tree.InsertBatch([]rbtree.KV[int, int]{{Key: 1, Value: 10}, {Key: 3, Value: 3}})
+	assert.Same(t, p, tree.Get(1))
+	assert.Equal(t, 10, *p)
+	tree.DeleteBatch([]int{2, 3})
+	assert.Same(t, p, tree.Get(1))
+}
+
+func TestMerge(t *testing.T) {
+	a := rbtree.New[int, string]()
+	b := rbtree.New[int, string]()
+	for i := 0; i < 100; i++ {
+		a.Insert(i, "a")
+		b.Insert(i+50, "b")
+	}
+	a.Merge(b)
+	a.Merge(a)
+	assert.Nil(t, a.Check())
+	assert.Equal(t, 150, a.Len())
+	assert.Equal(t, "a", *a.Get(49))
+	assert.Equal(t, "b", *a.Get(50))
+	assert.Equal(t, 100, b.Len())
+}
+
+func TestBatchConcurrent(t *testing.T) {
+	tree := rbtree.New[int, int]()
+	wg := sync.WaitGroup{}
+	for w := 0; w < 4; w++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				pairs := make([]rbtree.KV[int, int], 100)
+				for j := range pairs {
+					k := rand.IntN(2000)
+					pairs[j] = rbtree.KV[int, int]{Key: k, Value: k}
+				}
+				tree.InsertBatch(pairs)
+				tree.DeleteBatch([]int{rand.IntN(2000), rand.IntN(2000)})
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				k := rand.IntN(2000)
+				tree.Insert(k, k)
+				tree.Get(k)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Nil(t, tree.Check())
+	n := 0
+	tree.Range(func(int, int) bool {
+		n++
+		return true
+	})
+	assert.Equal(t, tree.Len(), n)
+}
+
+// burst returns size random keys for the batch benchmarks, or size
+// consecutive ones from a random start if sequential.
+func burst(size int, sequential bool) []rbtree.KV[int, int] {
+	pairs := make([]rbtree.KV[int, int], size)
+	start := rand.Int()
+	for i := range pairs {
+		k := start + i
+		if !sequential {
+			k = rand.Int()
+		}
+		pairs[i] = rbtree.KV[int, int]{Key: k, Value: k}
+	}
+	return pairs
+}
+
+func benchmarkBursts(b *testing.B, size int, sequential, batch bool) {
+	tree := rbtree.New[int, int]()
+	tree.InsertBatch(burst(1<<16, false))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			pairs := burst(size, sequential)
+			if batch {
+				tree.InsertBatch(pairs)
+				continue
+			}
+			for _, kv := range pairs {
+				tree.Insert(kv.Key, kv.Value)
+			}
+		}
+	})
+}
+
+func BenchmarkBurstPerKey256(b *testing.B)           { benchmarkBursts(b, 256, false, false) }
+func BenchmarkBurstBatch256(b *testing.B)            { benchmarkBursts(b, 256, false, true) }
+func BenchmarkBurstPerKeySequential256(b *testing.B) { benchmarkBursts(b, 256, true, false) }
+func BenchmarkBurstBatchSequential256(b *testing.B)  { benchmarkBursts(b, 256, true, true) }
+func BenchmarkBurstPerKey8192(b *testing.B)          { benchmarkBursts(b, 8192, false, false) }
+func BenchmarkBurstBatch8192(b *testing.B)           { benchmarkBursts(b, 8192, false, true) }
+
+// stopAfter is a context that reports itself canceled from its n-th look
+// on, so a batch stops at a known checkpoint.
+type stopAfter struct {
+	context.Context
+	n int
+}
+
+func (c *stopAfter) Err() error {
+	if c.n--; c.n < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestInsertBatchCtx(t *testing.T) {
+	tree := rbtree.New[int, int]()
+	var pairs []rbtree.KV[int, int]
+	for _, i := range rand.Perm(5000) {
+		pairs = append(pairs, rbtree.KV[int, int]{Key: i, Value: -i})
+	}
+	sum, err := tree.InsertBatchCtx(&stopAfter{context.Background(), 2}, pairs)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.False(t, sum.Complete)
+	assert.Equal(t, 2048, sum.Applied)
+	assert.Equal(t, 2048, sum.Resume)
+	assert.Equal(t, 2048, tree.Len())
+	assert.Nil(t, tree.Check())
+	k, _ := tree.Max()
+	assert.Equal(t, sum.Resume-1, k)
+
+	// picking up from Resume finishes the batch
+	var rest []rbtree.KV[int, int]
+	for _, p := range pairs {
+		if p.Key >= sum.Resume {
+			rest = append(rest, p)
+		}
+	}
+	sum, err = tree.InsertBatchCtx(context.Background(), rest)
+	assert.Nil(t, err)
+	assert.True(t, sum.Complete)
+	assert.Equal(t, 5000-2048, sum.Applied)
+	assert.Equal(t, 5000, tree.Len())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	sum, err = tree.InsertBatchCtx(ctx, []rbtree.KV[int, int]{{Key: 7, Value: 7}})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, rbtree.BatchSummary[int]{Resume: 7}, sum)
+	v := tree.Get(7)
+	assert.Equal(t, -7, *v)
+}
+
+func TestMergeCtx(t *testing.T) {
+	tree, other := rbtree.New[int, int](), rbtree.New[int, int]()
+	for i := 0; i < 3000; i++ {
+		other.Insert(i, i)
+	}
+	sum, err := tree.MergeCtx(&stopAfter{context.Background(), 1}, other)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, rbtree.BatchSummary[int]{Applied: 1024, Resume: 1024}, sum)
+	assert.Equal(t, 1024, tree.Len())
+	assert.Nil(t, tree.Check())
+
+	sum, err = tree.MergeCtx(context.Background(), other)
+	assert.Nil(t, err)
+	assert.True(t, sum.Complete)
+	assert.Equal(t, 3000, tree.Len())
+	sum, err = tree.MergeCtx(context.Background(), tree)
+	assert.Nil(t, err)
+	assert.True(t, sum.Complete)
+}
@@ -0,0 +1,55 @@
+package rbtree
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// ErrBudgetExhausted is returned by an operation that ran into a locked
+// node once the retry budget of its context was spent, see WithBudget.
+var ErrBudgetExhausted = errors.New("retry budget exhausted")
+
+// retryBudget is the retries left to the operations of one request.
+type retryBudget struct {
+	left atomic.Int64
+}
+
+type budgetKey struct{}
+
+// WithBudget returns a copy of ctx that allows the operations it is passed
+// to retry n times in all, across trees and goroutines, so that one
+// request cannot spin without bound over many contended calls. An
+// operation that would retry past the budget gives up with
+// ErrBudgetExhausted, like one that exceeds Backoff.MaxRetries. The Ctx
+// variants of the lookups and writes take the budget; the rebalancing
+// after a write, which must not be given up, does not.
+//
+// A context derived from one with a budget shares it; WithBudget on such a
+// context starts a new budget for the operations given the copy.
+func WithBudget(ctx context.Context, n int) context.Context {
+	b := &retryBudget{}
+	b.left.Store(int64(max(n, 0)))
+	return context.WithValue(ctx, budgetKey{}, b)
+}
+
+// BudgetLeft returns the retries left in ctx's budget, and false if ctx
+// has none.
+func BudgetLeft(ctx context.Context) (int, bool) {
+	b := budgetFrom(ctx)
+	if b == nil {
+		return 0, false
+	}
+	return int(max(b.left.Load(), 0)), true
+}
+
+func budgetFrom(ctx context.Context) *retryBudget {
+	b, _ := ctx.Value(budgetKey{}).(*retryBudget)
+	return b
+}
+
+// spend takes a retry from the budget and reports whether there was one
+// left. A nil budget is unlimited.
+func (b *retryBudget) spend() bool {
+	return b == nil || b.left.Add(-1) >= 0
+}
@@ -0,0 +1,41 @@
+package rbtree
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithBudget(t *testing.T) {
+	_, ok := BudgetLeft(context.Background())
+	assert.False(t, ok)
+
+	a := NewRBTree(1, 1, WithBackoff(Backoff{Base: time.Microsecond}))
+	b := NewRBTree(1, 1, WithBackoff(Backoff{Base: time.Microsecond}))
+	a.root.Load().flag.Store(true)
+	b.root.Load().flag.Store(true)
+
+	// the budget is shared by the operations on both trees
+	ctx := WithBudget(context.Background(), 5)
+	_, err := a.GetCtx(ctx, 1)
+	assert.ErrorIs(t, err, ErrBudgetExhausted)
+	left, ok := BudgetLeft(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, 0, left)
+	assert.ErrorIs(t, b.InsertCtx(ctx, 2, 2), ErrBudgetExhausted)
+	_, err = b.DeleteCtx(ctx, 1)
+	assert.ErrorIs(t, err, ErrBudgetExhausted)
+
+	// operations that need no retry still run
+	a.root.Load().flag.Store(false)
+	v, err := a.GetCtx(ctx, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, *v)
+
+	ctx = WithBudget(context.Background(), 100)
+	assert.Nil(t, a.InsertCtx(ctx, 2, 2))
+	left, _ = BudgetLeft(ctx)
+	assert.Equal(t, 100, left)
+}
@@ -0,0 +1,601 @@
+//go:build !rbtree_core
+
+package rbtree
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// CBORCodec encodes snapshots as CBOR (RFC 8949): a map of "version",
+// "count" and "nodes", the nodes an array of maps holding "key", "value"
+// and, where true, "red", "left" and "right".
+//
+// Keys and values are encoded by their Go types: booleans, integers,
+// floats, strings, byte slices and arrays as the CBOR types of the same
+// name, other slices and arrays as arrays, maps as maps with their keys
+// sorted as RFC 8949 asks for deterministic encoding, structs as maps of
+// their exported fields named by their json tags, and nil pointers,
+// slices and maps as null. Types that implement encoding.TextMarshaler
+// are encoded as text. Decoding also reads half-precision floats and
+// skips tags and unknown struct fields; indefinite lengths are not
+// supported.
+type CBORCodec[K any, V any] struct{}
+
+// cborTree is the layout of the CBOR encoding.
+type cborTree[K any, V any] struct {
+	Version int                  `json:"version"`
+	Count   int                  `json:"count"`
+	Nodes   []SnapshotNode[K, V] `json:"nodes"`
+}
+
+// Encode writes nodes to w as CBOR.
+func (CBORCodec[K, V]) Encode(w io.Writer, nodes []SnapshotNode[K, V]) error {
+	var e cborEncoder
+	tree := cborTree[K, V]{Version: encodingVersion, Count: len(nodes), Nodes: nodes}
+	if err := e.encode(reflect.ValueOf(tree)); err != nil {
+		return err
+	}
+	_, err := w.Write(e.buf)
+	return err
+}
+
+// Decode reads the nodes written by Encode from r.
+func (CBORCodec[K, V]) Decode(r io.Reader) ([]SnapshotNode[K, V], error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	d := cborDecoder{data: data}
+	var tree cborTree[K, V]
+	if err := d.decode(reflect.ValueOf(&tree).Elem(), 0); err != nil {
+		return nil, err
+	}
+	if d.pos != len(data) {
+		return nil, fmt.Errorf("%w: cbor: %d bytes after the tree", ErrBadEncoding, len(data)-d.pos)
+	}
+	if tree.Version != encodingVersion || tree.Count != len(tree.Nodes) {
+		return nil, fmt.Errorf("%w: version %d, count %d", ErrBadEncoding, tree.Version, tree.Count)
+	}
+	return tree.Nodes, nil
+}
+
+// The major types of CBOR, in the top three bits of an item's head.
+const (
+	cborUint   byte = 0 << 5
+	cborNeg    byte = 1 << 5
+	cborBytes  byte = 2 << 5
+	cborText   byte = 3 << 5
+	cborArray  byte = 4 << 5
+	cborMap    byte = 5 << 5
+	cborTag    byte = 6 << 5
+	cborSimple byte = 7 << 5
+)
+
+// The items of major type 7 the codec writes.
+const (
+	cborFalse   = cborSimple | 20
+	cborTrue    = cborSimple | 21
+	cborNull    = cborSimple | 22
+	cborFloat32 = cborSimple | 26
+	cborFloat64 = cborSimple | 27
+)
+
+// cborMaxDepth bounds the nesting of arrays and maps a decoding follows.
+const cborMaxDepth = 64
+
+var (
+	textMarshalerType   = reflect.TypeFor[encoding.TextMarshaler]()
+	textUnmarshalerType = reflect.TypeFor[encoding.TextUnmarshaler]()
+)
+
+type cborEncoder struct {
+	buf []byte
+}
+
+// head writes the head of an item of type major with argument n.
+func (e *cborEncoder) head(major byte, n uint64) {
+	switch {
+	case n < 24:
+		e.buf = append(e.buf, major|byte(n))
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, major|24, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, major|25), uint16(n))
+	case n <= math.MaxUint32:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, major|26), uint32(n))
+	default:
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, major|27), n)
+	}
+}
+
+func (e *cborEncoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.buf = append(e.buf, cborNull)
+		return nil
+	}
+	if v.Type().Implements(textMarshalerType) && v.CanInterface() {
+		if v.Kind() == reflect.Pointer && v.IsNil() {
+			e.buf = append(e.buf, cborNull)
+			return nil
+		}
+		text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return err
+		}
+		e.head(cborText, uint64(len(text)))
+		e.buf = append(e.buf, text...)
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf = append(e.buf, cborTrue)
+		} else {
+			e.buf = append(e.buf, cborFalse)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if i := v.Int(); i >= 0 {
+			e.head(cborUint, uint64(i))
+		} else {
+			e.head(cborNeg, uint64(-1-i))
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.head(cborUint, v.Uint())
+	case reflect.Float32:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, cborFloat32), math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, cborFloat64), math.Float64bits(v.Float()))
+	case reflect.String:
+		e.head(cborText, uint64(v.Len()))
+		e.buf = append(e.buf, v.String()...)
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			e.buf = append(e.buf, cborNull)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.head(cborBytes, uint64(v.Len()))
+			for i := 0; i < v.Len(); i++ {
+				e.buf = append(e.buf, byte(v.Index(i).Uint()))
+			}
+			return nil
+		}
+		e.head(cborArray, uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			if err := e.encode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			e.buf = append(e.buf, cborNull)
+			return nil
+		}
+		return e.encodeMap(v)
+	case reflect.Struct:
+		fields := cborFields(v.Type())
+		present := fields[:0:0]
+		for _, f := range fields {
+			if !f.omitEmpty || !v.Field(f.index).IsZero() {
+				present = append(present, f)
+			}
+		}
+		e.head(cborMap, uint64(len(present)))
+		for _, f := range present {
+			e.head(cborText, uint64(len(f.name)))
+			e.buf = append(e.buf, f.name...)
+			if err := e.encode(v.Field(f.index)); err != nil {
+				return err
+			}
+		}
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			e.buf = append(e.buf, cborNull)
+			return nil
+		}
+		return e.encode(v.Elem())
+	default:
+		return fmt.Errorf("rbtree: cbor cannot encode %s", v.Type())
+	}
+	return nil
+}
+
+// encodeMap writes a map with its entries sorted by their encoded keys.
+func (e *cborEncoder) encodeMap(v reflect.Value) error {
+	type entry struct{ key, value []byte }
+	entries := make([]entry, 0, v.Len())
+	for it := v.MapRange(); it.Next(); {
+		var k, val cborEncoder
+		if err := k.encode(it.Key()); err != nil {
+			return err
+		}
+		if err := val.encode(it.Value()); err != nil {
+			return err
+		}
+		entries = append(entries, entry{k.buf, val.buf})
+	}
+	slices.SortFunc(entries, func(a, b entry) int { return bytes.Compare(a.key, b.key) })
+	e.head(cborMap, uint64(len(entries)))
+	for _, en := range entries {
+		e.buf = append(append(e.buf, en.key...), en.value...)
+	}
+	return nil
+}
+
+// cborField is an exported struct field and the name it is encoded by.
+type cborField struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+func cborFields(t reflect.Type) []cborField {
+	var fields []cborField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" && opts == "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		omit := slices.Contains(strings.Split(opts, ","), "omitempty")
+		fields = append(fields, cborField{name: name, index: i, omitEmpty: omit})
+	}
+	return fields
+}
+
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *cborDecoder) fail(format string, args ...any) error {
+	return fmt.Errorf("%w: cbor: %s at byte %d", ErrBadEncoding, fmt.Sprintf(format, args...), d.pos)
+}
+
+// head reads the head of the next item: its major type, the additional
+// information in the low five bits and the argument that follows from it.
+func (d *cborDecoder) head() (major, info byte, n uint64, err error) {
+	if d.pos >= len(d.data) {
+		return 0, 0, 0, d.fail("unexpected end")
+	}
+	b := d.data[d.pos]
+	major, info = b&0xe0, b&0x1f
+	d.pos++
+	size := 0
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info <= 27:
+		size = 1 << (info - 24)
+	default:
+		return 0, 0, 0, d.fail("additional information %d not supported", info)
+	}
+	if len(d.data)-d.pos < size {
+		return 0, 0, 0, d.fail("unexpected end")
+	}
+	for _, c := range d.data[d.pos : d.pos+size] {
+		n = n<<8 | uint64(c)
+	}
+	d.pos += size
+	return major, info, n, nil
+}
+
+// length checks that n items of at least a byte each can follow.
+func (d *cborDecoder) length(n uint64) (int, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return 0, d.fail("length %d beyond the end", n)
+	}
+	return int(n), nil
+}
+
+func (d *cborDecoder) bytes(n uint64) ([]byte, error) {
+	l, err := d.length(n)
+	if err != nil {
+		return nil, err
+	}
+	b := d.data[d.pos : d.pos+l]
+	d.pos += l
+	return b, nil
+}
+
+// float interprets the argument of a float item.
+func cborFloat(info byte, n uint64) (float64, bool) {
+	switch info {
+	case 25:
+		return halfFloat(uint16(n)), true
+	case 26:
+		return float64(math.Float32frombits(uint32(n))), true
+	case 27:
+		return math.Float64frombits(n), true
+	}
+	return 0, false
+}
+
+// halfFloat converts an IEEE 754 half-precision float.
+func halfFloat(h uint16) float64 {
+	exp, mant := int(h>>10&0x1f), float64(h&0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 31:
+		f = math.Inf(1)
+		if mant != 0 {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
+
+// decode reads the next item into v.
+func (d *cborDecoder) decode(v reflect.Value, depth int) error {
+	if depth > cborMaxDepth {
+		return d.fail("nested too deep")
+	}
+	start := d.pos
+	major, info, n, err := d.head()
+	if err != nil {
+		return err
+	}
+	if major == cborTag {
+		return d.decode(v, depth+1)
+	}
+	if major == cborSimple && (info == 22 || info == 23) {
+		v.SetZero() // null and undefined
+		return nil
+	}
+	if v.CanAddr() && reflect.PointerTo(v.Type()).Implements(textUnmarshalerType) {
+		if major != cborText {
+			return d.fail("%s wants text", v.Type())
+		}
+		text, err := d.bytes(n)
+		if err != nil {
+			return err
+		}
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText(text)
+	}
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		d.pos = start
+		return d.decode(v.Elem(), depth+1)
+	case reflect.Interface:
+		if v.NumMethod() > 0 {
+			return d.fail("cannot decode into %s", v.Type())
+		}
+		d.pos = start
+		x, err := d.decodeAny(depth)
+		if err != nil {
+			return err
+		}
+		if x == nil {
+			v.SetZero()
+		} else {
+			v.Set(reflect.ValueOf(x))
+		}
+		return nil
+	case reflect.Bool:
+		if major != cborSimple || info != 20 && info != 21 {
+			return d.fail("%s wants a boolean", v.Type())
+		}
+		v.SetBool(info == 21)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if major != cborUint && major != cborNeg || n > math.MaxInt64 {
+			return d.fail("%s wants an integer in range", v.Type())
+		}
+		i := int64(n)
+		if major == cborNeg {
+			i = -1 - i
+		}
+		if v.OverflowInt(i) {
+			return d.fail("%d overflows %s", i, v.Type())
+		}
+		v.SetInt(i)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if major != cborUint || v.OverflowUint(n) {
+			return d.fail("%s wants an unsigned integer in range", v.Type())
+		}
+		v.SetUint(n)
+		return nil
+	case reflect.Float32, reflect.Float64:
+		switch f, ok := cborFloat(info, n); {
+		case major == cborSimple && ok:
+			v.SetFloat(f)
+		case major == cborUint:
+			v.SetFloat(float64(n))
+		case major == cborNeg:
+			v.SetFloat(-1 - float64(n))
+		default:
+			return d.fail("%s wants a number", v.Type())
+		}
+		return nil
+	case reflect.String:
+		if major != cborText {
+			return d.fail("%s wants text", v.Type())
+		}
+		text, err := d.bytes(n)
+		if err != nil {
+			return err
+		}
+		v.SetString(string(text))
+		return nil
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 && major == cborBytes {
+			b, err := d.bytes(n)
+			if err != nil {
+				return err
+			}
+			if v.Kind() == reflect.Slice {
+				v.SetBytes(bytes.Clone(b))
+				return nil
+			}
+			if len(b) != v.Len() {
+				return d.fail("%d bytes for %s", len(b), v.Type())
+			}
+			reflect.Copy(v, reflect.ValueOf(b))
+			return nil
+		}
+		if major != cborArray {
+			return d.fail("%s wants an array", v.Type())
+		}
+		l, err := d.length(n)
+		if err != nil {
+			return err
+		}
+		if v.Kind() == reflect.Slice {
+			v.Set(reflect.MakeSlice(v.Type(), l, l))
+		} else if l != v.Len() {
+			return d.fail("%d items for %s", l, v.Type())
+		}
+		for i := 0; i < l; i++ {
+			if err := d.decode(v.Index(i), depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		if major != cborMap {
+			return d.fail("%s wants a map", v.Type())
+		}
+		l, err := d.length(n)
+		if err != nil {
+			return err
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMapWithSize(v.Type(), l))
+		}
+		for i := 0; i < l; i++ {
+			key := reflect.New(v.Type().Key()).Elem()
+			if err := d.decode(key, depth+1); err != nil {
+				return err
+			}
+			value := reflect.New(v.Type().Elem()).Elem()
+			if err := d.decode(value, depth+1); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, value)
+		}
+		return nil
+	case reflect.Struct:
+		if major != cborMap {
+			return d.fail("%s wants a map", v.Type())
+		}
+		l, err := d.length(n)
+		if err != nil {
+			return err
+		}
+		fields := cborFields(v.Type())
+		for i := 0; i < l; i++ {
+			var name string
+			if err := d.decode(reflect.ValueOf(&name).Elem(), depth+1); err != nil {
+				return err
+			}
+			j := slices.IndexFunc(fields, func(f cborField) bool { return f.name == name })
+			if j < 0 {
+				if _, err := d.decodeAny(depth + 1); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.decode(v.Field(fields[j].index), depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return d.fail("cannot decode into %s", v.Type())
+}
+
+// decodeAny reads the next item into the Go value closest to it: uint64
+// or int64 for integers, float64, string, []byte, []any, map[any]any, bool
+// or nil.
+func (d *cborDecoder) decodeAny(depth int) (any, error) {
+	if depth > cborMaxDepth {
+		return nil, d.fail("nested too deep")
+	}
+	major, info, n, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case cborUint:
+		return n, nil
+	case cborNeg:
+		if n > math.MaxInt64 {
+			return nil, d.fail("negative integer out of range")
+		}
+		return -1 - int64(n), nil
+	case cborBytes:
+		b, err := d.bytes(n)
+		return bytes.Clone(b), err
+	case cborText:
+		b, err := d.bytes(n)
+		return string(b), err
+	case cborArray:
+		l, err := d.length(n)
+		if err != nil {
+			return nil, err
+		}
+		items := make([]any, l)
+		for i := range items {
+			if items[i], err = d.decodeAny(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	case cborMap:
+		l, err := d.length(n)
+		if err != nil {
+			return nil, err
+		}
+		m := make(map[any]any, l)
+		for i := 0; i < l; i++ {
+			k, err := d.decodeAny(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if k != nil && !reflect.TypeOf(k).Comparable() {
+				return nil, d.fail("map key of type %T", k)
+			}
+			if m[k], err = d.decodeAny(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case cborTag:
+		return d.decodeAny(depth + 1)
+	}
+	switch info {
+	case 20, 21:
+		return info == 21, nil
+	case 22, 23:
+		return nil, nil
+	}
+	if f, ok := cborFloat(info, n); ok {
+		return f, nil
+	}
+	return nil, d.fail("simple value %d", n)
+}
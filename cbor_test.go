@@ -0,0 +1,162 @@
+//go:build !rbtree_core
+
+package rbtree
+
+import (
+	"encoding/hex"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The examples of RFC 8949, Appendix A, that the encoder writes.
+var cborExamples = []struct {
+	value any
+	hex   string
+}{
+	{0, "00"},
+	{1, "01"},
+	{10, "0a"},
+	{23, "17"},
+	{24, "1818"},
+	{25, "1819"},
+	{100, "1864"},
+	{1000, "1903e8"},
+	{1000000, "1a000f4240"},
+	{1000000000000, "1b000000e8d4a51000"},
+	{uint64(18446744073709551615), "1bffffffffffffffff"},
+	{-1, "20"},
+	{-10, "29"},
+	{-100, "3863"},
+	{-1000, "3903e7"},
+	{1.1, "fb3ff199999999999a"},
+	{float32(100000.0), "fa47c35000"},
+	{-4.1, "fbc010666666666666"},
+	{false, "f4"},
+	{true, "f5"},
+	{(*int)(nil), "f6"},
+	{"", "60"},
+	{"a", "6161"},
+	{"IETF", "6449455446"},
+	{"ü", "62c3bc"},
+	{[]byte{1, 2, 3, 4}, "4401020304"},
+	{[]int{}, "80"},
+	{[]int{1, 2, 3}, "83010203"},
+	{[]any{1, []int{2, 3}, []int{4, 5}}, "8301820203820405"},
+	{map[int]int{}, "a0"},
+	{map[int]int{1: 2, 3: 4}, "a201020304"},
+	{map[string]any{"a": 1, "b": []int{2, 3}}, "a26161016162820203"},
+	{[]any{"a", map[string]string{"b": "c"}}, "826161a161626163"},
+}
+
+func TestCBOREncode(t *testing.T) {
+	for _, c := range cborExamples {
+		var e cborEncoder
+		assert.Nil(t, e.encode(reflect.ValueOf(c.value)))
+		assert.Equal(t, c.hex, hex.EncodeToString(e.buf), "%#v", c.value)
+	}
+}
+
+func TestCBORDecode(t *testing.T) {
+	for _, c := range cborExamples {
+		data, _ := hex.DecodeString(c.hex)
+		d := cborDecoder{data: data}
+		got := reflect.New(reflect.TypeOf(c.value))
+		if !assert.Nil(t, d.decode(got.Elem(), 0), c.hex) {
+			continue
+		}
+		assert.Equal(t, len(data), d.pos)
+		// items decoded into an interface get types of their own
+		var e cborEncoder
+		assert.Nil(t, e.encode(got.Elem()))
+		assert.Equal(t, c.hex, hex.EncodeToString(e.buf))
+		switch c.value.(type) {
+		case []any, map[string]any:
+		default:
+			assert.Equal(t, c.value, got.Elem().Interface(), c.hex)
+		}
+	}
+
+	// half floats, which the encoder does not write
+	for h, want := range map[string]float64{
+		"f90000": 0, "f93c00": 1, "f93e00": 1.5, "f97bff": 65504,
+		"f90001": 5.960464477539063e-8, "f90400": 0.00006103515625,
+		"f9c400": -4, "f97c00": math.Inf(1), "f9fc00": math.Inf(-1),
+	} {
+		data, _ := hex.DecodeString(h)
+		d := cborDecoder{data: data}
+		var f float64
+		assert.Nil(t, d.decode(reflect.ValueOf(&f).Elem(), 0), h)
+		assert.Equal(t, want, f, h)
+	}
+	data, _ := hex.DecodeString("f97e00")
+	var f float64
+	assert.Nil(t, (&cborDecoder{data: data}).decode(reflect.ValueOf(&f).Elem(), 0))
+	assert.True(t, math.IsNaN(f))
+
+	// a tag is skipped
+	data, _ = hex.DecodeString("c074323031332d30332d32315432303a30343a30305a")
+	var s string
+	assert.Nil(t, (&cborDecoder{data: data}).decode(reflect.ValueOf(&s).Elem(), 0))
+	assert.Equal(t, "2013-03-21T20:04:00Z", s)
+
+	// generic values
+	data, _ = hex.DecodeString("a3616101616282f5f6616340")
+	var x any
+	assert.Nil(t, (&cborDecoder{data: data}).decode(reflect.ValueOf(&x).Elem(), 0))
+	assert.Equal(t, map[any]any{"a": uint64(1), "b": []any{true, nil}, "c": []byte{}}, x)
+}
+
+func TestCBORDecodeErrors(t *testing.T) {
+	for h, into := range map[string]any{
+		"3bffffffffffffffff": int64(0),         // below the smallest int64
+		"1901f4":             int8(0),          // 500 overflows
+		"20":                 uint(0),          // negative into unsigned
+		"6161":               0,                // text into an integer
+		"1a000f42":           0,                // truncated argument
+		"6461":               "",               // truncated text
+		"9b00000000ffffffff": []int{},          // length beyond the end
+		"9f01ff":             []int{},          // indefinite length
+		"4101":               [2]byte{},        // wrong array length
+		"f8ff":               any(nil),         // simple value 255
+		"a10101":             struct{}{},       // a struct key must be text
+		"830102":             []int{},          // missing item
+		"a1616180":           map[string]int{}, // array into an integer
+	} {
+		data, _ := hex.DecodeString(h)
+		v := reflect.New(reflect.TypeOf(&into).Elem()).Elem()
+		if into != nil {
+			v = reflect.New(reflect.TypeOf(into)).Elem()
+		}
+		assert.ErrorIs(t, (&cborDecoder{data: data}).decode(v, 0), ErrBadEncoding, h)
+	}
+
+	deep := make([]byte, cborMaxDepth+2)
+	for i := range deep {
+		deep[i] = 0x81 // an array of one item
+	}
+	deep = append(deep, 0)
+	var x any
+	assert.ErrorIs(t, (&cborDecoder{data: deep}).decode(reflect.ValueOf(&x).Elem(), 0), ErrBadEncoding)
+}
+
+type cborPoint struct {
+	X, Y   int
+	Label  string `json:"label,omitempty"`
+	Hidden int    `json:"-"`
+	secret int
+}
+
+func TestCBORStruct(t *testing.T) {
+	var e cborEncoder
+	assert.Nil(t, e.encode(reflect.ValueOf(cborPoint{X: 1, Y: -2, Hidden: 3, secret: 4})))
+	assert.Equal(t, "a2615801615921", hex.EncodeToString(e.buf))
+
+	// unknown fields are skipped
+	data, _ := hex.DecodeString("a4615801617a8201026159216565787472618102")
+	var p cborPoint
+	assert.Nil(t, (&cborDecoder{data: data}).decode(reflect.ValueOf(&p).Elem(), 0))
+	assert.Equal(t, cborPoint{X: 1, Y: -2}, p)
+}
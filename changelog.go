@@ -0,0 +1,143 @@
+package rbtree
+
+import (
+	"iter"
+	"sync"
+)
+
+// EventKind is the kind of a modification in the changelog.
+type EventKind int
+
+const (
+	EventStore  EventKind = iota + 1 // Key was given Value
+	EventDelete                      // Key was removed, Value is what it held
+	EventResync                      // the events before it are lost or void, see ChangesSince
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventStore:
+		return "store"
+	case EventDelete:
+		return "delete"
+	case EventResync:
+		return "resync"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is a modification recorded by a tree built WithChangelog. Gen is
+// its generation, which counts the modifications of the tree from 1.
+type Event[K any, V any] struct {
+	Gen   uint64
+	Kind  EventKind
+	Key   K
+	Value V
+}
+
+// changelog is a ring of the latest events.
+type changelog[K any, V any] struct {
+	mu    sync.Mutex
+	gen   uint64 // generation of the latest event
+	ring  []Event[K, V]
+	start int // index of the oldest event
+	n     int
+}
+
+func newChangelog[K any, V any](capacity int) *changelog[K, V] {
+	return &changelog[K, V]{ring: make([]Event[K, V], capacity)}
+}
+
+// record logs a modification, if the tree keeps a changelog, and notes
+// the key for a Snapshot that is walking the tree. Writers call it with
+// the modified node still locked.
+func (t *RBTree[K, V]) record(kind EventKind, key K, value V) {
+	if t.hist != nil {
+		t.hist.tick()
+	}
+	if c := t.copying.Load(); c != nil {
+		if kind == EventResync {
+			c.void()
+		} else {
+			c.note(key)
+		}
+	}
+	l := t.log
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.gen++
+	e := Event[K, V]{Gen: l.gen, Kind: kind, Key: key, Value: value}
+	if l.n < len(l.ring) {
+		l.ring[(l.start+l.n)%len(l.ring)] = e
+		l.n++
+	} else {
+		l.ring[l.start] = e
+		l.start = (l.start + 1) % len(l.ring)
+	}
+	l.mu.Unlock()
+}
+
+// resync logs that the tree's contents were replaced as a whole.
+func (t *RBTree[K, V]) resync() {
+	var e Event[K, V]
+	t.record(EventResync, e.Key, e.Value)
+}
+
+// Generation returns the generation of the tree's latest modification, 0
+// if it has none or keeps no changelog.
+func (t *RBTree[K, V]) Generation() uint64 {
+	if t.log == nil {
+		return 0
+	}
+	t.log.mu.Lock()
+	defer t.log.mu.Unlock()
+	return t.log.gen
+}
+
+// ChangesSince returns the modifications after generation gen, oldest
+// first, and the generation to pass on the next call. It is for pollers
+// that sync incrementally: start from a Snapshot, then apply the changes
+// since its Generation.
+//
+// The sequence starts with an EventResync if the ring no longer holds all
+// the changes since gen, or gen is from the future. It also holds one
+// where the tree was replaced as a whole, by a Clear, a load, a Split or
+// a Join. The changes before a resync do not lead to the tree's contents,
+// the poller has to start over from a new Snapshot.
+//
+// The events are copied out when ChangesSince is called. A tree built
+// without WithChangelog returns an empty sequence and 0.
+func (t *RBTree[K, V]) ChangesSince(gen uint64) (iter.Seq[Event[K, V]], uint64) {
+	l := t.log
+	if l == nil {
+		return func(func(Event[K, V]) bool) {}, 0
+	}
+	l.mu.Lock()
+	cur := l.gen
+	oldest := cur - uint64(l.n) // the changes after it are in the ring
+	var events []Event[K, V]
+	if gen < oldest || gen > cur {
+		events = append(events, Event[K, V]{Gen: oldest, Kind: EventResync})
+		gen = oldest
+	}
+	for i := int(gen - oldest); i < l.n; i++ {
+		events = append(events, l.ring[(l.start+i)%len(l.ring)])
+	}
+	l.mu.Unlock()
+	return func(yield func(Event[K, V]) bool) {
+		for _, e := range events {
+			if !yield(e) {
+				return
+			}
+		}
+	}, cur
+}
+
+// Generation returns the changelog generation the snapshot was taken at,
+// see ChangesSince.
+func (s *Snapshot[K, V]) Generation() uint64 {
+	return s.gen
+}
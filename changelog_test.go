@@ -0,0 +1,176 @@
+package rbtree_test
+
+import (
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iku50/rbtree-go"
+)
+
+func collect[K any, V any](tree *rbtree.RBTree[K, V], gen uint64) ([]rbtree.Event[K, V], uint64) {
+	seq, next := tree.ChangesSince(gen)
+	return slices.Collect(seq), next
+}
+
+func TestChangesSince(t *testing.T) {
+	events, gen := collect(rbtree.New[int, int](), 0)
+	assert.Empty(t, events)
+	assert.Equal(t, uint64(0), gen)
+
+	tree := rbtree.New[int, string](rbtree.WithChangelog(16))
+	var changes []rbtree.Event[int, string]
+	tree.Insert(1, "a")
+	tree.Insert(2, "b")
+	tree.Insert(1, "c")
+	tree.Delete(2)
+	tree.Delete(3) // absent, not a change
+	tree.Update(1, func(old string, ok bool) (string, bool) { return old, false })
+	changes, gen = collect(tree, 0)
+	assert.Equal(t, uint64(4), gen)
+	assert.Equal(t, []rbtree.Event[int, string]{
+		{Gen: 1, Kind: rbtree.EventStore, Key: 1, Value: "a"},
+		{Gen: 2, Kind: rbtree.EventStore, Key: 2, Value: "b"},
+		{Gen: 3, Kind: rbtree.EventStore, Key: 1, Value: "c"},
+		{Gen: 4, Kind: rbtree.EventDelete, Key: 2, Value: "b"},
+	}, changes)
+	changes, _ = collect(tree, 2)
+	assert.Len(t, changes, 2)
+	changes, next := collect(tree, gen)
+	assert.Empty(t, changes)
+	assert.Equal(t, gen, next)
+
+	// stopping early
+	seq, _ := tree.ChangesSince(0)
+	n := 0
+	for range seq {
+		n++
+		break
+	}
+	assert.Equal(t, 1, n)
+	assert.Equal(t, "store", rbtree.EventStore.String())
+}
+
+func TestChangesSinceOverflow(t *testing.T) {
+	tree := rbtree.New[int, int](rbtree.WithChangelog(4))
+	for k := 0; k < 10; k++ {
+		tree.Insert(k, k)
+	}
+	events, gen := collect(tree, 0)
+	assert.Equal(t, uint64(10), gen)
+	if assert.Len(t, events, 5) {
+		assert.Equal(t, rbtree.Event[int, int]{Gen: 6, Kind: rbtree.EventResync}, events[0])
+		assert.Equal(t, uint64(7), events[1].Gen)
+		assert.Equal(t, 9, events[4].Key)
+	}
+	events, _ = collect(tree, 6)
+	assert.Len(t, events, 4, "the ring still holds every change")
+	events, _ = collect(tree, 99)
+	assert.Equal(t, rbtree.EventResync, events[0].Kind, "a generation from the future")
+}
+
+func TestChangesSinceBulk(t *testing.T) {
+	tree := rbtree.New[int, int](rbtree.WithChangelog(100))
+	tree.InsertBatch([]rbtree.KV[int, int]{{Key: 1, Value: 1}, {Key: 2, Value: 2}, {Key: 3, Value: 3}})
+	tree.DeleteRange(2, 10)
+	events, gen := collect(tree, 0)
+	var kinds []rbtree.EventKind
+	var keys []int
+	for _, e := range events {
+		kinds = append(kinds, e.Kind)
+		keys = append(keys, e.Key)
+	}
+	assert.Equal(t, []rbtree.EventKind{rbtree.EventStore, rbtree.EventStore, rbtree.EventStore, rbtree.EventDelete, rbtree.EventDelete}, kinds)
+	assert.Equal(t, []int{1, 2, 3, 2, 3}, keys)
+
+	tree.Split(0)
+	events, _ = collect(tree, gen)
+	assert.Equal(t, []rbtree.Event[int, int]{{Gen: gen + 1, Kind: rbtree.EventResync}}, events)
+
+	// a small batch goes down the tree and logs each key it stores
+	for i := 0; i < 100; i++ {
+		tree.Insert(i, i)
+	}
+	_, gen = collect(tree, 0)
+	tree.InsertBatch([]rbtree.KV[int, int]{{Key: 5, Value: 50}, {Key: 1000, Value: 1}, {Key: 1001, Value: 2}})
+	events, next := collect(tree, gen)
+	assert.Equal(t, gen+3, next)
+	for i := range events {
+		events[i].Gen = 0 // logged in the order the descent reached them
+	}
+	assert.ElementsMatch(t, []rbtree.Event[int, int]{
+		{Kind: rbtree.EventStore, Key: 5, Value: 50},
+		{Kind: rbtree.EventStore, Key: 1000, Value: 1},
+		{Kind: rbtree.EventStore, Key: 1001, Value: 2},
+	}, events)
+}
+
+func TestChangesSincePoller(t *testing.T) {
+	tree := rbtree.New[int, int](rbtree.WithChangelog(1 << 12))
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 5000; i++ {
+				k := rand.IntN(100)
+				if rand.IntN(3) == 0 {
+					tree.Delete(k)
+				} else {
+					tree.Insert(k, i)
+				}
+			}
+		}()
+	}
+
+	// a poller that follows the tree from a snapshot
+	var state map[int]int
+	var gen uint64
+	load := func() {
+		s := tree.Snapshot()
+		state = map[int]int{}
+		s.Range(func(key, value int) bool {
+			state[key] = value
+			return true
+		})
+		gen = s.Generation()
+	}
+	load()
+	poll := func() {
+		seq, next := tree.ChangesSince(gen)
+		for e := range seq {
+			switch e.Kind {
+			case rbtree.EventStore:
+				state[e.Key] = e.Value
+			case rbtree.EventDelete:
+				delete(state, e.Key)
+			case rbtree.EventResync:
+				load()
+				return
+			}
+		}
+		gen = next
+	}
+	go func() {
+		wg.Wait()
+		stop.Store(true)
+	}()
+	for !stop.Load() {
+		poll()
+	}
+	poll()
+
+	want := map[int]int{}
+	tree.Range(func(key, value int) bool {
+		want[key] = value
+		return true
+	})
+	assert.Equal(t, want, state)
+	assert.Equal(t, slices.Sorted(maps.Keys(want)), treeKeys(tree))
+}
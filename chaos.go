@@ -0,0 +1,14 @@
+package rbtree
+
+// chaosPoint is a place in the locking protocol where WithChaos may
+// perturb the scheduling. WithChaos is only built with the rbtree_chaos
+// tag; without it perturb does nothing and compiles away.
+type chaosPoint int
+
+const (
+	chaosLocked chaosPoint = iota // a writer just locked a node or an area
+	chaosMark                     // a delete fixup is about to mark ancestors
+	chaosRotate                   // a rotation has relinked half its pointers
+	chaosPinned                   // a reader just pinned a node
+	chaosPoints
+)
@@ -0,0 +1,12 @@
+//go:build !rbtree_chaos
+
+package rbtree
+
+// chaos is empty without the rbtree_chaos tag, see chaosPoint.
+type chaos struct{}
+
+func newChaos(uint64) *chaos {
+	return nil
+}
+
+func (t *RBTree[K, V]) perturb(chaosPoint) {}
@@ -0,0 +1,70 @@
+//go:build rbtree_chaos
+
+package rbtree
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// WithChaos is for tests, and only built with the rbtree_chaos tag:
+//
+//	go test -tags rbtree_chaos ./...
+//
+// It perturbs the scheduling at the points of the locking protocol where a
+// concurrency bug would show: right after a writer locks a node or an
+// area, before a delete fixup marks ancestors, halfway through a rotation
+// and after a reader pins a node. There it yields the processor now and
+// then and sleeps for a few microseconds more rarely, so that goroutines
+// interleave in the windows between the steps far more often than under
+// plain -race runs. seed fixes the sequence of decisions.
+//
+// A chaotic tree is much slower. It ignores WithSingleProcFallback, which
+// would serialize the writers the chaos is meant to interleave.
+func WithChaos(seed uint64) Option {
+	return func(o *options) {
+		o.chaos = true
+		o.chaosSeed = seed
+	}
+}
+
+// chaos decides at every point whether to yield or sleep. The decisions
+// come from a counter hashed with SplitMix64, so for a given seed each run
+// makes the same sequence of them; which goroutines they fall on is up to
+// the scheduler.
+type chaos struct {
+	state atomic.Uint64
+	hits  [chaosPoints]atomic.Uint64 // perturbations made at each point
+}
+
+func newChaos(seed uint64) *chaos {
+	c := &chaos{}
+	c.state.Store(seed)
+	return c
+}
+
+// perturb yields the processor at one in four visits of p and sleeps up
+// to 20µs at one in 32. A rotation is only ever yielded at: its nodes stay
+// locked while it sleeps, and sleeping there just slows every writer down.
+func (c *chaos) perturb(p chaosPoint) {
+	x := c.state.Add(0x9e3779b97f4a7c15)
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	x ^= x >> 31
+	switch r := x % 32; {
+	case r == 0 && p != chaosRotate:
+		c.hits[p].Add(1)
+		time.Sleep(time.Duration(x>>8%20+1) * time.Microsecond)
+	case r < 8:
+		c.hits[p].Add(1)
+		runtime.Gosched()
+	}
+}
+
+// perturb calls the chaos of a tree built WithChaos at p.
+func (t *RBTree[K, V]) perturb(p chaosPoint) {
+	if t.chaos != nil {
+		t.chaos.perturb(p)
+	}
+}
@@ -0,0 +1,57 @@
+//go:build rbtree_chaos
+
+package rbtree
+
+import (
+	"math/rand/v2"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChaos(t *testing.T) {
+	tree := New[int, int](WithChaos(7))
+	assert.False(t, tree.serial, "chaos interleaves the writers")
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			r := rand.New(rand.NewPCG(uint64(w), 0))
+			for i := 0; i < 2000; i++ {
+				k := r.IntN(256)
+				switch r.IntN(3) {
+				case 0:
+					tree.Delete(k)
+				case 1:
+					tree.Get(k)
+				default:
+					tree.Insert(k, k)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	assert.Nil(t, tree.Check())
+	for p := range chaosPoints {
+		assert.NotZero(t, tree.chaos.hits[p].Load(), "point %d", p)
+	}
+
+	// the seed fixes the decisions
+	a, b := newChaos(3), newChaos(3)
+	for i := 0; i < 100; i++ {
+		a.perturb(chaosRotate)
+		b.perturb(chaosRotate)
+	}
+	assert.Equal(t, a.hits[chaosRotate].Load(), b.hits[chaosRotate].Load())
+	assert.NotZero(t, a.hits[chaosRotate].Load())
+}
+
+func TestConformanceSamplingChaos(t *testing.T) {
+	tree := sampleConformance(t, func(err error) {
+		t.Error(err)
+	}, WithChaos(7))
+	assert.Zero(t, tree.Stats().ProtocolViolations)
+	assert.Nil(t, tree.Verify())
+}
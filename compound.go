@@ -0,0 +1,89 @@
+package rbtree
+
+import (
+	"context"
+)
+
+// GetOrInsert returns the value stored for key if present. Otherwise it
+// inserts value and returns it. loaded is true if the value was already
+// present. The lookup and the insert happen under the same node lock.
+func (t *RBTree[K, V]) GetOrInsert(key K, value V) (actual V, loaded bool) {
+	actual, loaded, _ = t.GetOrInsertCtx(context.Background(), key, value)
+	return actual, loaded
+}
+
+// GetOrInsertCtx is like GetOrInsert but stops retrying once ctx is done or
+// the backoff policy gives up, returning the reason.
+func (t *RBTree[K, V]) GetOrInsertCtx(ctx context.Context, key K, value V) (actual V, loaded bool, err error) {
+	old, loaded, err := t.update(ctx, key, func(_ V, ok bool) (V, bool) {
+		return value, !ok
+	}, keepDeadline)
+	if loaded {
+		return old, true, err
+	}
+	return value, false, err
+}
+
+// Update atomically replaces the value for key with the result of fn.
+// fn receives the current value and whether key is present, and returns
+// the value to store and whether to store it at all; returning false
+// leaves the tree unchanged. Update returns the value held for key
+// afterwards and whether key is present.
+//
+// fn runs while a node lock is held, so it must be quick and must not use
+// the tree. It may run more than once if the operation is retried, only
+// the result of the last call takes effect.
+func (t *RBTree[K, V]) Update(key K, fn func(old V, ok bool) (V, bool)) (value V, ok bool) {
+	value, ok, _ = t.UpdateCtx(context.Background(), key, fn)
+	return value, ok
+}
+
+// UpdateCtx is like Update but stops retrying once ctx is done or the
+// backoff policy gives up, returning the reason.
+func (t *RBTree[K, V]) UpdateCtx(ctx context.Context, key K, fn func(old V, ok bool) (V, bool)) (value V, ok bool, err error) {
+	_, _, err = t.update(ctx, key, func(old V, loaded bool) (V, bool) {
+		v, store := fn(old, loaded)
+		if store {
+			value, ok = v, true
+		} else {
+			value, ok = old, loaded
+		}
+		return v, store
+	}, keepDeadline)
+	return value, ok, err
+}
+
+// CompareAndDelete deletes key if its value is equal to expected and
+// reports whether it did. The value type must be comparable, otherwise
+// CompareAndDelete panics, as sync.Map does.
+func (t *RBTree[K, V]) CompareAndDelete(key K, expected V) (deleted bool) {
+	deleted, _ = t.CompareAndDeleteCtx(context.Background(), key, expected)
+	return deleted
+}
+
+// comparable panics if v is not comparable, or WithPanicRecovery returns
+// a *PanicError. Checked before the key's node is locked, the panic
+// leaves no lock behind.
+func (t *RBTree[K, V]) comparable(v V) (err error) {
+	if t.guard {
+		defer func() {
+			if r := recover(); r != nil {
+				err = t.recovered(r)
+			}
+		}()
+	}
+	_ = any(v) == any(v)
+	return nil
+}
+
+// CompareAndDeleteCtx is like CompareAndDelete but stops retrying once ctx
+// is done or the backoff policy gives up, returning the reason.
+func (t *RBTree[K, V]) CompareAndDeleteCtx(ctx context.Context, key K, expected V) (deleted bool, err error) {
+	if err := t.comparable(expected); err != nil {
+		return false, t.opError(OpDelete, key, 0, 0, err)
+	}
+	v, expired, err := t.deleteIf(ctx, key, func(old V) bool {
+		return any(old) == any(expected)
+	})
+	return v != nil && !expired, err
+}
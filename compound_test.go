@@ -0,0 +1,80 @@
+package rbtree_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iku50/rbtree-go"
+)
+
+func TestGetOrInsert(t *testing.T) {
+	tree := rbtree.New[int, string]()
+	v, loaded := tree.GetOrInsert(1, "one")
+	assert.False(t, loaded)
+	assert.Equal(t, "one", v)
+	v, loaded = tree.GetOrInsert(1, "uno")
+	assert.True(t, loaded)
+	assert.Equal(t, "one", v)
+	assert.Equal(t, 1, tree.Len())
+}
+
+func TestUpdate(t *testing.T) {
+	tree := rbtree.New[string, int]()
+	incr := func(old int, ok bool) (int, bool) { return old + 1, true }
+	v, ok := tree.Update("a", incr)
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+	v, _ = tree.Update("a", incr)
+	assert.Equal(t, 2, v)
+
+	v, ok = tree.Update("b", func(int, bool) (int, bool) { return 0, false })
+	assert.False(t, ok)
+	assert.Equal(t, 0, v)
+	assert.Nil(t, tree.Get("b"))
+	assert.Equal(t, 1, tree.Len())
+}
+
+func TestUpdateConcurrent(t *testing.T) {
+	tree := rbtree.New[int, int]()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				tree.Update(j%4, func(old int, ok bool) (int, bool) { return old + 1, true })
+			}
+		}()
+	}
+	wg.Wait()
+	total := 0
+	tree.Range(func(_ int, v int) bool {
+		total += v
+		return true
+	})
+	assert.Equal(t, 8000, total)
+}
+
+func TestCompareAndDelete(t *testing.T) {
+	tree := rbtree.New[int, string]()
+	tree.Insert(1, "one")
+	tree.Insert(2, "two")
+	assert.False(t, tree.CompareAndDelete(1, "uno"))
+	assert.NotNil(t, tree.Get(1))
+	assert.True(t, tree.CompareAndDelete(1, "one"))
+	assert.Nil(t, tree.Get(1))
+	assert.False(t, tree.CompareAndDelete(3, "three"))
+	assert.True(t, tree.CompareAndDelete(2, "two"))
+	assert.Equal(t, 0, tree.Len())
+}
+
+func TestCompareAndDeletePanics(t *testing.T) {
+	tree := rbtree.New[int, []int](rbtree.WithBackoff(rbtree.Backoff{MaxRetries: 3}))
+	tree.Insert(1, []int{1})
+	assert.Panics(t, func() { tree.CompareAndDelete(1, []int{1}) }, "like sync.Map")
+	assert.NoError(t, tree.InsertCtx(context.Background(), 1, []int{2}), "the node was not left locked")
+	assert.Equal(t, []int{2}, *tree.Get(1))
+}
@@ -0,0 +1,48 @@
+package rbtree
+
+import (
+	"context"
+)
+
+// OpCounter adds up the work tree operations do on behalf of one request,
+// for attributing it in a multi-tenant service. Operations count into it
+// when they are given a context made by WithOpCounter: the Ctx variants of
+// the lookups and single-key writes do.
+//
+// The fields are plain integers, so a counter must only be used by one
+// goroutine at a time, like the request it belongs to.
+type OpCounter struct {
+	Ops          uint64 // operations run
+	Retries      uint64 // retries after hitting a locked node
+	NodesVisited uint64 // nodes examined on the way down, across all attempts
+}
+
+type opCounterKey struct{}
+
+// WithOpCounter returns a copy of ctx that makes the operations it is
+// passed to add their work to c.
+func WithOpCounter(ctx context.Context, c *OpCounter) context.Context {
+	return context.WithValue(ctx, opCounterKey{}, c)
+}
+
+func counterFrom(ctx context.Context) *OpCounter {
+	c, _ := ctx.Value(opCounterKey{}).(*OpCounter)
+	return c
+}
+
+// add counts an operation that was retried retries times and examined
+// visited nodes. It does nothing on a nil counter.
+func (c *OpCounter) add(retries, visited int) {
+	if c != nil {
+		c.Ops++
+		c.Retries += uint64(retries)
+		c.NodesVisited += uint64(visited)
+	}
+}
+
+// visit counts a node that a write examined.
+func (d *opDesc[K]) visit() {
+	if d != nil && d.counter != nil {
+		d.counter.NodesVisited++
+	}
+}
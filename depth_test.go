@@ -0,0 +1,40 @@
+package rbtree
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDepthGuardOnCycle(t *testing.T) {
+	tree := NewRBTree(2, 2)
+	tree.Insert(1, 1)
+	tree.Insert(3, 3)
+	assert.Nil(t, tree.Check())
+
+	// link the smallest leaf back to the root to form a cycle
+	tree.root.Load().left.Load().left.Store(tree.root.Load())
+
+	assert.Nil(t, tree.Get(0))
+	assert.ErrorIs(t, tree.Check(), ErrCorrupted)
+	assert.True(t, strings.Contains(tree.String(), ErrCorrupted.Error()))
+	_, v := tree.Floor(0)
+	assert.Nil(t, v)
+}
+
+func TestDepthGuardOnWrite(t *testing.T) {
+	for _, write := range []func(tree *RBTree[int, int]) error{
+		func(tree *RBTree[int, int]) error { return tree.InsertCtx(context.Background(), 0, 0) },
+		func(tree *RBTree[int, int]) error { _, err := tree.DeleteCtx(context.Background(), 0); return err },
+	} {
+		tree := NewRBTree(2, 2)
+		tree.Insert(1, 1)
+		tree.Insert(3, 3)
+		tree.root.Load().left.Load().left.Store(tree.root.Load())
+
+		assert.ErrorIs(t, write(tree), ErrCorrupted)
+		assert.True(t, tree.corrupt.Load(), "a write marks the tree corrupted like a read")
+	}
+}
@@ -0,0 +1,228 @@
+package rbtree
+
+import (
+	"context"
+	"math"
+)
+
+// CountEstimate is an approximate number of keys. Count is the estimate,
+// Min and Max bound the true number while no writer is running.
+type CountEstimate struct {
+	Count int
+	Min   int
+	Max   int
+}
+
+// pathStep is a node on a search path and the side the search left it by.
+type pathStep[K any, V any] struct {
+	n     *RBTreeNode[K, V]
+	black bool
+	right bool
+}
+
+// path records the search path towards key down to a nil link, turning
+// right where key is greater. The nodes it turns right at and their left
+// subtrees hold the keys smaller than key. Colors are read while the nodes
+// are pinned.
+func (t *RBTree[K, V]) path(key K) (path []pathStep[K, V], err error) {
+	_, err = t.descend(OpSeek, func(n *RBTreeNode[K, V]) *RBTreeNode[K, V] {
+		right := t.compare(key, n.key) > 0
+		path = append(path, pathStep[K, V]{n: n, black: n.isBlack(), right: right})
+		if right {
+			return n.right.Load()
+		}
+		return n.left.Load()
+	})
+	return path, err
+}
+
+// blackHeights returns, for every step of path and one past its end, the
+// number of black nodes from there down to the nil link. It is also the
+// black height of the subtree the step passes by.
+func blackHeights[K any, V any](path []pathStep[K, V]) []int {
+	bh := make([]int, len(path)+1)
+	for i := len(path) - 1; i >= 0; i-- {
+		bh[i] = bh[i+1]
+		if path[i].black {
+			bh[i]++
+		}
+	}
+	return bh
+}
+
+// pathEstimator sizes the subtrees a search path passes by from their
+// black height: a red-black subtree of black height b holds between 2^b-1
+// and 2^(2b+1)-1 keys. The estimate scales the size of the whole tree down
+// to the subtree's height.
+type pathEstimator struct {
+	n      float64 // keys in the tree
+	height float64 // black height of the root
+}
+
+// add counts a node on the path and the subtree of black height b it
+// passes by.
+func (e pathEstimator) add(c *CountEstimate, b int) {
+	lo := 1<<min(b, 62) - 1
+	hi := 1<<min(2*b+1, 62) - 1
+	est := lo
+	if e.height > 0 {
+		est = int(math.Round(math.Pow(e.n+1, float64(b)/e.height) - 1))
+	}
+	c.Min += 1 + lo
+	c.Max += 1 + hi
+	c.Count += 1 + min(max(est, lo), hi)
+}
+
+// estimateRange estimates the keys between the keys lo and hi were
+// searched for. Where the paths part at a node, the keys in between are
+// that node, the subtrees lo's path passes by on the right below it and
+// those hi's path passes by on the left.
+func estimateRange[K any, V any](lo, hi []pathStep[K, V], e pathEstimator) CountEstimate {
+	blo, bhi := blackHeights(lo), blackHeights(hi)
+	i := 0
+	for i < len(lo) && i < len(hi) && lo[i] == hi[i] {
+		i++
+	}
+	var c CountEstimate
+	if i == len(lo) && i == len(hi) {
+		return c
+	}
+	if i < len(lo) && i < len(hi) && lo[i].n == hi[i].n && !lo[i].right && hi[i].right {
+		c = CountEstimate{Count: 1, Min: 1, Max: 1}
+		for j := i + 1; j < len(lo); j++ {
+			if !lo[j].right {
+				e.add(&c, blo[j+1])
+			}
+		}
+		for j := i + 1; j < len(hi); j++ {
+			if hi[j].right {
+				e.add(&c, bhi[j+1])
+			}
+		}
+		return c
+	}
+	// a writer changed the tree between the two searches, so the keys
+	// below lo are taken from those below hi
+	var below, above CountEstimate
+	for j := i; j < len(lo); j++ {
+		if lo[j].right {
+			e.add(&below, blo[j+1])
+		}
+	}
+	for j := i; j < len(hi); j++ {
+		if hi[j].right {
+			e.add(&above, bhi[j+1])
+		}
+	}
+	return CountEstimate{
+		Count: max(above.Count-below.Count, 0),
+		Min:   max(above.Min-below.Max, 0),
+		Max:   max(above.Max-below.Min, 0),
+	}
+}
+
+// EstimateCountRange estimates the number of keys in [lo, hi), expired
+// ones included, for query planners choosing between a scan of the range
+// and another index. It searches for lo and hi and estimates the subtrees
+// between the two paths from the colors on them, without reading the
+// subtree sizes Rank relies on, so it costs two lookups and is exact when
+// the paths pass no subtrees by.
+//
+// The bounds follow from the red-black properties, so they are wide for
+// ranges spanning large subtrees, and only hold while no writer runs.
+func (t *RBTree[K, V]) EstimateCountRange(lo, hi K) CountEstimate {
+	if t.compare(lo, hi) >= 0 {
+		return CountEstimate{}
+	}
+	ctx := context.Background()
+	if t.prof != nil {
+		defer t.prof.restore(ctx)
+	}
+	var below, above []pathStep[K, V]
+	err := t.retry(ctx, func() error {
+		var err error
+		if below, err = t.path(lo); err != nil {
+			return err
+		}
+		above, err = t.path(hi)
+		return err
+	})
+	if err != nil {
+		if err == ErrCorrupted {
+			t.markCorrupted()
+		}
+		return CountEstimate{}
+	}
+	n := t.Len()
+	c := estimateRange(below, above, pathEstimator{
+		n:      float64(n),
+		height: float64(blackHeights(below)[0]),
+	})
+	if n >= c.Min {
+		c.Max = min(c.Max, n)
+		c.Count = min(c.Count, n)
+	}
+	return c
+}
+
+// Bucket is a range of keys in a KeyHistogram: Count keys from Lower to
+// Upper, both included.
+type Bucket[K any] struct {
+	Lower K
+	Upper K
+	Count int
+}
+
+// KeyHistogram splits the keys into up to buckets ranges of equal depth,
+// so that each holds the same number of keys give or take one, for
+// selectivity estimates. On a tree built WithOrderStatistics the
+// boundaries are found with Select, two lookups per bucket; other trees
+// have no sizes to find them by and walk all the keys once, which takes a
+// lookup per key. Expired keys are counted.
+//
+// Like Rank and Select the histogram may lag behind concurrent writers,
+// and it ends early if the tree shrank while it was taken.
+func (t *RBTree[K, V]) KeyHistogram(buckets int) []Bucket[K] {
+	n := t.Len()
+	if buckets <= 0 || n == 0 {
+		return nil
+	}
+	buckets = min(buckets, n)
+	hist := make([]Bucket[K], 0, buckets)
+	if !t.ordered {
+		return t.histogramWalk(hist, n, buckets)
+	}
+	for i := 0; i < buckets; i++ {
+		first, last := i*n/buckets, (i+1)*n/buckets-1
+		lower, _, ok := t.Select(first)
+		if !ok {
+			break
+		}
+		upper, _, ok := t.Select(last)
+		if !ok {
+			break
+		}
+		hist = append(hist, Bucket[K]{Lower: lower, Upper: upper, Count: last - first + 1})
+	}
+	return hist
+}
+
+// histogramWalk appends the buckets of KeyHistogram for n keys to hist,
+// finding their boundaries in a single walk over the keys.
+func (t *RBTree[K, V]) histogramWalk(hist []Bucket[K], n, buckets int) []Bucket[K] {
+	var b Bucket[K]
+	i := 0
+	t.forward(nil, nil, func(key K) bool {
+		first, last := len(hist)*n/buckets, (len(hist)+1)*n/buckets-1
+		if i == first {
+			b.Lower = key
+		}
+		if i == last {
+			b.Upper, b.Count = key, last-first+1
+			hist = append(hist, b)
+		}
+		i++
+		return len(hist) < buckets
+	})
+	return hist
+}
@@ -0,0 +1,108 @@
+package rbtree_test
+
+import (
+	"math/rand/v2"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iku50/rbtree-go"
+)
+
+func TestEstimateCountRange(t *testing.T) {
+	tree := rbtree.New[int, int]()
+	assert.Equal(t, rbtree.CountEstimate{}, tree.EstimateCountRange(0, 10))
+	tree.Insert(5, 5)
+	assert.Equal(t, rbtree.CountEstimate{Count: 1, Min: 1, Max: 1}, tree.EstimateCountRange(0, 10))
+	assert.Equal(t, rbtree.CountEstimate{}, tree.EstimateCountRange(6, 10))
+	assert.Equal(t, rbtree.CountEstimate{}, tree.EstimateCountRange(10, 0))
+
+	for _, n := range []int{10, 1000, 50000} {
+		tree := rbtree.New[int, int](rbtree.WithOrderStatistics())
+		for _, k := range rand.Perm(n) {
+			tree.Insert(2*k, k)
+		}
+		for k := 0; k < n/4; k++ {
+			tree.Delete(2 * rand.IntN(n))
+		}
+		var ratios float64
+		var ranges int
+		for i := 0; i < 1000; i++ {
+			lo := rand.IntN(2 * n)
+			hi := lo + rand.IntN(2*n-lo+1)
+			e := tree.EstimateCountRange(lo, hi)
+			exact := tree.Rank(hi) - tree.Rank(lo)
+			if !assert.True(t, e.Min <= exact && exact <= e.Max, "[%d, %d): %d keys, estimate %+v", lo, hi, exact, e) {
+				return
+			}
+			assert.True(t, e.Min <= e.Count && e.Count <= e.Max)
+			if exact > 0 {
+				ratios += float64(e.Count) / float64(exact)
+				ranges++
+			}
+		}
+		mean := ratios / float64(ranges)
+		assert.True(t, mean > 0.5 && mean < 2, "%d keys: estimates are %.2f times the counts on average", n, mean)
+	}
+}
+
+func TestEstimateCountRangeConcurrent(t *testing.T) {
+	tree := rbtree.New[int, int]()
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 3000; i++ {
+				k := rand.IntN(1000)
+				if rand.IntN(3) == 0 {
+					tree.Delete(k)
+				} else {
+					tree.Insert(k, k)
+				}
+			}
+		}()
+	}
+	for i := 0; i < 2000; i++ {
+		lo := rand.IntN(1000)
+		e := tree.EstimateCountRange(lo, lo+rand.IntN(500)+1)
+		assert.True(t, e.Min <= e.Count && e.Count <= e.Max, "%+v", e)
+	}
+	wg.Wait()
+}
+
+func TestKeyHistogram(t *testing.T) {
+	tree := rbtree.New[int, int]()
+	assert.Nil(t, tree.KeyHistogram(4))
+	for k := 0; k < 10; k++ {
+		tree.Insert(k*10, k)
+	}
+	assert.Nil(t, tree.KeyHistogram(0))
+	assert.Equal(t, []rbtree.Bucket[int]{
+		{Lower: 0, Upper: 10, Count: 2},
+		{Lower: 20, Upper: 40, Count: 3},
+		{Lower: 50, Upper: 60, Count: 2},
+		{Lower: 70, Upper: 90, Count: 3},
+	}, tree.KeyHistogram(4))
+	assert.Len(t, tree.KeyHistogram(100), 10, "one key per bucket at most")
+
+	tree = rbtree.New[int, int]()
+	ordered := rbtree.New[int, int](rbtree.WithOrderStatistics())
+	for _, k := range rand.Perm(10000) {
+		tree.Insert(k, k)
+		ordered.Insert(k, k)
+	}
+	hist := tree.KeyHistogram(7)
+	assert.Equal(t, ordered.KeyHistogram(7), hist, "a walk finds what Select does")
+	total := 0
+	for i, b := range hist {
+		assert.Equal(t, b.Count, b.Upper-b.Lower+1)
+		assert.InDelta(t, 10000/7, b.Count, 1)
+		if i > 0 {
+			assert.Equal(t, hist[i-1].Upper+1, b.Lower)
+		}
+		total += b.Count
+	}
+	assert.Equal(t, 10000, total)
+}
@@ -1,6 +1,6 @@
 module github.com/iku50/rbtree-go
 
-go 1.22.5
+go 1.23
 
 require github.com/stretchr/testify v1.9.0
 
@@ -0,0 +1,208 @@
+// Package hashring is a consistent hashing ring kept in the concurrent
+// red-black tree of package rbtree. Every node is placed on the ring at a
+// number of points, its virtual nodes, and a key belongs to the node of
+// the first point at or after the key's hash, wrapping around past the
+// largest:
+//
+//	r := hashring.New(hashring.WithReplicas(100))
+//	r.Add("cache-a", "cache-b", "cache-c")
+//	node, _ := r.Get("user:42")
+//	owners := r.GetN("user:42", 2) // node and the one to replicate to
+//
+// Lookups take no lock and run alongside Add and Remove, which are
+// serialized among themselves. A node's points are placed and taken away
+// one by one, so while a node is added or removed a lookup may map a key
+// to either the old or the new owner, but always to a node that is, or
+// was just, on the ring.
+package hashring
+
+import (
+	"cmp"
+	"hash/fnv"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/iku50/rbtree-go"
+)
+
+// DefaultReplicas is the number of points a node is placed at on rings
+// not given WithReplicas.
+const DefaultReplicas = 128
+
+// point is a position on the ring. Points of different nodes with the
+// same hash are ordered by node name, so the ring is the same however the
+// nodes were added.
+type point struct {
+	hash uint64
+	node string
+}
+
+func comparePoints(a, b point) int {
+	if c := cmp.Compare(a.hash, b.hash); c != 0 {
+		return c
+	}
+	return strings.Compare(a.node, b.node)
+}
+
+// Ring is a consistent hashing ring. It is safe for concurrent use.
+type Ring struct {
+	hash     func(key []byte) uint64
+	replicas int
+	points   *rbtree.RBTree[point, struct{}]
+
+	mu    sync.Mutex // serializes Add and Remove
+	nodes map[string]bool
+}
+
+// Option configures a Ring.
+type Option func(*Ring)
+
+// WithReplicas places every node at n points on the ring. More points
+// spread the keys more evenly over the nodes at the cost of memory. n
+// must be positive.
+func WithReplicas(n int) Option {
+	return func(r *Ring) {
+		r.replicas = n
+	}
+}
+
+// WithHash hashes keys and virtual node names with hash instead of the
+// default, 64-bit FNV-1a followed by a mixing step. All processes sharing
+// a ring must use the same hash.
+func WithHash(hash func(key []byte) uint64) Option {
+	return func(r *Ring) {
+		r.hash = hash
+	}
+}
+
+// New returns an empty ring configured by opts.
+func New(opts ...Option) *Ring {
+	r := &Ring{
+		hash:     defaultHash,
+		replicas: DefaultReplicas,
+		nodes:    make(map[string]bool),
+	}
+	for _, o := range opts {
+		o(r)
+	}
+	if r.replicas <= 0 {
+		panic("hashring: replicas must be positive")
+	}
+	r.points = rbtree.NewRBTreeFunc[point, struct{}](comparePoints)
+	return r
+}
+
+// defaultHash is FNV-1a, whose high bits are poorly spread for names that
+// differ in their last bytes only, as virtual nodes do, with the
+// splitmix64 finalizer on top.
+func defaultHash(key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// at returns the points of node.
+func (r *Ring) at(node string) []point {
+	points := make([]point, r.replicas)
+	buf := make([]byte, 0, len(node)+8)
+	for i := range points {
+		buf = strconv.AppendInt(append(append(buf[:0], node...), '#'), int64(i), 10)
+		points[i] = point{hash: r.hash(buf), node: node}
+	}
+	return points
+}
+
+// Add places nodes on the ring. Nodes already on it are left as they are.
+func (r *Ring) Add(nodes ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, node := range nodes {
+		if r.nodes[node] {
+			continue
+		}
+		r.nodes[node] = true
+		for _, p := range r.at(node) {
+			r.points.Insert(p, struct{}{})
+		}
+	}
+}
+
+// Remove takes nodes off the ring. Their keys move to the nodes that
+// follow their points; the keys of the other nodes stay where they are.
+func (r *Ring) Remove(nodes ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, node := range nodes {
+		if !r.nodes[node] {
+			continue
+		}
+		delete(r.nodes, node)
+		for _, p := range r.at(node) {
+			r.points.Delete(p)
+		}
+	}
+}
+
+// Nodes returns the nodes on the ring in ascending order.
+func (r *Ring) Nodes() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	nodes := make([]string, 0, len(r.nodes))
+	for node := range r.nodes {
+		nodes = append(nodes, node)
+	}
+	slices.Sort(nodes)
+	return nodes
+}
+
+// Len returns the number of nodes on the ring.
+func (r *Ring) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.nodes)
+}
+
+// Get returns the node key belongs to, or false if the ring is empty.
+func (r *Ring) Get(key string) (node string, ok bool) {
+	p, v := r.points.Ceiling(point{hash: r.hash([]byte(key))})
+	if v == nil {
+		// past the largest point the ring wraps around
+		if p, v = r.points.Min(); v == nil {
+			return "", false
+		}
+	}
+	return p.node, true
+}
+
+// GetN returns up to n distinct nodes for key: the node it belongs to and
+// the nodes met after it walking the ring onwards, the usual replicas of
+// key. It returns fewer if the ring has fewer nodes. The walk is a lookup
+// per point, so nodes added or removed meanwhile may or may not show.
+func (r *Ring) GetN(key string, n int) []string {
+	if n <= 0 {
+		return nil
+	}
+	p, v := r.points.Ceiling(point{hash: r.hash([]byte(key))})
+	var nodes []string
+	// the walk ends after as many points as the ring had, however it changes
+	for steps := r.points.Len(); steps > 0 && len(nodes) < n; steps-- {
+		if v == nil {
+			if p, v = r.points.Min(); v == nil {
+				break
+			}
+		}
+		if !slices.Contains(nodes, p.node) {
+			nodes = append(nodes, p.node)
+		}
+		p, v = r.points.Successor(p)
+	}
+	return nodes
+}
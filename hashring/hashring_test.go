@@ -0,0 +1,91 @@
+package hashring_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iku50/rbtree-go/hashring"
+)
+
+func TestRing(t *testing.T) {
+	r := hashring.New()
+	_, ok := r.Get("a")
+	assert.False(t, ok)
+	assert.Nil(t, r.GetN("a", 2))
+
+	r.Add("n1", "n2", "n3")
+	r.Add("n1")
+	assert.Equal(t, []string{"n1", "n2", "n3"}, r.Nodes())
+	assert.Equal(t, 3, r.Len())
+
+	owners := make(map[string]string)
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprint("key", i)
+		node, ok := r.Get(key)
+		assert.True(t, ok)
+		owners[key] = node
+		counts[node]++
+
+		replicas := r.GetN(key, 2)
+		assert.Len(t, replicas, 2)
+		assert.Equal(t, node, replicas[0])
+		assert.NotEqual(t, replicas[0], replicas[1])
+		assert.ElementsMatch(t, []string{"n1", "n2", "n3"}, r.GetN(key, 5))
+	}
+	for node, n := range counts {
+		assert.Greater(t, n, 600, node)
+	}
+
+	// only the keys of a removed node move
+	r.Remove("n2", "n4")
+	assert.Equal(t, []string{"n1", "n3"}, r.Nodes())
+	for key, was := range owners {
+		node, _ := r.Get(key)
+		if was != "n2" {
+			assert.Equal(t, was, node, key)
+		} else {
+			assert.NotEqual(t, "n2", node, key)
+		}
+	}
+
+	// adding it back restores the mapping
+	r.Add("n2")
+	for key, was := range owners {
+		node, _ := r.Get(key)
+		assert.Equal(t, was, node, key)
+	}
+}
+
+func TestRingConcurrent(t *testing.T) {
+	r := hashring.New(hashring.WithReplicas(16))
+	r.Add("stable")
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				key := fmt.Sprint(g, i)
+				node, ok := r.Get(key)
+				assert.True(t, ok)
+				assert.NotEmpty(t, node)
+				assert.NotEmpty(t, r.GetN(key, 3))
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			node := fmt.Sprint("n", i%5)
+			r.Add(node)
+			r.Remove(node)
+		}
+	}()
+	wg.Wait()
+	assert.Equal(t, []string{"stable"}, r.Nodes())
+}
@@ -0,0 +1,107 @@
+package rbtree
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// hintWays is the number of keys a hint set remembers.
+const hintWays = 4
+
+// hintCache remembers the nodes recent Gets found their keys in, see
+// WithHintCache. The sets live in a sync.Pool, which keeps about one per
+// P, so Gets running on different processors do not share one.
+type hintCache[K any, V any] struct {
+	// gen is bumped whenever a node may stop holding its key: a delete
+	// retires a node or moves a successor's key, a batch merge or a
+	// surgery replaces nodes. A hint taken at an older generation is void.
+	gen  atomic.Uint64
+	sets sync.Pool // of *hintSet[K, V]
+}
+
+type hintSet[K any, V any] struct {
+	hints  [hintWays]hint[K, V]
+	victim int // the slot the next miss takes
+}
+
+// hint is the node that held key at generation gen.
+type hint[K any, V any] struct {
+	node *RBTreeNode[K, V]
+	key  K
+	gen  uint64
+}
+
+func (h *hintCache[K, V]) get() *hintSet[K, V] {
+	if s, ok := h.sets.Get().(*hintSet[K, V]); ok {
+		return s
+	}
+	return &hintSet[K, V]{}
+}
+
+// moved voids the hints and forgets the append tail. Callers bump the
+// generation before a node they unlink can be recycled, and before the
+// locks on a node whose key they changed are released.
+func (t *RBTree[K, V]) moved() {
+	if t.hints != nil {
+		t.hints.gen.Add(1)
+	}
+	if t.appends.tail.Load() != nil {
+		t.appends.tail.Store(nil)
+	}
+}
+
+// lookup answers a Get for key from the hints. ok is false on a miss,
+// leaving slot for remember. compares counts the keys probed. A panic of
+// the comparator is returned as the error WithPanicRecovery.
+//
+// A hint is only followed while the generation is unchanged, which keeps
+// the node from being recycled: the lookup entered the node pool before
+// reading it. The node is pinned like a descent pins it and the
+// generation checked again, so a delete that moved the key meanwhile is
+// noticed.
+func (s *hintSet[K, V]) lookup(t *RBTree[K, V], key K) (v *V, slot, compares int, ok bool, err error) {
+	defer t.exit(t.enter())
+	if t.guard {
+		// the comparator only runs before the pin
+		defer func() {
+			if r := recover(); r != nil {
+				v, ok, err = nil, false, t.recovered(r)
+			}
+		}()
+	}
+	gen := t.hints.gen.Load()
+	slot = s.victim
+	for i := range s.hints {
+		h := &s.hints[i]
+		if h.node == nil {
+			slot = i
+			continue
+		}
+		compares++
+		if t.compare(key, h.key) != 0 {
+			continue
+		}
+		slot = i
+		if h.gen != gen || !h.node.pin() {
+			return nil, slot, compares, false, nil
+		}
+		if t.hints.gen.Load() != gen {
+			h.node.unpin()
+			return nil, slot, compares, false, nil
+		}
+		if !t.expired(h.node, t.now()) {
+			v = h.node.valuePtr()
+		}
+		h.node.unpin()
+		return v, slot, compares, true, nil
+	}
+	return nil, slot, compares, false, nil
+}
+
+// remember stores in slot that n held key at generation gen.
+func (s *hintSet[K, V]) remember(slot int, key K, n *RBTreeNode[K, V], gen uint64) {
+	s.hints[slot] = hint[K, V]{node: n, key: key, gen: gen}
+	if slot == s.victim {
+		s.victim = (s.victim + 1) % hintWays
+	}
+}
@@ -0,0 +1,134 @@
+package rbtree_test
+
+import (
+	"math/rand/v2"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iku50/rbtree-go"
+)
+
+func TestHintCache(t *testing.T) {
+	tree := rbtree.New[int, int](rbtree.WithHintCache(), rbtree.WithGetSampling(1))
+	for k := 0; k < 1000; k++ {
+		tree.Insert(k, k)
+	}
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, 7, *tree.Get(7))
+	}
+	s := tree.Stats()
+	assert.Equal(t, uint64(100), s.GetSamples)
+	assert.Greater(t, s.HintHitRate(), 0.5)
+	assert.Less(t, s.ComparisonsPerGet(), 4.0, "a hit probes the hints only")
+
+	// the hints follow updates and forget deleted keys
+	tree.Insert(7, 70)
+	assert.Equal(t, 70, *tree.Get(7))
+	tree.Delete(7)
+	assert.Nil(t, tree.Get(7))
+	tree.Insert(7, 700)
+	assert.Equal(t, 700, *tree.Get(7))
+
+	// and deletes that move a successor's key into the hinted node
+	assert.Equal(t, 500, *tree.Get(500))
+	tree.Delete(500)
+	assert.Equal(t, 501, *tree.Get(501))
+	assert.Nil(t, tree.Get(500))
+
+	tree.InsertWithTTL(9, 9, -1)
+	assert.Nil(t, tree.Get(9))
+	assert.Nil(t, tree.Get(9))
+
+	assert.Equal(t, 10, tree.DeleteRange(10, 20))
+	for k := 10; k < 20; k++ {
+		assert.Nil(t, tree.Get(k))
+	}
+	tree.InsertBatch([]rbtree.KV[int, int]{{Key: 1, Value: -1}, {Key: 2, Value: -2}})
+	assert.Equal(t, -1, *tree.Get(1))
+	left, right := tree.Split(100)
+	assert.Nil(t, tree.Get(1))
+	assert.Nil(t, tree.Get(200))
+	assert.Equal(t, -2, *left.Get(2))
+	assert.Equal(t, 200, *right.Get(200))
+	assert.Nil(t, left.Join(right))
+	assert.Nil(t, right.Get(200))
+	assert.Equal(t, 200, *left.Get(200))
+	assert.Nil(t, left.Verify())
+}
+
+func TestComparisonsPerGet(t *testing.T) {
+	tree := rbtree.New[int, int](rbtree.WithGetSampling(1))
+	for k := 0; k < 1023; k++ {
+		tree.Insert(k, k)
+	}
+	for k := 0; k < 1023; k++ {
+		tree.Get(k)
+	}
+	s := tree.Stats()
+	assert.Equal(t, s.GetNodesVisited, s.GetComparisons, "a descent compares once per node")
+	assert.Zero(t, s.GetHintHits)
+	assert.InDelta(t, 10, s.ComparisonsPerGet(), 2)
+	assert.Zero(t, rbtree.Stats{}.ComparisonsPerGet())
+	assert.Zero(t, rbtree.Stats{}.HintHitRate())
+}
+
+func TestHintCacheConcurrent(t *testing.T) {
+	for name, opts := range map[string][]rbtree.Option{
+		"default":  {rbtree.WithHintCache()},
+		"nodepool": {rbtree.WithHintCache(), rbtree.WithNodePool()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// every key only ever holds itself and values stay in their
+			// boxes, so a Get that follows a void hint shows as a wrong key
+			tree := rbtree.New[int, int](append(opts, rbtree.WithStableValuePointers())...)
+			var wg sync.WaitGroup
+			for g := 0; g < 4; g++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < 5000; i++ {
+						// few keys, so that the hints are hit and voided often
+						k := rand.IntN(16)
+						switch rand.IntN(4) {
+						case 0:
+							tree.Delete(k)
+						case 1:
+							tree.GetOrInsert(k, k)
+						default:
+							if v := tree.Get(k); v != nil {
+								assert.Equal(t, k, *v)
+							}
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			assert.Nil(t, tree.Verify())
+			tree.Range(func(key, value int) bool {
+				assert.Equal(t, key, *tree.Get(key))
+				return true
+			})
+		})
+	}
+}
+
+func TestContains(t *testing.T) {
+	for _, opts := range [][]rbtree.Option{nil, {rbtree.WithHintCache()}} {
+		tree := rbtree.New[int, [1 << 10]byte](append(opts, rbtree.WithGetSampling(1))...)
+		assert.False(t, tree.Contains(1))
+		for k := 0; k < 100; k += 2 {
+			tree.Insert(k, [1 << 10]byte{})
+		}
+		for k := 0; k < 100; k++ {
+			assert.Equal(t, k%2 == 0, tree.Contains(k), k)
+			assert.Equal(t, k%2 == 0, tree.Contains(k), k)
+		}
+		tree.InsertWithTTL(1, [1 << 10]byte{}, -1)
+		assert.False(t, tree.Contains(1))
+		tree.Delete(2)
+		assert.False(t, tree.Contains(2))
+		assert.Equal(t, uint64(203), tree.Stats().GetSamples, "contains counts as a get")
+	}
+}
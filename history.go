@@ -0,0 +1,169 @@
+package rbtree
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// history is the ring of structural captures kept WithDebugHistory.
+type history[K any] struct {
+	every int64
+	out   io.Writer // gets the history when corruption is detected, may be nil
+	muts  atomic.Int64
+	due   atomic.Bool // a capture is owed since muts reached a multiple of every
+
+	mu     sync.Mutex // guards the fields below
+	ring   []capture[K]
+	start  int // index of the oldest capture
+	n      int
+	dumped bool
+}
+
+// capture is the shape of the tree after muts committed mutations.
+type capture[K any] struct {
+	muts  int64
+	nodes []shapeNode[K] // preorder
+}
+
+// shapeNode is a node of a capture: its key, its color and which of its
+// children are present, which is enough to rebuild the shape.
+type shapeNode[K any] struct {
+	key   K
+	red   bool
+	left  bool
+	right bool
+}
+
+func newHistory[K any](every, depth int, out io.Writer) *history[K] {
+	return &history[K]{every: int64(every), out: out, ring: make([]capture[K], depth)}
+}
+
+// tick counts a committed mutation. Writers call it from record, with the
+// modified node still locked.
+func (h *history[K]) tick() {
+	if h.muts.Add(1)%h.every == 0 {
+		h.due.Store(true)
+	}
+}
+
+func (h *history[K]) push(c capture[K]) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.n < len(h.ring) {
+		h.ring[(h.start+h.n)%len(h.ring)] = c
+		h.n++
+		return
+	}
+	h.ring[h.start] = c
+	h.start = (h.start + 1) % len(h.ring)
+}
+
+// shape flattens the subtree below n into nodes. It gives up on a subtree
+// deeper than depth, which only a corrupted tree has.
+func (t *RBTree[K, V]) shape(n *RBTreeNode[K, V], nodes []shapeNode[K], depth int) []shapeNode[K] {
+	if n == nil || depth <= 0 {
+		return nodes
+	}
+	l, r := n.left.Load(), n.right.Load()
+	nodes = append(nodes, shapeNode[K]{key: n.key, red: n.isRed(), left: l != nil && depth > 1, right: r != nil && depth > 1})
+	nodes = t.shape(l, nodes, depth-1)
+	return t.shape(r, nodes, depth-1)
+}
+
+// captureShape records the shape of the tree if a capture is owed. The
+// writer that finishes a write on the way to it calls it after endWrite,
+// so the tree is captured between writes, with the writers paused.
+func (t *RBTree[K, V]) captureShape() {
+	h := t.hist
+	t.gate.Lock()
+	defer t.gate.Unlock()
+	if !h.due.Swap(false) {
+		return // another writer was first
+	}
+	h.push(capture[K]{muts: h.muts.Load(), nodes: t.shape(t.root.Load(), nil, t.maxDepth())})
+}
+
+// reportCorruption writes the history to the WithDebugHistory writer, if
+// it has one, the first time the tree is found broken. Verify calls it
+// after capturing the broken tree.
+func (t *RBTree[K, V]) reportCorruption(reason error) {
+	h := t.hist
+	if h == nil || h.out == nil {
+		return
+	}
+	h.mu.Lock()
+	dumped := h.dumped
+	h.dumped = true
+	h.mu.Unlock()
+	if !dumped {
+		fmt.Fprintf(h.out, "rbtree: %v, history follows\n", reason)
+		t.DumpHistory(h.out)
+	}
+}
+
+// DumpHistory writes the shapes captured WithDebugHistory to w, oldest
+// first, one line per capture. A line gives the number of mutations before
+// the capture and the tree as nested parentheses: (key left right), with
+// a key suffixed R for red and B for black, a leaf without parentheses and
+// a missing child as "-". Replaying the lines shows the shape change that
+// broke the tree. A tree built without WithDebugHistory writes nothing.
+func (t *RBTree[K, V]) DumpHistory(w io.Writer) error {
+	h := t.hist
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	captures := make([]capture[K], h.n)
+	for i := range captures {
+		captures[i] = h.ring[(h.start+i)%len(h.ring)]
+	}
+	h.mu.Unlock()
+	for _, c := range captures {
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "after %d mutations: ", c.muts)
+		if len(c.nodes) == 0 {
+			sb.WriteString("-")
+		}
+		writeShape(&sb, c.nodes)
+		sb.WriteByte('\n')
+		if _, err := io.WriteString(w, sb.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeShape writes the subtree at the start of nodes and returns the
+// nodes after it.
+func writeShape[K any](sb *strings.Builder, nodes []shapeNode[K]) []shapeNode[K] {
+	if len(nodes) == 0 {
+		return nil
+	}
+	n := nodes[0]
+	nodes = nodes[1:]
+	c := 'B'
+	if n.red {
+		c = 'R'
+	}
+	if !n.left && !n.right {
+		fmt.Fprintf(sb, "%v%c", n.key, c)
+		return nodes
+	}
+	fmt.Fprintf(sb, "(%v%c ", n.key, c)
+	if n.left {
+		nodes = writeShape(sb, nodes)
+	} else {
+		sb.WriteString("-")
+	}
+	sb.WriteByte(' ')
+	if n.right {
+		nodes = writeShape(sb, nodes)
+	} else {
+		sb.WriteString("-")
+	}
+	sb.WriteByte(')')
+	return nodes
+}
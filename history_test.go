@@ -0,0 +1,72 @@
+package rbtree
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDumpHistory(t *testing.T) {
+	var sb strings.Builder
+	assert.Nil(t, New[int, int]().DumpHistory(&sb))
+	assert.Empty(t, sb.String())
+
+	tree := New[int, int](WithDebugHistory(2, 3, nil))
+	for k := 1; k <= 8; k++ {
+		tree.Insert(k, k)
+	}
+	tree.Delete(1)
+	tree.Delete(2)
+	assert.Nil(t, tree.DumpHistory(&sb))
+	assert.Equal(t, "after 6 mutations: (2B 1B (4R 3B (5B - 6R)))\n"+
+		"after 8 mutations: (4B (2R 1B 3B) (6R 5B (7B - 8R)))\n"+
+		"after 10 mutations: (4B 3B (6R 5B (7B - 8R)))\n", sb.String())
+}
+
+func TestDumpHistoryOnCorruption(t *testing.T) {
+	var sb strings.Builder
+	tree := New[int, int](WithDebugHistory(1, 2, &sb))
+	tree.Insert(2, 2)
+	tree.Insert(1, 1)
+	tree.Insert(3, 3)
+	assert.Empty(t, sb.String(), "nothing is written while the tree is sound")
+
+	tree.root.Load().left.Load().key = 5
+	assert.ErrorIs(t, tree.Verify(), ErrOrder)
+	assert.Equal(t, "rbtree: keys out of order at key path [2 5], history follows\n"+
+		"after 3 mutations: (2B 1R 3R)\n"+
+		"after 3 mutations: (2B 5R 3R)\n", sb.String())
+	tree.Verify()
+	tree.markCorrupted()
+	assert.Equal(t, 3, strings.Count(sb.String(), "\n"), "the history is written once")
+
+	sb.Reset()
+	tree = New[int, int](WithDebugHistory(1, 2, &sb))
+	tree.Insert(1, 1)
+	tree.markCorrupted()
+	assert.Equal(t, "rbtree: tree corrupted, history follows\nafter 1 mutations: 1R\n", sb.String())
+}
+
+func TestDebugHistoryConcurrent(t *testing.T) {
+	tree := New[int, int](WithDebugHistory(10, 50, nil))
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				tree.Insert(g*1000+i, i)
+				if i%3 == 0 {
+					tree.Delete(g*1000 + i/2)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Nil(t, tree.Verify())
+	var sb strings.Builder
+	assert.Nil(t, tree.DumpHistory(&sb))
+	assert.Equal(t, 50, strings.Count(sb.String(), "\n"))
+}
@@ -0,0 +1,259 @@
+//go:build !rbtree_core
+
+package rbtree
+
+import (
+	"bufio"
+	"bytes"
+	"encoding"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// Codec converts keys and values to and from the fields of the JSON lines
+// and CSV formats. A nil function selects the format's default: JSON for
+// JSON lines, and for CSV the text itself for strings and byte slices,
+// MarshalText and UnmarshalText where implemented and JSON otherwise.
+// JSON lines fields must be valid JSON.
+type Codec[K any, V any] struct {
+	MarshalKey     func(key K) ([]byte, error)
+	UnmarshalKey   func(data []byte) (K, error)
+	MarshalValue   func(value V) ([]byte, error)
+	UnmarshalValue func(data []byte) (V, error)
+}
+
+// withDefaults returns c with its nil functions set to marshal and
+// unmarshal.
+func (c *Codec[K, V]) withDefaults(marshal func(v any) ([]byte, error), unmarshal func(data []byte, v any) error) Codec[K, V] {
+	var d Codec[K, V]
+	if c != nil {
+		d = *c
+	}
+	if d.MarshalKey == nil {
+		d.MarshalKey = func(key K) ([]byte, error) { return marshal(key) }
+	}
+	if d.UnmarshalKey == nil {
+		d.UnmarshalKey = func(data []byte) (key K, err error) { return key, unmarshal(data, &key) }
+	}
+	if d.MarshalValue == nil {
+		d.MarshalValue = func(value V) ([]byte, error) { return marshal(value) }
+	}
+	if d.UnmarshalValue == nil {
+		d.UnmarshalValue = func(data []byte) (value V, err error) { return value, unmarshal(data, &value) }
+	}
+	return d
+}
+
+func marshalText(v any) ([]byte, error) {
+	switch v := v.(type) {
+	case string:
+		return []byte(v), nil
+	case []byte:
+		return v, nil
+	case encoding.TextMarshaler:
+		return v.MarshalText()
+	}
+	return json.Marshal(v)
+}
+
+func unmarshalText(data []byte, v any) error {
+	switch v := v.(type) {
+	case *string:
+		*v = string(data)
+		return nil
+	case *[]byte:
+		*v = bytes.Clone(data)
+		return nil
+	case encoding.TextUnmarshaler:
+		return v.UnmarshalText(data)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// jsonlRow is one line of the JSON lines format.
+type jsonlRow struct {
+	Key   json.RawMessage `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+// csvHeader is the first record of the CSV format.
+var csvHeader = []string{"key", "value"}
+
+// ExportJSONL writes the snapshot to w as JSON lines, one
+// {"key": ..., "value": ...} object per key in ascending key order.
+// c may be nil to use the default codec.
+func (s *Snapshot[K, V]) ExportJSONL(w io.Writer, c *Codec[K, V]) error {
+	codec := c.withDefaults(json.Marshal, json.Unmarshal)
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	var err error
+	s.Range(func(key K, value V) bool {
+		var row jsonlRow
+		if row.Key, err = codec.MarshalKey(key); err != nil {
+			return false
+		}
+		if row.Value, err = codec.MarshalValue(value); err != nil {
+			return false
+		}
+		err = enc.Encode(row)
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// ExportCSV writes the snapshot to w as CSV, a key,value header followed by
+// one record per key in ascending key order. c may be nil to use the
+// default codec.
+func (s *Snapshot[K, V]) ExportCSV(w io.Writer, c *Codec[K, V]) error {
+	codec := c.withDefaults(marshalText, unmarshalText)
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	var err error
+	s.Range(func(key K, value V) bool {
+		var k, v []byte
+		if k, err = codec.MarshalKey(key); err != nil {
+			return false
+		}
+		if v, err = codec.MarshalValue(value); err != nil {
+			return false
+		}
+		err = cw.Write([]string{string(k), string(v)})
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ExportJSONL writes a snapshot of the tree, see Snapshot.ExportJSONL.
+func (t *RBTree[K, V]) ExportJSONL(w io.Writer, c *Codec[K, V]) error {
+	return t.Snapshot().ExportJSONL(w, c)
+}
+
+// ExportCSV writes a snapshot of the tree, see Snapshot.ExportCSV.
+func (t *RBTree[K, V]) ExportCSV(w io.Writer, c *Codec[K, V]) error {
+	return t.Snapshot().ExportCSV(w, c)
+}
+
+// ImportJSONL replaces the tree's content with the JSON lines read from r,
+// as written by ExportJSONL. The lines may come in any order; for a key
+// that appears more than once the last line wins. The tree is bulk loaded
+// and left unchanged if r cannot be read or decoded.
+func (t *RBTree[K, V]) ImportJSONL(r io.Reader, c *Codec[K, V]) error {
+	codec := c.withDefaults(json.Marshal, json.Unmarshal)
+	dec := json.NewDecoder(r)
+	var keys []K
+	var values []V
+	for line := 1; ; line++ {
+		var row jsonlRow
+		if err := dec.Decode(&row); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if row.Key == nil || row.Value == nil {
+			return fmt.Errorf("%w: line %d: missing key or value", ErrBadEncoding, line)
+		}
+		key, err := codec.UnmarshalKey(row.Key)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		value, err := codec.UnmarshalValue(row.Value)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		keys = append(keys, key)
+		values = append(values, value)
+	}
+	return t.bulkLoad(keys, values)
+}
+
+// ImportCSV replaces the tree's content with the CSV records read from r,
+// as written by ExportCSV. The key,value header is required; the records
+// are handled like the lines of ImportJSONL.
+func (t *RBTree[K, V]) ImportCSV(r io.Reader, c *Codec[K, V]) error {
+	codec := c.withDefaults(marshalText, unmarshalText)
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(csvHeader)
+	header, err := cr.Read()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if !slices.Equal(header, csvHeader) {
+		return fmt.Errorf("%w: header %q", ErrBadEncoding, header)
+	}
+	var keys []K
+	var values []V
+	for {
+		record, err := cr.Read()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		line, _ := cr.FieldPos(0)
+		key, err := codec.UnmarshalKey([]byte(record[0]))
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		value, err := codec.UnmarshalValue([]byte(record[1]))
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		keys = append(keys, key)
+		values = append(values, value)
+	}
+	return t.bulkLoad(keys, values)
+}
+
+// bulkLoad sorts keys and values, keeping the last value of duplicate keys,
+// and installs a balanced tree built from them.
+func (t *RBTree[K, V]) bulkLoad(keys []K, values []V) error {
+	if t.compare == nil {
+		return errors.New("rbtree: importing into a tree not created by New or NewRBTreeFunc")
+	}
+	sorted := true
+	for i := 1; i < len(keys) && sorted; i++ {
+		sorted = t.compare(keys[i-1], keys[i]) < 0
+	}
+	if !sorted {
+		order := make([]int, len(keys))
+		for i := range order {
+			order[i] = i
+		}
+		slices.SortStableFunc(order, func(a, b int) int { return t.compare(keys[a], keys[b]) })
+		k := make([]K, 0, len(keys))
+		v := make([]V, 0, len(values))
+		for _, i := range order {
+			if len(k) > 0 && t.compare(k[len(k)-1], keys[i]) == 0 {
+				v[len(v)-1] = values[i]
+				continue
+			}
+			k = append(k, keys[i])
+			v = append(v, values[i])
+		}
+		keys, values = k, v
+	}
+	root, err := t.build(keys, values)
+	if err != nil {
+		return err
+	}
+	t.install(root, len(keys))
+	return nil
+}
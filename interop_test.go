@@ -0,0 +1,99 @@
+//go:build !rbtree_core
+
+package rbtree_test
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iku50/rbtree-go"
+)
+
+func TestJSONLRoundTrip(t *testing.T) {
+	tree := newSerializeTree()
+	var buf bytes.Buffer
+	assert.Nil(t, tree.ExportJSONL(&buf, nil))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, tree.Len(), len(lines))
+	assert.Equal(t, `{"key":0,"value":"0"}`, lines[0])
+
+	got := rbtree.New[int, string]()
+	assert.Nil(t, got.ImportJSONL(&buf, nil))
+	assert.Nil(t, got.Check())
+	assert.Equal(t, tree.Len(), got.Len())
+	tree.Range(func(key int, value string) bool {
+		assert.Equal(t, value, *got.Get(key))
+		return true
+	})
+
+	in := "{\"key\":3,\"value\":\"c\"}\n{\"key\":1,\"value\":\"a\"}\n{\"key\":3,\"value\":\"d\"}\n"
+	assert.Nil(t, got.ImportJSONL(strings.NewReader(in), nil))
+	assert.Nil(t, got.Check())
+	assert.Equal(t, 2, got.Len())
+	assert.Equal(t, "d", *got.Get(3))
+
+	assert.ErrorIs(t, got.ImportJSONL(strings.NewReader(`{"key":1}`), nil), rbtree.ErrBadEncoding)
+	assert.NotNil(t, got.ImportJSONL(strings.NewReader(`{"key":"x","value":"a"}`), nil))
+	assert.Equal(t, 2, got.Len())
+}
+
+func TestCSVRoundTrip(t *testing.T) {
+	tree := rbtree.New[string, float64]()
+	tree.Insert("b, with comma", 2.5)
+	tree.Insert("a", 1)
+	var buf bytes.Buffer
+	assert.Nil(t, tree.ExportCSV(&buf, nil))
+	assert.Equal(t, "key,value\na,1\n\"b, with comma\",2.5\n", buf.String())
+
+	got := rbtree.New[string, float64]()
+	assert.Nil(t, got.ImportCSV(&buf, nil))
+	assert.Nil(t, got.Check())
+	assert.Equal(t, 2.5, *got.Get("b, with comma"))
+
+	assert.ErrorIs(t, got.ImportCSV(strings.NewReader("k,v\na,1\n"), nil), rbtree.ErrBadEncoding)
+	assert.NotNil(t, got.ImportCSV(strings.NewReader("key,value\na,one\n"), nil))
+	assert.Equal(t, 2, got.Len())
+}
+
+func TestCodec(t *testing.T) {
+	hex := &rbtree.Codec[int, string]{
+		MarshalKey: func(key int) ([]byte, error) {
+			return []byte(strconv.FormatInt(int64(key), 16)), nil
+		},
+		UnmarshalKey: func(data []byte) (int, error) {
+			k, err := strconv.ParseInt(string(data), 16, 64)
+			return int(k), err
+		},
+	}
+	tree := rbtree.New[int, string]()
+	tree.Insert(255, "ff")
+	var buf bytes.Buffer
+	assert.Nil(t, tree.ExportCSV(&buf, hex))
+	assert.Equal(t, "key,value\nff,ff\n", buf.String())
+
+	got := rbtree.New[int, string]()
+	assert.Nil(t, got.ImportCSV(&buf, hex))
+	assert.Equal(t, "ff", *got.Get(255))
+}
+
+func TestImportMaxKeySize(t *testing.T) {
+	tree := rbtree.New[string, int](rbtree.WithMaxKeySize(8))
+	big := rbtree.New[string, int]()
+	big.Insert("a very long key", 1)
+	var buf bytes.Buffer
+	assert.Nil(t, big.ExportCSV(&buf, nil))
+	assert.ErrorIs(t, tree.ImportCSV(&buf, nil), rbtree.ErrKeyTooLarge)
+	assert.Equal(t, 0, tree.Len())
+}
+
+func TestProgressImport(t *testing.T) {
+	p := &progressLog{}
+	tree := rbtree.New[string, string](rbtree.WithProgress(p.report))
+	assert.Nil(t, tree.ImportCSV(strings.NewReader("key,value\nb,2\na,1\nc,3\n"), nil))
+	assert.Equal(t, [][2]int{{3, 3}}, p.take())
+	assert.Equal(t, 3, tree.Len())
+}
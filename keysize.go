@@ -0,0 +1,48 @@
+package rbtree
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"unsafe"
+)
+
+var ErrKeyTooLarge = errors.New("key too large")
+
+// KeySizeBuckets is the number of buckets of Stats.KeySizes. Bucket 0
+// counts empty keys, bucket i keys of 2^(i-1) up to 2^i-1 bytes, and the
+// last one every key of 2^(KeySizeBuckets-2) bytes or more.
+const KeySizeBuckets = 18
+
+// keySize returns the size of key in bytes: as WithKeySize reports it, the
+// length of a string or byte slice, or the size of the key itself for any
+// other type.
+func (t *RBTree[K, V]) keySize(key K) int {
+	if t.keySizer != nil {
+		return t.keySizer(key)
+	}
+	switch k := any(key).(type) {
+	case string:
+		return len(k)
+	case []byte:
+		return len(k)
+	}
+	return int(unsafe.Sizeof(key))
+}
+
+// checkKey refuses a key larger than WithMaxKeySize allows, counting the
+// refusal.
+func (t *RBTree[K, V]) checkKey(key K) error {
+	if t.maxKey <= 0 {
+		return nil
+	}
+	if size := t.keySize(key); size > t.maxKey {
+		t.stats.keysTooLarge.Add(1)
+		return fmt.Errorf("%w: %d bytes, at most %d allowed", ErrKeyTooLarge, size, t.maxKey)
+	}
+	return nil
+}
+
+func keySizeBucket(size int) int {
+	return min(bits.Len(uint(max(size, 0))), KeySizeBuckets-1)
+}
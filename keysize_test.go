@@ -0,0 +1,69 @@
+package rbtree_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iku50/rbtree-go"
+)
+
+func TestMaxKeySize(t *testing.T) {
+	tree := rbtree.New[string, int](rbtree.WithMaxKeySize(8))
+	assert.Nil(t, tree.InsertCtx(context.Background(), "12345678", 1))
+	assert.ErrorIs(t, tree.InsertCtx(context.Background(), "123456789", 1), rbtree.ErrKeyTooLarge)
+	tree.Insert("123456789", 1)
+	_, _, err := tree.GetOrInsertCtx(context.Background(), strings.Repeat("x", 100), 1)
+	assert.ErrorIs(t, err, rbtree.ErrKeyTooLarge)
+	tree.InsertBatch([]rbtree.KV[string, int]{{Key: "a", Value: 1}, {Key: "abcdefghij", Value: 2}})
+	assert.Equal(t, 2, tree.Len())
+	assert.Nil(t, tree.Get("abcdefghij"))
+	assert.Equal(t, uint64(4), tree.Stats().KeysTooLarge)
+
+	_, err = rbtree.NewFromSorted([]string{"a", "too long a key"}, []int{1, 2}, rbtree.WithMaxKeySize(4))
+	assert.ErrorIs(t, err, rbtree.ErrKeyTooLarge)
+
+	// decoding a snapshot checks the keys too
+	big := rbtree.New[string, int]()
+	big.Insert("a very long key", 1)
+	data, err := big.MarshalBinary()
+	assert.Nil(t, err)
+	assert.ErrorIs(t, tree.UnmarshalBinary(data), rbtree.ErrKeyTooLarge)
+	assert.Equal(t, 2, tree.Len())
+}
+
+func TestKeySize(t *testing.T) {
+	type key struct{ name string }
+	tree := rbtree.NewRBTreeFunc[key, int](func(a, b key) int { return strings.Compare(a.name, b.name) },
+		rbtree.WithMaxKeySize(3), rbtree.WithKeySize(func(k key) int { return len(k.name) }))
+	assert.Nil(t, tree.InsertCtx(context.Background(), key{"abc"}, 1))
+	assert.ErrorIs(t, tree.InsertCtx(context.Background(), key{"abcd"}, 1), rbtree.ErrKeyTooLarge)
+
+	assert.Panics(t, func() { rbtree.New[int, int](rbtree.WithKeySize(func(string) int { return 0 })) })
+}
+
+func TestKeySizeStats(t *testing.T) {
+	tree := rbtree.New[string, int](rbtree.WithGetSampling(1))
+	for _, k := range []string{"", "a", "bc", "def", "ghij", strings.Repeat("k", 1000), strings.Repeat("l", 1<<20)} {
+		tree.Insert(k, 0)
+	}
+	tree.Insert("a", 1) // not a new key
+	s := tree.Stats()
+	assert.Equal(t, 1<<20, s.MaxKeySize)
+	want := [rbtree.KeySizeBuckets]uint64{1, 1, 2, 1}
+	want[10] = 1 // 512 to 1023 bytes
+	want[rbtree.KeySizeBuckets-1] = 1
+	assert.Equal(t, want, s.KeySizes)
+
+	prev := s
+	tree.Insert("m", 0)
+	d := tree.Stats().Delta(prev)
+	assert.Equal(t, uint64(1), d.KeySizes[1])
+	assert.Equal(t, uint64(0), d.KeySizes[0])
+
+	ints := rbtree.New[int64, int](rbtree.WithGetSampling(1))
+	ints.Insert(1, 1)
+	assert.Equal(t, uint64(1), ints.Stats().KeySizes[4], "an int64 is 8 bytes")
+}
@@ -0,0 +1,88 @@
+package rbtree
+
+import (
+	"context"
+	"iter"
+)
+
+// OverlayEntry is the value of a key in an overlay tree read by
+// LayeredIter: a new value for the key, or a tombstone that deletes it.
+type OverlayEntry[V any] struct {
+	Value     V
+	Tombstone bool
+}
+
+// LayeredIter returns the merged view of the keys of base and overlay in
+// ascending order, as a memtable over an immutable table is read: a key
+// in overlay shadows the same key in base, with its value or, if it holds
+// a tombstone, by leaving the key out. base may be nil.
+//
+// base is read as it was taken, like Snapshot.Range reads it. overlay is
+// read as Range reads a tree, an independent Successor lookup per key, so
+// writes to overlay during the iteration may or may not show; a lookup
+// whose backoff policy gives up ends the iteration. Compaction folds the
+// view into a new base, e.g. with NewFromSortedFunc, after which the
+// overlay can be cleared.
+func LayeredIter[K any, V any](base *Snapshot[K, V], overlay *RBTree[K, OverlayEntry[V]]) iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		var cur frozenCursor[K, V]
+		if base != nil {
+			cur.now = base.now()
+			cur.descend(base.root)
+		}
+		b := cur.next()
+		k, e, ok := overlay.first()
+		for b != nil || ok {
+			if !ok || b != nil && overlay.compare(b.key, k) < 0 {
+				if !yield(b.key, b.value) {
+					return
+				}
+				b = cur.next()
+				continue
+			}
+			if b != nil && overlay.compare(b.key, k) == 0 {
+				b = cur.next()
+			}
+			if !e.Tombstone && !yield(k, e.Value) {
+				return
+			}
+			k, e, ok, _ = overlay.following(context.Background(), k, false)
+		}
+	}
+}
+
+// first returns the smallest live key and a copy of its value. ok is false
+// if the tree is empty.
+func (t *RBTree[K, V]) first() (k K, value V, ok bool) {
+	// the value is copied before a pooled node can be reused
+	defer t.exit(t.enter())
+	k, v := t.extreme(true, &value)
+	return k, value, v != nil
+}
+
+// frozenCursor walks the nodes of a snapshot in ascending key order,
+// passing over those that had expired by now.
+type frozenCursor[K any, V any] struct {
+	stack []*frozenNode[K, V] // the nodes whose left subtree is being walked
+	now   int64
+}
+
+// descend stacks n and the left spine below it.
+func (c *frozenCursor[K, V]) descend(n *frozenNode[K, V]) {
+	for ; n != nil; n = n.left {
+		c.stack = append(c.stack, n)
+	}
+}
+
+// next returns the next node, or nil once the walk is done.
+func (c *frozenCursor[K, V]) next() *frozenNode[K, V] {
+	for len(c.stack) > 0 {
+		n := c.stack[len(c.stack)-1]
+		c.stack = c.stack[:len(c.stack)-1]
+		c.descend(n.right)
+		if !n.expired(c.now) {
+			return n
+		}
+	}
+	return nil
+}
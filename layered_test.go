@@ -0,0 +1,91 @@
+package rbtree_test
+
+import (
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iku50/rbtree-go"
+)
+
+type layeredEntry = rbtree.OverlayEntry[int]
+
+func collectLayered(seq func(yield func(int, int) bool)) (keys, values []int) {
+	for k, v := range seq {
+		keys = append(keys, k)
+		values = append(values, v)
+	}
+	return keys, values
+}
+
+func TestLayeredIter(t *testing.T) {
+	base := rbtree.New[int, int]()
+	for _, k := range []int{1, 3, 5, 7} {
+		base.Insert(k, k)
+	}
+	overlay := rbtree.New[int, layeredEntry]()
+	overlay.Insert(0, layeredEntry{Value: 100})
+	overlay.Insert(3, layeredEntry{Value: 300})
+	overlay.Insert(5, layeredEntry{Tombstone: true})
+	overlay.Insert(6, layeredEntry{Tombstone: true})
+	overlay.Insert(9, layeredEntry{Value: 900})
+
+	keys, values := collectLayered(rbtree.LayeredIter(base.Snapshot(), overlay))
+	assert.Equal(t, []int{0, 1, 3, 7, 9}, keys)
+	assert.Equal(t, []int{100, 1, 300, 7, 900}, values)
+
+	// stopping early
+	keys = nil
+	for k := range rbtree.LayeredIter(base.Snapshot(), overlay) {
+		keys = append(keys, k)
+		if k == 3 {
+			break
+		}
+	}
+	assert.Equal(t, []int{0, 1, 3}, keys)
+
+	keys, _ = collectLayered(rbtree.LayeredIter(nil, overlay))
+	assert.Equal(t, []int{0, 3, 9}, keys)
+	keys, _ = collectLayered(rbtree.LayeredIter(base.Snapshot(), rbtree.New[int, layeredEntry]()))
+	assert.Equal(t, []int{1, 3, 5, 7}, keys)
+	keys, _ = collectLayered(rbtree.LayeredIter(nil, rbtree.New[int, layeredEntry]()))
+	assert.Nil(t, keys)
+}
+
+func TestLayeredIterRandom(t *testing.T) {
+	r := rand.New(rand.NewPCG(4, 2))
+	base := rbtree.New[int, int]()
+	overlay := rbtree.New[int, layeredEntry]()
+	want := map[int]int{}
+	for i := 0; i < 2000; i++ {
+		k := r.IntN(1000)
+		base.Insert(k, k)
+		want[k] = k
+	}
+	snap := base.Snapshot()
+	for i := 0; i < 1000; i++ {
+		k := r.IntN(1200)
+		if r.IntN(3) == 0 {
+			overlay.Insert(k, layeredEntry{Tombstone: true})
+			delete(want, k)
+		} else {
+			overlay.Insert(k, layeredEntry{Value: -k})
+			want[k] = -k
+		}
+	}
+	// the base changing after its snapshot is not seen
+	base.DeleteRange(0, 1000)
+	keys, values := collectLayered(rbtree.LayeredIter(snap, overlay))
+	assert.Equal(t, slices.Sorted(maps.Keys(want)), keys)
+	for i, k := range keys {
+		assert.Equal(t, want[k], values[i])
+	}
+
+	// compacting the view into a new base
+	compacted, err := rbtree.NewFromSorted(keys, values)
+	assert.Nil(t, err)
+	assert.Equal(t, len(want), compacted.Len())
+}
@@ -0,0 +1,99 @@
+package rbtree
+
+import (
+	"context"
+	"unsafe"
+)
+
+// sizeClasses are the object sizes the Go allocator rounds small
+// allocations up to, as of Go 1.23.
+var sizeClasses = [...]uintptr{
+	8, 16, 24, 32, 48, 64, 80, 96, 112, 128, 144, 160, 176, 192, 208, 224,
+	240, 256, 288, 320, 352, 384, 416, 448, 480, 512, 576, 640, 704, 768,
+	896, 1024, 1152, 1280, 1408, 1536, 1792, 2048, 2304, 2688, 3072, 3200,
+	3456, 4096, 4864, 5376, 6144, 6528, 6784, 6912, 8192, 9472, 9728,
+	10240, 10880, 12288, 13568, 14336, 16384, 18432, 19072, 20480, 21760,
+	24576, 27264, 28672, 32768,
+}
+
+// allocSize is the memory an allocation of size bytes takes: small ones
+// are rounded up to their size class, large ones to whole 8 KiB pages.
+func allocSize(size uintptr) int64 {
+	if size == 0 {
+		return 0
+	}
+	for _, c := range sizeClasses {
+		if size <= c {
+			return int64(c)
+		}
+	}
+	const page = 8192
+	return int64((size + page - 1) / page * page)
+}
+
+// MemoryUsage reports the nodes the tree holds, those unlinked ones that
+// wait for reuse in a node pool included, and roughly how many bytes of
+// heap they and the changelog ring take. Node and value box sizes are
+// rounded up to the allocator's size classes. Memory that keys and values
+// point to is only counted for a tree built WithSizeOf, which walks every
+// key, expired ones included, and so costs a lookup per key.
+//
+// It is meant for memory accounting, to flush or evict before the
+// process runs out of memory. Under concurrent writers the figures are
+// of a tree that was changing while they were taken.
+func (t *RBTree[K, V]) MemoryUsage() (nodes, bytesApprox int64) {
+	nodes = t.count.Load()
+	if t.pool != nil {
+		nodes += t.pool.pending.Load()
+	}
+	nodes = max(nodes, 0)
+	per := allocSize(unsafe.Sizeof(RBTreeNode[K, V]{}))
+	if t.stable {
+		per += allocSize(unsafe.Sizeof(*new(V)))
+	}
+	bytesApprox = nodes * per
+	if l := t.log; l != nil {
+		bytesApprox += allocSize(uintptr(len(l.ring)) * unsafe.Sizeof(Event[K, V]{}))
+	}
+	if t.sizeOf != nil {
+		bytesApprox += t.referenced()
+	}
+	return nodes, bytesApprox
+}
+
+// referenced sums what the WithSizeOf function reports for every key.
+func (t *RBTree[K, V]) referenced() int64 {
+	ctx := context.Background()
+	var (
+		total int64
+		k     K
+		v     *V
+		value V
+		first = true
+	)
+	bucket := t.enter()
+	for {
+		from := k
+		err := t.retry(ctx, func() error {
+			var err error
+			// with now at 0 expired keys are visited too
+			if first {
+				k, v, _, err = t.edge(true, 0, &value)
+			} else {
+				k, v, _, err = t.seek(from, false, false, 0, &value)
+			}
+			return err
+		})
+		if err != nil || v == nil {
+			t.exit(bucket)
+			if err == ErrCorrupted {
+				t.markCorrupted()
+			}
+			return total
+		}
+		first = false
+		t.exit(bucket)
+		total += int64(t.sizeOf(k, value))
+		bucket = t.enter()
+	}
+}
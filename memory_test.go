@@ -0,0 +1,51 @@
+package rbtree_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iku50/rbtree-go"
+)
+
+func TestMemoryUsage(t *testing.T) {
+	nodes, bytes := rbtree.New[int, int]().MemoryUsage()
+	assert.Zero(t, nodes)
+	assert.Zero(t, bytes)
+
+	tree := rbtree.New[int, int]()
+	for k := 0; k < 100; k++ {
+		tree.Insert(k, k)
+	}
+	nodes, bytes = tree.MemoryUsage()
+	assert.Equal(t, int64(100), nodes)
+	perNode := bytes / 100
+	assert.Equal(t, bytes, 100*perNode)
+	assert.GreaterOrEqual(t, perNode, int64(64))
+
+	// boxes and the changelog ring come on top
+	stable := rbtree.New[int, int](rbtree.WithStableValuePointers(), rbtree.WithChangelog(10))
+	for k := 0; k < 100; k++ {
+		stable.Insert(k, k)
+	}
+	_, boxed := stable.MemoryUsage()
+	assert.Greater(t, boxed, bytes+100*8)
+
+	// and what keys and values point to, expired keys included
+	strs := rbtree.New[string, []byte](rbtree.WithSizeOf(func(key string, value []byte) int {
+		return len(key) + cap(value)
+	}))
+	strs.Insert("abc", make([]byte, 100))
+	strs.InsertWithTTL("de", make([]byte, 10), -1)
+	plain := rbtree.New[string, []byte]()
+	plain.Insert("abc", nil)
+	plain.Insert("de", nil)
+	_, want := plain.MemoryUsage()
+	nodes, bytes = strs.MemoryUsage()
+	assert.Equal(t, int64(2), nodes)
+	assert.Equal(t, want+115, bytes)
+
+	assert.Panics(t, func() {
+		rbtree.New[int, int](rbtree.WithSizeOf(func(string, int) int { return 0 }))
+	})
+}
@@ -0,0 +1,13 @@
+//go:build rbtree_chaos
+
+package rbtree_test
+
+import (
+	"testing"
+
+	"github.com/iku50/rbtree-go"
+)
+
+func TestMirrorChaos(t *testing.T) {
+	newMirror(t, 500, rbtree.WithChaos(1), rbtree.WithNodePool()).run(8, 2000, 300)
+}
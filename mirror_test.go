@@ -0,0 +1,293 @@
+package rbtree_test
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iku50/rbtree-go"
+)
+
+// mirror wraps a tree for regression runs. Every operation is applied to
+// the tree and to a mutex-protected map, and their answers must agree.
+// Every so many operations the writers are stopped and the whole tree is
+// compared with the map, so a divergence is reported together with the
+// window of operations since the last check that agreed.
+type mirror struct {
+	tb    testing.TB
+	kv    *rbtree.OrderedMap[int, int] // reads copy the value under the pin
+	tree  *rbtree.RBTree[int, int]
+	every int64 // operations between full checks
+
+	world   sync.RWMutex   // operations share it, full checks take it
+	stripes [64]sync.Mutex // order the tree and the map for each key
+	mu      sync.Mutex     // guards model and window
+	model   map[int]int
+	window  []string
+	ops     atomic.Int64
+	failed  atomic.Bool
+}
+
+func newMirror(tb testing.TB, every int, opts ...rbtree.Option) *mirror {
+	kv := rbtree.NewOrderedMap[int, int](opts...)
+	return &mirror{
+		tb:    tb,
+		kv:    kv,
+		tree:  kv.Tree(),
+		every: int64(every),
+		model: make(map[int]int),
+	}
+}
+
+// apply runs op for key with the key's stripe locked. op is described by
+// name in the window and returns its result in the tree and in the model.
+func (m *mirror) apply(name string, key int, op func(model map[int]int) (got, want any)) {
+	m.world.RLock()
+	s := &m.stripes[uint(key)%uint(len(m.stripes))]
+	s.Lock()
+	got, want := op(nil)
+	m.mu.Lock()
+	_, want = op(m.model)
+	m.window = append(m.window, fmt.Sprintf("%s %d", name, key))
+	m.mu.Unlock()
+	s.Unlock()
+	m.world.RUnlock()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		m.fail("%s %d: tree %v, map %v", name, key, got, want)
+	}
+	if m.ops.Add(1)%m.every == 0 {
+		m.check()
+	}
+}
+
+func (m *mirror) fail(format string, args ...any) {
+	if m.failed.Swap(true) {
+		return // the first divergence is the interesting one
+	}
+	m.mu.Lock()
+	window := slices.Clone(m.window)
+	m.mu.Unlock()
+	m.tb.Errorf("%s\nwindow of %d operations since the last check:\n%s",
+		fmt.Sprintf(format, args...), len(window), strings.Join(window, "\n"))
+}
+
+// check stops the operations and compares the whole tree with the map.
+func (m *mirror) check() {
+	m.world.Lock()
+	defer m.world.Unlock()
+	if err := m.tree.Verify(); err != nil {
+		m.fail("verify: %v", err)
+	}
+	if m.tree.Len() != len(m.model) {
+		m.fail("len: tree %d, map %d", m.tree.Len(), len(m.model))
+	}
+	seen := 0
+	m.tree.Range(func(key, value int) bool {
+		if want, ok := m.model[key]; !ok || want != value {
+			m.fail("range: tree has %d=%d, map %d=%d (%v)", key, value, key, want, ok)
+			return false
+		}
+		seen++
+		return true
+	})
+	if seen != len(m.model) {
+		m.fail("range: tree yields %d keys, map holds %d", seen, len(m.model))
+	}
+	m.mu.Lock()
+	m.window = m.window[:0]
+	m.mu.Unlock()
+}
+
+func (m *mirror) Insert(key, value int) {
+	m.apply("insert", key, func(model map[int]int) (any, any) {
+		if model == nil {
+			m.tree.Insert(key, value)
+			return nil, nil
+		}
+		model[key] = value
+		return nil, nil
+	})
+}
+
+func (m *mirror) Get(key int) {
+	m.apply("get", key, func(model map[int]int) (any, any) {
+		if model == nil {
+			v, ok := m.kv.Load(key)
+			return found(v, ok), nil
+		}
+		v, ok := model[key]
+		return nil, found(v, ok)
+	})
+}
+
+func (m *mirror) Delete(key int) {
+	m.apply("delete", key, func(model map[int]int) (any, any) {
+		if model == nil {
+			return deref(m.tree.Delete(key)), nil
+		}
+		v, ok := model[key]
+		delete(model, key)
+		return nil, found(v, ok)
+	})
+}
+
+func (m *mirror) GetOrInsert(key, value int) {
+	m.apply("getorinsert", key, func(model map[int]int) (any, any) {
+		if model == nil {
+			actual, loaded := m.tree.GetOrInsert(key, value)
+			return [2]any{actual, loaded}, nil
+		}
+		actual, loaded := model[key]
+		if !loaded {
+			model[key], actual = value, value
+		}
+		return nil, [2]any{actual, loaded}
+	})
+}
+
+func (m *mirror) CompareAndDelete(key, expected int) {
+	m.apply("compareanddelete", key, func(model map[int]int) (any, any) {
+		if model == nil {
+			return m.tree.CompareAndDelete(key, expected), nil
+		}
+		v, ok := model[key]
+		if ok && v == expected {
+			delete(model, key)
+			return nil, true
+		}
+		return nil, false
+	})
+}
+
+func (m *mirror) Add(key, delta int) {
+	m.apply("add", key, func(model map[int]int) (any, any) {
+		if model == nil {
+			v, _ := m.tree.Update(key, func(old int, _ bool) (int, bool) { return old + delta, true })
+			return v, nil
+		}
+		model[key] += delta
+		return nil, model[key]
+	})
+}
+
+// DeleteRange removes [lo, hi) with every other operation stopped, as it
+// spans the stripes.
+func (m *mirror) DeleteRange(lo, hi int) {
+	m.world.Lock()
+	got := m.tree.DeleteRange(lo, hi)
+	want := 0
+	for k := range m.model {
+		if k >= lo && k < hi {
+			delete(m.model, k)
+			want++
+		}
+	}
+	m.window = append(m.window, fmt.Sprintf("deleterange %d %d", lo, hi))
+	m.world.Unlock()
+	if got != want {
+		m.fail("deleterange %d %d: tree %d, map %d", lo, hi, got, want)
+	}
+}
+
+func deref(v *int) any {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
+
+func found(v int, ok bool) any {
+	if !ok {
+		return nil
+	}
+	return v
+}
+
+// run drives m with a random mix of operations from goroutines, over keys
+// in [0, keys).
+func (m *mirror) run(goroutines, ops, keys int) {
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < ops; i++ {
+				k := rand.IntN(keys)
+				switch op := rand.IntN(100); {
+				case op < 30:
+					m.Get(k)
+				case op < 55:
+					m.Insert(k, rand.IntN(8))
+				case op < 75:
+					m.Delete(k)
+				case op < 85:
+					m.GetOrInsert(k, rand.IntN(8))
+				case op < 92:
+					m.CompareAndDelete(k, rand.IntN(8))
+				case op < 99:
+					m.Add(k, 1)
+				default:
+					m.DeleteRange(k, k+rand.IntN(keys/10+1))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	m.check()
+}
+
+func TestMirror(t *testing.T) {
+	for name, opts := range map[string][]rbtree.Option{
+		"default":    nil,
+		"concurrent": {rbtree.WithSingleProcFallback(false)},
+		"autotune":   {rbtree.WithAutoTune()},
+		"nodepool":   {rbtree.WithNodePool()},
+		"tokens":     {rbtree.WithWriteTokens(3)},
+		"opdescs":    {rbtree.WithOpDescriptors()},
+		"everything": {rbtree.WithAutoTune(), rbtree.WithNodePool(), rbtree.WithWriteTokens(2), rbtree.WithOpDescriptors()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			newMirror(t, 500, opts...).run(8, 2000, 300)
+		})
+	}
+}
+
+// recorder keeps the failures of a mirror instead of reporting them.
+type recorder struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recorder) Errorf(format string, args ...any) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestMirrorReportsWindow(t *testing.T) {
+	r := &recorder{TB: t}
+	m := newMirror(r, 4)
+	m.Insert(1, 1)
+	m.Insert(2, 2)
+	m.Get(1)
+	m.Get(2) // full check passes
+	assert.Empty(t, r.errors)
+
+	m.Insert(3, 3)
+	m.tree.Delete(2) // behind the mirror's back
+	m.Insert(4, 4)
+	m.Get(1)
+	m.Get(3) // full check finds 2 missing
+	if assert.Len(t, r.errors, 1) {
+		assert.Contains(t, r.errors[0], "len: tree 3, map 4")
+		assert.Contains(t, r.errors[0], "insert 3\ninsert 4\nget 1")
+		assert.NotContains(t, r.errors[0], "insert 1")
+	}
+
+	m.Get(2) // later divergences are not reported again
+	assert.Len(t, r.errors, 1)
+}
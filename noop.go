@@ -0,0 +1,44 @@
+package rbtree
+
+// unchanged reports whether key holds value without a deadline, as
+// WithSkipNoopWrites compares values, so that an insert of it would change
+// nothing. The value is compared while its node is pinned, which keeps
+// writers off it. A lookup that meets a locked node or a panic reports
+// false, and the insert takes the locking path.
+func (t *RBTree[K, V]) unchanged(key K, value V) bool {
+	now := t.now()
+	same := false
+	_, err := t.descend(OpGet, func(n *RBTreeNode[K, V]) *RBTreeNode[K, V] {
+		c := t.compare(key, n.key)
+		if c == 0 {
+			same = n.deadline == 0 && !t.expired(n, now) && t.equal(*n.valuePtr(), value)
+			return nil
+		}
+		if c < 0 {
+			return n.left.Load()
+		}
+		return n.right.Load()
+	})
+	if err != nil || !same {
+		return false
+	}
+	t.stats.noopWrites.Add(1)
+	return true
+}
+
+// sameValue compares a and b for a write that holds the key's node,
+// turning a panic of the comparison into a *PanicError WithPanicRecovery.
+// Equal values count as a skipped write.
+func (t *RBTree[K, V]) sameValue(a, b V) (same bool, err error) {
+	if t.guard {
+		defer func() {
+			if r := recover(); r != nil {
+				same, err = false, t.recovered(r)
+			}
+		}()
+	}
+	if same = t.equal(a, b); same {
+		t.stats.noopWrites.Add(1)
+	}
+	return same, nil
+}
@@ -0,0 +1,84 @@
+package rbtree_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iku50/rbtree-go"
+)
+
+func TestSkipNoopWrites(t *testing.T) {
+	eq := func(a, b string) bool { return a == b }
+	tree := rbtree.New[int, string](rbtree.WithSkipNoopWrites(eq), rbtree.WithChangelog(64))
+	for k := 0; k < 100; k++ {
+		tree.Insert(k, "v")
+	}
+	gen := tree.Generation()
+	assert.Equal(t, uint64(100), gen)
+
+	for k := 0; k < 100; k++ {
+		tree.Insert(k, "v")
+	}
+	assert.Equal(t, gen, tree.Generation())
+	assert.Equal(t, uint64(100), tree.Stats().NoopWrites)
+
+	// a store under the node lock is skipped as well
+	v, ok := tree.Update(7, func(old string, ok bool) (string, bool) { return old, true })
+	assert.Equal(t, "v", v)
+	assert.True(t, ok)
+	assert.Equal(t, gen, tree.Generation())
+	assert.Equal(t, uint64(101), tree.Stats().NoopWrites)
+
+	tree.Insert(7, "w")
+	assert.Equal(t, gen+1, tree.Generation())
+	assert.Equal(t, "w", *tree.Get(7))
+	tree.Insert(100, "v")
+	assert.Equal(t, gen+2, tree.Generation())
+	events, _ := tree.ChangesSince(gen)
+	n := 0
+	for range events {
+		n++
+	}
+	assert.Equal(t, 2, n)
+
+	// without the option every write is logged
+	plain := rbtree.New[int, string](rbtree.WithChangelog(64))
+	plain.Insert(1, "v")
+	plain.Insert(1, "v")
+	assert.Equal(t, uint64(2), plain.Generation())
+	assert.Zero(t, plain.Stats().NoopWrites)
+}
+
+func TestSkipNoopWritesDeadline(t *testing.T) {
+	tree := rbtree.New[int, int](rbtree.WithSkipNoopWrites(func(a, b int) bool { return a == b }))
+	assert.Nil(t, tree.InsertWithTTLCtx(context.Background(), 1, 1, 20*time.Millisecond))
+	// the insert clears the deadline, so it is no no-op
+	tree.Insert(1, 1)
+	assert.Zero(t, tree.Stats().NoopWrites)
+	time.Sleep(40 * time.Millisecond)
+	assert.Equal(t, 1, *tree.Get(1))
+
+	// a new deadline is never skipped either
+	assert.Nil(t, tree.InsertWithTTLCtx(context.Background(), 1, 1, time.Millisecond))
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, tree.Get(1))
+	assert.Zero(t, tree.Stats().NoopWrites)
+}
+
+func TestSkipNoopWritesPanic(t *testing.T) {
+	tree := rbtree.New[int, int](rbtree.WithSkipNoopWrites(func(a, b int) bool { panic("eq") }), rbtree.WithPanicRecovery())
+	tree.Insert(1, 1)
+	err := tree.InsertCtx(context.Background(), 1, 2)
+	var pe *rbtree.PanicError
+	assert.ErrorAs(t, err, &pe)
+	assert.Equal(t, 1, *tree.Get(1))
+	assert.Nil(t, tree.Check())
+	assert.Nil(t, tree.InsertCtx(context.Background(), 2, 2))
+
+	assert.Panics(t, func() {
+		rbtree.New[int, int](rbtree.WithSkipNoopWrites(func(a, b string) bool { return a == b }))
+	})
+}
@@ -0,0 +1,216 @@
+package rbtree
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Phase is the stage a write has reached, see OpInfo.
+type Phase int32
+
+const (
+	PhaseLocate    Phase = iota + 1 // walking down to the key with lock coupling
+	PhaseApply                      // linking, updating or unlinking the key's node
+	PhaseRebalance                  // restoring the colors above the change
+	PhaseResize                     // carrying the size change up to the root
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseLocate:
+		return "locate"
+	case PhaseApply:
+		return "apply"
+	case PhaseRebalance:
+		return "rebalance"
+	case PhaseResize:
+		return "resize"
+	default:
+		return "unknown"
+	}
+}
+
+// OpInfo describes a write in flight, as published by a tree built
+// WithOpDescriptors.
+type OpInfo struct {
+	ID       uint64
+	Op       Op
+	Key      any
+	Phase    Phase
+	Started  time.Time
+	Attempts int   // tries of the locate and apply phases so far
+	Locked   []any // keys of the nodes the write holds locked
+}
+
+func (o OpInfo) String() string {
+	return fmt.Sprintf("#%d %v %v: %v, attempt %d, %v running, holding %v",
+		o.ID, o.Op, o.Key, o.Phase, o.Attempts, time.Since(o.Started).Round(time.Microsecond), o.Locked)
+}
+
+// opDesc is the published state of one write. Its methods do nothing on
+// a nil descriptor, so the write paths call them unconditionally. A write
+// that only counts its work for an OpCounter has a quiet one, which is not
+// published.
+type opDesc[K any] struct {
+	counter  *OpCounter // see WithOpCounter
+	quiet    bool
+	id       uint64
+	op       Op
+	key      K
+	started  time.Time
+	phase    atomic.Int32
+	attempts atomic.Int32
+
+	mu     sync.Mutex // guards locked
+	locked []K
+
+	trace *protoTrace[K] // see WithConformanceSampling
+}
+
+func (d *opDesc[K]) enter(p Phase) {
+	if d != nil {
+		d.phase.Store(int32(p))
+	}
+}
+
+// attempt starts a new try at the locate phase.
+func (d *opDesc[K]) attempt() {
+	if d != nil {
+		d.attempts.Add(1)
+		d.phase.Store(int32(PhaseLocate))
+		if d.trace != nil {
+			d.trace.record(stepAttempt, nil)
+		}
+	}
+}
+
+// wait tells the protocol model that the write backs off.
+func (d *opDesc[K]) wait() {
+	if d != nil && d.trace != nil {
+		d.trace.record(stepWait, nil)
+	}
+}
+
+// hold publishes the nodes the write has locked, replacing the previous
+// set.
+func (d *opDesc[K]) hold(nodes ...K) {
+	if d == nil {
+		return
+	}
+	if d.trace != nil {
+		d.trace.record(stepHold, nodes)
+	}
+	if d.quiet {
+		return
+	}
+	d.mu.Lock()
+	d.locked = append(d.locked[:0], nodes...)
+	d.mu.Unlock()
+}
+
+// publish makes a's nodes the write's locked set.
+func (a *localArea[K, V]) publish() {
+	d := a.desc
+	if d == nil {
+		return
+	}
+	if d.trace != nil {
+		var keys []K
+		for _, n := range a.list() {
+			if n != nil {
+				keys = append(keys, n.key)
+			}
+		}
+		d.trace.record(stepArea, keys)
+	}
+	if d.quiet {
+		return
+	}
+	d.mu.Lock()
+	d.locked = d.locked[:0]
+	for _, n := range a.nodes[:a.n] {
+		if n != nil {
+			d.locked = append(d.locked, n.key)
+		}
+	}
+	for _, n := range a.overflow {
+		if n != nil {
+			d.locked = append(d.locked, n.key)
+		}
+	}
+	d.mu.Unlock()
+}
+
+func (d *opDesc[K]) info() OpInfo {
+	info := OpInfo{
+		ID:       d.id,
+		Op:       d.op,
+		Key:      d.key,
+		Phase:    Phase(d.phase.Load()),
+		Started:  d.started,
+		Attempts: int(d.attempts.Load()),
+	}
+	d.mu.Lock()
+	for _, k := range d.locked {
+		info.Locked = append(info.Locked, k)
+	}
+	d.mu.Unlock()
+	return info
+}
+
+// opRegistry holds the descriptors of the writes in flight.
+type opRegistry[K any] struct {
+	next atomic.Uint64
+	ops  sync.Map // id to *opDesc[K]
+}
+
+// beginOp publishes a descriptor for a write of key. It returns nil if the
+// tree does not publish descriptors, or a quiet one if ctx carries an
+// OpCounter or the write is sampled WithConformanceSampling.
+func (t *RBTree[K, V]) beginOp(ctx context.Context, op Op, key K) *opDesc[K] {
+	c := counterFrom(ctx)
+	p := t.sampleConformance()
+	if t.descs == nil {
+		if c == nil && p == nil {
+			return nil
+		}
+		return &opDesc[K]{counter: c, quiet: true, op: op, key: key, trace: p}
+	}
+	d := &opDesc[K]{counter: c, id: t.descs.next.Add(1), op: op, key: key, started: time.Now(), trace: p}
+	t.descs.ops.Store(d.id, d)
+	return d
+}
+
+func (t *RBTree[K, V]) endOp(d *opDesc[K]) {
+	if d == nil {
+		return
+	}
+	if !d.quiet {
+		t.descs.ops.Delete(d.id)
+	}
+	if d.trace != nil {
+		t.conformed(d.trace)
+	}
+}
+
+// InFlight returns the single-key writes currently running, oldest first,
+// for trees built WithOpDescriptors; it returns nil otherwise. Each
+// descriptor is read on its own while the writes go on, so the list is
+// no consistent snapshot, but a write that is stuck shows where it is.
+func (t *RBTree[K, V]) InFlight() []OpInfo {
+	if t.descs == nil {
+		return nil
+	}
+	var ops []OpInfo
+	t.descs.ops.Range(func(_, d any) bool {
+		ops = append(ops, d.(*opDesc[K]).info())
+		return true
+	})
+	slices.SortFunc(ops, func(a, b OpInfo) int { return cmp.Compare(a.ID, b.ID) })
+	return ops
+}
@@ -0,0 +1,66 @@
+package rbtree
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInFlight(t *testing.T) {
+	assert.Nil(t, New[int, int]().InFlight())
+
+	// both writes must be in flight at once, even on a single processor
+	tree := New[int, int](WithOpDescriptors(), WithSingleProcFallback(false))
+	for k := 0; k < 10; k++ {
+		tree.Insert(k, k)
+	}
+	assert.Empty(t, tree.InFlight())
+
+	// with the root held the writes start over at the locate phase
+	root := tree.root.Load()
+	root.flag.Store(true)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		tree.Insert(20, 20)
+	}()
+	go func() {
+		defer wg.Done()
+		tree.Delete(3)
+	}()
+	var ops []OpInfo
+	for len(ops) < 2 || ops[0].Attempts < 2 || ops[1].Attempts < 2 {
+		time.Sleep(time.Millisecond)
+		ops = tree.InFlight()
+	}
+	assert.Less(t, ops[0].ID, ops[1].ID)
+	keys := map[any]Op{ops[0].Key: ops[0].Op, ops[1].Key: ops[1].Op}
+	assert.Equal(t, map[any]Op{20: OpInsert, 3: OpDelete}, keys)
+	for _, op := range ops {
+		assert.Equal(t, PhaseLocate, op.Phase)
+		assert.Empty(t, op.Locked)
+		assert.Contains(t, op.String(), "locate")
+	}
+	root.flag.Store(false)
+	wg.Wait()
+	assert.Empty(t, tree.InFlight())
+	assert.Nil(t, tree.Check())
+}
+
+func TestPublishLockedSet(t *testing.T) {
+	tree := New[int, int]()
+	for k := 0; k < 10; k++ {
+		tree.Insert(k, k)
+	}
+	d := &opDesc[int]{}
+	x := tree.root.Load().left.Load()
+	area := localArea[int, int]{desc: d}
+	assert.True(t, area.lockSet(sizeSet, x))
+	assert.ElementsMatch(t, []any{x.key, tree.root.Load().key}, d.info().Locked)
+	area.unlock()
+	assert.Empty(t, d.info().Locked)
+	assert.Same(t, d, area.desc)
+}
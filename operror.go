@@ -0,0 +1,61 @@
+package rbtree
+
+import (
+	"fmt"
+	"time"
+)
+
+// OpError is the error the single-key operations with a context, such as
+// GetCtx, InsertCtx, DeleteCtx and UpdateCtx, return when they fail: on
+// exhausted retries, a done context, a corrupted tree or a panicking
+// callback. It wraps the cause, so errors.Is still matches the sentinel
+// errors, and records the state of the tree when the operation gave up.
+type OpError struct {
+	Op  Op
+	Key any
+	// Generation is the tree's Generation when the operation failed.
+	// Trees without a changelog count no generations and leave it 0,
+	// which a tree with one that was never written reports too; Error
+	// leaves it out for them.
+	Generation uint64
+	Len        int // the tree's Len when the operation failed
+	Retries    int // how often the operation restarted on a locked node
+	// Elapsed is how long the operation retried, from the first locked
+	// node it met until it gave up; 0 if it never met one.
+	Elapsed time.Duration
+	Err     error
+
+	logged bool // the tree keeps a changelog
+}
+
+func (e *OpError) Error() string {
+	s := fmt.Sprintf("rbtree: %v %v: %v", e.Op, e.Key, e.Err)
+	if e.Retries > 0 {
+		s += fmt.Sprintf(" after %d retries in %v", e.Retries, e.Elapsed)
+	}
+	if !e.logged {
+		return s + fmt.Sprintf(" (len %d)", e.Len)
+	}
+	return s + fmt.Sprintf(" (len %d, generation %d)", e.Len, e.Generation)
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// opError wraps err, if any, in an *OpError for op on key.
+func (t *RBTree[K, V]) opError(op Op, key K, retries int, elapsed time.Duration, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &OpError{
+		Op:         op,
+		Key:        key,
+		Generation: t.Generation(),
+		Len:        t.Len(),
+		Retries:    retries,
+		Elapsed:    elapsed,
+		Err:        err,
+		logged:     t.log != nil,
+	}
+}
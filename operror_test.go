@@ -0,0 +1,66 @@
+package rbtree
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpError(t *testing.T) {
+	tree := New[int, int](WithBackoff(Backoff{MaxRetries: 3, Base: time.Millisecond}), WithChangelog(16), WithSingleProcFallback(false))
+	for k := 0; k < 10; k++ {
+		tree.Insert(k, k)
+	}
+	root := tree.root.Load()
+	assert.True(t, root.lock())
+	_, err := tree.GetCtx(context.Background(), root.key)
+	var oe *OpError
+	if assert.ErrorAs(t, err, &oe) {
+		assert.ErrorIs(t, err, ErrRetriesExhausted)
+		assert.Equal(t, OpGet, oe.Op)
+		assert.Equal(t, root.key, oe.Key)
+		assert.Equal(t, uint64(10), oe.Generation)
+		assert.Equal(t, 10, oe.Len)
+		assert.Equal(t, 3, oe.Retries)
+		assert.GreaterOrEqual(t, oe.Elapsed, 3*time.Millisecond)
+		assert.Contains(t, err.Error(), fmt.Sprintf("rbtree: get %d: retries exhausted after 3 retries in ", root.key))
+		assert.Contains(t, err.Error(), "(len 10, generation 10)")
+	}
+	err = tree.InsertCtx(context.Background(), 20, 20)
+	if assert.ErrorAs(t, err, &oe) {
+		assert.Equal(t, OpInsert, oe.Op)
+		assert.Equal(t, 20, oe.Key)
+	}
+	_, err = tree.DeleteCtx(context.Background(), 1)
+	if assert.ErrorAs(t, err, &oe) {
+		assert.Equal(t, OpDelete, oe.Op)
+		assert.Equal(t, 1, oe.Key)
+	}
+	root.unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Nil(t, tree.InsertCtx(ctx, 5, 5), "a write that needs no retry succeeds")
+	_, err = tree.ContainsCtx(context.Background(), 5)
+	assert.Nil(t, err)
+}
+
+func TestOpErrorWraps(t *testing.T) {
+	tree := New[string, int](WithMaxKeySize(2), WithPanicRecovery())
+	err := tree.InsertCtx(context.Background(), "abc", 1)
+	assert.ErrorIs(t, err, ErrKeyTooLarge)
+	assert.Equal(t, "rbtree: insert abc: key too large: 3 bytes, at most 2 allowed (len 0)", err.Error())
+
+	_, _, err = tree.UpdateCtx(context.Background(), "a", func(int, bool) (int, bool) { panic("boom") })
+	var pe *PanicError
+	assert.ErrorAs(t, err, &pe)
+	var oe *OpError
+	assert.ErrorAs(t, err, &oe)
+	assert.Equal(t, 0, oe.Retries)
+	assert.Zero(t, oe.Elapsed)
+	assert.True(t, errors.Is(err, ErrCallbackPanic))
+}
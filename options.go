@@ -0,0 +1,497 @@
+package rbtree
+
+import (
+	"context"
+	"io"
+	"math/rand/v2"
+	"runtime"
+	"time"
+)
+
+// Backoff is the retry policy used when an operation runs into a node that
+// is locked by a concurrent writer. The first Spins retries only yield the
+// processor. After that the wait before retry Spins+i is Base·2^i capped at
+// Max, with up to Jitter of it randomized.
+type Backoff struct {
+	Spins      int           // retries that yield instead of sleeping
+	Base       time.Duration // wait before the first retry
+	Max        time.Duration // upper bound for a single wait, the wait does not grow when zero
+	Jitter     float64       // fraction of each wait that is randomized, in [0, 1]
+	MaxRetries int           // give up with ErrRetriesExhausted after this many retries, 0 for no limit
+}
+
+// DefaultBackoff is used by trees that are not given WithBackoff.
+var DefaultBackoff = Backoff{
+	Base:   10 * time.Nanosecond,
+	Max:    100 * time.Microsecond,
+	Jitter: 0.5,
+}
+
+func (b Backoff) delay(attempt int) time.Duration {
+	if attempt < b.Spins {
+		return 0
+	}
+	attempt -= b.Spins
+	d := b.Base
+	for i := 0; i < attempt && d < b.Max; i++ {
+		d *= 2
+	}
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+	if b.Jitter > 0 && d > 0 {
+		j := time.Duration(float64(d) * min(b.Jitter, 1))
+		if j > 0 {
+			d = d - j + rand.N(2*j)
+		}
+	}
+	return d
+}
+
+// wait blocks before retry number attempt. It returns ctx's error if ctx is
+// done first and ErrRetriesExhausted once MaxRetries is exceeded.
+func (b Backoff) wait(ctx context.Context, attempt int) error {
+	if b.MaxRetries > 0 && attempt >= b.MaxRetries {
+		return ErrRetriesExhausted
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	d := b.delay(attempt)
+	if d <= 0 {
+		if attempt < b.Spins {
+			runtime.Gosched()
+		}
+		return nil
+	}
+	if ctx.Done() == nil {
+		time.Sleep(d)
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// yield is wait for a tree on a single processor, see
+// WithSingleProcFallback. It gives the processor up instead of sleeping:
+// only the goroutine holding the node can free it, and sleeping just
+// delays the retry after it did.
+func (b Backoff) yield(ctx context.Context, attempt int) error {
+	if b.MaxRetries > 0 && attempt >= b.MaxRetries {
+		return ErrRetriesExhausted
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	runtime.Gosched()
+	return nil
+}
+
+// pause waits before retry number attempt of a step that must not be
+// given up, such as a rebalancing fixup. It ignores MaxRetries.
+func (b Backoff) pause(attempt int) {
+	if d := b.delay(attempt); d > 0 {
+		time.Sleep(d)
+		return
+	}
+	runtime.Gosched()
+}
+
+// Limiter admits writes, see WithWriteLimiter. Wait blocks until a write
+// may start and returns an error if it may not, such as ctx's once ctx is
+// done. *rate.Limiter from golang.org/x/time/rate implements it.
+type Limiter interface {
+	Wait(ctx context.Context) error
+}
+
+type options struct {
+	backoff Backoff
+	compare any // func(a, b K) int, checked against K by New
+	stable  bool
+	ordered bool
+	sample  uint32
+	tracer  Tracer
+	labels  bool
+	serial  bool
+	tune    bool
+	tokens  int // WithWriteTokens depth plus one, 0 when off
+	pool    bool
+	descs   bool
+	changes int // changelog capacity, 0 when off
+	guard   bool
+	sizeOf  any // func(key K, value V) int, checked against K and V by New
+	limiter Limiter
+	hints   bool
+	single  bool // see WithSingleProcFallback, on by default
+	maxKey  int
+	keySize any // func(key K) int, checked against K by New
+
+	progress func(done, total int)
+	noop     any // func(a, b V) bool, checked against V by New
+
+	conform     uint32 // see WithConformanceSampling, 0 when off
+	onViolation func(error)
+
+	chaos     bool // see WithChaos, built with the rbtree_chaos tag
+	chaosSeed uint64
+
+	history      int // mutations between captures of WithDebugHistory, 0 when off
+	historyDepth int
+	historyOut   io.Writer
+}
+
+// Option configures a tree at construction time.
+type Option func(*options)
+
+func newOptions(opts []Option) options {
+	o := options{
+		backoff: DefaultBackoff,
+		sample:  DefaultGetSampling,
+		single:  true,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithBackoff sets the retry policy for operations that hit locked nodes.
+func WithBackoff(b Backoff) Option {
+	return func(o *options) {
+		o.backoff = b
+	}
+}
+
+// WithComparator orders keys by compare instead of cmp.Compare. compare
+// must return a negative number, zero or a positive number when a is less
+// than, equal to or greater than b. Its key type must match the tree's.
+func WithComparator[K any](compare func(a, b K) int) Option {
+	return func(o *options) {
+		o.compare = compare
+	}
+}
+
+// WithStableValuePointers stores every value in its own allocation instead
+// of inside the tree node. A pointer returned by Get, Floor, Ceiling and the
+// other lookups then stays valid, and keeps observing later Inserts of the
+// same key, until that key is deleted. Rebalancing and deletes only move the
+// allocation between nodes, never the value out of it.
+//
+// The mode costs one extra allocation per inserted key.
+func WithStableValuePointers() Option {
+	return func(o *options) {
+		o.stable = true
+	}
+}
+
+// WithOrderStatistics keeps the subtree sizes up to date, so that Rank and
+// Select answer in O(log n) from the sizes on one path. Every insert and
+// delete then carries its size change up to the root, one node and its
+// parent at a time, which contends on the nodes near the root and makes
+// inserts and deletes about 1.5 to 2.5 times slower.
+//
+// Without it Rank and Select count the keys in order, a lookup each, and
+// Split and DeleteRange count the keys they move by walking them.
+func WithOrderStatistics() Option {
+	return func(o *options) {
+		o.ordered = true
+	}
+}
+
+// WithGetSampling records read statistics for one in every n calls to Get,
+// and insert statistics for one in every n new keys, see Stats. Zero turns
+// sampling off.
+func WithGetSampling(n int) Option {
+	return func(o *options) {
+		o.sample = uint32(max(n, 0))
+	}
+}
+
+// WithTracer calls tr for every node examined by lookups, inserts and
+// deletes. tr runs on the hot path and must be cheap.
+func WithTracer(tr Tracer) Option {
+	return func(o *options) {
+		o.tracer = tr
+	}
+}
+
+// WithProfileLabels tags the goroutine running a tree operation with pprof
+// labels naming the operation and the tree level being visited, so CPU
+// profiles (and perf through pprof's label support) attribute samples to
+// tree levels. See profile.go for the label keys.
+func WithProfileLabels() Option {
+	return func(o *options) {
+		o.labels = true
+	}
+}
+
+// WithSerializedWrites lets only one mutation run at a time while reads
+// stay concurrent. Writers queue on an exclusive lock, which orders them
+// exactly as funnelling them through a single goroutine would, without a
+// goroutine to stop. Node locks are still taken, so the locking protocol
+// runs unchanged but without competing writers.
+//
+// It is meant as a correctness oracle: if a workload misbehaves with
+// concurrent writers but not with serialized ones, the bug is in the write
+// protocol.
+func WithSerializedWrites() Option {
+	return func(o *options) {
+		o.serial = true
+	}
+}
+
+// WithAutoTune lets the tree adjust its backoff policy at runtime from how
+// often retries succeed. The policy set by WithBackoff, or DefaultBackoff,
+// is the starting point; see Backoff.Spins for the phases being tuned.
+//
+// When most retries find the node free the tuner shortens the waits and
+// spins longer; when most find it still locked it spins less and waits
+// longer, so that a crowd of writers backs off rather than livelocks.
+// Jitter and MaxRetries are kept as configured. RBTree.Backoff reports the
+// policy currently in effect.
+func WithAutoTune() Option {
+	return func(o *options) {
+		o.tune = true
+	}
+}
+
+// WithWriteTokens makes single-key writers claim a token for the region of
+// the tree they write to before taking any node lock. A region is the
+// subtree under the ancestor at depth k of the writer's target, so at most
+// one writer at a time works in each of the 2^k regions and the others
+// queue for its token instead of racing for the same locks. Writes to
+// different regions, and all reads, proceed as before. Batch operations do
+// not take tokens.
+//
+// k is clamped to [0, 12]; 0 funnels all single-key writers through one
+// token. Negative k leaves tokens off.
+func WithWriteTokens(k int) Option {
+	return func(o *options) {
+		o.tokens = 0
+		if k >= 0 {
+			o.tokens = min(k, maxTokenDepth) + 1
+		}
+	}
+}
+
+// WithNodePool recycles the nodes that deletes unlink for later inserts
+// instead of leaving them to the garbage collector, which cuts allocation
+// and GC work for workloads that churn keys. A node is only reused once
+// every lookup and write that might still reach it has finished; see
+// Stats for how many nodes were allocated and reused.
+//
+// Without WithStableValuePointers, a pointer returned by Get or another
+// lookup points into a node that may hold a different key's value once
+// its key is deleted and the node reused. Pooling also costs every
+// operation two atomic updates of counters shared by the whole tree.
+func WithNodePool() Option {
+	return func(o *options) {
+		o.pool = true
+	}
+}
+
+// WithOpDescriptors makes every single-key write publish a descriptor of
+// its progress: the key, the phase it is in, how often it started over and
+// which nodes it holds locked. InFlight lists them, which tells where
+// writes are stuck when the tree hangs or a crash dump is taken.
+//
+// Publishing costs a registry update and an allocation per write, and a
+// short critical section whenever the locked set changes. Batch
+// operations publish nothing.
+func WithOpDescriptors() Option {
+	return func(o *options) {
+		o.descs = true
+	}
+}
+
+// WithChangelog keeps the last n modifications of the tree in a ring, for
+// ChangesSince. Recording one costs a short critical section shared by all
+// writers, taken while the modified node is still locked so that the log
+// orders the changes of a key as they happened. n <= 0 turns it off.
+func WithChangelog(n int) Option {
+	return func(o *options) {
+		o.changes = max(n, 0)
+	}
+}
+
+// WithPanicRecovery makes operations recover from panics in the callbacks
+// they run while holding node locks or pins: the comparator, the Tracer,
+// the function passed to Update and the comparison of CompareAndDelete.
+// The operation releases its locks and pins, has no effect and returns a
+// *PanicError, which the Ctx variants pass on; Stats counts the panics.
+// Without it such a panic leaves a node locked or pinned for good, and
+// every later write that reaches it hangs.
+//
+// InsertBatch and Merge do let the panic through, as the keys they applied
+// before it cannot be taken back, but only once they have released their
+// node locks and rebalanced the tree. Operations that pause writers, such
+// as DeleteRange, Split and Snapshot, hold nothing but the tree's gate,
+// which they release on the way out, and let the panic through as well.
+// Callbacks run outside the tree, like the one Range calls, are not
+// covered.
+func WithPanicRecovery() Option {
+	return func(o *options) {
+		o.guard = true
+	}
+}
+
+// WithSizeOf has MemoryUsage count the heap memory keys and values point
+// to, such as the bytes of strings and slices, as sizeOf reports it for
+// each key. The memory held in the key and value themselves is counted
+// without it. Its key and value types must match the tree's.
+func WithSizeOf[K any, V any](sizeOf func(key K, value V) int) Option {
+	return func(o *options) {
+		o.sizeOf = sizeOf
+	}
+}
+
+// WithWriteLimiter makes every single-key insert, update and delete, the
+// sweeper's included, wait for l before it takes a token or a node lock.
+// Rate limiting the writes keeps a bulk load from filling the tree with
+// contended locks that foreground operations then retry on. A write that
+// l refuses fails with l's error, which the Ctx variants return. Reads
+// and batch operations are not limited.
+func WithWriteLimiter(l Limiter) Option {
+	return func(o *options) {
+		o.limiter = l
+	}
+}
+
+// WithDebugHistory captures the shape of the tree, its keys and colors,
+// every so many committed mutations and keeps the last depth captures in
+// a ring, for DumpHistory. When a traversal or Verify finds the tree
+// broken, the history is written to w, unless w is nil, so the states
+// leading to the violation can be replayed.
+//
+// It is meant for debugging the write protocol. A capture pauses the
+// writers and copies every key, and the mutations count
+// every store and delete, those of batch operations included. A capture
+// that falls due while writers are paused whole, as in DeleteRange or
+// Split, is taken once the next single-key write finishes. every or depth
+// <= 0 turns it off.
+func WithDebugHistory(every, depth int, w io.Writer) Option {
+	return func(o *options) {
+		o.history, o.historyDepth, o.historyOut = 0, 0, nil
+		if every > 0 && depth > 0 {
+			o.history, o.historyDepth, o.historyOut = every, depth, w
+		}
+	}
+}
+
+// WithHintCache lets Get remember the nodes it found recent keys in, a
+// few per processor, so that repeated Gets of the same hot keys go to the
+// node directly instead of descending from the root. A hint is checked
+// against a generation every delete and every whole-tree operation bumps,
+// and a Get whose hint is void or whose node is locked descends as usual.
+// Stats reports the hit rate of the sampled Gets and the comparisons they
+// made.
+//
+// A hit costs a key comparison per hint probed, a miss the probes on top
+// of the descent, and deletes bump a counter shared by the whole tree.
+// Gets answered from a hint report no level to the Tracer. Other lookups
+// do not use the hints.
+func WithHintCache() Option {
+	return func(o *options) {
+		o.hints = true
+	}
+}
+
+// WithSingleProcFallback turns the fallback for a single processor on or
+// off; it is on by default. A tree built while GOMAXPROCS is 1 then
+// serializes its writes as WithSerializedWrites does, and its retries
+// yield the processor instead of sleeping as Backoff says. With one
+// processor concurrent writers gain no parallelism, and a writer that
+// finds a node locked can only wait for the goroutine holding it to be
+// scheduled again, which sleeping delays. Readers stay concurrent.
+//
+// GOMAXPROCS is read when the tree is built, so a tree built before it
+// is raised keeps the fallback. Backoff still reports the configured
+// policy, whose MaxRetries and context checks keep applying.
+func WithSingleProcFallback(on bool) Option {
+	return func(o *options) {
+		o.single = on
+	}
+}
+
+// WithMaxKeySize refuses keys larger than max bytes. Single-key writes
+// return ErrKeyTooLarge for them, as do NewFromSorted, the imports and
+// the decoders, while Insert, InsertBatch and Merge, which return no
+// error, drop them; Stats counts every refusal. A string or byte slice
+// key is as large as its length, any other key as large as its type
+// unless WithKeySize measures it. Zero or less allows any size.
+//
+// Large keys cost memory in every node and time in every comparison on
+// the way to them, and Stats.KeySizes shows whether they are coming in.
+func WithMaxKeySize(max int) Option {
+	return func(o *options) {
+		o.maxKey = max
+	}
+}
+
+// WithKeySize measures keys with size for WithMaxKeySize and
+// Stats.KeySizes. Its key type must match the tree's.
+func WithKeySize[K any](size func(key K) int) Option {
+	return func(o *options) {
+		o.keySize = size
+	}
+}
+
+// WithProgress has the bulk operations report their progress to f: the
+// bulk loads of NewFromSorted, ImportJSONL and ImportCSV, and InsertBatch,
+// Merge and DeleteRange with their Ctx variants. These then work in chunks
+// of about a thousand keys and call f after each with the number of keys
+// handled so far and the number the operation handles in all, ending with
+// done equal to total.
+//
+// f runs on the goroutine of the operation, between the chunks and with
+// nothing locked, so it may take its time and even use the tree. The total
+// of DeleteRange is counted when it starts; should concurrent inserts add
+// keys to the range, it grows as the count passes it. An operation with
+// nothing to do does not call f. Chunks make the writes of a batch visible
+// piece by piece rather than in one pass, as they are without f.
+func WithProgress(f func(done, total int)) Option {
+	return func(o *options) {
+		o.progress = f
+	}
+}
+
+// WithSkipNoopWrites has writes that would store the value a key already
+// holds, as equal tells, leave the tree alone: they log no change event,
+// so the Generation does not move either, and Insert takes no lock at all.
+// Insert first looks the key up as Get does and returns at once if it
+// holds an equal value and no deadline; an insert or update that finds an
+// equal value once it holds the key's node skips the store. Writes that
+// set a new deadline, as InsertWithTTL does, are never skipped. Stats
+// counts the skipped writes.
+//
+// This suits pipelines of idempotent upserts, which mostly rewrite what is
+// already there. equal must be quick and must not use the tree.
+func WithSkipNoopWrites[V any](equal func(a, b V) bool) Option {
+	return func(o *options) {
+		o.noop = equal
+	}
+}
+
+// WithConformanceSampling checks one in every every single-key writes
+// against the model of the locking protocol: that it walks down with lock
+// coupling, locks its areas as a whole, marks ancestors only while it holds
+// an area, and backs off and starts over holding nothing. A write that
+// strays from it is counted in Stats and, the first time, reported to the
+// WithDebugHistory writer; report, if not nil, is called with an error
+// wrapping ErrProtocolViolation that lists the write's latest steps. It
+// runs on the writer's goroutine once the write has returned its locks.
+//
+// A sampled write costs a small allocation per change of its locked set.
+// Batch operations are not sampled. every <= 0 turns the checks off.
+func WithConformanceSampling(every int, report func(err error)) Option {
+	return func(o *options) {
+		o.conform = uint32(max(every, 0))
+		o.onViolation = report
+	}
+}
@@ -0,0 +1,130 @@
+package rbtree
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{Base: time.Microsecond, Max: 8 * time.Microsecond}
+	assert.Equal(t, time.Microsecond, b.delay(0))
+	assert.Equal(t, 2*time.Microsecond, b.delay(1))
+	assert.Equal(t, 8*time.Microsecond, b.delay(3))
+	assert.Equal(t, 8*time.Microsecond, b.delay(60))
+
+	b.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := b.delay(3)
+		assert.GreaterOrEqual(t, d, 4*time.Microsecond)
+		assert.Less(t, d, 12*time.Microsecond)
+	}
+}
+
+func TestBackoffMaxRetries(t *testing.T) {
+	tree := NewRBTree(1, 1, WithBackoff(Backoff{Base: time.Microsecond, MaxRetries: 3}))
+	tree.root.Load().flag.Store(true)
+
+	_, err := tree.GetCtx(context.Background(), 1)
+	assert.ErrorIs(t, err, ErrRetriesExhausted)
+	assert.ErrorIs(t, tree.InsertCtx(context.Background(), 2, 2), ErrRetriesExhausted)
+
+	tree.root.Load().flag.Store(false)
+	v, err := tree.GetCtx(context.Background(), 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, *v)
+}
+
+func TestSingleProcFallback(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	tree := New[int, int]()
+	assert.True(t, tree.serial)
+	assert.True(t, tree.yield)
+	assert.Equal(t, DefaultBackoff, tree.Backoff())
+	tree = New[int, int](WithSingleProcFallback(false))
+	assert.False(t, tree.serial)
+	assert.False(t, tree.yield)
+	runtime.GOMAXPROCS(2)
+	assert.False(t, New[int, int]().yield)
+	assert.True(t, New[int, int](WithSerializedWrites()).serial)
+	runtime.GOMAXPROCS(1)
+
+	// yielding retries still give up as the policy says
+	tree = NewRBTree(1, 1, WithBackoff(Backoff{Base: time.Hour, MaxRetries: 3}))
+	tree.root.Load().flag.Store(true)
+	_, err := tree.GetCtx(context.Background(), 1)
+	assert.ErrorIs(t, err, ErrRetriesExhausted, "no hour-long sleeps")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, tree.InsertCtx(ctx, 2, 2), context.Canceled)
+	tree.root.Load().flag.Store(false)
+
+	// writers take turns
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				tree.Insert(g*1000+i, i)
+				tree.Get(i)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 4000, tree.Len(), "key 1 was there")
+	assert.Nil(t, tree.Verify())
+}
+
+func TestContextCancel(t *testing.T) {
+	tree := NewRBTree(1, 1)
+	tree.Insert(2, 2)
+	tree.root.Load().flag.Store(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := tree.DeleteCtx(ctx, 2)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	tree.root.Load().flag.Store(false)
+	v, err := tree.DeleteCtx(context.Background(), 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, *v)
+	assert.Nil(t, tree.Get(2))
+}
+
+// countingLimiter admits the first n writes and refuses the others.
+type countingLimiter struct {
+	n, waits int
+}
+
+func (l *countingLimiter) Wait(ctx context.Context) error {
+	l.waits++
+	if l.waits > l.n {
+		return ErrRetriesExhausted
+	}
+	return ctx.Err()
+}
+
+func TestWriteLimiter(t *testing.T) {
+	l := &countingLimiter{n: 3}
+	tree := New[int, int](WithWriteLimiter(l))
+	tree.Insert(1, 1)
+	tree.Update(2, func(int, bool) (int, bool) { return 2, true })
+	assert.NotNil(t, tree.Get(1), "reads are not limited")
+	assert.Equal(t, 1, *tree.Delete(1))
+	assert.Equal(t, 3, l.waits)
+
+	assert.ErrorIs(t, tree.InsertCtx(context.Background(), 3, 3), ErrRetriesExhausted)
+	_, err := tree.DeleteCtx(context.Background(), 2)
+	assert.ErrorIs(t, err, ErrRetriesExhausted)
+	assert.Equal(t, 1, tree.Len())
+
+	tree.InsertBatch([]KV[int, int]{{Key: 4, Value: 4}})
+	assert.Equal(t, 5, l.waits, "batches are not limited")
+	assert.Equal(t, 2, tree.Len())
+}
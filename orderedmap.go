@@ -0,0 +1,138 @@
+package rbtree
+
+import (
+	"cmp"
+	"context"
+	"sync/atomic"
+)
+
+// OrderedMap is a typed drop-in for sync.Map that keeps its keys ordered.
+// It has sync.Map's methods and semantics, with K and V in place of any,
+// so a sync.Map becomes an OrderedMap by changing its declaration. Range
+// visits keys in ascending order.
+//
+// The zero OrderedMap is empty and ready for use, with the default
+// options. Use NewOrderedMap to pass options. An OrderedMap must not be
+// copied after first use.
+type OrderedMap[K cmp.Ordered, V any] struct {
+	t atomic.Pointer[RBTree[K, V]]
+}
+
+// NewOrderedMap returns an empty OrderedMap backed by a tree built with
+// opts.
+func NewOrderedMap[K cmp.Ordered, V any](opts ...Option) *OrderedMap[K, V] {
+	m := &OrderedMap[K, V]{}
+	m.t.Store(New[K, V](opts...))
+	return m
+}
+
+func (m *OrderedMap[K, V]) tree() *RBTree[K, V] {
+	if t := m.t.Load(); t != nil {
+		return t
+	}
+	m.t.CompareAndSwap(nil, New[K, V]())
+	return m.t.Load()
+}
+
+// Tree returns the tree backing m. Changes through either are seen by both.
+func (m *OrderedMap[K, V]) Tree() *RBTree[K, V] {
+	return m.tree()
+}
+
+// lookup copies the value stored for key while its node is pinned, so that
+// the copy does not race with an insert overwriting it.
+func (t *RBTree[K, V]) lookup(key K) (value V, ok bool) {
+	now := t.now()
+	err := t.retry(context.Background(), func() error {
+		_, err := t.descend(OpGet, func(n *RBTreeNode[K, V]) *RBTreeNode[K, V] {
+			c := t.compare(key, n.key)
+			if c == 0 {
+				if !t.expired(n, now) {
+					value, ok = *n.valuePtr(), true
+				}
+				return nil
+			}
+			if c < 0 {
+				return n.left.Load()
+			}
+			return n.right.Load()
+		})
+		return err
+	})
+	if err == ErrCorrupted {
+		t.markCorrupted()
+	}
+	return value, ok
+}
+
+// Load returns the value stored for key. ok reports whether key is
+// present.
+func (m *OrderedMap[K, V]) Load(key K) (value V, ok bool) {
+	return m.tree().lookup(key)
+}
+
+// Store sets the value for key.
+func (m *OrderedMap[K, V]) Store(key K, value V) {
+	m.tree().Insert(key, value)
+}
+
+// LoadOrStore returns the existing value for key if present. Otherwise it
+// stores and returns value. loaded is true if the value was loaded.
+func (m *OrderedMap[K, V]) LoadOrStore(key K, value V) (actual V, loaded bool) {
+	return m.tree().GetOrInsert(key, value)
+}
+
+// LoadAndDelete deletes the value for key, returning the previous value if
+// any. loaded reports whether key was present.
+func (m *OrderedMap[K, V]) LoadAndDelete(key K) (value V, loaded bool) {
+	if v := m.tree().Delete(key); v != nil {
+		return *v, true
+	}
+	return value, false
+}
+
+// Delete deletes the value for key.
+func (m *OrderedMap[K, V]) Delete(key K) {
+	m.tree().Delete(key)
+}
+
+// Swap stores value for key and returns the previous value if any. loaded
+// reports whether key was present.
+func (m *OrderedMap[K, V]) Swap(key K, value V) (previous V, loaded bool) {
+	previous, loaded, _ = m.tree().update(context.Background(), key, func(V, bool) (V, bool) {
+		return value, true
+	}, 0)
+	return previous, loaded
+}
+
+// CompareAndSwap stores new for key if the value stored is equal to old,
+// and reports whether it did. Like sync.Map it panics if V is not
+// comparable.
+func (m *OrderedMap[K, V]) CompareAndSwap(key K, old, new V) (swapped bool) {
+	if m.tree().comparable(old) != nil {
+		return false
+	}
+	_, _, _ = m.tree().update(context.Background(), key, func(cur V, ok bool) (V, bool) {
+		swapped = ok && any(cur) == any(old)
+		return new, swapped
+	}, keepDeadline)
+	return swapped
+}
+
+// CompareAndDelete deletes key if its value is equal to old and reports
+// whether it did, see RBTree.CompareAndDelete.
+func (m *OrderedMap[K, V]) CompareAndDelete(key K, old V) (deleted bool) {
+	return m.tree().CompareAndDelete(key, old)
+}
+
+// Range calls f for each key and value in ascending key order until f
+// returns false. Like sync.Map's it is no consistent snapshot: a key that
+// is stored or deleted concurrently may or may not be visited.
+func (m *OrderedMap[K, V]) Range(f func(key K, value V) bool) {
+	m.tree().Range(f)
+}
+
+// Clear deletes all the keys.
+func (m *OrderedMap[K, V]) Clear() {
+	m.tree().install(nil, 0)
+}
@@ -0,0 +1,171 @@
+package rbtree_test
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iku50/rbtree-go"
+)
+
+func TestOrderedMap(t *testing.T) {
+	var m rbtree.OrderedMap[int, string]
+	m.Store(3, "three")
+	m.Store(1, "one")
+
+	v, ok := m.Load(3)
+	assert.True(t, ok)
+	assert.Equal(t, "three", v)
+	_, ok = m.Load(2)
+	assert.False(t, ok)
+
+	actual, loaded := m.LoadOrStore(1, "uno")
+	assert.True(t, loaded)
+	assert.Equal(t, "one", actual)
+	actual, loaded = m.LoadOrStore(2, "two")
+	assert.False(t, loaded)
+	assert.Equal(t, "two", actual)
+
+	previous, loaded := m.Swap(2, "dos")
+	assert.True(t, loaded)
+	assert.Equal(t, "two", previous)
+	_, loaded = m.Swap(4, "four")
+	assert.False(t, loaded)
+
+	assert.False(t, m.CompareAndSwap(4, "cuatro", "4"))
+	assert.True(t, m.CompareAndSwap(4, "four", "cuatro"))
+	assert.False(t, m.CompareAndSwap(5, "", "five"))
+	_, ok = m.Load(5)
+	assert.False(t, ok)
+	assert.False(t, m.CompareAndDelete(4, "four"))
+	assert.True(t, m.CompareAndDelete(4, "cuatro"))
+
+	v, loaded = m.LoadAndDelete(2)
+	assert.True(t, loaded)
+	assert.Equal(t, "dos", v)
+	_, loaded = m.LoadAndDelete(2)
+	assert.False(t, loaded)
+	m.Delete(3)
+
+	m.Store(0, "zero")
+	var keys []int
+	m.Range(func(key int, value string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	assert.Equal(t, []int{0, 1}, keys)
+	assert.Equal(t, 2, m.Tree().Len())
+
+	m.Clear()
+	assert.Equal(t, 0, m.Tree().Len())
+	m.Store(7, "seven")
+	assert.Nil(t, m.Tree().Check())
+}
+
+func TestOrderedMapCompareAndSwapPanics(t *testing.T) {
+	m := rbtree.NewOrderedMap[int, any](rbtree.WithBackoff(rbtree.Backoff{MaxRetries: 3}))
+	m.Store(1, []int{1})
+	assert.Panics(t, func() { m.CompareAndSwap(1, []int{1}, []int{2}) }, "like sync.Map")
+	assert.NoError(t, m.Tree().InsertCtx(context.Background(), 1, 2), "the node was not left locked")
+	assert.True(t, m.CompareAndSwap(1, 2, 3))
+}
+
+func TestOrderedMapConcurrent(t *testing.T) {
+	m := rbtree.NewOrderedMap[int, int]()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				k := i % 50
+				for {
+					old, _ := m.LoadOrStore(k, 0)
+					if m.CompareAndSwap(k, old, old+1) {
+						break
+					}
+				}
+				if v, ok := m.Load(k); ok {
+					assert.Greater(t, v, 0)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	m.Range(func(key, value int) bool {
+		assert.Equal(t, 8*20, value, "key %d", key)
+		return true
+	})
+}
+
+// orderedMapKeys is the key space of the map benchmarks, prefilled to half.
+const orderedMapKeys = 1 << 16
+
+type benchMap interface {
+	Load(key int) (int, bool)
+	Store(key, value int)
+	Delete(key int)
+}
+
+// syncMap adapts sync.Map to benchMap.
+type syncMap struct{ m sync.Map }
+
+func (s *syncMap) Load(key int) (int, bool) {
+	v, ok := s.m.Load(key)
+	if !ok {
+		return 0, false
+	}
+	return v.(int), true
+}
+
+func (s *syncMap) Store(key, value int) { s.m.Store(key, value) }
+func (s *syncMap) Delete(key int)       { s.m.Delete(key) }
+
+// benchmarkMap runs a parallel mix of operations on m: of every 100,
+// writes store or delete a key and the rest load one.
+func benchmarkMap(b *testing.B, m benchMap, writes int) {
+	for k := 0; k < orderedMapKeys; k += 2 {
+		m.Store(k, k)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			k := rand.IntN(orderedMapKeys)
+			switch op := rand.IntN(100); {
+			case op >= writes:
+				m.Load(k)
+			case op%2 == 0:
+				m.Store(k, k)
+			default:
+				m.Delete(k)
+			}
+		}
+	})
+}
+
+func BenchmarkOrderedMapLoadParallel(b *testing.B) {
+	benchmarkMap(b, rbtree.NewOrderedMap[int, int](), 0)
+}
+
+func BenchmarkSyncMapLoadParallel(b *testing.B) {
+	benchmarkMap(b, &syncMap{}, 0)
+}
+
+func BenchmarkOrderedMapMixedParallel(b *testing.B) {
+	benchmarkMap(b, rbtree.NewOrderedMap[int, int](), 10)
+}
+
+func BenchmarkSyncMapMixedParallel(b *testing.B) {
+	benchmarkMap(b, &syncMap{}, 10)
+}
+
+func BenchmarkOrderedMapStoreParallel(b *testing.B) {
+	benchmarkMap(b, rbtree.NewOrderedMap[int, int](), 100)
+}
+
+func BenchmarkSyncMapStoreParallel(b *testing.B) {
+	benchmarkMap(b, &syncMap{}, 100)
+}
@@ -0,0 +1,60 @@
+package rbtree
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+)
+
+// ErrCallbackPanic is wrapped by the *PanicError a tree built
+// WithPanicRecovery returns when a user callback panics.
+var ErrCallbackPanic = errors.New("callback panicked")
+
+// PanicError reports a panic in a comparator, a Tracer or an update or
+// match function that ran inside an operation. The operation released
+// what it held and had no effect.
+type PanicError struct {
+	Value any    // what the callback panicked with
+	Stack []byte // the stack of the panicking goroutine
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("rbtree: callback panicked: %v", e.Value)
+}
+
+func (e *PanicError) Unwrap() error {
+	return ErrCallbackPanic
+}
+
+// recovered turns r, recovered from a callback's panic, into a *PanicError.
+func (t *RBTree[K, V]) recovered(r any) error {
+	t.stats.panics.Add(1)
+	return &PanicError{Value: r, Stack: debug.Stack()}
+}
+
+// guardUpdate wraps fn so that a panic in it stores nothing and leaves a
+// *PanicError in err.
+func (t *RBTree[K, V]) guardUpdate(fn updateFunc[V], err *error) updateFunc[V] {
+	return func(old V, ok bool) (value V, store bool) {
+		defer func() {
+			if r := recover(); r != nil {
+				var zero V
+				value, store, *err = zero, false, t.recovered(r)
+			}
+		}()
+		return fn(old, ok)
+	}
+}
+
+// guardMatch wraps match so that a panic in it rejects the value and
+// leaves a *PanicError in err.
+func (t *RBTree[K, V]) guardMatch(match func(V) bool, err *error) func(V) bool {
+	return func(v V) (ok bool) {
+		defer func() {
+			if r := recover(); r != nil {
+				ok, *err = false, t.recovered(r)
+			}
+		}()
+		return match(v)
+	}
+}
@@ -0,0 +1,113 @@
+package rbtree_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iku50/rbtree-go"
+)
+
+func TestPanicRecovery(t *testing.T) {
+	ctx := context.Background()
+	bad := -1
+	tree := rbtree.NewRBTreeFunc[int, int](func(a, b int) int {
+		if a == bad || b == bad {
+			panic("bad key")
+		}
+		return a - b
+	}, rbtree.WithPanicRecovery())
+	for k := 0; k < 100; k++ {
+		tree.Insert(k, k)
+	}
+
+	// a comparator panicking under a write's node lock and a read's pin
+	err := tree.InsertCtx(ctx, bad, 0)
+	var pe *rbtree.PanicError
+	if assert.ErrorAs(t, err, &pe) {
+		assert.Equal(t, "bad key", pe.Value)
+		assert.NotEmpty(t, pe.Stack)
+	}
+	assert.ErrorIs(t, err, rbtree.ErrCallbackPanic)
+	_, err = tree.GetCtx(ctx, bad)
+	assert.ErrorIs(t, err, rbtree.ErrCallbackPanic)
+	_, err = tree.DeleteCtx(ctx, bad)
+	assert.ErrorIs(t, err, rbtree.ErrCallbackPanic)
+
+	// an update function panicking stores nothing
+	_, _, err = tree.UpdateCtx(ctx, 5, func(old int, ok bool) (int, bool) { panic("update") })
+	assert.ErrorIs(t, err, rbtree.ErrCallbackPanic)
+	_, _, err = tree.UpdateCtx(ctx, 500, func(old int, ok bool) (int, bool) { panic("update") })
+	assert.ErrorIs(t, err, rbtree.ErrCallbackPanic)
+	assert.Equal(t, 5, *tree.Get(5))
+	assert.Nil(t, tree.Get(500))
+
+	// every node was released
+	assert.Nil(t, tree.Verify())
+	for k := 0; k < 100; k++ {
+		assert.Equal(t, k, *tree.Delete(k))
+	}
+	assert.Equal(t, 0, tree.Len())
+	assert.Equal(t, uint64(5), tree.Stats().Panics)
+}
+
+func TestPanicRecoveryBatch(t *testing.T) {
+	armed := false
+	tree := rbtree.NewRBTreeFunc[int, int](func(a, b int) int {
+		if armed && (a == 13 || b == 13) {
+			panic("13")
+		}
+		return a - b
+	}, rbtree.WithPanicRecovery(), rbtree.WithOrderStatistics(), rbtree.WithBackoff(rbtree.Backoff{MaxRetries: 3}))
+	for k := 0; k < 4000; k += 2 {
+		tree.Insert(k, k)
+	}
+	// batches this small go down the tree rather than merge with it
+	armed = true
+	assert.Panics(t, func() { tree.InsertBatch([]rbtree.KV[int, int]{{Key: 13, Value: 13}}) })
+	assert.Panics(t, func() {
+		tree.InsertBatch([]rbtree.KV[int, int]{{Key: 1, Value: 1}, {Key: 13, Value: 13}, {Key: 14, Value: 14}, {Key: 2001, Value: 2001}, {Key: 3001, Value: 3001}})
+	})
+	armed = false
+
+	// the batch left no node locked, and the tree is whole
+	assert.NoError(t, tree.InsertCtx(context.Background(), 13, 13))
+	assert.Nil(t, tree.Verify())
+	n := 0
+	tree.Range(func(int, int) bool { n++; return true })
+	assert.Equal(t, n, tree.Len())
+	assert.Equal(t, n, tree.Rank(5000))
+}
+
+func TestPanicRecoveryCallbacks(t *testing.T) {
+	ctx := context.Background()
+	armed := false
+	tree := rbtree.New[int, any](rbtree.WithPanicRecovery(), rbtree.WithTracer(func(op rbtree.Op, level int) {
+		if armed && level > 0 {
+			panic(errors.New("tracer"))
+		}
+	}))
+	for k := 0; k < 10; k++ {
+		tree.Insert(k, k)
+	}
+	armed = true
+	_, err := tree.GetCtx(ctx, 0)
+	assert.ErrorIs(t, err, rbtree.ErrCallbackPanic)
+	assert.ErrorIs(t, tree.InsertCtx(ctx, 0, 0), rbtree.ErrCallbackPanic)
+	armed = false
+
+	// CompareAndDelete panics on values that are not comparable
+	tree.Insert(3, []int{3})
+	deleted, err := tree.CompareAndDeleteCtx(ctx, 3, []int{3})
+	assert.False(t, deleted)
+	assert.ErrorIs(t, err, rbtree.ErrCallbackPanic)
+	assert.NotNil(t, tree.Get(3))
+	assert.Nil(t, tree.Verify())
+
+	// without recovery the panic goes through
+	plain := rbtree.New[int, any]()
+	plain.Insert(1, []int{1})
+	assert.Panics(t, func() { plain.CompareAndDelete(1, []int{1}) })
+}
@@ -0,0 +1,100 @@
+package rbtree
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// nodePool recycles the nodes deletes unlink, see WithNodePool.
+//
+// A node may only be reused once no operation can still reach it, which
+// an epoch scheme decides. Lookups and writes announce themselves in one
+// of three buckets, the one of the epoch they started in, and unlinked
+// nodes wait in the bucket of the epoch they were retired in. The epoch
+// moves from e to e+1 once nothing is left in the bucket of e-1, so when
+// it reaches e+2 every operation that started before a node retired in e
+// was unlinked has finished. The node is reused when its bucket comes
+// round again.
+type nodePool[K any, V any] struct {
+	free   sync.Pool
+	epoch  atomic.Uint64
+	active [3]atomic.Int64
+
+	mu      sync.Mutex // guards limbo
+	limbo   [3][]*RBTreeNode[K, V]
+	pending atomic.Int64 // nodes in limbo
+}
+
+// enter announces an operation and returns the bucket it must leave.
+func (p *nodePool[K, V]) enter() uint64 {
+	for {
+		e := p.epoch.Load()
+		p.active[e%3].Add(1)
+		// an epoch read just before the epoch moved on may name a bucket
+		// that is being drained or already reused
+		if p.epoch.Load() == e {
+			return e % 3
+		}
+		p.active[e%3].Add(-1)
+	}
+}
+
+func (p *nodePool[K, V]) exit(bucket uint64) {
+	p.active[bucket].Add(-1)
+}
+
+// retire queues n, which is unlinked, for reuse, and advances the epoch
+// if no operation is left in the previous one.
+func (p *nodePool[K, V]) retire(n *RBTreeNode[K, V]) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e := p.epoch.Load()
+	p.limbo[e%3] = append(p.limbo[e%3], n)
+	p.pending.Add(1)
+	if p.active[(e+2)%3].Load() != 0 {
+		return
+	}
+	p.epoch.Store(e + 1)
+	// the bucket of e+1 last held e-2, whose operations are all gone
+	old := p.limbo[(e+1)%3]
+	for i, n := range old {
+		*n = RBTreeNode[K, V]{}
+		p.free.Put(n)
+		old[i] = nil
+	}
+	p.pending.Add(-int64(len(old)))
+	p.limbo[(e+1)%3] = old[:0]
+}
+
+// get returns a recycled node, or nil if there is none.
+func (p *nodePool[K, V]) get() *RBTreeNode[K, V] {
+	n, _ := p.free.Get().(*RBTreeNode[K, V])
+	return n
+}
+
+// enter announces a lookup or write to the node pool, if there is one.
+// The result is passed to exit.
+func (t *RBTree[K, V]) enter() uint64 {
+	if t.pool == nil {
+		return 0
+	}
+	return t.pool.enter()
+}
+
+func (t *RBTree[K, V]) exit(bucket uint64) {
+	if t.pool != nil {
+		t.pool.exit(bucket)
+	}
+}
+
+// allocNode returns a zero node, recycled if the tree pools nodes.
+func (t *RBTree[K, V]) allocNode() *RBTreeNode[K, V] {
+	if t.pool != nil {
+		if n := t.pool.get(); n != nil {
+			t.stats.nodeReuses.Add(1)
+			return n
+		}
+	}
+	t.stats.nodeAllocs.Add(1)
+	return &RBTreeNode[K, V]{}
+}
@@ -0,0 +1,126 @@
+package rbtree
+
+import (
+	"math/rand/v2"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNodePoolReuse(t *testing.T) {
+	tree := New[int, int](WithNodePool())
+	for round := 0; round < 10; round++ {
+		for k := 0; k < 100; k++ {
+			tree.Insert(k, round)
+		}
+		for k := 0; k < 100; k += 2 {
+			assert.Equal(t, round, *tree.Delete(k))
+		}
+		assert.Nil(t, tree.Check())
+	}
+	s := tree.Stats()
+	assert.Greater(t, s.NodeReuses, uint64(0))
+	assert.Equal(t, uint64(100+9*50), s.NodeAllocs+s.NodeReuses)
+	assert.GreaterOrEqual(t, s.LiveNodes, tree.Len())
+	assert.LessOrEqual(t, s.LiveNodes, int(s.NodeAllocs))
+	for k := 1; k < 100; k += 2 {
+		assert.Equal(t, 9, *tree.Get(k))
+	}
+
+	plain := New[int, int]()
+	plain.Insert(1, 1)
+	plain.Delete(1)
+	plain.Insert(1, 1)
+	assert.Equal(t, Stats{NodeAllocs: 2, LiveNodes: 1}, plain.Stats())
+}
+
+func TestNodePoolWaitsForReaders(t *testing.T) {
+	tree := New[int, int](WithNodePool())
+	for k := 0; k < 100; k++ {
+		tree.Insert(k, k)
+	}
+	// an operation that started before the deletes may still reach the
+	// unlinked nodes, so none of them is reused while it runs
+	bucket := tree.enter()
+	for k := 0; k < 100; k++ {
+		tree.Delete(k)
+		tree.Insert(k, k)
+	}
+	assert.Equal(t, uint64(0), tree.Stats().NodeReuses)
+	tree.exit(bucket)
+
+	for k := 0; k < 100; k++ {
+		tree.Delete(k)
+		tree.Insert(k, k)
+	}
+	assert.Greater(t, tree.Stats().NodeReuses, uint64(0))
+	assert.Nil(t, tree.Check())
+}
+
+func TestNodePoolStableValuePointers(t *testing.T) {
+	tree := New[int, int](WithNodePool(), WithStableValuePointers())
+	tree.Insert(1, 1)
+	p := tree.Get(1)
+	tree.Delete(1)
+	for k := 2; k < 500; k++ {
+		tree.Insert(k, k)
+		tree.Delete(k - 1)
+	}
+	assert.Greater(t, tree.Stats().NodeReuses, uint64(0))
+	assert.Equal(t, 1, *p)
+}
+
+func TestNodePoolConcurrent(t *testing.T) {
+	tree := New[int, int](WithNodePool())
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				k := (i*11 + g) % 200
+				switch i % 4 {
+				case 0:
+					tree.Delete(k)
+				case 1:
+					if _, v, ok := tree.Select(k % 50); ok {
+						assert.GreaterOrEqual(t, v, 0)
+					}
+				default:
+					tree.Insert(k, k)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	assert.Nil(t, tree.Check())
+	tree.Range(func(key, value int) bool {
+		assert.Equal(t, key, value)
+		return true
+	})
+}
+
+func benchmarkChurnParallel(b *testing.B, opts ...Option) {
+	tree := New[int, int](opts...)
+	for i := 0; i < 1<<16; i++ {
+		tree.Insert(rand.IntN(1<<17), i)
+	}
+	start := tree.Stats()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			k := rand.IntN(1 << 17)
+			if tree.Delete(k) == nil {
+				tree.Insert(k, k)
+			}
+		}
+	})
+	b.StopTimer()
+	s := tree.Stats()
+	b.ReportMetric(float64(s.NodeAllocs-start.NodeAllocs)/float64(b.N), "nodes/op")
+	b.ReportMetric(float64(s.NodeReuses)/float64(b.N), "reused/op")
+}
+
+func BenchmarkChurnParallel(b *testing.B)         { benchmarkChurnParallel(b) }
+func BenchmarkChurnParallelNodePool(b *testing.B) { benchmarkChurnParallel(b, WithNodePool()) }
@@ -0,0 +1,83 @@
+package rbtree
+
+import (
+	"context"
+	"runtime/pprof"
+	"strconv"
+)
+
+// Op identifies a kind of tree operation in traces and profiles.
+type Op int
+
+const (
+	OpGet Op = iota + 1
+	OpSeek
+	OpInsert
+	OpDelete
+)
+
+func (o Op) String() string {
+	switch o {
+	case OpGet:
+		return "get"
+	case OpSeek:
+		return "seek"
+	case OpInsert:
+		return "insert"
+	case OpDelete:
+		return "delete"
+	default:
+		return "unknown"
+	}
+}
+
+// Tracer is invoked with the level (0 for the root) of every node an
+// operation examines. Retried operations report their levels again.
+type Tracer func(op Op, level int)
+
+const (
+	// LabelOp and LabelLevel are the pprof label keys set by
+	// WithProfileLabels.
+	LabelOp    = "rbtree_op"
+	LabelLevel = "rbtree_level"
+
+	// maxLabeledLevel is the deepest level with its own label, deeper
+	// levels share it.
+	maxLabeledLevel = 63
+)
+
+// profiler holds one prebuilt label context per operation and level, so
+// that switching labels on every visited node is a pointer store.
+type profiler struct {
+	labels [OpDelete + 1][maxLabeledLevel + 1]context.Context
+}
+
+func newProfiler() *profiler {
+	p := &profiler{}
+	for op := OpGet; op <= OpDelete; op++ {
+		for level := range p.labels[op] {
+			p.labels[op][level] = pprof.WithLabels(context.Background(),
+				pprof.Labels(LabelOp, op.String(), LabelLevel, strconv.Itoa(level)))
+		}
+	}
+	return p
+}
+
+func (p *profiler) enter(op Op, level int) {
+	pprof.SetGoroutineLabels(p.labels[op][min(level, maxLabeledLevel)])
+}
+
+// restore puts back the labels carried by ctx once an operation finishes.
+// Labels set on the goroutine without going through ctx are not restored.
+func (p *profiler) restore(ctx context.Context) {
+	pprof.SetGoroutineLabels(ctx)
+}
+
+func (t *RBTree[K, V]) visit(op Op, level int) {
+	if t.tracer != nil {
+		t.tracer(op, level)
+	}
+	if t.prof != nil {
+		t.prof.enter(op, level)
+	}
+}
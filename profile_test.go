@@ -0,0 +1,33 @@
+package rbtree_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iku50/rbtree-go"
+)
+
+func TestTracer(t *testing.T) {
+	levels := make(map[rbtree.Op][]int)
+	tree := rbtree.New[int, int](rbtree.WithTracer(func(op rbtree.Op, level int) {
+		levels[op] = append(levels[op], level)
+	}), rbtree.WithProfileLabels())
+	for i := 0; i < 16; i++ {
+		tree.Insert(i, i)
+	}
+	levels = make(map[rbtree.Op][]int)
+
+	tree.Get(15)
+	tree.Floor(7)
+	tree.Delete(3)
+
+	for _, op := range []rbtree.Op{rbtree.OpGet, rbtree.OpSeek, rbtree.OpDelete} {
+		if assert.NotEmpty(t, levels[op], op.String()) {
+			for i, level := range levels[op] {
+				assert.Equal(t, i, level, op.String())
+			}
+		}
+	}
+	assert.Equal(t, "insert", rbtree.OpInsert.String())
+}
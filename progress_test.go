@@ -0,0 +1,85 @@
+package rbtree_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iku50/rbtree-go"
+)
+
+// progressLog records the calls of a WithProgress callback.
+type progressLog struct {
+	calls [][2]int
+}
+
+func (p *progressLog) report(done, total int) {
+	p.calls = append(p.calls, [2]int{done, total})
+}
+
+func (p *progressLog) take() [][2]int {
+	calls := p.calls
+	p.calls = nil
+	return calls
+}
+
+func TestProgress(t *testing.T) {
+	p := &progressLog{}
+	keys, values := make([]int, 2500), make([]int, 2500)
+	for i := range keys {
+		keys[i], values[i] = i, i
+	}
+	tree, err := rbtree.NewFromSorted(keys, values, rbtree.WithProgress(p.report))
+	assert.Nil(t, err)
+	assert.Equal(t, [][2]int{{1024, 2500}, {2048, 2500}, {2500, 2500}}, p.take())
+
+	var pairs []rbtree.KV[int, int]
+	for i := 2500; i < 4600; i++ {
+		pairs = append(pairs, rbtree.KV[int, int]{Key: i, Value: i})
+	}
+	tree.InsertBatch(pairs)
+	assert.Equal(t, [][2]int{{1024, 2100}, {2048, 2100}, {2100, 2100}}, p.take())
+	assert.Equal(t, 4600, tree.Len())
+	assert.Nil(t, tree.Check())
+
+	other := rbtree.New[int, int]()
+	for i := 0; i < 1500; i++ {
+		other.Insert(-i-1, i)
+	}
+	tree.Merge(other)
+	assert.Equal(t, [][2]int{{1024, 1500}, {1500, 1500}}, p.take())
+
+	assert.Equal(t, 3000, tree.DeleteRange(-1000, 2000))
+	assert.Equal(t, [][2]int{{1024, 3000}, {2048, 3000}, {3000, 3000}}, p.take())
+	assert.Equal(t, 3100, tree.Len())
+	assert.Nil(t, tree.Check())
+
+	sum, err := tree.DeleteRangeCtx(context.Background(), 4000, 4100)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, sum.Applied)
+	assert.Equal(t, [][2]int{{100, 100}}, p.take())
+
+	// nothing to do, nothing reported
+	tree.InsertBatch(nil)
+	assert.Equal(t, 0, tree.DeleteRange(10000, 20000))
+	assert.Equal(t, 0, tree.DeleteRange(5, 5))
+	assert.Nil(t, p.take())
+}
+
+func TestProgressUsesTree(t *testing.T) {
+	// the callback runs with nothing locked, so it may read and write
+	var tree *rbtree.RBTree[int, int]
+	lens := []int{}
+	tree = rbtree.New[int, int](rbtree.WithProgress(func(done, total int) {
+		lens = append(lens, tree.Len())
+		tree.Insert(-done, 0)
+	}))
+	var pairs []rbtree.KV[int, int]
+	for i := 1; i <= 2048; i++ {
+		pairs = append(pairs, rbtree.KV[int, int]{Key: i, Value: i})
+	}
+	tree.InsertBatch(pairs)
+	assert.Equal(t, []int{1024, 2049}, lens)
+	assert.Equal(t, 2050, tree.Len())
+}
@@ -0,0 +1,217 @@
+//go:build !rbtree_core
+
+package rbtree
+
+import (
+	_ "embed"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// ProtobufSchema is the proto3 schema of the messages ProtobufCodec
+// writes, the content of rbtree.proto, for generating readers in other
+// languages.
+//
+//go:embed rbtree.proto
+var ProtobufSchema string
+
+// ProtobufCodec encodes snapshots as a Protocol Buffers Snapshot message,
+// see ProtobufSchema. Keys and values travel as bytes, converted by Fields
+// as the CSV format converts them; a nil Fields, or a nil function in it,
+// selects the CSV default.
+type ProtobufCodec[K any, V any] struct {
+	Fields *Codec[K, V]
+}
+
+// The wire types of the protobuf encoding.
+const (
+	pbVarint  = 0
+	pbFixed64 = 1
+	pbBytes   = 2
+	pbFixed32 = 5
+)
+
+// The field numbers of rbtree.proto.
+const (
+	pbSnapshotVersion = 1
+	pbSnapshotCount   = 2
+	pbSnapshotNodes   = 3
+
+	pbNodeKey   = 1
+	pbNodeValue = 2
+	pbNodeRed   = 3
+	pbNodeLeft  = 4
+	pbNodeRight = 5
+)
+
+func pbTag(b []byte, field, wire int) []byte {
+	return binary.AppendUvarint(b, uint64(field)<<3|uint64(wire))
+}
+
+func pbAppendBytes(b []byte, field int, data []byte) []byte {
+	b = pbTag(b, field, pbBytes)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// pbAppendBool appends a bool field, omitting it when false as proto3
+// does.
+func pbAppendBool(b []byte, field int, on bool) []byte {
+	if !on {
+		return b
+	}
+	return append(pbTag(b, field, pbVarint), 1)
+}
+
+// Encode writes nodes to w as a Snapshot message.
+func (c ProtobufCodec[K, V]) Encode(w io.Writer, nodes []SnapshotNode[K, V]) error {
+	codec := c.Fields.withDefaults(marshalText, unmarshalText)
+	b := pbTag(nil, pbSnapshotVersion, pbVarint)
+	b = binary.AppendUvarint(b, encodingVersion)
+	if len(nodes) > 0 {
+		b = pbTag(b, pbSnapshotCount, pbVarint)
+		b = binary.AppendUvarint(b, uint64(len(nodes)))
+	}
+	var node []byte
+	for _, n := range nodes {
+		key, err := codec.MarshalKey(n.Key)
+		if err != nil {
+			return err
+		}
+		value, err := codec.MarshalValue(n.Value)
+		if err != nil {
+			return err
+		}
+		node = node[:0]
+		if len(key) > 0 {
+			node = pbAppendBytes(node, pbNodeKey, key)
+		}
+		if len(value) > 0 {
+			node = pbAppendBytes(node, pbNodeValue, value)
+		}
+		node = pbAppendBool(node, pbNodeRed, n.Red)
+		node = pbAppendBool(node, pbNodeLeft, n.Left)
+		node = pbAppendBool(node, pbNodeRight, n.Right)
+		b = pbAppendBytes(b, pbSnapshotNodes, node)
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// Decode reads the Snapshot message written by Encode from r. Fields not
+// in the schema are skipped.
+func (c ProtobufCodec[K, V]) Decode(r io.Reader) ([]SnapshotNode[K, V], error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	codec := c.Fields.withDefaults(marshalText, unmarshalText)
+	var (
+		version, count uint64
+		nodes          []SnapshotNode[K, V]
+	)
+	err = pbFields(data, func(field, wire int, n uint64, b []byte) error {
+		switch {
+		case field == pbSnapshotVersion && wire == pbVarint:
+			version = n
+		case field == pbSnapshotCount && wire == pbVarint:
+			count = n
+		case field == pbSnapshotNodes && wire == pbBytes:
+			node, err := c.decodeNode(codec, b)
+			if err != nil {
+				return err
+			}
+			nodes = append(nodes, node)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if version != encodingVersion || count != uint64(len(nodes)) {
+		return nil, fmt.Errorf("%w: version %d, count %d", ErrBadEncoding, version, count)
+	}
+	return nodes, nil
+}
+
+func (ProtobufCodec[K, V]) decodeNode(codec Codec[K, V], data []byte) (SnapshotNode[K, V], error) {
+	var (
+		node       SnapshotNode[K, V]
+		key, value []byte
+	)
+	err := pbFields(data, func(field, wire int, n uint64, b []byte) error {
+		switch {
+		case field == pbNodeKey && wire == pbBytes:
+			key = b
+		case field == pbNodeValue && wire == pbBytes:
+			value = b
+		case field == pbNodeRed && wire == pbVarint:
+			node.Red = n != 0
+		case field == pbNodeLeft && wire == pbVarint:
+			node.Left = n != 0
+		case field == pbNodeRight && wire == pbVarint:
+			node.Right = n != 0
+		}
+		return nil
+	})
+	if err != nil {
+		return node, err
+	}
+	if node.Key, err = codec.UnmarshalKey(key); err != nil {
+		return node, err
+	}
+	node.Value, err = codec.UnmarshalValue(value)
+	return node, err
+}
+
+// pbFields calls f for each field of the message in data, with the value
+// of a varint or fixed-size field as n and the content of a
+// length-delimited one as b.
+func pbFields(data []byte, f func(field, wire int, n uint64, b []byte) error) error {
+	for len(data) > 0 {
+		tag, l := binary.Uvarint(data)
+		if l <= 0 {
+			return fmt.Errorf("%w: protobuf: bad tag", ErrBadEncoding)
+		}
+		data = data[l:]
+		field, wire := int(tag>>3), int(tag&7)
+		if field == 0 || tag>>3 > 1<<29-1 {
+			return fmt.Errorf("%w: protobuf: field number %d", ErrBadEncoding, tag>>3)
+		}
+		var (
+			n uint64
+			b []byte
+		)
+		switch wire {
+		case pbVarint:
+			n, l = binary.Uvarint(data)
+			if l <= 0 {
+				return fmt.Errorf("%w: protobuf: bad varint in field %d", ErrBadEncoding, field)
+			}
+			data = data[l:]
+		case pbFixed64:
+			if len(data) < 8 {
+				return fmt.Errorf("%w: protobuf: field %d truncated", ErrBadEncoding, field)
+			}
+			n, data = binary.LittleEndian.Uint64(data), data[8:]
+		case pbFixed32:
+			if len(data) < 4 {
+				return fmt.Errorf("%w: protobuf: field %d truncated", ErrBadEncoding, field)
+			}
+			n, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		case pbBytes:
+			size, l := binary.Uvarint(data)
+			if l <= 0 || size > uint64(len(data)-l) {
+				return fmt.Errorf("%w: protobuf: field %d truncated", ErrBadEncoding, field)
+			}
+			b, data = data[l:l+int(size)], data[l+int(size):]
+		default:
+			return fmt.Errorf("%w: protobuf: wire type %d in field %d", ErrBadEncoding, wire, field)
+		}
+		if err := f(field, wire, n, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
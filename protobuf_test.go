@@ -0,0 +1,100 @@
+//go:build !rbtree_core
+
+package rbtree_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iku50/rbtree-go"
+)
+
+func TestSnapshotCodecs(t *testing.T) {
+	for name, codec := range map[string]rbtree.SnapshotCodec[int, string]{
+		"cbor":     rbtree.CBORCodec[int, string]{},
+		"protobuf": rbtree.ProtobufCodec[int, string]{},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tree := newSerializeTree()
+			var buf bytes.Buffer
+			assert.Nil(t, tree.Encode(&buf, codec))
+
+			got := rbtree.New[int, string]()
+			got.Insert(-1, "gone")
+			assert.Nil(t, got.Decode(bytes.NewReader(buf.Bytes()), codec))
+			assert.Nil(t, got.Check())
+			assert.Equal(t, tree.Snapshot().Tree().String(), got.String(), "the shape of the snapshot")
+
+			buf.Reset()
+			assert.Nil(t, rbtree.New[int, string]().Snapshot().Encode(&buf, codec))
+			assert.Nil(t, got.Decode(&buf, codec))
+			assert.Equal(t, 0, got.Len())
+
+			// a truncated encoding is refused and leaves the tree alone
+			buf.Reset()
+			assert.Nil(t, tree.Encode(&buf, codec))
+			assert.ErrorIs(t, got.Decode(bytes.NewReader(buf.Bytes()[:buf.Len()-3]), codec), rbtree.ErrBadEncoding)
+			assert.Equal(t, 0, got.Len())
+		})
+	}
+}
+
+func TestSnapshotCodecGolden(t *testing.T) {
+	// a snapshot of two keys has a black root and a red child
+	tree := rbtree.New[int, string]()
+	tree.Insert(1, "a")
+	tree.Insert(2, "b")
+	for _, c := range []struct {
+		codec rbtree.SnapshotCodec[int, string]
+		hex   string
+	}{
+		{rbtree.CBORCodec[int, string]{}, "a36776657273696f6e0165636f756e7402656e6f64657382a3636b6579026576616c75656162646c656674f5a3636b6579016576616c7565616163726564f5"},
+		{rbtree.ProtobufCodec[int, string]{}, "080110021a080a013212016220011a080a01311201611801"},
+	} {
+		var buf bytes.Buffer
+		assert.Nil(t, tree.Encode(&buf, c.codec))
+		assert.Equal(t, c.hex, hex.EncodeToString(buf.Bytes()))
+	}
+}
+
+func TestProtobufCodec(t *testing.T) {
+	codec := rbtree.ProtobufCodec[int, string]{Fields: &rbtree.Codec[int, string]{
+		MarshalValue:   func(v string) ([]byte, error) { return []byte(strings.ToUpper(v)), nil },
+		UnmarshalValue: func(data []byte) (string, error) { return strings.ToLower(string(data)), nil },
+	}}
+	tree := rbtree.New[int, string]()
+	for i := 0; i < 50; i++ {
+		tree.Insert(i, "v"+strconv.Itoa(i))
+	}
+	var buf bytes.Buffer
+	assert.Nil(t, tree.Encode(&buf, codec))
+	assert.Contains(t, buf.String(), "V49")
+	got := rbtree.New[int, string]()
+	assert.Nil(t, got.Decode(&buf, codec))
+	assert.Equal(t, tree.Snapshot().Tree().String(), got.String(), "the shape of the snapshot")
+
+	// fields not in the schema are skipped: a fixed64 field 9, a fixed32
+	// field 10 and a string field 11 in the node
+	data, _ := hex.DecodeString("4900000000000000005500000000080110011a0a0a01311201615a02787a")
+	assert.Nil(t, got.Decode(bytes.NewReader(data), rbtree.ProtobufCodec[int, string]{}))
+	assert.Equal(t, "a", *got.Get(1))
+
+	for _, h := range []string{
+		"0802",       // version 2
+		"0801100a",   // count 10, no nodes
+		"08011001",   // count 1, no nodes
+		"0801100113", // a group
+		"08011a09",   // truncated node
+		"080180",     // truncated tag
+		"0801100000", // field number 0
+	} {
+		data, _ := hex.DecodeString(h)
+		assert.ErrorIs(t, got.Decode(bytes.NewReader(data), rbtree.ProtobufCodec[int, string]{}), rbtree.ErrBadEncoding, h)
+	}
+	assert.Contains(t, rbtree.ProtobufSchema, "message Snapshot")
+}
@@ -0,0 +1,187 @@
+package rbtree
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+)
+
+// ErrProtocolViolation is reported WithConformanceSampling for a write
+// whose locking did not follow the protocol model.
+var ErrProtocolViolation = errors.New("locking protocol violated")
+
+// The protocol model is what a single-key write may hold at each point,
+// after [1] and [2]: it walks down with lock coupling, holding a node and
+// then also the child it locked next before it lets go of the node; it
+// locks each area as a whole and reserves ancestors with markers only
+// while it holds the area; it waits, and starts a new try, holding
+// nothing. As every wait starts from an empty hand, no write ever waits
+// for a node while another waits for one of its own, which is why the
+// tree cannot deadlock. protocol_test.go explores the interleavings of
+// the pin, lock and marker flags the model rests on.
+//
+// The model sees a write through the locked sets it publishes, see
+// opDesc.hold, and the steps below.
+
+// protoState is what a write holds, as far as the model tells apart.
+type protoState int
+
+const (
+	protoIdle    protoState = iota // nothing
+	protoDescend                   // the node a descent reached
+	protoCoupled                   // that node and the child locked next
+	protoArea                      // a locked area
+)
+
+func (s protoState) String() string {
+	switch s {
+	case protoIdle:
+		return "idle"
+	case protoDescend:
+		return "descend"
+	case protoCoupled:
+		return "coupled"
+	case protoArea:
+		return "area"
+	default:
+		return "unknown"
+	}
+}
+
+// protoStep is something a write does that the model checks.
+type protoStep int
+
+const (
+	stepAttempt protoStep = iota // a try at locating the key begins
+	stepHold                     // the write's locked set is now the nodes given
+	stepArea                     // an area of the nodes given was locked as a whole
+	stepMark                     // ancestors were marked for a delete fixup
+	stepWait                     // the write backs off before trying again
+	stepEnd                      // the write returns
+)
+
+func (s protoStep) String() string {
+	switch s {
+	case stepAttempt:
+		return "attempt"
+	case stepHold:
+		return "hold"
+	case stepArea:
+		return "area"
+	case stepMark:
+		return "mark"
+	case stepWait:
+		return "wait"
+	case stepEnd:
+		return "end"
+	default:
+		return "unknown"
+	}
+}
+
+// protoNext is the model's transition from s on step, with held the
+// number of nodes the step leaves the write holding. ok is false if the
+// model does not allow the step in s.
+func protoNext(s protoState, step protoStep, held int) (next protoState, ok bool) {
+	switch step {
+	case stepAttempt, stepWait, stepEnd:
+		return protoIdle, s == protoIdle
+	case stepMark:
+		return s, s == protoArea
+	case stepArea:
+		return protoArea, held > 0 && (s == protoIdle || s == protoDescend)
+	case stepHold:
+		switch held {
+		case 0:
+			return protoIdle, true
+		case 1:
+			return protoDescend, s != protoArea
+		case 2:
+			return protoCoupled, s == protoDescend
+		}
+	}
+	return s, false
+}
+
+// protoHistory is how many of its latest steps a trace keeps for the
+// report of a violation.
+const protoHistory = 16
+
+// protoTrace checks the steps of one sampled write against the model as
+// they happen. On top of the transitions it checks that a coupled pair
+// starts at the node held and that the descent moves on to its child, and
+// that an area includes the node a descent holds. Only the write's own
+// goroutine uses it.
+type protoTrace[K any] struct {
+	compare func(a, b K) int
+	state   protoState
+	held    []K
+	history []string
+	err     error
+}
+
+func (t *RBTree[K, V]) sampleConformance() *protoTrace[K] {
+	if t.conform == 0 || t.conform > 1 && rand.Uint32N(t.conform) != 0 {
+		return nil
+	}
+	return &protoTrace[K]{compare: t.compare}
+}
+
+// record checks step, which leaves the write holding keys. The first step
+// the model refuses is kept, the trace checks nothing after it.
+func (p *protoTrace[K]) record(step protoStep, keys []K) {
+	if p.err != nil {
+		return
+	}
+	if len(p.history) == protoHistory {
+		p.history = append(p.history[:0], p.history[1:]...)
+	}
+	p.history = append(p.history, fmt.Sprintf("%v%v", step, keys))
+	next, ok := protoNext(p.state, step, len(keys))
+	if ok {
+		ok = p.follows(step, keys)
+	}
+	if !ok {
+		p.err = fmt.Errorf("%w: %v%v while %v holding %v, after %s", ErrProtocolViolation,
+			step, keys, p.state, p.held, strings.Join(p.history, " "))
+		return
+	}
+	p.state = next
+	if step == stepHold || step == stepArea {
+		p.held = append(p.held[:0], keys...)
+	}
+}
+
+// follows checks that keys continue what the write held.
+func (p *protoTrace[K]) follows(step protoStep, keys []K) bool {
+	same := func(a, b K) bool { return p.compare(a, b) == 0 }
+	switch {
+	case step == stepArea && p.state == protoDescend:
+		for _, k := range keys {
+			if same(k, p.held[0]) {
+				return true
+			}
+		}
+		return false
+	case step != stepHold:
+		return true
+	case p.state == protoDescend && len(keys) > 0:
+		return same(keys[0], p.held[0])
+	case p.state == protoCoupled && len(keys) == 1:
+		return same(keys[0], p.held[1])
+	}
+	return true
+}
+
+// conformed reports the verdict on a sampled write that ended.
+func (t *RBTree[K, V]) conformed(p *protoTrace[K]) {
+	if p.record(stepEnd, nil); p.err == nil {
+		return
+	}
+	t.stats.violations.Add(1)
+	t.reportCorruption(p.err)
+	if t.onViolation != nil {
+		t.onViolation(p.err)
+	}
+}
@@ -0,0 +1,483 @@
+package rbtree
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The explorer below runs small programs of the tree's protocol on a path
+// of mNodes nodes, root first, in every interleaving of their memory
+// steps. Readers pin hand over hand, pin announcing before it checks the
+// flag; writers lock with a CAS and then check for readers, lock coupling
+// down the path or locking an area as a whole and marking the node above
+// it. Failed steps release everything and start over, up to mTries times.
+// Each reachable state is checked for exclusion, and every writer's steps
+// run through the same protoTrace the tree samples at run time.
+
+const (
+	mNodes = 4
+	mTries = 2
+)
+
+type mKind int8
+
+const (
+	mReader   mKind = iota + 1
+	mLocator        // locate: lock coupling from the root to the leaf
+	mAreaLow        // an area of the two lowest nodes, marking the one above
+	mAreaHigh       // an area of the two middle nodes, marking the root
+)
+
+type mPC int8
+
+const (
+	pcStart mPC = iota
+	pcAnnounce
+	pcCheck
+	pcUndo
+	pcRestart
+	pcDropParent
+	pcNext
+	pcCAS
+	pcLockCheck
+	pcRelease
+	pcMark
+	pcFail
+	pcDone
+	pcGaveUp
+)
+
+type mThread struct {
+	kind  mKind
+	pc    mPC
+	at    int8  // node being pinned or locked
+	idx   int8  // area: nodes locked so far
+	held  uint8 // writer: nodes locked and checked for readers
+	pins  uint8 // reader: nodes announced on
+	in    uint8 // reader: nodes pinned and checked for writers
+	marks uint8
+	tries int8
+
+	// the protoTrace of a writer, kept in the state
+	proto protoState
+	hk    [2]int8
+	hn    int8
+}
+
+type mState struct {
+	flag   [mNodes]int8 // the locker's index plus one, 0 when free
+	hp     [mNodes]int8
+	marker [mNodes]int8 // the marker's index plus one, 0 when free
+	th     [3]mThread
+}
+
+func bit(i int8) uint8 { return 1 << i }
+
+// area returns the nodes an area thread locks and the node it marks.
+func (k mKind) area() (nodes [2]int8, mark int8) {
+	if k == mAreaLow {
+		return [2]int8{2, 3}, 1
+	}
+	return [2]int8{1, 2}, 0
+}
+
+// explorer holds the knobs of one exploration.
+type explorer struct {
+	skipReaderCheck bool // writers do not check for readers after the CAS
+}
+
+// emit runs a writer's step through protoTrace.
+func (th *mThread) emit(step protoStep, keys ...int8) error {
+	p := protoTrace[int8]{compare: cmp.Compare[int8], state: th.proto, held: th.hk[:th.hn]}
+	p.record(step, keys)
+	if p.err != nil {
+		return p.err
+	}
+	th.proto = p.state
+	th.hn = int8(copy(th.hk[:], p.held))
+	return nil
+}
+
+// releaseAll unlocks and unmarks everything thread i holds.
+func (s *mState) releaseAll(i int) {
+	th := &s.th[i]
+	for n := int8(0); n < mNodes; n++ {
+		if th.held&bit(n) != 0 || s.flag[n] == int8(i+1) {
+			s.flag[n] = 0
+		}
+		if th.marks&bit(n) != 0 {
+			s.marker[n] = 0
+		}
+	}
+	th.held, th.marks = 0, 0
+}
+
+// retry ends a failed try of thread i.
+func (s *mState) retry(i int, restart mPC) error {
+	th := &s.th[i]
+	th.tries++
+	th.at, th.idx = 0, 0
+	if th.tries > mTries {
+		th.pc = pcGaveUp
+		if th.kind != mReader {
+			return th.emit(stepEnd)
+		}
+		return nil
+	}
+	th.pc = restart
+	return nil
+}
+
+// step runs the next step of thread i. It reports false if the thread has
+// finished.
+func (e explorer) step(s *mState, i int) (bool, error) {
+	th := &s.th[i]
+	if th.pc == pcDone || th.pc == pcGaveUp {
+		return false, nil
+	}
+	id := int8(i + 1)
+	switch th.kind {
+	case mReader:
+		switch th.pc {
+		case pcStart, pcAnnounce:
+			s.hp[th.at]++
+			th.pins |= bit(th.at)
+			th.pc = pcCheck
+		case pcCheck:
+			if s.flag[th.at] != 0 {
+				th.pc = pcUndo
+			} else {
+				th.in |= bit(th.at)
+				th.pc = pcDropParent
+			}
+		case pcUndo:
+			s.hp[th.at]--
+			th.pins &^= bit(th.at)
+			th.pc = pcRestart
+		case pcRestart:
+			if p := th.at - 1; p >= 0 && th.pins&bit(p) != 0 {
+				s.hp[p]--
+			}
+			th.pins, th.in = 0, 0
+			return true, s.retry(i, pcAnnounce)
+		case pcDropParent:
+			if p := th.at - 1; p >= 0 {
+				s.hp[p]--
+				th.pins &^= bit(p)
+				th.in &^= bit(p)
+			}
+			th.pc = pcNext
+		case pcNext:
+			if th.at == mNodes-1 {
+				s.hp[th.at]--
+				th.pins, th.in = 0, 0
+				th.pc = pcDone
+			} else {
+				th.at++
+				th.pc = pcAnnounce
+			}
+		}
+	case mLocator:
+		switch th.pc {
+		case pcStart:
+			th.pc = pcCAS
+			return true, th.emit(stepAttempt)
+		case pcCAS:
+			if s.flag[th.at] != 0 {
+				th.pc = pcFail
+			} else {
+				s.flag[th.at] = id
+				th.pc = pcLockCheck
+			}
+		case pcLockCheck:
+			if !e.skipReaderCheck && s.hp[th.at] > 0 {
+				s.flag[th.at] = 0
+				th.pc = pcFail
+				break
+			}
+			th.held |= bit(th.at)
+			th.pc = pcRelease
+			if th.at == 0 {
+				return true, th.emit(stepHold, 0)
+			}
+			return true, th.emit(stepHold, th.at-1, th.at)
+		case pcRelease:
+			th.pc = pcNext
+			if th.at > 0 {
+				s.flag[th.at-1] = 0
+				th.held &^= bit(th.at - 1)
+				return true, th.emit(stepHold, th.at)
+			}
+		case pcNext:
+			if th.at < mNodes-1 {
+				th.at++
+				th.pc = pcCAS
+				break
+			}
+			s.releaseAll(i)
+			th.pc = pcDone
+			if err := th.emit(stepHold); err != nil {
+				return true, err
+			}
+			return true, th.emit(stepEnd)
+		case pcFail:
+			s.releaseAll(i)
+			if err := th.emit(stepHold); err != nil {
+				return true, err
+			}
+			if err := th.emit(stepWait); err != nil {
+				return true, err
+			}
+			return true, s.retry(i, pcStart)
+		}
+	case mAreaLow, mAreaHigh:
+		nodes, mark := th.kind.area()
+		switch th.pc {
+		case pcStart, pcCAS:
+			n := nodes[th.idx]
+			if s.flag[n] != 0 {
+				th.pc = pcFail
+			} else {
+				s.flag[n] = id
+				th.pc = pcLockCheck
+			}
+		case pcLockCheck:
+			n := nodes[th.idx]
+			if !e.skipReaderCheck && s.hp[n] > 0 {
+				s.flag[n] = 0
+				th.pc = pcFail
+				break
+			}
+			th.held |= bit(n)
+			if th.idx++; int(th.idx) < len(nodes) {
+				th.pc = pcCAS
+				break
+			}
+			th.pc = pcMark
+			return true, th.emit(stepArea, nodes[:]...)
+		case pcMark:
+			if s.marker[mark] != 0 {
+				th.pc = pcFail
+				break
+			}
+			s.marker[mark] = id
+			th.marks |= bit(mark)
+			th.pc = pcRelease
+			return true, th.emit(stepMark)
+		case pcRelease:
+			s.releaseAll(i)
+			th.pc = pcDone
+			if err := th.emit(stepHold); err != nil {
+				return true, err
+			}
+			return true, th.emit(stepEnd)
+		case pcFail:
+			s.releaseAll(i)
+			if err := th.emit(stepHold); err != nil {
+				return true, err
+			}
+			if err := th.emit(stepWait); err != nil {
+				return true, err
+			}
+			return true, s.retry(i, pcCAS)
+		}
+	}
+	return true, nil
+}
+
+// check tests the exclusion invariants of s.
+func (s *mState) check() error {
+	for n := int8(0); n < mNodes; n++ {
+		var holders, readers int
+		for i, th := range s.th {
+			if th.held&bit(n) != 0 {
+				holders++
+				if s.flag[n] != int8(i+1) {
+					return fmt.Errorf("thread %d holds node %d without its flag", i, n)
+				}
+			}
+			if th.in&bit(n) != 0 {
+				readers++
+			}
+		}
+		if holders > 1 {
+			return fmt.Errorf("node %d held by %d writers", n, holders)
+		}
+		if holders > 0 && readers > 0 {
+			return fmt.Errorf("node %d held by a writer while a reader is on it", n)
+		}
+		if m := s.marker[n]; m != 0 {
+			th := s.th[m-1]
+			nodes, _ := th.kind.area()
+			if th.held != bit(nodes[0])|bit(nodes[1]) {
+				return fmt.Errorf("node %d marked by thread %d without its area", n, m-1)
+			}
+		}
+	}
+	return nil
+}
+
+// explore visits every state reachable from the threads of kinds. It
+// returns the number of states, whether a state where every thread
+// finished its work is reachable, and the first violation found.
+func (e explorer) explore(kinds ...mKind) (states int, completes bool, err error) {
+	var start mState
+	for i, k := range kinds {
+		start.th[i].kind = k
+	}
+	seen := map[mState]bool{start: true}
+	queue := []mState{start}
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+		moved := false
+		for i := range kinds {
+			next := s
+			ok, err := e.step(&next, i)
+			if err != nil {
+				return len(seen), completes, fmt.Errorf("thread %d (%v): %w", i, kinds[i], err)
+			}
+			if !ok {
+				continue
+			}
+			moved = true
+			if err := next.check(); err != nil {
+				return len(seen), completes, err
+			}
+			if !seen[next] {
+				seen[next] = true
+				queue = append(queue, next)
+			}
+		}
+		if moved {
+			continue
+		}
+		// no thread can move: every one must have finished
+		all := true
+		for i := range kinds {
+			switch s.th[i].pc {
+			case pcDone:
+			case pcGaveUp:
+				all = false
+			default:
+				return len(seen), completes, fmt.Errorf("deadlock in %+v", s)
+			}
+		}
+		completes = completes || all
+	}
+	return len(seen), completes, nil
+}
+
+func TestProtocolModel(t *testing.T) {
+	for name, kinds := range map[string][]mKind{
+		"reader/locator":     {mReader, mLocator},
+		"locator/locator":    {mLocator, mLocator},
+		"reader/areas":       {mReader, mAreaLow, mAreaHigh},
+		"locator/areas":      {mLocator, mAreaLow, mAreaHigh},
+		"reader/locator/low": {mReader, mLocator, mAreaLow},
+		"areas/area":         {mAreaHigh, mAreaLow, mAreaHigh},
+	} {
+		t.Run(name, func(t *testing.T) {
+			states, completes, err := explorer{}.explore(kinds...)
+			assert.Nil(t, err)
+			assert.True(t, completes, "no interleaving lets every thread finish")
+			t.Logf("%d states", states)
+		})
+	}
+}
+
+func TestProtocolModelFindsRace(t *testing.T) {
+	// a writer that does not look for readers after its CAS meets one
+	_, _, err := explorer{skipReaderCheck: true}.explore(mReader, mLocator)
+	assert.ErrorContains(t, err, "while a reader is on it")
+}
+
+func TestProtocolTrace(t *testing.T) {
+	run := func(steps ...func(p *protoTrace[int])) error {
+		p := &protoTrace[int]{compare: cmp.Compare[int]}
+		for _, s := range steps {
+			s(p)
+		}
+		p.record(stepEnd, nil)
+		return p.err
+	}
+	do := func(step protoStep, keys ...int) func(p *protoTrace[int]) {
+		return func(p *protoTrace[int]) { p.record(step, keys) }
+	}
+	// a descent that couples, then an area around its node and a mark
+	assert.Nil(t, run(do(stepAttempt), do(stepHold, 5), do(stepHold, 5, 3), do(stepHold, 3),
+		do(stepArea, 3, 4, 2), do(stepMark), do(stepHold), do(stepWait), do(stepAttempt), do(stepHold)))
+
+	for name, steps := range map[string][]func(p *protoTrace[int]){
+		"wait holding":       {do(stepAttempt), do(stepHold, 5), do(stepWait)},
+		"attempt holding":    {do(stepAttempt), do(stepHold, 5), do(stepAttempt)},
+		"end holding":        {do(stepArea, 1, 2)},
+		"mark without area":  {do(stepHold, 5), do(stepMark)},
+		"couple elsewhere":   {do(stepHold, 5), do(stepHold, 4, 3)},
+		"skip the child":     {do(stepHold, 5), do(stepHold, 5, 3), do(stepHold, 2)},
+		"area without node":  {do(stepHold, 5), do(stepArea, 1, 2)},
+		"three held coupled": {do(stepHold, 5), do(stepHold, 5, 3, 1)},
+	} {
+		err := run(steps...)
+		assert.ErrorIs(t, err, ErrProtocolViolation, name)
+	}
+}
+
+func TestConformanceSampling(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		errs []error
+	)
+	tree := sampleConformance(t, func(err error) {
+		mu.Lock()
+		errs = append(errs, err)
+		mu.Unlock()
+	}, WithSingleProcFallback(false))
+	assert.Empty(t, errs)
+	assert.Zero(t, tree.Stats().ProtocolViolations)
+	assert.Nil(t, tree.Verify())
+
+	// a write that backs off holding a node is caught
+	d := &opDesc[int]{quiet: true, trace: &protoTrace[int]{compare: cmp.Compare[int]}}
+	d.attempt()
+	d.hold(1)
+	d.wait()
+	tree.conformed(d.trace)
+	assert.Len(t, errs, 1)
+	assert.True(t, errors.Is(errs[0], ErrProtocolViolation))
+	assert.Equal(t, uint64(1), tree.Stats().ProtocolViolations)
+}
+
+// sampleConformance checks every write of a mixed concurrent workload
+// against the protocol model, reporting departures to onViolation.
+func sampleConformance(t *testing.T, onViolation func(error), opts ...Option) *RBTree[int, int] {
+	t.Helper()
+	tree := New[int, int](append(opts, WithConformanceSampling(1, onViolation))...)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				k := rand.IntN(200)
+				switch i % 3 {
+				case 0:
+					tree.Insert(k, k)
+				case 1:
+					tree.Delete(k)
+				default:
+					_, _, _ = tree.UpdateCtx(context.Background(), k, func(old int, ok bool) (int, bool) { return old + 1, true })
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return tree
+}
@@ -0,0 +1,197 @@
+package rbtree
+
+import (
+	"context"
+)
+
+// seek finds the closest key to key on one side of it. below selects the
+// floor side (keys smaller than key), inclusive allows key itself to match.
+// The best candidate is recorded while its node is pinned, expired reports
+// whether it had expired by now. If value is not nil the candidate's value
+// is copied to it too, before an insert can overwrite it in place.
+func (t *RBTree[K, V]) seek(key K, below, inclusive bool, now int64, value *V) (k K, v *V, expired bool, err error) {
+	take := func(n *RBTreeNode[K, V]) {
+		if k, v, expired = t.entry(n, now); value != nil {
+			*value = *v
+		}
+	}
+	_, err = t.descend(OpSeek, func(n *RBTreeNode[K, V]) *RBTreeNode[K, V] {
+		c := t.compare(key, n.key)
+		if c == 0 && inclusive {
+			take(n)
+			return nil
+		}
+		if below {
+			if c > 0 {
+				take(n)
+				return n.right.Load()
+			}
+			return n.left.Load()
+		}
+		if c < 0 {
+			take(n)
+			return n.left.Load()
+		}
+		return n.right.Load()
+	})
+	return k, v, expired, err
+}
+
+// edge walks down to the leftmost or rightmost node of the tree. value is
+// as for seek.
+func (t *RBTree[K, V]) edge(leftmost bool, now int64, value *V) (k K, v *V, expired bool, err error) {
+	_, err = t.descend(OpSeek, func(n *RBTreeNode[K, V]) *RBTreeNode[K, V] {
+		if k, v, expired = t.entry(n, now); value != nil {
+			*value = *v
+		}
+		if leftmost {
+			return n.left.Load()
+		}
+		return n.right.Load()
+	})
+	return k, v, expired, err
+}
+
+// entry is n's key, value pointer and whether it had expired by now, or
+// no value for a nil n.
+func (t *RBTree[K, V]) entry(n *RBTreeNode[K, V], now int64) (K, *V, bool) {
+	if n == nil {
+		var zero K
+		return zero, nil, false
+	}
+	return n.key, n.valuePtr(), t.expired(n, now)
+}
+
+// nearest is seek with retries. An expired candidate is passed over by
+// seeking again beyond it, as the live key closest to key may sit in the
+// candidate's far subtree, which the first walk did not enter. If value is
+// not nil the value found is copied to it, or zeroed if there is none.
+func (t *RBTree[K, V]) nearest(key K, below, inclusive bool, value *V) (k K, v *V) {
+	ctx := context.Background()
+	if t.prof != nil {
+		defer t.prof.restore(ctx)
+	}
+	now := t.now()
+	for {
+		var expired bool
+		err := t.retry(ctx, func() error {
+			var err error
+			k, v, expired, err = t.seek(key, below, inclusive, now, value)
+			return err
+		})
+		if err != nil {
+			if err == ErrCorrupted {
+				t.markCorrupted()
+			}
+			return t.none(value)
+		}
+		if v == nil {
+			return t.none(value)
+		}
+		if !expired {
+			return k, v
+		}
+		key, inclusive = k, false
+	}
+}
+
+func (t *RBTree[K, V]) extreme(leftmost bool, value *V) (k K, v *V) {
+	ctx := context.Background()
+	if t.prof != nil {
+		defer t.prof.restore(ctx)
+	}
+	now := t.now()
+	var expired bool
+	err := t.retry(ctx, func() error {
+		var err error
+		k, v, expired, err = t.edge(leftmost, now, value)
+		return err
+	})
+	if err != nil {
+		if err == ErrCorrupted {
+			t.markCorrupted()
+		}
+		return t.none(value)
+	}
+	if expired {
+		return t.nearest(k, !leftmost, false, value)
+	}
+	return k, v
+}
+
+// none is what nearest and extreme return when they find no key.
+func (t *RBTree[K, V]) none(value *V) (k K, v *V) {
+	if value != nil {
+		var zero V
+		*value = zero
+	}
+	return k, nil
+}
+
+// Floor returns the largest key less than or equal to key and its value.
+// The value is nil if there is no such key.
+func (t *RBTree[K, V]) Floor(key K) (K, *V) {
+	return t.nearest(key, true, true, nil)
+}
+
+// Ceiling returns the smallest key greater than or equal to key and its value.
+// The value is nil if there is no such key.
+func (t *RBTree[K, V]) Ceiling(key K) (K, *V) {
+	return t.nearest(key, false, true, nil)
+}
+
+// Predecessor returns the largest key strictly less than key and its value.
+// The value is nil if there is no such key.
+func (t *RBTree[K, V]) Predecessor(key K) (K, *V) {
+	return t.nearest(key, true, false, nil)
+}
+
+// Successor returns the smallest key strictly greater than key and its value.
+// The value is nil if there is no such key.
+func (t *RBTree[K, V]) Successor(key K) (K, *V) {
+	return t.nearest(key, false, false, nil)
+}
+
+// Min returns the smallest key in the tree and its value.
+// The value is nil if the tree is empty.
+func (t *RBTree[K, V]) Min() (K, *V) {
+	return t.extreme(true, nil)
+}
+
+// Max returns the largest key in the tree and its value.
+// The value is nil if the tree is empty.
+func (t *RBTree[K, V]) Max() (K, *V) {
+	return t.extreme(false, nil)
+}
+
+// Range calls f for each key and value in ascending key order until f
+// returns false. Each step is an independent Successor lookup, so Range
+// does not observe a consistent snapshot under concurrent writers.
+func (t *RBTree[K, V]) Range(f func(key K, value V) bool) {
+	t.scan(false, f)
+}
+
+// RangeDescending is Range in descending key order. Each step is an
+// independent Predecessor lookup, which costs the same as a Successor
+// lookup, so scanning backwards is no slower than scanning forwards.
+func (t *RBTree[K, V]) RangeDescending(f func(key K, value V) bool) {
+	t.scan(true, f)
+}
+
+// scan is Range, or RangeDescending if descending. Each value is copied
+// while its node is pinned, and handed to f outside the epoch bucket that
+// keeps a pooled node from being reused meanwhile.
+func (t *RBTree[K, V]) scan(descending bool, f func(key K, value V) bool) {
+	var value V
+	bucket := t.enter()
+	k, v := t.extreme(!descending, &value)
+	for v != nil {
+		t.exit(bucket)
+		if !f(k, value) {
+			return
+		}
+		bucket = t.enter()
+		k, v = t.nearest(k, descending, false, &value)
+	}
+	t.exit(bucket)
+}
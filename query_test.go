@@ -0,0 +1,121 @@
+package rbtree_test
+
+import (
+	"math/rand/v2"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iku50/rbtree-go"
+)
+
+func newQueryTree() *rbtree.RBTree[int, int] {
+	tree := rbtree.NewRBTree(10, 10)
+	for _, k := range []int{20, 30, 40, 50} {
+		tree.Insert(k, k)
+	}
+	return tree
+}
+
+func TestFloorCeiling(t *testing.T) {
+	tree := newQueryTree()
+
+	k, v := tree.Floor(35)
+	assert.Equal(t, 30, k)
+	assert.Equal(t, 30, *v)
+	k, v = tree.Floor(30)
+	assert.Equal(t, 30, k)
+	assert.Equal(t, 30, *v)
+	_, v = tree.Floor(5)
+	assert.Nil(t, v)
+
+	k, v = tree.Ceiling(35)
+	assert.Equal(t, 40, k)
+	assert.Equal(t, 40, *v)
+	k, v = tree.Ceiling(40)
+	assert.Equal(t, 40, k)
+	assert.Equal(t, 40, *v)
+	_, v = tree.Ceiling(55)
+	assert.Nil(t, v)
+}
+
+func TestPredecessorSuccessor(t *testing.T) {
+	tree := newQueryTree()
+
+	k, v := tree.Predecessor(30)
+	assert.Equal(t, 20, k)
+	assert.Equal(t, 20, *v)
+	_, v = tree.Predecessor(10)
+	assert.Nil(t, v)
+
+	k, v = tree.Successor(30)
+	assert.Equal(t, 40, k)
+	assert.Equal(t, 40, *v)
+	_, v = tree.Successor(50)
+	assert.Nil(t, v)
+}
+
+func TestMinMax(t *testing.T) {
+	tree := newQueryTree()
+
+	k, v := tree.Min()
+	assert.Equal(t, 10, k)
+	assert.Equal(t, 10, *v)
+	k, v = tree.Max()
+	assert.Equal(t, 50, k)
+	assert.Equal(t, 50, *v)
+
+	tree = rbtree.NewRBTree(1, 1)
+	tree.Delete(1)
+	_, v = tree.Min()
+	assert.Nil(t, v)
+	_, v = tree.Max()
+	assert.Nil(t, v)
+}
+
+func TestRangeDescending(t *testing.T) {
+	tree := rbtree.New[int, int]()
+	tree.RangeDescending(func(key, value int) bool {
+		t.Fatal("empty tree")
+		return true
+	})
+	for _, k := range rand.Perm(100) {
+		tree.Insert(k, -k)
+	}
+	var keys []int
+	tree.RangeDescending(func(key, value int) bool {
+		assert.Equal(t, -key, value)
+		keys = append(keys, key)
+		return key > 50
+	})
+	var want []int
+	for k := 99; k >= 50; k-- {
+		want = append(want, k)
+	}
+	assert.Equal(t, want, keys)
+}
+
+func TestRangeOverwrites(t *testing.T) {
+	// under -race: values are copied while their nodes are pinned
+	tree := rbtree.New[int, [4]int]()
+	for k := 0; k < 64; k++ {
+		tree.Insert(k, [4]int{k, k, k, k})
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5000; i++ {
+			k := rand.IntN(64)
+			tree.Insert(k, [4]int{k, k, k, k})
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		check := func(k int, v [4]int) bool {
+			assert.Equal(t, [4]int{k, k, k, k}, v)
+			return true
+		}
+		tree.Range(check)
+		tree.RangeDescending(check)
+	}
+	<-done
+}
@@ -0,0 +1,154 @@
+package rbtree
+
+import (
+	"context"
+)
+
+// rank counts the keys smaller than key from the sizes the nodes on the
+// way down have counted for their left subtrees.
+func (t *RBTree[K, V]) rank(key K) (rank int, err error) {
+	_, err = t.descend(OpSeek, func(n *RBTreeNode[K, V]) *RBTreeNode[K, V] {
+		c := t.compare(key, n.key)
+		if c < 0 {
+			return n.left.Load()
+		}
+		rank += n.left.Load().weight()
+		if c == 0 {
+			return nil
+		}
+		rank++
+		return n.right.Load()
+	})
+	return rank, err
+}
+
+// sel finds the key at index i in key order. The value is copied while
+// its node is pinned. ok is false if the counts seen on the way down put
+// no key at i.
+func (t *RBTree[K, V]) sel(i int) (k K, v V, ok bool, err error) {
+	_, err = t.descend(OpSeek, func(n *RBTreeNode[K, V]) *RBTreeNode[K, V] {
+		l := n.left.Load()
+		if w := l.weight(); i < w {
+			return l
+		} else if i > w {
+			i -= w + 1
+			return n.right.Load()
+		}
+		k, v, ok = n.key, *n.valuePtr(), true
+		return nil
+	})
+	return k, v, ok, err
+}
+
+// forward calls f with the keys after from in ascending order, or from
+// the smallest on if from is nil, expired ones included, until f returns
+// false. Each key is a lookup of its own, like Range. If value is not nil
+// it holds the value of the key f is called with.
+func (t *RBTree[K, V]) forward(from *K, value *V, f func(key K) bool) {
+	ctx := context.Background()
+	var k K
+	first := from == nil
+	if !first {
+		k = *from
+	}
+	for {
+		var v *V
+		from := k
+		err := t.retry(ctx, func() error {
+			var err error
+			// with now at 0 expired keys are visited too
+			if first {
+				k, v, _, err = t.edge(true, 0, value)
+			} else {
+				k, v, _, err = t.seek(from, false, false, 0, value)
+			}
+			return err
+		})
+		if err == ErrCorrupted {
+			t.markCorrupted()
+		}
+		if err != nil || v == nil || !f(k) {
+			return
+		}
+		first = false
+	}
+}
+
+// Rank returns the number of keys smaller than key, which is key's index
+// in ascending order if it is present.
+//
+// Rank takes O(log n) only on a tree built WithOrderStatistics, where it
+// reads the subtree sizes on one path. Sizes reach the root some time
+// after the insert or delete that changed them, so under concurrent
+// writers the rank may lag behind them. It is exact once writers are done.
+// Other trees keep no sizes: Rank counts the smaller keys one lookup at a
+// time, which takes O(n log n).
+func (t *RBTree[K, V]) Rank(key K) int {
+	ctx := context.Background()
+	if t.prof != nil {
+		defer t.prof.restore(ctx)
+	}
+	var rank int
+	if !t.ordered {
+		t.forward(nil, nil, func(k K) bool {
+			if t.compare(k, key) >= 0 {
+				return false
+			}
+			rank++
+			return true
+		})
+		return rank
+	}
+	err := t.retry(ctx, func() error {
+		var err error
+		rank, err = t.rank(key)
+		return err
+	})
+	if err != nil {
+		if err == ErrCorrupted {
+			t.markCorrupted()
+		}
+		return 0
+	}
+	return rank
+}
+
+// Select returns the key and value at index i in ascending key order,
+// counting from 0. ok is false if i is out of range. Like Rank it may lag
+// behind concurrent writers, and it takes O(log n) only on a tree built
+// WithOrderStatistics; on others it counts i keys one lookup at a time.
+func (t *RBTree[K, V]) Select(i int) (key K, value V, ok bool) {
+	if i < 0 {
+		return key, value, false
+	}
+	ctx := context.Background()
+	if t.prof != nil {
+		defer t.prof.restore(ctx)
+	}
+	if !t.ordered {
+		var v V
+		t.forward(nil, &v, func(k K) bool {
+			if i > 0 {
+				i--
+				return true
+			}
+			key, value, ok = k, v, true
+			return false
+		})
+		return key, value, ok
+	}
+	err := t.retry(ctx, func() error {
+		var err error
+		key, value, ok, err = t.sel(i)
+		return err
+	})
+	if err != nil {
+		if err == ErrCorrupted {
+			t.markCorrupted()
+		}
+		var k K
+		var v V
+		return k, v, false
+	}
+	return key, value, ok
+}
@@ -0,0 +1,124 @@
+package rbtree_test
+
+import (
+	"math/rand/v2"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iku50/rbtree-go"
+)
+
+func TestRankSelect(t *testing.T) {
+	// without order statistics the keys are counted one by one
+	for _, opts := range [][]rbtree.Option{{rbtree.WithOrderStatistics()}, nil} {
+		testRankSelect(t, opts...)
+	}
+}
+
+func testRankSelect(t *testing.T, opts ...rbtree.Option) {
+	tree := rbtree.New[int, int](opts...)
+	for _, i := range rand.Perm(100) {
+		tree.Insert(i*2, i)
+	}
+	for i := 0; i < 100; i += 2 {
+		tree.Delete(i * 2)
+	}
+	assert.Nil(t, tree.Check())
+	// the odd i remain, as keys 2, 6, 10, ...
+	for j := 0; j < 50; j++ {
+		key := (2*j + 1) * 2
+		assert.Equal(t, j, tree.Rank(key))
+		assert.Equal(t, j+1, tree.Rank(key+1))
+		k, v, ok := tree.Select(j)
+		assert.True(t, ok)
+		assert.Equal(t, key, k)
+		assert.Equal(t, 2*j+1, v)
+	}
+	assert.Equal(t, 0, tree.Rank(-1))
+	assert.Equal(t, 50, tree.Rank(1000))
+	_, _, ok := tree.Select(50)
+	assert.False(t, ok)
+	_, _, ok = tree.Select(-1)
+	assert.False(t, ok)
+
+	_, _, ok = rbtree.New[int, int](opts...).Select(0)
+	assert.False(t, ok)
+}
+
+func TestRankSelectBulk(t *testing.T) {
+	keys := make([]int, 300)
+	for i := range keys {
+		keys[i] = i
+	}
+	tree, err := rbtree.NewFromSorted(keys, keys, rbtree.WithOrderStatistics())
+	assert.Nil(t, err)
+	assert.Nil(t, tree.Check())
+	assert.Equal(t, 150, tree.Rank(150))
+	k, _, ok := tree.Snapshot().Tree(rbtree.WithOrderStatistics()).Select(299)
+	assert.True(t, ok)
+	assert.Equal(t, 299, k)
+}
+
+func TestRankConcurrent(t *testing.T) {
+	tree := rbtree.New[int, int](rbtree.WithOrderStatistics())
+	wg := sync.WaitGroup{}
+	for w := 0; w < 8; w++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				k := rand.IntN(1024)
+				if rand.IntN(2) == 0 {
+					tree.Insert(k, k)
+				} else {
+					tree.Delete(k)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				tree.Rank(rand.IntN(1024))
+				tree.Select(rand.IntN(512))
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Nil(t, tree.Check())
+	i := 0
+	tree.Range(func(key, _ int) bool {
+		assert.Equal(t, i, tree.Rank(key))
+		k, _, ok := tree.Select(i)
+		assert.True(t, ok)
+		assert.Equal(t, key, k)
+		i++
+		return true
+	})
+	assert.Equal(t, tree.Len(), i)
+}
+
+func TestOrderStatisticsSplitJoin(t *testing.T) {
+	plain := rbtree.New[int, int]()
+	for _, k := range rand.Perm(200) {
+		plain.Insert(k, k)
+	}
+	lo, hi := plain.Split(120)
+	assert.Equal(t, 120, lo.Len())
+	assert.Equal(t, 80, hi.Len())
+	assert.Equal(t, 30, hi.DeleteRange(150, 180))
+	assert.Equal(t, 50, hi.Len())
+
+	// joining a tree without sizes settles them
+	tree := rbtree.New[int, int](rbtree.WithOrderStatistics())
+	for k := 0; k < 120; k++ {
+		tree.Insert(k, k)
+	}
+	assert.Nil(t, tree.Join(hi))
+	assert.Nil(t, tree.Verify())
+	assert.Equal(t, 150, tree.Rank(180))
+	k, _, ok := tree.Select(169)
+	assert.True(t, ok)
+	assert.Equal(t, 199, k)
+}
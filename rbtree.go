@@ -5,9 +5,13 @@ package rbtree
 
 import (
 	"cmp"
+	"context"
 	"errors"
 	"fmt"
+	"math/bits"
+	"runtime"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -15,8 +19,18 @@ import (
 var (
 	ErrParentChildDoublRed = errors.New("parent child doubl red")
 	ErrBlackHeightMisMatch = errors.New("black height mismatch")
+	ErrCorrupted           = errors.New("tree corrupted")
+	ErrSizeMismatch        = errors.New("subtree size mismatch")
+	ErrRetriesExhausted    = errors.New("retries exhausted")
+
+	errLocked   = errors.New("node locked")
+	errPanicked = errors.New("callback panicked")
 )
 
+// depthSlack is the constant term of the traversal bound 2·log2(n)+C. It
+// leaves room for nodes that are linked but not yet counted or rebalanced.
+const depthSlack = 16
+
 type color int
 
 const (
@@ -32,55 +46,134 @@ const (
 	right
 )
 
-type RBTreeNode[K cmp.Ordered, V any] struct {
-	c      color
+type RBTreeNode[K any, V any] struct {
+	c color
+
+	left   atomic.Pointer[RBTreeNode[K, V]]
+	right  atomic.Pointer[RBTreeNode[K, V]]
+	parent atomic.Pointer[RBTreeNode[K, V]]
+
+	key   K
+	value V
+	box   *V // holds the value instead of value when pointers must stay stable
+
+	// deadline is when the key expires in Unix nanoseconds, 0 for never.
+	// Like the value it is written under flag and read while pinned.
+	deadline int64
 
-	left   *RBTreeNode[K, V]
-	right  *RBTreeNode[K, V]
-	parent *RBTreeNode[K, V]
+	// seq is the tombstone generation of the last write of the value, see
+	// TombstoneRange. It is guarded like deadline.
+	seq uint64
 
-	key    K
-	value  V
+	flag    atomic.Bool  // lock
+	hpflag  atomic.Int32 // readers
+	marker  atomic.Bool  // mark above node to avoid areas getting too close
+	retired atomic.Bool  // unlinked from the tree, flag stays set for good
 
-	flag   atomic.Bool   // lock
-	hpflag atomic.Int32 // readers
-	marker atomic.Bool   // mark above node to avoid areas getting too close
-	l      localArea[K,V]     // a list to impl area lock
+	// next is the node that took a retired node's place, so that a fixup
+	// pending on the retired node can follow it.
+	next atomic.Pointer[RBTreeNode[K, V]]
+
+	// extra counts the blacks that pending delete fixups owe the paths
+	// through n. Rotations must not move such a node. Guarded by flag.
+	extra int32
+
+	// size is the number of keys below and at n as far as n has been told,
+	// reported the part of it n's parent has counted. Their difference is
+	// still to be carried up by fixSize, which only runs WithOrderStatistics;
+	// without it the differences stay where they arose. size is guarded
+	// by n's flag, reported by the parent's.
+	size     int
+	reported int
+
+	// seen is the copy of n a relaxed read last took while n was pinned,
+	// read by GetRelaxed when a writer holds n.
+	seen atomic.Pointer[sighting[K, V]]
 }
 
-type localArea[K cmp.Ordered, V any] struct {
-	Next *localArea[K,V]
-	Val  *RBTreeNode[K,V]
+// areaSize is the number of nodes a local area holds inline. The largest
+// area, a delete fixup's, is the node, its parent and grandparent, the
+// sibling, both nephews and two levels below the inner nephew.
+const areaSize = 12
+
+// markDepth is how many ancestors above its area a delete fixup marks.
+const markDepth = 4
+
+// localArea is the set of nodes an operation has locked to rebalance
+// around one node. It lives in the operation's stack frame, so locking an
+// area does not allocate unless it outgrows areaSize.
+type localArea[K any, V any] struct {
+	nodes    [areaSize]*RBTreeNode[K, V]
+	n        int
+	overflow []*RBTreeNode[K, V]
+	marks    [markDepth]*RBTreeNode[K, V]
+	m        int
+	desc     *opDesc[K] // where the locked nodes are published, if anywhere
+}
+
+// valuePtr returns where the node's value lives, its box in stable mode and
+// the node itself otherwise.
+func (n *RBTreeNode[K, V]) valuePtr() *V {
+	if n.box != nil {
+		return n.box
+	}
+	return &n.value
 }
 
 func (n *RBTreeNode[K, V]) dir() direction {
-	if n.parent == nil {
+	p := n.parent.Load()
+	if p == nil {
 		return root
 	}
-	if n.parent.left != nil && n.parent.left == n {
+	if p.left.Load() == n {
 		return left
 	}
 	return right
 }
 
-func (n *RBTreeNode[K, V]) uncle() *RBTreeNode[K, V] {
-	if n.parent == nil || n.parent.parent == nil {
+// child returns n's child on side d.
+func (n *RBTreeNode[K, V]) child(d direction) *RBTreeNode[K, V] {
+	if n == nil {
 		return nil
 	}
-	if n.parent.dir() == left {
-		return n.parent.parent.right
+	if d == left {
+		return n.left.Load()
+	}
+	return n.right.Load()
+}
+
+func (n *RBTreeNode[K, V]) uncle() *RBTreeNode[K, V] {
+	p := n.parent.Load()
+	if p == nil {
+		return nil
 	}
-	return n.parent.parent.left
+	return p.sibling()
 }
 
 func (n *RBTreeNode[K, V]) sibling() *RBTreeNode[K, V] {
-	if n.parent == nil {
+	p := n.parent.Load()
+	if p == nil {
 		return nil
 	}
 	if n.dir() == left {
-		return n.parent.right
+		return p.right.Load()
+	}
+	return p.left.Load()
+}
+
+// weight is what n's parent counts for the subtree below it.
+func (n *RBTreeNode[K, V]) weight() int {
+	if n == nil {
+		return 0
 	}
-	return n.parent.left
+	return n.reported
+}
+
+// resize recomputes the size of a node whose children are settled and
+// reports all of it, as fresh nodes do.
+func (n *RBTreeNode[K, V]) resize() {
+	n.size = 1 + n.left.Load().weight() + n.right.Load().weight()
+	n.reported = n.size
 }
 
 func (n *RBTreeNode[K, V]) isRed() bool {
@@ -91,27 +184,79 @@ func (n *RBTreeNode[K, V]) isBlack() bool {
 	return n == nil || n.c == black
 }
 
-func (n *RBTreeNode[K, V]) get(key K) (*V, bool) {
+// descend walks from the root towards the leaves for a reader. Each node is
+// pinned before its parent is released, and a node locked by a writer
+// aborts the walk with errLocked. step is called on every pinned node and
+// returns the child to visit next, or nil to stop. visited counts the nodes
+// step was called on.
+func (t *RBTree[K, V]) descend(op Op, step func(n *RBTreeNode[K, V]) *RBTreeNode[K, V]) (visited int, err error) {
+	defer t.exit(t.enter())
+	n := t.root.Load()
 	if n == nil {
-		return nil, true
+		return 0, nil
 	}
-	if n.islock() {
-		return nil, false
+	if !n.pin() {
+		return 0, errLocked
 	}
-	n.hpflag.Add(1)
-	defer n.hpflag.Add(-1)
-	switch cmp.Compare(key, n.key) {
-	case 0:
-		return &n.value, true
-	case -1:
-		return n.left.get(key)
-	case 1:
-		return n.right.get(key)
-	default:
-		return nil, true
+	if t.root.Load() != n {
+		n.unpin()
+		return 0, errLocked
+	}
+	if t.guard {
+		// step and the tracer only run on the pinned n
+		defer func() {
+			if r := recover(); r != nil {
+				n.unpin()
+				err = t.recovered(r)
+			}
+		}()
+	}
+	for level := 0; ; level++ {
+		t.visit(op, level)
+		visited++
+		next := step(n)
+		if next == nil {
+			n.unpin()
+			return visited, nil
+		}
+		if level+1 >= t.maxDepth() {
+			n.unpin()
+			return visited, ErrCorrupted
+		}
+		if !next.pin() {
+			n.unpin()
+			return visited, errLocked
+		}
+		n.unpin()
+		n = next
+		t.perturb(chaosPinned)
 	}
 }
 
+// get looks key up. at is the node holding it, v its value pointer if
+// value is set. visited counts the nodes examined, including the one the
+// lookup stopped at.
+func (t *RBTree[K, V]) get(key K, value bool) (v *V, at *RBTreeNode[K, V], visited int, err error) {
+	now := t.now()
+	visited, err = t.descend(OpGet, func(n *RBTreeNode[K, V]) *RBTreeNode[K, V] {
+		c := t.compare(key, n.key)
+		if c == 0 {
+			if !t.expired(n, now) {
+				at = n
+				if value {
+					v = n.valuePtr()
+				}
+			}
+			return nil
+		}
+		if c < 0 {
+			return n.left.Load()
+		}
+		return n.right.Load()
+	})
+	return v, at, visited, err
+}
+
 // rotate Left is like
 //
 //	  |                       |
@@ -120,29 +265,33 @@ func (n *RBTreeNode[K, V]) get(key K) (*V, bool) {
 //	L   S    ==========>    N   R
 //	   / \                 / \
 //	  M   R               L   M
+//
+// The caller holds N's parent, N, S and M.
 func (t *RBTree[K, V]) rotateLeft(n *RBTreeNode[K, V]) {
-	if n == nil || n.right == nil {
+	newn := n.right.Load()
+	if newn == nil {
 		return
 	}
-	n.cleanMarker(false)
 	dir := n.dir()
-	p := n.parent
-	newn := n.right
-	n.right = newn.left
-	n.parent = newn
-	if newn.left != nil {
-		newn.left.parent = n
-	}
-	newn.parent = p
-	newn.left = n
+	p := n.parent.Load()
+	m := newn.left.Load()
+	n.right.Store(m)
+	if m != nil {
+		m.parent.Store(n)
+	}
+	n.parent.Store(newn)
+	t.perturb(chaosRotate)
+	newn.parent.Store(p)
+	newn.left.Store(n)
 	switch dir {
 	case root:
-		t.root = newn
+		t.root.Store(newn)
 	case left:
-		p.left = newn
+		p.left.Store(newn)
 	case right:
-		p.right = newn
+		p.right.Store(newn)
 	}
+	rotateSizes(n, newn)
 }
 
 // rotate right is like
@@ -153,188 +302,343 @@ func (t *RBTree[K, V]) rotateLeft(n *RBTreeNode[K, V]) {
 //	  L   S    ==========>    M   N
 //	 / \                         / \
 //	M   R                       R   S
+//
+// The caller holds N's parent, N, L and R.
 func (t *RBTree[K, V]) rotateRight(n *RBTreeNode[K, V]) {
-	if n == nil || n.left == nil {
+	newn := n.left.Load()
+	if newn == nil {
 		return
 	}
-	n.cleanMarker(true)
 	dir := n.dir()
-	p := n.parent
-	newn := n.left
-	n.left = newn.right
-	n.parent = newn
-	if newn.right != nil {
-		newn.right.parent = n
-	}
-	newn.parent = p
-	newn.right = n
+	p := n.parent.Load()
+	r := newn.right.Load()
+	n.left.Store(r)
+	if r != nil {
+		r.parent.Store(n)
+	}
+	n.parent.Store(newn)
+	t.perturb(chaosRotate)
+	newn.parent.Store(p)
+	newn.right.Store(n)
 	switch dir {
 	case root:
-		t.root = newn
+		t.root.Store(newn)
 	case left:
-		p.left = newn
+		p.left.Store(newn)
 	case right:
-		p.right = newn
+		p.right.Store(newn)
 	}
+	rotateSizes(n, newn)
+}
+
+// rotateSizes recomputes the sizes of n and the pivot that replaced it.
+// n's old parent keeps the count it had for n, now for the pivot, so the
+// difference still to be carried up stays on the path above n.
+func rotateSizes[K any, V any](n, pivot *RBTreeNode[K, V]) {
+	above := n.reported
+	n.resize()
+	pivot.size = 1 + pivot.left.Load().weight() + pivot.right.Load().weight()
+	pivot.reported = above
 }
 
-func (n *RBTreeNode[K, V]) cleanMarker(left bool) {
-	n.marker.Swap(false)
-	if n.parent != nil {
-		n.parent.marker.Swap(false)
+// rotateToward rotates at n so that n moves down on side d.
+func (t *RBTree[K, V]) rotateToward(n *RBTreeNode[K, V], d direction) {
+	if d == left {
+		t.rotateLeft(n)
+	} else {
+		t.rotateRight(n)
 	}
-	if left {
-		n.left.marker.Swap(false)
+}
+
+// RBTree is a concurrent red-black tree mapping keys of type K to values of
+// type V.
+//
+// Pointers returned by Get and the other lookups point into the node that
+// holds the key. Deleting a key with two children moves its successor's
+// value into that node, so such pointers may go stale after any Delete.
+// Build the tree WithStableValuePointers if pointers must be kept.
+type RBTree[K any, V any] struct {
+	root    atomic.Pointer[RBTreeNode[K, V]]
+	count   atomic.Int64
+	corrupt atomic.Bool // set once a traversal exceeded maxDepth
+	backoff Backoff
+	limiter Limiter      // see WithWriteLimiter
+	tune    *tuner       // see WithAutoTune
+	tokens  *writeTokens // see WithWriteTokens
+	pool    *nodePool[K, V]
+	descs   *opRegistry[K]   // see WithOpDescriptors
+	log     *changelog[K, V] // see WithChangelog
+	hist    *history[K]      // see WithDebugHistory
+	hints   *hintCache[K, V] // see WithHintCache
+	chaos   *chaos           // see WithChaos
+	appends appender[K, V]
+	compare func(a, b K) int
+	stable  bool // values are boxed, see WithStableValuePointers
+	ordered bool // sizes are carried to the root, see WithOrderStatistics
+	sample  uint32
+	stats   stats
+	tracer  Tracer
+	prof    *profiler
+	opts    options      // kept for Clone
+	serial  bool         // see WithSerializedWrites
+	yield   bool         // retries yield, see WithSingleProcFallback
+	guard   bool         // see WithPanicRecovery
+	gate    sync.RWMutex // shared by writers, held exclusively to quiesce them
+
+	snapMu  sync.Mutex                 // serializes Snapshot
+	copying atomic.Pointer[copyLog[K]] // see Snapshot, nil unless one walks the tree
+
+	expiring atomic.Bool // set once a key was given a deadline
+	sweepMu  sync.Mutex  // guards sweeper
+	sweeper  *sweeper
+
+	sizeOf func(key K, value V) int // see WithSizeOf
+
+	maxKey   int         // see WithMaxKeySize, 0 when off
+	keySizer func(K) int // see WithKeySize
+
+	progress func(done, total int) // see WithProgress
+	equal    func(a, b V) bool     // see WithSkipNoopWrites
+
+	tombMu  sync.Mutex                          // serializes changes to tombs
+	tombs   atomic.Pointer[[]rangeTombstone[K]] // see TombstoneRange, nil when none
+	tombGen atomic.Uint64                       // written while writers are paused
+
+	conform     uint32      // see WithConformanceSampling, 0 when off
+	onViolation func(error) // see WithConformanceSampling
+}
+
+// beginWrite admits a mutation. Writers share the gate, Snapshot takes it
+// exclusively so that it sees no half-done rotation. With serialized
+// writes every writer takes it exclusively. The result is passed to
+// endWrite.
+func (t *RBTree[K, V]) beginWrite() uint64 {
+	if t.serial {
+		t.gate.Lock()
 	} else {
-		n.right.marker.Swap(false)
+		t.gate.RLock()
 	}
-	return
+	return t.enter()
 }
 
-func (n *RBTreeNode[K, V]) getMarker() bool {
-	d := n.parent
-	for i := 0;i < 4&&d!=nil;i++{
-		if d.islock(){
-			return false
-		}
-		if !d.marker.CompareAndSwap(false,true){
-			return false
-		}
-		d=d.parent
+func (t *RBTree[K, V]) endWrite(bucket uint64) {
+	t.exit(bucket)
+	if t.serial {
+		t.gate.Unlock()
+	} else {
+		t.gate.RUnlock()
+	}
+	if t.hist != nil && t.hist.due.Load() {
+		t.captureShape()
 	}
-	return true
 }
 
-func (n *RBTreeNode[K, V]) unlockMarker()  {
-	d := n.parent
-	for i := 0;i < 4&&d!=nil;i++{
-		if d.islock(){
-			return
+func (t *RBTree[K, V]) newNode(key K, value V, parent *RBTreeNode[K, V]) *RBTreeNode[K, V] {
+	n := t.allocNode()
+	n.c = red
+	n.key = key
+	n.size = 1
+	n.reported = 1
+	n.seq = t.tombGen.Load()
+	n.parent.Store(parent)
+	if t.stable {
+		n.box = new(V)
+		*n.box = value
+	} else {
+		n.value = value
+	}
+	return n
+}
+
+// maxDepth bounds every traversal so that a parent/child cycle aborts
+// with ErrCorrupted instead of looping forever.
+func (t *RBTree[K, V]) maxDepth() int {
+	n := max(t.count.Load(), 0)
+	return 2*bits.Len(uint(n)) + depthSlack
+}
+
+// retry runs op until it stops reporting errLocked, waiting between
+// attempts according to the tree's backoff policy.
+func (t *RBTree[K, V]) retry(ctx context.Context, op func() error) error {
+	_, _, err := t.retryCount(ctx, op)
+	return err
+}
+
+// retryCount is retry that also reports how many times op was retried and
+// for how long. Every retry is taken from ctx's budget, see WithBudget.
+func (t *RBTree[K, V]) retryCount(ctx context.Context, op func() error) (int, time.Duration, error) {
+	var (
+		start  time.Time
+		budget *retryBudget
+	)
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if t.tune != nil && attempt > 0 {
+			t.tune.record(err != errLocked)
+		}
+		if err != errLocked {
+			var waited time.Duration
+			if attempt > 0 {
+				waited = time.Since(start)
+				storeMax(&t.stats.maxLockWait, uint64(waited))
+			}
+			return attempt, waited, err
+		}
+		if attempt == 0 {
+			start = time.Now()
+			budget = budgetFrom(ctx)
+		}
+		if !budget.spend() {
+			return attempt, time.Since(start), ErrBudgetExhausted
+		}
+		wait := t.policy().wait
+		if t.yield {
+			wait = t.policy().yield
+		}
+		if err = wait(ctx, attempt); err != nil {
+			return attempt, time.Since(start), err
 		}
-		d.marker.Swap(false)
-		d=d.parent
 	}
-	return
 }
 
-type RBTree[K cmp.Ordered, V any] struct {
-	root  *RBTreeNode[K, V]
-	count int
+// admit waits for the write limiter, if the tree has one.
+func (t *RBTree[K, V]) admit(ctx context.Context) error {
+	if t.limiter == nil {
+		return nil
+	}
+	return t.limiter.Wait(ctx)
 }
 
-func NewRBTree[K cmp.Ordered, V any](key K, value V) *RBTree[K, V] {
-	return &RBTree[K, V]{
-		count: 1,
-		root: &RBTreeNode[K, V]{
-			c:     red,
-			key:   key,
-			value: value,
-		},
+// markCorrupted records that a traversal ran past maxDepth. Check reports
+// ErrCorrupted from then on.
+func (t *RBTree[K, V]) markCorrupted() {
+	if !t.corrupt.Swap(true) {
+		t.reportCorruption(ErrCorrupted)
 	}
 }
 
-func (t *RBTree[K, V]) maintainAfterInsert(n *RBTreeNode[K, V]) bool {
-	if !n.lockInsert(){
-		return false
+// New returns an empty tree configured by opts. Keys are ordered by
+// cmp.Compare unless WithComparator is given.
+func New[K cmp.Ordered, V any](opts ...Option) *RBTree[K, V] {
+	return newTree[K, V](cmp.Compare[K], newOptions(opts))
+}
+
+// NewRBTreeFunc returns an empty tree whose keys are ordered by compare,
+// which must return a negative number, zero or a positive number when a is
+// less than, equal to or greater than b. Any key type can be used, e.g.
+// structs for composite keys or byte slices with bytes.Compare.
+func NewRBTreeFunc[K any, V any](compare func(a, b K) int, opts ...Option) *RBTree[K, V] {
+	return newTree[K, V](compare, newOptions(opts))
+}
+
+func newTree[K any, V any](compare func(a, b K) int, o options) *RBTree[K, V] {
+	t := &RBTree[K, V]{
+		backoff: o.backoff,
+		limiter: o.limiter,
+		compare: compare,
+		stable:  o.stable,
+		ordered: o.ordered,
+		sample:  o.sample,
+		tracer:  o.tracer,
+		opts:    o,
+		serial:  o.serial,
+		guard:   o.guard,
 	}
-	defer n.unlockArea()
-	if n.isBlack() || n.parent == nil || n.parent.c == black {
-		return true
+	if o.single && !o.chaos && runtime.GOMAXPROCS(0) == 1 {
+		t.serial, t.yield = true, true
 	}
-	if n.parent.parent == nil {
-		n.parent.c = black
-		return true
+	if o.labels {
+		t.prof = newProfiler()
 	}
-	if n.uncle().isRed() {
-		n.parent.c = black
-		n.parent.parent.c = red
-		n.uncle().c = black
-		n.unlockArea()
-		return t.maintainAfterInsert(n.parent.parent)
+	if o.tune {
+		t.tune = newTuner(o.backoff)
 	}
-	if n.dir() != n.parent.dir() {
-		p := n.parent
-		if n.dir() == left {
-			t.rotateRight(n.parent)
-		} else {
-			t.rotateLeft(n.parent)
-		}
-		n = p
+	if o.pool {
+		t.pool = &nodePool[K, V]{}
 	}
-	if n.dir() == n.parent.dir() {
-		if n.dir() == left {
-			t.rotateRight(n.parent.parent)
-		} else {
-			t.rotateLeft(n.parent.parent)
-		}
-		n.parent.c = black
-		if n.sibling() != nil {
-			n.sibling().c = red
-		}
+	if o.descs {
+		t.descs = &opRegistry[K]{}
 	}
-	return true
-}
-
-func (t *RBTree[K, V]) maintainAfterDelete(n *RBTreeNode[K, V]) bool {
-	if n.parent == nil {
-		return true
+	if o.tokens > 0 {
+		t.tokens = newWriteTokens(o.tokens - 1)
 	}
-	if !n.lockDelete(){
-		return false
+	if o.changes > 0 {
+		t.log = newChangelog[K, V](o.changes)
 	}
-	defer n.unlockArea()
-	if !n.getMarker(){
-		return false
+	if o.hints {
+		t.hints = &hintCache[K, V]{}
 	}
-	defer n.unlockMarker()
-	if n.sibling().isRed() {
-		s := n.sibling()
-		if n.dir() == left {
-			t.rotateLeft(n.parent)
-		} else {
-			t.rotateRight(n.parent)
-		}
-		s.c = black
-		n.parent.c = red
+	if o.chaos {
+		t.chaos = newChaos(o.chaosSeed)
 	}
-	if n.sibling().left.isBlack() &&
-		n.sibling().right.isBlack() &&
-		n.parent.isRed() {
-		n.sibling().c = red
-		n.parent.c = black
-		return true
+	if o.history > 0 {
+		t.hist = newHistory[K](o.history, o.historyDepth, o.historyOut)
 	}
-	if n.sibling().left.isBlack() &&
-		n.sibling().right.isBlack() &&
-		n.parent.c == black {
-		n.sibling().c = red
-		n.unlockArea()
-		t.maintainAfterDelete(n.parent)
-		return true
+	if o.compare != nil {
+		f, ok := o.compare.(func(a, b K) int)
+		if !ok {
+			panic(fmt.Sprintf("rbtree: comparator %T does not match key type %T", o.compare, new(K)))
+		}
+		t.compare = f
+	}
+	if t.compare == nil {
+		panic("rbtree: nil comparator")
+	}
+	t.maxKey = o.maxKey
+	t.progress = o.progress
+	t.conform, t.onViolation = o.conform, o.onViolation
+	if o.noop != nil {
+		f, ok := o.noop.(func(a, b V) bool)
+		if !ok {
+			panic(fmt.Sprintf("rbtree: equality %T does not match value type %T", o.noop, new(V)))
+		}
+		t.equal = f
 	}
-	if n.dir() == left && n.sibling().left.isRed() && n.sibling().right.isBlack() ||
-		n.dir() == right && n.sibling().right.isRed() && n.sibling().left.isBlack() {
-		if n.dir() == left {
-			t.rotateRight(n.sibling())
-			n.sibling().right.c = red
-		} else {
-			t.rotateLeft(n.sibling())
-			n.sibling().left.c = red
+	if o.keySize != nil {
+		f, ok := o.keySize.(func(key K) int)
+		if !ok {
+			panic(fmt.Sprintf("rbtree: key size function %T does not match key type %T", o.keySize, new(K)))
 		}
-		n.sibling().c = black
+		t.keySizer = f
 	}
-	if n.dir() == left && n.sibling().right.isRed() || n.dir() == right && n.sibling().left.isRed() {
-		if n.dir() == left {
-			t.rotateLeft(n.parent)
-		} else {
-			t.rotateRight(n.parent)
+	if o.sizeOf != nil {
+		f, ok := o.sizeOf.(func(key K, value V) int)
+		if !ok {
+			panic(fmt.Sprintf("rbtree: size function %T does not match key and value types %T, %T", o.sizeOf, new(K), new(V)))
 		}
-		n.parent.parent.c, n.parent.c = n.parent.c, n.parent.parent.c
-		n.parent.sibling().c = black
+		t.sizeOf = f
+	}
+	return t
+}
+
+// NewRBTree returns a tree holding key and value, configured by opts.
+func NewRBTree[K cmp.Ordered, V any](key K, value V, opts ...Option) *RBTree[K, V] {
+	t := New[K, V](opts...)
+	t.Insert(key, value)
+	return t
+}
+
+// Len returns the number of keys stored in the tree.
+func (t *RBTree[K, V]) Len() int {
+	return int(t.count.Load())
+}
+
+// pin announces a reader on n. It fails if a writer holds n, the reader
+// must then restart from the root. pin announces before it checks and lock
+// checks after it takes the flag, so one of the two always sees the other.
+func (n *RBTreeNode[K, V]) pin() bool {
+	n.hpflag.Add(1)
+	if n.flag.Load() {
+		n.hpflag.Add(-1)
+		return false
 	}
 	return true
 }
 
+func (n *RBTreeNode[K, V]) unpin() {
+	n.hpflag.Add(-1)
+}
+
 func (n *RBTreeNode[K, V]) lock() bool {
 	if n == nil {
 		return false
@@ -343,8 +647,8 @@ func (n *RBTreeNode[K, V]) lock() bool {
 	if !ok {
 		return false
 	}
-	if n.hpflag.Load() > 1 {
-		n.flag.Swap(false)
+	if n.hpflag.Load() > 0 {
+		n.flag.Store(false)
 		return false
 	}
 	return true
@@ -358,282 +662,864 @@ func (n *RBTreeNode[K, V]) unlock() bool {
 	return n.flag.CompareAndSwap(true, false)
 }
 
-func (n *RBTreeNode[K, V]) unlockArea() {
-	p := &n.l
-	for p != nil && p.Val != nil {
-		p.Val.flag.CompareAndSwap(true, false)
-		p = p.Next
+func (a *localArea[K, V]) has(n *RBTreeNode[K, V]) bool {
+	for _, m := range a.nodes[:a.n] {
+		if m == n {
+			return true
+		}
+	}
+	for _, m := range a.overflow {
+		if m == n {
+			return true
+		}
+	}
+	return false
+}
+
+// own records n, which the caller has already locked, as part of the area.
+func (a *localArea[K, V]) own(n *RBTreeNode[K, V]) {
+	if a.n < len(a.nodes) {
+		a.nodes[a.n] = n
+		a.n++
+		return
 	}
-	n.l = localArea[K,V]{}
+	// overflow strategy: spill to the heap rather than fail the operation
+	a.overflow = append(a.overflow, n)
 }
 
-func (n *RBTreeNode[K, V]) lockDelete() bool {
-	n.l =  localArea[K,V]{}
-	d := &n.l
+// add locks n into the area unless it already belongs to it. It fails if
+// n is locked by someone else or pinned by readers.
+func (a *localArea[K, V]) add(n *RBTreeNode[K, V]) bool {
+	if a.has(n) {
+		return true
+	}
 	if ok := n.lock(); !ok {
 		return false
 	}
-	d.Val = n
-	d.Next = new(localArea[K,V])
-	d = d.Next
-	if n.parent != nil {
-		if ok := n.parent.lock(); !ok {
-			n.unlockArea()
+	a.own(n)
+	return true
+}
+
+// lockSet locks the nodes set(n) lists into the area. The list is computed
+// from pointers read before the locks are held, so once they are it is
+// computed again and must not name a node the area lacks. On failure the
+// caller unlocks the area.
+func (a *localArea[K, V]) lockSet(set func(*RBTreeNode[K, V]) nodeSet[K, V], n *RBTreeNode[K, V]) bool {
+	s := set(n)
+	for _, m := range s.nodes[:s.n] {
+		if !a.add(m) {
 			return false
 		}
-		d.Val = n.parent
-		d.Next = new(localArea[K,V])
-		d = d.Next
+	}
+	s = set(n)
+	for _, m := range s.nodes[:s.n] {
+		if !a.has(m) {
+			return false
+		}
+	}
+	a.publish()
+	return true
+}
 
-		if n.uncle() != nil {
-			if ok := n.uncle().lock(); !ok {
-				n.unlockArea()
-				return false
-			}
-			d.Val = n.uncle()
-			d.Next = new(localArea[K,V])
-			d = d.Next
-			if n.uncle().left != nil {
-				if ok := n.uncle().left.lock(); !ok {
-					n.unlockArea()
-					return false
-				}
-				d.Val = n.uncle().left
-				d.Next = new(localArea[K,V])
-				d = d.Next
-			}
-			if n.uncle().right != nil {
-				if ok := n.uncle().right.lock(); !ok {
-					n.unlockArea()
-					return false
-				}
-				d.Val = n.uncle().right
-				d.Next = new(localArea[K,V])
-				d = d.Next
-			}
+// mark reserves the ancestors markSet lists for a delete fixup at n. It
+// fails if another fixup holds one of them.
+func (a *localArea[K, V]) mark(n *RBTreeNode[K, V]) bool {
+	s := markSet(n)
+	for _, d := range s.nodes[:s.n] {
+		if !d.marker.CompareAndSwap(false, true) {
+			return false
 		}
+		a.marks[a.m] = d
+		a.m++
+	}
+	if a.desc != nil && a.desc.trace != nil {
+		a.desc.trace.record(stepMark, nil)
 	}
 	return true
 }
 
-func (n *RBTreeNode[K, V]) lockInsert() bool {
-	n.l = localArea[K,V]{}
-	d := &n.l
-	if ok := n.lock(); !ok {
-		return false
+// list returns the nodes of the area.
+func (a *localArea[K, V]) list() []*RBTreeNode[K, V] {
+	if len(a.overflow) == 0 {
+		return a.nodes[:a.n]
 	}
-	d.Val = n
-	d.Next = new(localArea[K,V])
-	d = d.Next
-	if n.parent != nil {
-		if ok := n.parent.lock(); !ok {
-			n.unlockArea()
-			return false
+	return append(a.nodes[:a.n:a.n], a.overflow...)
+}
+
+// retire flags n as unlinked and drops it from the area without unlocking
+// it. Readers and writers that still reach n find it locked and restart.
+func (a *localArea[K, V]) retire(n *RBTreeNode[K, V]) {
+	n.retired.Store(true)
+	for i, m := range a.nodes[:a.n] {
+		if m == n {
+			a.nodes[i] = nil
 		}
-		d.Val = n.parent
-		d.Next = new(localArea[K,V])
-		d = d.Next
-		if n.parent.parent != nil {
-			if ok := n.parent.parent.lock(); !ok {
-				n.unlockArea()
-				return false
-			}
-			d.Val = n.parent.parent
-			d.Next = new(localArea[K,V])
-			d = d.Next
-		}
-		if n.uncle() != nil {
-			if ok := n.uncle().lock(); !ok {
-				n.unlockArea()
-				return false
-			}
-			d.Val = n.uncle()
-			d.Next = new(localArea[K,V])
-			d = d.Next
+	}
+	for i, m := range a.overflow {
+		if m == n {
+			a.overflow[i] = nil
 		}
 	}
-	return true
 }
 
-func (t *RBTree[K, V]) insert(n *RBTreeNode[K, V], key K, value V) (isNew bool, succeed bool) {
-	if ok := n.lock(); !ok {
-		return false, false
+// unlock releases every node and marker of the area and empties it.
+func (a *localArea[K, V]) unlock() {
+	for _, n := range a.nodes[:a.n] {
+		if n != nil {
+			n.flag.CompareAndSwap(true, false)
+		}
 	}
-	defer n.unlock()
-	if n.key == key {
-		n.value = value
-		return false, true
+	for _, n := range a.overflow {
+		if n != nil {
+			n.flag.CompareAndSwap(true, false)
+		}
 	}
-	if n.key > key && n.left != nil {
-		n.unlock()
-		return t.insert(n.left, key, value)
+	for _, d := range a.marks[:a.m] {
+		d.marker.Store(false)
 	}
-	if n.key < key && n.right != nil {
-		n.unlock()
-		return t.insert(n.right, key, value)
+	*a = localArea[K, V]{desc: a.desc}
+	a.desc.hold()
+}
+
+func opposite(d direction) direction {
+	if d == left {
+		return right
 	}
-	insert := &RBTreeNode[K, V]{
-		c:      red,
-		key:    key,
-		value:  value,
-		parent: n,
+	return left
+}
+
+// insertStep resolves a red-red violation between x and its parent as far
+// as x's area allows. The area must be locked. It returns the node the
+// violation moved up to, or nil.
+func (t *RBTree[K, V]) insertStep(x *RBTreeNode[K, V]) *RBTreeNode[K, V] {
+	p := x.parent.Load()
+	if x.isBlack() || p == nil || p.isBlack() {
+		return nil
 	}
-	if n.key > key {
-		n.left = insert
-	} else {
-		n.right = insert
+	g := p.parent.Load()
+	if g == nil {
+		p.c = black
+		return nil
 	}
+	if u := p.sibling(); u.isRed() {
+		p.c = black
+		g.c = red
+		u.c = black
+		return g
+	}
+	if x.dir() != p.dir() {
+		t.rotateToward(p, p.dir())
+		x = p
+		p = x.parent.Load()
+	}
+	t.rotateToward(g, opposite(x.dir()))
+	p.c = black
+	g.c = red
+	return nil
+}
+
+// deleteStep moves the black missing from the paths through n one step
+// towards the root, or puts it back if the surroundings allow. n's area
+// must be locked and, apart from n's sibling, owe nothing. It returns the
+// node that lacks the black now, or nil.
+func (t *RBTree[K, V]) deleteStep(n *RBTreeNode[K, V]) *RBTreeNode[K, V] {
 	if n.isRed() {
+		n.c = black
+		return nil
+	}
+	p := n.parent.Load()
+	if p == nil {
+		return nil
+	}
+	d := n.dir()
+	o := opposite(d)
+	s := p.child(o)
+	if s == nil {
+		return nil
+	}
+	// both sides of p are one black short, so p owes it instead
+	if s.extra > 0 {
+		s.extra--
+		if p.isRed() {
+			p.c = black
+			return nil
+		}
+		return p
+	}
+	if s.isRed() {
+		t.rotateToward(p, d)
+		s.c = black
+		p.c = red
+		if s = p.child(o); s == nil {
+			return nil
+		}
+	}
+	if s.left.Load().isBlack() && s.right.Load().isBlack() {
+		s.c = red
+		if p.isRed() {
+			p.c = black
+			return nil
+		}
+		return p
+	}
+	if s.child(o).isBlack() {
+		t.rotateToward(s, o)
+		s.c = red
+		s = p.child(o)
+		s.c = black
+	}
+	t.rotateToward(p, d)
+	s.c, p.c = p.c, black
+	s.child(o).c = black
+	return nil
+}
+
+// fixInsert carries a red-red violation at x up the tree, one locked area
+// per step, and returns the number of steps. A step that cannot get its
+// area waits and tries again: the colors below are already changed, so the
+// fixup must not be abandoned.
+func (t *RBTree[K, V]) fixInsert(x *RBTreeNode[K, V], d *opDesc[K]) (steps int) {
+	d.enter(PhaseRebalance)
+	for attempt := 0; x != nil && !x.retired.Load(); {
+		next, ok := t.tryInsertStep(x, d)
+		if !ok {
+			d.wait()
+			t.pause(attempt)
+			attempt++
+			continue
+		}
+		x = next
+		steps++
+		attempt = 0
+	}
+	return steps
+}
+
+// tryInsertStep runs insertStep at x in its locked area. ok is false if
+// the area is taken or the step has to wait.
+func (t *RBTree[K, V]) tryInsertStep(x *RBTreeNode[K, V], d *opDesc[K]) (next *RBTreeNode[K, V], ok bool) {
+	area := localArea[K, V]{desc: d}
+	defer area.unlock()
+	if !area.lockSet(insertSet, x) || insertWaits(x) {
+		return nil, false
+	}
+	t.perturb(chaosLocked)
+	return t.insertStep(x), true
+}
+
+// fixDelete settles a black that n owes, carrying it up the tree like
+// fixInsert. If n is unlinked meanwhile the fixup follows the node that
+// replaced it. A sibling's fixup may settle the debt first.
+func (t *RBTree[K, V]) fixDelete(n *RBTreeNode[K, V], d *opDesc[K]) {
+	d.enter(PhaseRebalance)
+	for attempt := 0; n != nil; {
+		if n.retired.Load() {
+			n = n.next.Load()
+			continue
+		}
+		area := localArea[K, V]{desc: d}
+		if !area.lockSet(deleteSet, n) {
+			area.unlock()
+			d.wait()
+			t.pause(attempt)
+			attempt++
+			continue
+		}
+		if n.extra == 0 {
+			area.unlock()
+			return
+		}
+		t.perturb(chaosMark)
+		if !n.isRed() && (deleteWaits(area.list(), n, n.sibling()) || !area.mark(n)) {
+			area.unlock()
+			d.wait()
+			t.pause(attempt)
+			attempt++
+			continue
+		}
+		n.extra--
+		if n = t.deleteStep(n); n != nil {
+			n.extra++
+		}
+		area.unlock()
+		attempt = 0
+	}
+}
+
+// fixSize carries the size changes below x up to the root, one node and
+// its parent at a time. It walks all the way up, as rotations may have
+// moved a change that was waiting at x to a node above it. A fixup that
+// reaches an unlinked node stops, the delete that unlinked it carries the
+// change from there.
+func (t *RBTree[K, V]) fixSize(x *RBTreeNode[K, V], d *opDesc[K]) {
+	d.enter(PhaseResize)
+	for attempt := 0; x != nil && !x.retired.Load(); {
+		p, ok := t.trySizeStep(x, d)
+		if !ok {
+			d.wait()
+			t.pause(attempt)
+			attempt++
+			continue
+		}
+		x = p
+		attempt = 0
+	}
+}
+
+// trySizeStep carries x's size change to its parent, which it returns. ok
+// is false if the two nodes cannot be locked.
+func (t *RBTree[K, V]) trySizeStep(x *RBTreeNode[K, V], d *opDesc[K]) (p *RBTreeNode[K, V], ok bool) {
+	area := localArea[K, V]{desc: d}
+	defer area.unlock()
+	if !area.lockSet(sizeSet, x) {
+		return nil, false
+	}
+	t.perturb(chaosLocked)
+	if p = x.parent.Load(); p != nil {
+		p.size += x.size - x.reported
+		x.reported = x.size
+	}
+	return p, true
+}
+
+// locate walks from the root towards key with lock coupling: a child is
+// locked before its parent is released. It returns the locked node holding
+// key or, if key is absent, the locked node it would be linked below, and
+// the comparison of key with that node's key. n is nil for an empty tree.
+// rightmost tells whether the walk only turned right, so n holds the
+// largest key.
+func (t *RBTree[K, V]) locate(op Op, key K, d *opDesc[K]) (n *RBTreeNode[K, V], c int, rightmost bool, err error) {
+	d.attempt()
+	n = t.root.Load()
+	if n == nil {
+		return nil, 0, false, nil
+	}
+	if !n.lock() {
+		return nil, 0, false, errLocked
+	}
+	if t.root.Load() != n {
 		n.unlock()
-		if !t.maintainAfterInsert(insert){
-			if n.key > key {
-				n.left = nil
-			}else{
-				n.right = nil
+		return nil, 0, false, errLocked
+	}
+	if t.guard {
+		// the comparator and the tracer only run on the locked n
+		defer func() {
+			if r := recover(); r != nil {
+				n.unlock()
+				d.hold()
+				n, c, rightmost, err = nil, 0, false, t.recovered(r)
 			}
-			return true, false
+		}()
+	}
+	rightmost = true
+	for level := 0; ; level++ {
+		t.visit(op, level)
+		d.visit()
+		d.hold(n.key)
+		c = t.compare(key, n.key)
+		next := n.right.Load()
+		if c < 0 {
+			next = n.left.Load()
+		}
+		if c == 0 || next == nil {
+			d.enter(PhaseApply)
+			return n, c, rightmost && c > 0, nil
 		}
+		rightmost = rightmost && c > 0
+		if level+1 >= t.maxDepth() {
+			n.unlock()
+			d.hold()
+			return nil, 0, false, ErrCorrupted
+		}
+		if !next.lock() {
+			n.unlock()
+			d.hold()
+			return nil, 0, false, errLocked
+		}
+		d.hold(n.key, next.key)
+		n.unlock()
+		n = next
+		t.perturb(chaosLocked)
 	}
-	return true, true
 }
 
-func (t *RBTree[K, V]) Insert(key K, value V) {
+// updateFunc computes the value to store for a key from the current one.
+// ok tells whether the key is present, store whether to write value.
+type updateFunc[V any] func(old V, ok bool) (value V, store bool)
+
+// keepDeadline leaves the deadline of a key that is present as it is.
+const keepDeadline int64 = -1
+
+// insert finds key and applies fn to it while the node that holds or will
+// hold the key is locked. If key is present its value is returned with
+// loaded set, created reports whether a new node was linked. A stored
+// value gets deadline, or no deadline if it is keepDeadline and the key
+// was absent. An expired key counts as absent.
+func (t *RBTree[K, V]) insert(key K, fn updateFunc[V], deadline int64, d *opDesc[K]) (old V, loaded bool, created bool, err error) {
+	c, largest := 1, true
+	n, tail, err := t.appendAt(key, d)
+	if err == nil && !tail {
+		n, c, largest, err = t.locate(OpInsert, key, d)
+	}
+	if err != nil {
+		return old, false, false, err
+	}
 	// case 1
-	if t.root == nil {
-		t.root = &RBTreeNode[K, V]{
-			c:     red,
-			key:   key,
-			value: value,
+	if n == nil {
+		value, store := fn(old, false)
+		if !store {
+			return old, false, false, nil
 		}
-		return
+		root := t.newNode(key, value, nil)
+		root.deadline = max(deadline, 0)
+		if t.log != nil {
+			// a delete of the key must not be logged before its insert
+			root.lock()
+			defer root.unlock()
+		}
+		if !t.root.CompareAndSwap(nil, root) {
+			return old, false, false, errLocked
+		}
+		t.record(EventStore, key, value)
+		if t.sampleGet() {
+			t.stats.recordInsert(0, false, t.keySize(key))
+		}
+		return old, false, true, nil
 	}
-	var new bool
-	var ok bool
-	for new, ok = t.insert(t.root, key, value); !ok; new, ok = t.insert(t.root, key, value) {
-		time.Sleep(100 * time.Nanosecond)
+	if c == 0 {
+		p := n.valuePtr()
+		loaded = !t.expired(n, t.now())
+		if loaded {
+			old = *p
+		}
+		value, store := fn(old, loaded)
+		if store && t.equal != nil && loaded && (deadline == keepDeadline || deadline == n.deadline) {
+			same, err := t.sameValue(old, value)
+			if err != nil {
+				n.unlock()
+				d.hold()
+				return old, false, false, err
+			}
+			store = !same
+		}
+		if store {
+			*p = value
+			n.seq = t.tombGen.Load()
+			if deadline != keepDeadline {
+				n.deadline = deadline
+			} else if !loaded {
+				n.deadline = 0
+			}
+			t.record(EventStore, key, value)
+		}
+		n.unlock()
+		d.hold()
+		return old, loaded, false, nil
 	}
-	if new {
-		t.count++
+	value, store := fn(old, false)
+	if !store {
+		n.unlock()
+		d.hold()
+		return old, false, false, nil
+	}
+	insert := t.newNode(key, value, n)
+	insert.deadline = max(deadline, 0)
+	slot := &n.right
+	if c < 0 {
+		slot = &n.left
+	}
+	// n is locked, so nothing can have filled the slot since locate saw it
+	slot.CompareAndSwap(nil, insert)
+	n.size++
+	t.appended(insert, largest)
+	t.record(EventStore, key, value)
+	red := n.isRed()
+	n.unlock()
+	d.hold()
+	steps := 0
+	if red {
+		steps = t.fixInsert(insert, d)
+	}
+	if t.ordered {
+		t.fixSize(n, d)
+	}
+	if t.sampleGet() {
+		t.stats.recordInsert(steps, tail, t.keySize(key))
+	}
+	return old, false, true, nil
+}
+
+// Insert sets the value for key. If the tree was built with a bounded
+// Backoff the insert may be abandoned, use InsertCtx to observe that.
+func (t *RBTree[K, V]) Insert(key K, value V) {
+	_ = t.InsertCtx(context.Background(), key, value)
+}
+
+// InsertCtx is like Insert but stops retrying once ctx is done or the
+// backoff policy gives up, returning the reason.
+func (t *RBTree[K, V]) InsertCtx(ctx context.Context, key K, value V) error {
+	if t.equal != nil && t.unchanged(key, value) {
+		return nil
 	}
+	_, _, err := t.update(ctx, key, func(V, bool) (V, bool) {
+		return value, true
+	}, 0)
+	return err
+}
+
+// update applies fn to key under the insert locking protocol. It returns
+// the value that was present before, if any. fn runs again on every retry.
+// deadline is passed on to insert.
+func (t *RBTree[K, V]) update(ctx context.Context, key K, fn updateFunc[V], deadline int64) (old V, loaded bool, err error) {
+	var (
+		retries int
+		waited  time.Duration
+	)
+	defer func() { err = t.opError(OpInsert, key, retries, waited, err) }()
+	if err := t.checkKey(key); err != nil {
+		return old, false, err
+	}
+	if err := t.admit(ctx); err != nil {
+		return old, false, err
+	}
+	if t.tokens != nil {
+		release, err := t.claim(ctx, OpInsert, key)
+		if err != nil {
+			return old, false, err
+		}
+		defer release()
+	}
+	defer t.endWrite(t.beginWrite())
+	if t.prof != nil {
+		defer t.prof.restore(ctx)
+	}
+	d := t.beginOp(ctx, OpInsert, key)
+	defer t.endOp(d)
+	var panicked error
+	if t.guard {
+		fn = t.guardUpdate(fn, &panicked)
+	}
+	var created bool
+	retries, waited, err = t.retryCount(ctx, func() error {
+		var err error
+		old, loaded, created, err = t.insert(key, fn, deadline, d)
+		return err
+	})
+	counterFrom(ctx).add(retries, 0)
+	if err == ErrCorrupted {
+		t.markCorrupted()
+	}
+	if err == nil {
+		err = panicked
+	}
+	if err != nil {
+		return old, false, err
+	}
+	if created {
+		t.count.Add(1)
+	}
+	return old, loaded, nil
 }
 
 func (n *RBTreeNode[K, V]) swap(d *RBTreeNode[K, V]) {
 	n.key, d.key = d.key, n.key
 	d.value, n.value = n.value, d.value
+	d.box, n.box = n.box, d.box
+	n.deadline, d.deadline = d.deadline, n.deadline
+	n.seq, d.seq = d.seq, n.seq
 }
 
-func (t *RBTree[K, V]) delete(n *RBTreeNode[K, V], key K) (*V, bool) {
-	if n == nil {
-		return nil, true
+// unlink removes s, which has at most one child, from the tree. The child
+// takes s's place, and s's black if it had one.
+func (t *RBTree[K, V]) unlink(s *RBTreeNode[K, V]) {
+	rep := s.left.Load()
+	if rep == nil {
+		rep = s.right.Load()
+	}
+	p := s.parent.Load()
+	switch s.dir() {
+	case root:
+		t.root.Store(rep)
+	case left:
+		p.left.Store(rep)
+	case right:
+		p.right.Store(rep)
 	}
-	if ok := n.lock(); !ok {
-		return nil, false
+	if rep != nil {
+		rep.parent.Store(p)
+		if s.isBlack() {
+			rep.c = black
+		}
+		rep.extra += s.extra
+		s.next.Store(rep)
 	}
-	defer n.unlock()
-	switch cmp.Compare(key, n.key) {
-	case 0:
-		{
-			v := n.value
-			// case 1
-			if n.left != nil && n.right != nil {
-				// step 1: find successor s
-				s := n.right
-				p := n
-				for s.left != nil {
-					p = s
-					s = p.left
-				}
-				// step 2: swap data
-				n.swap(s)
-				n = s
-				// step 3: fall into case 2,3
+	if p != nil {
+		p.size = 1 + p.left.Load().weight() + p.right.Load().weight()
+	}
+}
+
+// delete removes key and returns the value it held. If match is not nil
+// the key is only removed when match accepts its current value. An expired
+// key is removed without asking match, and expired reports it.
+func (t *RBTree[K, V]) delete(key K, match func(V) bool, d *opDesc[K]) (_ *V, expired bool, err error) {
+	n, c, _, err := t.locate(OpDelete, key, d)
+	if err != nil || n == nil {
+		return nil, false, err
+	}
+	if c != 0 {
+		n.unlock()
+		d.hold()
+		return nil, false, nil
+	}
+	v := *n.valuePtr()
+	expired = t.expired(n, t.now())
+	if !expired && match != nil && !match(v) {
+		n.unlock()
+		d.hold()
+		return nil, false, nil
+	}
+	area := localArea[K, V]{desc: d}
+	area.own(n)
+	// case 1: with two children the successor s is unlinked instead, once
+	// its data is swapped into n. It is found with lock coupling down the
+	// left spine of n's right subtree: a smaller key linked below an
+	// unlocked successor could be rotated above it, leaving s without a
+	// left child but no longer the successor.
+	s := n
+	if n.left.Load() != nil && n.right.Load() != nil {
+		if s = n.right.Load(); !s.lock() {
+			area.unlock()
+			return nil, false, errLocked
+		}
+		for level := 0; s.left.Load() != nil; level++ {
+			next, err := s.left.Load(), errLocked
+			if level >= t.maxDepth() {
+				err = ErrCorrupted
 			}
-			// case 2: if is leaf node
-			if n.left == nil && n.right == nil {
-				if n.c == black {
-					n.unlock()
-					t.maintainAfterDelete(n)
-				}
-				if n.dir() == left {
-					n.parent.left = nil
-				} else {
-					n.parent.right = nil
-				}
-				// case 3: only have one non-nil child
-			} else {
-				var rep *RBTreeNode[K, V]
-				if n.left == nil {
-					rep = n.right
-				} else {
-					rep = n.left
-				}
-				p := n.parent
-				switch n.dir() {
-				case root:
-					t.root = rep
-				case left:
-					p.left = rep
-				case right:
-					p.right = rep
-				}
-				rep.parent = p
-				rep.c = black
+			if err == ErrCorrupted || !next.lock() {
+				s.unlock()
+				area.unlock()
+				return nil, false, err
 			}
-			t.count--
-			return &v, true
+			s.unlock()
+			s = next
+		}
+		area.own(s)
+	}
+	if !area.lockSet(removalSet, s) {
+		area.unlock()
+		return nil, false, errLocked
+	}
+	t.perturb(chaosLocked)
+	// a leaf that still owes a black waits for the fixups settling it
+	leaf := s.left.Load() == nil && s.right.Load() == nil
+	if leaf && s.extra > 0 {
+		area.unlock()
+		return nil, false, errLocked
+	}
+	// case 2: a black leaf leaves its paths one black short, which the
+	// fixup restores while s is still linked
+	fix := leaf && s.isBlack() && s.parent.Load() != nil
+	t.perturb(chaosMark)
+	if fix && (deleteWaits(area.list(), nil, s.sibling()) || !area.mark(s)) {
+		area.unlock()
+		return nil, false, errLocked
+	}
+	n.swap(s)
+	var up *RBTreeNode[K, V]
+	if fix {
+		if up = t.deleteStep(s); up != nil {
+			up.extra++
 		}
-	case -1:
-		n.unlock()
-		return t.delete(n.left, key)
-	case 1:
-		n.unlock()
-		return t.delete(n.right, key)
 	}
-	return nil, true
+	// case 3: otherwise s has at most one child that takes its place
+	p := s.parent.Load()
+	t.unlink(s)
+	area.retire(s)
+	t.moved()
+	t.record(EventDelete, key, v)
+	area.unlock()
+	if t.pool != nil {
+		t.pool.retire(s)
+	}
+	t.count.Add(-1)
+	t.fixDelete(up, d)
+	if t.ordered {
+		t.fixSize(p, d)
+	}
+	if expired {
+		t.stats.expired.Add(1)
+	}
+	return &v, expired, nil
 }
 
+// Delete removes key and returns its value, or nil if key was not present
+// or had expired.
 func (t *RBTree[K, V]) Delete(key K) *V {
-	// case 0
-	if t.count == 1 && t.root.key == key {
-		v := t.root.value
-		t.root = nil
-		t.count--
-		return &v
-	}
-	var b *V
-	var ok bool
-	for b, ok = t.delete(t.root, key); !ok; b, ok = t.root.get(key) {
-		time.Sleep(10 * time.Nanosecond)
-	}
+	b, _ := t.DeleteCtx(context.Background(), key)
 	return b
 }
 
+// DeleteCtx is like Delete but stops retrying once ctx is done or the
+// backoff policy gives up, returning the reason.
+func (t *RBTree[K, V]) DeleteCtx(ctx context.Context, key K) (*V, error) {
+	v, expired, err := t.deleteIf(ctx, key, nil)
+	if expired {
+		return nil, err
+	}
+	return v, err
+}
+
+// deleteIf runs delete under the delete locking protocol. expired reports
+// that the key it removed had expired, v is its value all the same.
+func (t *RBTree[K, V]) deleteIf(ctx context.Context, key K, match func(V) bool) (v *V, expired bool, err error) {
+	var (
+		retries int
+		waited  time.Duration
+	)
+	defer func() { err = t.opError(OpDelete, key, retries, waited, err) }()
+	if err := t.admit(ctx); err != nil {
+		return nil, false, err
+	}
+	if t.tokens != nil {
+		release, err := t.claim(ctx, OpDelete, key)
+		if err != nil {
+			return nil, false, err
+		}
+		defer release()
+	}
+	defer t.endWrite(t.beginWrite())
+	if t.prof != nil {
+		defer t.prof.restore(ctx)
+	}
+	d := t.beginOp(ctx, OpDelete, key)
+	defer t.endOp(d)
+	var panicked error
+	if t.guard && match != nil {
+		match = t.guardMatch(match, &panicked)
+	}
+	retries, waited, err = t.retryCount(ctx, func() error {
+		var err error
+		v, expired, err = t.delete(key, match, d)
+		return err
+	})
+	counterFrom(ctx).add(retries, 0)
+	if err == ErrCorrupted {
+		t.markCorrupted()
+	}
+	if err == nil && panicked != nil {
+		return nil, false, panicked
+	}
+	return v, expired, err
+}
+
+// Get returns a pointer to the value stored for key, or nil if key is not
+// present or has expired.
 func (t *RBTree[K, V]) Get(key K) *V {
-	var b *V
-	var ok bool
-	for b, ok = t.root.get(key); !ok; b, ok = t.root.get(key) {
-		time.Sleep(10 * time.Nanosecond)
-	}
+	b, _ := t.GetCtx(context.Background(), key)
 	return b
 }
 
-func (t *RBTree[K, V]) check(n *RBTreeNode[K, V], bc int) (int, error) {
+// GetCtx is like Get but stops retrying once ctx is done or the backoff
+// policy gives up, returning the reason. It returns ErrCorrupted if the
+// lookup ran past the traversal bound.
+func (t *RBTree[K, V]) GetCtx(ctx context.Context, key K) (*V, error) {
+	v, _, err := t.find(ctx, key, true)
+	return v, err
+}
+
+// Contains reports whether key is present and has not expired. It is the
+// cheapest lookup: it neither copies the value nor hands out a pointer to
+// it, and is answered from the hint cache first WithHintCache.
+func (t *RBTree[K, V]) Contains(key K) bool {
+	ok, _ := t.ContainsCtx(context.Background(), key)
+	return ok
+}
+
+// ContainsCtx is like Contains but stops retrying once ctx is done or the
+// backoff policy gives up, returning the reason.
+func (t *RBTree[K, V]) ContainsCtx(ctx context.Context, key K) (bool, error) {
+	_, found, err := t.find(ctx, key, false)
+	return found, err
+}
+
+// find is GetCtx and ContainsCtx, with the value pointer only looked up if
+// value is set. Lookups count as Gets in the statistics.
+func (t *RBTree[K, V]) find(ctx context.Context, key K, value bool) (*V, bool, error) {
+	if t.prof != nil {
+		defer t.prof.restore(ctx)
+	}
+	var (
+		b       *V
+		found   bool
+		set     *hintSet[K, V]
+		slot    int
+		hit     bool
+		retries int
+		waited  time.Duration
+		err     error
+	)
+	visited, compares := 0, 0
+	if t.hints != nil {
+		set = t.hints.get()
+		defer t.hints.sets.Put(set)
+		if b, slot, compares, hit, err = set.lookup(t, key); hit {
+			visited, found = 1, b != nil
+		}
+	}
+	if !hit && err == nil {
+		var at *RBTreeNode[K, V]
+		var gen uint64
+		retries, waited, err = t.retryCount(ctx, func() error {
+			if set != nil {
+				gen = t.hints.gen.Load()
+			}
+			var err error
+			var seen int
+			b, at, seen, err = t.get(key, value)
+			visited += seen
+			return err
+		})
+		found = at != nil
+		// every node examined was compared with key once
+		compares += visited
+		if err == nil && at != nil && set != nil {
+			set.remember(slot, key, at, gen)
+		}
+	}
+	if t.sampleGet() {
+		t.stats.recordGet(visited, retries, compares, hit)
+	}
+	counterFrom(ctx).add(retries, visited)
+	if err == ErrCorrupted {
+		t.markCorrupted()
+	}
+	if err != nil {
+		return nil, false, t.opError(OpGet, key, retries, waited, err)
+	}
+	return b, found, nil
+}
+
+func (t *RBTree[K, V]) check(n *RBTreeNode[K, V], bc int, depth int) (int, error) {
 	if n == nil {
 		return bc, nil
 	}
+	if depth <= 0 {
+		return 0, ErrCorrupted
+	}
 	if n.isRed() {
-		if n.left.isRed() || n.right.isRed() {
+		if n.left.Load().isRed() || n.right.Load().isRed() {
 			return 0, ErrParentChildDoublRed
 		}
 	}
 	if n.isBlack() {
 		bc++
 	}
-	lc, le := t.check(n.left, bc)
+	lc, le := t.check(n.left.Load(), bc, depth-1)
 	if le != nil {
 		return 0, le
 	}
-	rc, re := t.check(n.right, bc)
+	rc, re := t.check(n.right.Load(), bc, depth-1)
 	if re != nil {
 		return 0, re
 	}
@@ -644,13 +1530,46 @@ func (t *RBTree[K, V]) check(n *RBTreeNode[K, V], bc int) (int, error) {
 }
 
 func (t *RBTree[K, V]) Check() error {
-	if t.root == nil {
+	if t.corrupt.Load() {
+		return ErrCorrupted
+	}
+	r := t.root.Load()
+	if r == nil {
 		return nil
 	}
-	_, err := t.check(t.root, 0)
+	_, err := t.check(r, 0, t.maxDepth())
+	if err == nil && t.ordered {
+		_, err = t.checkSize(r, t.maxDepth())
+	}
+	if err == ErrCorrupted {
+		t.markCorrupted()
+	}
 	return err
 }
 
+// checkSize verifies that every size below n counts its subtree and has
+// been carried up to the parent. It returns the size of n's subtree.
+func (t *RBTree[K, V]) checkSize(n *RBTreeNode[K, V], depth int) (int, error) {
+	if n == nil {
+		return 0, nil
+	}
+	if depth <= 0 {
+		return 0, ErrCorrupted
+	}
+	l, err := t.checkSize(n.left.Load(), depth-1)
+	if err != nil {
+		return 0, err
+	}
+	r, err := t.checkSize(n.right.Load(), depth-1)
+	if err != nil {
+		return 0, err
+	}
+	if n.size != l+r+1 || n.parent.Load() != nil && n.reported != n.size {
+		return 0, fmt.Errorf("%w: key %v", ErrSizeMismatch, n.key)
+	}
+	return n.size, nil
+}
+
 func (c color) String() string {
 	switch c {
 	case red:
@@ -667,37 +1586,47 @@ func (n *RBTreeNode[K, V]) String() string {
 		return "nil"
 	}
 	left := "nil"
-	if n.left != nil {
-		left = fmt.Sprintf("%v", n.left.key)
+	if l := n.left.Load(); l != nil {
+		left = fmt.Sprintf("%v", l.key)
 	}
 	right := "nil"
-	if n.right != nil {
-		right = fmt.Sprintf("%v", n.right.key)
+	if r := n.right.Load(); r != nil {
+		right = fmt.Sprintf("%v", r.key)
 	}
 	parent := "nil"
-	if n.parent != nil {
-		parent = fmt.Sprintf("%v", n.parent.key)
+	if p := n.parent.Load(); p != nil {
+		parent = fmt.Sprintf("%v", p.key)
 	}
 	return fmt.Sprintf("[key: %v, value: %v, color: %s, parent: %s, left: %s, right: %s]",
-		n.key, n.value, n.c, parent, left, right)
+		n.key, *n.valuePtr(), n.c, parent, left, right)
 }
 
+// String dumps the tree one node per line, for debugging. It pauses
+// writers like Verify while it walks the tree.
 func (t *RBTree[K, V]) String() string {
-	if t.root == nil {
+	t.gate.Lock()
+	defer t.gate.Unlock()
+	r := t.root.Load()
+	if r == nil {
 		return "nil"
 	}
 	var sb strings.Builder
-	t.buildString(t.root, "", &sb)
+	t.buildString(r, "", &sb, t.maxDepth())
 	return sb.String()
 }
 
-func (t *RBTree[K, V]) buildString(n *RBTreeNode[K, V], prefix string, sb *strings.Builder) {
+func (t *RBTree[K, V]) buildString(n *RBTreeNode[K, V], prefix string, sb *strings.Builder, depth int) {
 	if n == nil {
 		return
 	}
+	if depth <= 0 {
+		sb.WriteString(fmt.Sprintf("%s%v\n", prefix, ErrCorrupted))
+		t.markCorrupted()
+		return
+	}
 	sb.WriteString(fmt.Sprintf("%s%s\n", prefix, n))
-	if n.left != nil || n.right != nil {
-		t.buildString(n.left, prefix+"L-> ", sb)
-		t.buildString(n.right, prefix+"R-> ", sb)
+	if l, r := n.left.Load(), n.right.Load(); l != nil || r != nil {
+		t.buildString(l, prefix+"L-> ", sb, depth-1)
+		t.buildString(r, prefix+"R-> ", sb, depth-1)
 	}
 }
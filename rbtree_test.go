@@ -1,8 +1,11 @@
 package rbtree_test
 
 import (
+	"bytes"
+	"cmp"
 	"fmt"
 	"math/rand/v2"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -333,4 +336,176 @@ func BenchmarkDeleteParallel(b *testing.B) {
             tree.Delete(k)
         }
     })
-}
\ No newline at end of file
+}
+
+func TestNewEmpty(t *testing.T) {
+	tree := rbtree.New[int, string]()
+	assert.Equal(t, 0, tree.Len())
+	assert.Nil(t, tree.Get(1))
+	assert.Nil(t, tree.Delete(1))
+	tree.Insert(1, "one")
+	tree.Insert(2, "two")
+	tree.Insert(2, "deux")
+	assert.Equal(t, 2, tree.Len())
+	tree.Delete(1)
+	tree.Delete(2)
+	assert.Equal(t, 0, tree.Len())
+	assert.Equal(t, "nil", tree.String())
+}
+
+func TestNewConcurrentFirstInsert(t *testing.T) {
+	for round := 0; round < 100; round++ {
+		tree := rbtree.New[int, int]()
+		wg := sync.WaitGroup{}
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				tree.Insert(i, i)
+			}()
+		}
+		wg.Wait()
+		for i := 0; i < 8; i++ {
+			if !assert.NotNil(t, tree.Get(i)) {
+				t.FailNow()
+			}
+		}
+		assert.Equal(t, 8, tree.Len())
+	}
+}
+
+func TestWithComparator(t *testing.T) {
+	tree := rbtree.New[int, int](rbtree.WithComparator(func(a, b int) int { return b - a }))
+	for i := 0; i < 10; i++ {
+		tree.Insert(i, i)
+	}
+	assert.Nil(t, tree.Check())
+	k, _ := tree.Min()
+	assert.Equal(t, 9, k)
+	k, _ = tree.Max()
+	assert.Equal(t, 0, k)
+
+	assert.Panics(t, func() {
+		rbtree.New[int, int](rbtree.WithComparator(func(a, b string) int { return 0 }))
+	})
+}
+
+func TestStableValuePointers(t *testing.T) {
+	tree := rbtree.New[int, int](rbtree.WithStableValuePointers())
+	for i := 0; i < 64; i++ {
+		tree.Insert(i, i)
+	}
+	ptrs := make(map[int]*int)
+	for i := 0; i < 64; i++ {
+		ptrs[i] = tree.Get(i)
+	}
+	for i := 0; i < 64; i += 2 {
+		tree.Delete(i)
+	}
+	for i := 1; i < 64; i += 2 {
+		assert.Equal(t, i, *ptrs[i])
+		assert.Same(t, ptrs[i], tree.Get(i))
+	}
+	assert.Nil(t, tree.Check())
+	tree.Insert(1, 100)
+	assert.Equal(t, 100, *ptrs[1])
+}
+
+func TestNewRBTreeFunc(t *testing.T) {
+	type point struct{ x, y int }
+	tree := rbtree.NewRBTreeFunc[point, string](func(a, b point) int {
+		if c := cmp.Compare(a.x, b.x); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.y, b.y)
+	})
+	tree.Insert(point{1, 2}, "a")
+	tree.Insert(point{1, 1}, "b")
+	tree.Insert(point{0, 9}, "c")
+	assert.Nil(t, tree.Check())
+	assert.Equal(t, "b", *tree.Get(point{1, 1}))
+	k, _ := tree.Min()
+	assert.Equal(t, point{0, 9}, k)
+
+	raw := rbtree.NewRBTreeFunc[[]byte, int](bytes.Compare)
+	raw.Insert([]byte("b"), 2)
+	raw.Insert([]byte("a"), 1)
+	assert.Equal(t, 1, *raw.Get([]byte("a")))
+
+	fold := rbtree.NewRBTreeFunc[string, int](func(a, b string) int {
+		return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+	})
+	fold.Insert("Key", 1)
+	fold.Insert("KEY", 2)
+	assert.Equal(t, 1, fold.Len())
+	assert.Equal(t, 2, *fold.Get("key"))
+}
+
+func TestSerializedWrites(t *testing.T) {
+	tree := rbtree.New[int, int](rbtree.WithSerializedWrites())
+	wg := sync.WaitGroup{}
+	for w := 0; w < 8; w++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				tree.Insert(i*8+w, i)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				tree.Get(i*8 + w)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Nil(t, tree.Check())
+	assert.Equal(t, 8000, tree.Len())
+	for i := 0; i < 8000; i++ {
+		assert.Equal(t, i/8, *tree.Get(i))
+	}
+}
+
+func TestDeleteRebalance(t *testing.T) {
+	tree := rbtree.New[int, int]()
+	for i := 0; i < 64; i++ {
+		tree.Insert(i, i)
+	}
+	for i := 0; i < 64; i++ {
+		tree.Delete(i)
+		assert.Nil(t, tree.Check())
+	}
+	assert.Equal(t, 0, tree.Len())
+}
+
+func TestConcurrentMixed(t *testing.T) {
+	tree := rbtree.New[int, int]()
+	wg := sync.WaitGroup{}
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 5000; i++ {
+				k := rand.IntN(512)
+				switch rand.IntN(3) {
+				case 0:
+					tree.Insert(k, k)
+				case 1:
+					tree.Delete(k)
+				default:
+					tree.Get(k)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Nil(t, tree.Check())
+	n := 0
+	tree.Range(func(key, value int) bool {
+		assert.Equal(t, key, value)
+		n++
+		return true
+	})
+	assert.Equal(t, tree.Len(), n)
+}
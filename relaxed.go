@@ -0,0 +1,108 @@
+package rbtree
+
+import "time"
+
+// sighting is a copy of a node's key and value as a relaxed read saw them
+// at time at, in Unix nanoseconds. Nothing writes it once it is published.
+type sighting[K any, V any] struct {
+	key      K
+	value    V
+	deadline int64
+	seq      uint64
+	at       int64
+}
+
+// GetRelaxed is Get for callers that want an answer now rather than a
+// precise one later, such as monitoring and diagnostics. It makes a single
+// descent and never retries or backs off, and may answer with a value that
+// is stale by up to stale.
+//
+// A node a writer holds is never read: its key and value may be changing,
+// and reading them would race with the writer. Instead every node a
+// relaxed read pins keeps a copy of its key and value, and where Get would
+// restart at a held node GetRelaxed reads the copy an earlier relaxed read
+// left and follows the node's links. stale is how long ago that copy of
+// the key's node was taken, 0 if the node was read directly; the value was
+// current then and may have been replaced or deleted since. A key that is
+// absent at its copy is reported as nil with the same bound.
+//
+// answered is false, with a nil pointer that says nothing about key, if a
+// held node on the way had never been read by GetRelaxed, or if the
+// descent went through a held node and did not find key: the links of a
+// node being rotated may lead past it. The copies cost one allocation per
+// node visited and keep a value alive until the node is read again.
+// GetRelaxed skips the hint cache and the Get statistics.
+func (t *RBTree[K, V]) GetRelaxed(key K) (v *V, stale time.Duration, answered bool) {
+	v, stale, answered, err := t.getRelaxed(key)
+	if err == ErrCorrupted {
+		t.markCorrupted()
+	}
+	if err != nil {
+		return nil, 0, false
+	}
+	return v, stale, answered
+}
+
+// getRelaxed descends like descend, pinning hand over hand, but passes
+// held nodes through their last sighting instead of giving up.
+func (t *RBTree[K, V]) getRelaxed(key K) (v *V, stale time.Duration, answered bool, err error) {
+	defer t.exit(t.enter())
+	at := time.Now().UnixNano()
+	now := t.now()
+	var pinned *RBTreeNode[K, V]
+	if t.guard {
+		// compare runs while a node may be pinned
+		defer func() {
+			if r := recover(); r != nil {
+				if pinned != nil {
+					pinned.unpin()
+				}
+				v, stale, answered, err = nil, 0, false, t.recovered(r)
+			}
+		}()
+	}
+	release := func() {
+		if pinned != nil {
+			pinned.unpin()
+			pinned = nil
+		}
+	}
+	blind := false // a link was followed out of a held node
+	n := t.root.Load()
+	for level := 0; n != nil; level++ {
+		if level >= t.maxDepth() {
+			release()
+			return nil, 0, false, ErrCorrupted
+		}
+		t.visit(OpGet, level)
+		var s *sighting[K, V]
+		if n.pin() {
+			release()
+			pinned = n
+			s = &sighting[K, V]{key: n.key, value: *n.valuePtr(), deadline: n.deadline, seq: n.seq, at: at}
+			n.seen.Store(s)
+		} else {
+			release()
+			if s = n.seen.Load(); s == nil {
+				return nil, 0, false, nil
+			}
+		}
+		c := t.compare(key, s.key)
+		if c == 0 {
+			release()
+			stale = time.Duration(at - s.at)
+			if expiredAt(s.deadline, now) || t.covered(s.key, s.seq) {
+				return nil, stale, true, nil
+			}
+			return &s.value, stale, true, nil
+		}
+		blind = blind || pinned == nil
+		if c < 0 {
+			n = n.left.Load()
+		} else {
+			n = n.right.Load()
+		}
+	}
+	release()
+	return nil, 0, !blind, nil
+}
@@ -0,0 +1,123 @@
+package rbtree
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetRelaxed(t *testing.T) {
+	tree := New[int, int](WithBackoff(Backoff{MaxRetries: 3}))
+	for k := 0; k < 100; k++ {
+		tree.Insert(k, -k)
+	}
+
+	// a held node no relaxed read has seen ends the lookup at once
+	root := tree.root.Load()
+	assert.True(t, root.lock())
+	v, _, ok := tree.GetRelaxed(42)
+	assert.False(t, ok)
+	assert.Nil(t, v)
+	root.unlock()
+
+	v, stale, ok := tree.GetRelaxed(42)
+	assert.True(t, ok)
+	assert.Equal(t, -42, *v)
+	assert.Zero(t, stale)
+	v, _, ok = tree.GetRelaxed(1000)
+	assert.True(t, ok)
+	assert.Nil(t, v)
+
+	// once seen, a held node is read through its last copy
+	time.Sleep(5 * time.Millisecond)
+	assert.True(t, root.lock())
+	old := *root.valuePtr()
+	*root.valuePtr() = 7
+	v, stale, ok = tree.GetRelaxed(root.key)
+	assert.True(t, ok)
+	assert.Equal(t, old, *v, "the value before the writer took the node")
+	assert.GreaterOrEqual(t, stale, 5*time.Millisecond)
+	v, stale, ok = tree.GetRelaxed(42)
+	assert.True(t, ok)
+	assert.Equal(t, -42, *v)
+	assert.Zero(t, stale, "the key's own node was not held")
+	v, _, ok = tree.GetRelaxed(1000)
+	assert.False(t, ok, "a miss below a held node is no answer")
+	assert.Nil(t, v)
+	_, err := tree.GetCtx(context.Background(), 42)
+	assert.ErrorIs(t, err, ErrRetriesExhausted, "Get retries instead")
+	*root.valuePtr() = old
+	root.unlock()
+	v, stale, ok = tree.GetRelaxed(root.key)
+	assert.True(t, ok)
+	assert.Equal(t, old, *v)
+	assert.Zero(t, stale)
+}
+
+func TestGetRelaxedExpired(t *testing.T) {
+	tree := New[int, int]()
+	tree.InsertWithTTL(0, 0, time.Hour)
+	tree.InsertWithTTL(1, 1, -1)
+	tree.Insert(2, 2)
+	tree.Insert(3, 3)
+	v, _, ok := tree.GetRelaxed(0)
+	assert.True(t, ok)
+	assert.Equal(t, 0, *v)
+	v, _, ok = tree.GetRelaxed(1)
+	assert.True(t, ok)
+	assert.Nil(t, v)
+
+	tree.TombstoneRange(2, 3)
+	v, _, ok = tree.GetRelaxed(2)
+	assert.True(t, ok)
+	assert.Nil(t, v)
+	v, _, ok = tree.GetRelaxed(3)
+	assert.True(t, ok)
+	assert.Equal(t, 3, *v)
+}
+
+func TestGetRelaxedPanic(t *testing.T) {
+	tree := NewRBTreeFunc[int, int](func(a, b int) int {
+		if a == 13 || b == 13 {
+			panic("13")
+		}
+		return a - b
+	}, WithPanicRecovery())
+	tree.Insert(1, 1)
+	v, _, ok := tree.GetRelaxed(13)
+	assert.False(t, ok)
+	assert.Nil(t, v)
+}
+
+func TestGetRelaxedConcurrent(t *testing.T) {
+	tree := New[int, int]()
+	for k := 0; k < 256; k++ {
+		tree.Insert(k, k)
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20000; i++ {
+			k := i % 512
+			if i%3 == 0 {
+				tree.Delete(k)
+			} else {
+				tree.Insert(k, k)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20000; i++ {
+			k := i % 512
+			if v, _, ok := tree.GetRelaxed(k); ok && v != nil {
+				assert.Equal(t, k, *v)
+			}
+		}
+	}()
+	wg.Wait()
+}
@@ -0,0 +1,144 @@
+package rbtree
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	ErrNoRow      = errors.New("scan without a current row")
+	ErrRowsClosed = errors.New("rows are closed")
+)
+
+// Rows is a cursor over a range of keys with the methods of database/sql's
+// Rows, for code that consumes scans the way it consumes query results:
+//
+//	rows := tree.Query(ctx, lo, hi)
+//	defer rows.Close()
+//	for rows.Next() {
+//		var key K
+//		var value V
+//		if err := rows.Scan(&key, &value); err != nil {
+//			return err
+//		}
+//		...
+//	}
+//	return rows.Err()
+//
+// Like Range, each Next is an independent Successor lookup, so the rows
+// are not a consistent snapshot under concurrent writers. A Rows is not
+// safe for concurrent use.
+type Rows[K any, V any] struct {
+	t      *RBTree[K, V]
+	ctx    context.Context
+	hi     K
+	from   K    // the next lookup starts here
+	first  bool // from itself is still to be looked at
+	key    K
+	value  V
+	row    bool // key and value hold the current row
+	closed bool
+	err    error
+}
+
+// Query returns the rows of the keys from lo up to but excluding hi, in
+// ascending order. The rows end once ctx is done, or a lookup's backoff
+// policy gives up, with the reason as Err.
+func (t *RBTree[K, V]) Query(ctx context.Context, lo, hi K) *Rows[K, V] {
+	r := &Rows[K, V]{t: t, ctx: ctx, hi: hi, from: lo, first: true}
+	if t.compare(lo, hi) >= 0 {
+		r.Close()
+	}
+	return r
+}
+
+// Next moves to the next row and reports whether there is one. Once it
+// returns false the rows are closed, and Err tells whether they ended
+// early.
+func (r *Rows[K, V]) Next() bool {
+	if r.closed {
+		return false
+	}
+	r.row = false
+	if err := r.ctx.Err(); err != nil {
+		r.err = err
+		r.Close()
+		return false
+	}
+	k, v, ok, err := r.t.following(r.ctx, r.from, r.first)
+	if err != nil || !ok || r.t.compare(k, r.hi) >= 0 {
+		r.err = err
+		r.Close()
+		return false
+	}
+	r.key, r.value, r.row = k, v, true
+	r.from, r.first = k, false
+	return true
+}
+
+// Scan copies the current row's key and value into key and value. Either
+// may be nil to skip it. It returns ErrNoRow unless the last Next returned
+// true, ErrRowsClosed once the rows are closed.
+func (r *Rows[K, V]) Scan(key *K, value *V) error {
+	if r.closed {
+		return ErrRowsClosed
+	}
+	if !r.row {
+		return ErrNoRow
+	}
+	if key != nil {
+		*key = r.key
+	}
+	if value != nil {
+		*value = r.value
+	}
+	return nil
+}
+
+// Err returns the error that ended the rows early, nil if they ran to the
+// end of the range or are still open.
+func (r *Rows[K, V]) Err() error {
+	return r.err
+}
+
+// Close ends the rows. It may be called more than once and always returns
+// nil; there is nothing to release, it is there for the defer that
+// database/sql code puts after every query.
+func (r *Rows[K, V]) Close() error {
+	var key K
+	var value V
+	r.key, r.value, r.from = key, value, key
+	r.row, r.closed = false, true
+	return nil
+}
+
+// following finds the first live key after key, or at it if inclusive,
+// and copies its value. ok is false if there is none.
+func (t *RBTree[K, V]) following(ctx context.Context, key K, inclusive bool) (k K, value V, ok bool, err error) {
+	if t.prof != nil {
+		defer t.prof.restore(ctx)
+	}
+	// the value is copied before a pooled node can be reused
+	defer t.exit(t.enter())
+	now := t.now()
+	for {
+		var v *V
+		var expired bool
+		err = t.retry(ctx, func() error {
+			var err error
+			k, v, expired, err = t.seek(key, false, inclusive, now, &value)
+			return err
+		})
+		if err == ErrCorrupted {
+			t.markCorrupted()
+		}
+		if err != nil || v == nil {
+			var zero V
+			return k, zero, false, err
+		}
+		if !expired {
+			return k, value, true, nil
+		}
+		key, inclusive = k, false
+	}
+}
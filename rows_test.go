@@ -0,0 +1,66 @@
+package rbtree_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iku50/rbtree-go"
+)
+
+func TestQuery(t *testing.T) {
+	tree := rbtree.New[int, string]()
+	for k := 0; k < 10; k++ {
+		tree.Insert(k, string(rune('a'+k)))
+	}
+	tree.InsertWithTTL(5, "expired", -1)
+
+	rows := tree.Query(context.Background(), 3, 8)
+	var key int
+	var value string
+	assert.ErrorIs(t, rows.Scan(&key, &value), rbtree.ErrNoRow)
+	var keys []int
+	var values []string
+	for rows.Next() {
+		assert.Nil(t, rows.Scan(&key, &value))
+		keys = append(keys, key)
+		values = append(values, value)
+	}
+	assert.Nil(t, rows.Err())
+	assert.Equal(t, []int{3, 4, 6, 7}, keys)
+	assert.Equal(t, []string{"d", "e", "g", "h"}, values)
+	assert.False(t, rows.Next())
+	assert.ErrorIs(t, rows.Scan(&key, nil), rbtree.ErrRowsClosed)
+	assert.Nil(t, rows.Close())
+
+	// closing early, and skipping a field
+	rows = tree.Query(context.Background(), 0, 100)
+	assert.True(t, rows.Next())
+	assert.Nil(t, rows.Scan(nil, &value))
+	assert.Equal(t, "a", value)
+	assert.Nil(t, rows.Close())
+	assert.Nil(t, rows.Close())
+	assert.False(t, rows.Next())
+	assert.Nil(t, rows.Err())
+
+	for _, r := range [][2]int{{8, 3}, {3, 3}, {20, 30}} {
+		rows = tree.Query(context.Background(), r[0], r[1])
+		assert.False(t, rows.Next(), "range %v", r)
+		assert.Nil(t, rows.Err())
+	}
+}
+
+func TestQueryCanceled(t *testing.T) {
+	tree := rbtree.New[int, int](rbtree.WithBackoff(rbtree.Backoff{Base: time.Millisecond}))
+	for k := 0; k < 10; k++ {
+		tree.Insert(k, k)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	rows := tree.Query(ctx, 0, 10)
+	assert.True(t, rows.Next())
+	cancel()
+	assert.False(t, rows.Next())
+	assert.ErrorIs(t, rows.Err(), context.Canceled)
+}
@@ -0,0 +1,471 @@
+package rbtree
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+)
+
+var (
+	ErrUnsorted       = errors.New("keys are not strictly ascending")
+	ErrLengthMismatch = errors.New("keys and values differ in length")
+	ErrBadEncoding    = errors.New("invalid tree encoding")
+)
+
+// encodingVersion is bumped whenever the wire layout changes.
+const encodingVersion = 1
+
+// wireHeader starts every encoded tree.
+type wireHeader struct {
+	Version int `json:"version"`
+	Count   int `json:"count"`
+}
+
+// SnapshotNode is one node of an encoded tree. Nodes are written in
+// preorder, Left and Right tell whether the node has the respective child,
+// so the original shape and colors can be rebuilt exactly.
+type SnapshotNode[K any, V any] struct {
+	Key   K    `json:"key"`
+	Value V    `json:"value"`
+	Red   bool `json:"red,omitempty"`
+	Left  bool `json:"left,omitempty"`
+	Right bool `json:"right,omitempty"`
+}
+
+type wireTree[K any, V any] struct {
+	wireHeader
+	Nodes []SnapshotNode[K, V] `json:"nodes"`
+}
+
+// wire lists the snapshot's nodes in preorder. Keys that have expired are
+// left out, and if there are any the live ones are laid out afresh, as
+// dropping nodes would break the shape.
+func (s *Snapshot[K, V]) wire() []SnapshotNode[K, V] {
+	if now := s.now(); now != 0 {
+		live := make([]*frozenNode[K, V], 0, s.count)
+		var collect func(n *frozenNode[K, V])
+		collect = func(n *frozenNode[K, V]) {
+			if n == nil {
+				return
+			}
+			collect(n.left)
+			if !n.expired(now) {
+				live = append(live, n)
+			}
+			collect(n.right)
+		}
+		collect(s.root)
+		if len(live) < s.count {
+			return layout(live)
+		}
+	}
+	nodes := make([]SnapshotNode[K, V], 0, s.count)
+	var walk func(n *frozenNode[K, V])
+	walk = func(n *frozenNode[K, V]) {
+		if n == nil {
+			return
+		}
+		nodes = append(nodes, SnapshotNode[K, V]{
+			Key:   n.key,
+			Value: n.value,
+			Red:   n.c == red,
+			Left:  n.left != nil,
+			Right: n.right != nil,
+		})
+		walk(n.left)
+		walk(n.right)
+	}
+	walk(s.root)
+	return nodes
+}
+
+// layout lists the nodes of the balanced tree NewFromSorted would build
+// from sorted, in preorder.
+func layout[K any, V any](sorted []*frozenNode[K, V]) []SnapshotNode[K, V] {
+	nodes := make([]SnapshotNode[K, V], 0, len(sorted))
+	rl := redLevel(len(sorted))
+	var lay func(lo, hi, level int)
+	lay = func(lo, hi, level int) {
+		if lo >= hi {
+			return
+		}
+		mid := int(uint(lo+hi) >> 1)
+		nodes = append(nodes, SnapshotNode[K, V]{
+			Key:   sorted[mid].key,
+			Value: sorted[mid].value,
+			Red:   level == rl,
+			Left:  lo < mid,
+			Right: mid+1 < hi,
+		})
+		lay(lo, mid, level+1)
+		lay(mid+1, hi, level+1)
+	}
+	lay(0, len(sorted), 0)
+	return nodes
+}
+
+// MarshalBinary encodes the snapshot as a gob stream: a header followed by
+// one value per node in preorder.
+func (s *Snapshot[K, V]) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	nodes := s.wire()
+	if err := enc.Encode(wireHeader{Version: encodingVersion, Count: len(nodes)}); err != nil {
+		return nil, err
+	}
+	for _, n := range nodes {
+		if err := enc.Encode(n); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// MarshalJSON encodes the snapshot's nodes in preorder together with their
+// colors and shape.
+func (s *Snapshot[K, V]) MarshalJSON() ([]byte, error) {
+	nodes := s.wire()
+	return json.Marshal(wireTree[K, V]{
+		wireHeader: wireHeader{Version: encodingVersion, Count: len(nodes)},
+		Nodes:      nodes,
+	})
+}
+
+// MarshalBinary encodes a snapshot of the tree, see Snapshot.MarshalBinary.
+func (t *RBTree[K, V]) MarshalBinary() ([]byte, error) {
+	return t.Snapshot().MarshalBinary()
+}
+
+// MarshalJSON encodes a snapshot of the tree, see Snapshot.MarshalJSON.
+func (t *RBTree[K, V]) MarshalJSON() ([]byte, error) {
+	return t.Snapshot().MarshalJSON()
+}
+
+// UnmarshalBinary replaces the tree's content with data produced by
+// MarshalBinary. The tree must have been created by New or NewRBTreeFunc,
+// since the encoding does not carry the comparator.
+func (t *RBTree[K, V]) UnmarshalBinary(data []byte) error {
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	var h wireHeader
+	if err := dec.Decode(&h); err != nil {
+		return err
+	}
+	if h.Version != encodingVersion || h.Count < 0 {
+		return fmt.Errorf("%w: version %d, count %d", ErrBadEncoding, h.Version, h.Count)
+	}
+	i := 0
+	next := func() (SnapshotNode[K, V], error) {
+		var n SnapshotNode[K, V]
+		if i == h.Count {
+			return n, fmt.Errorf("%w: more than %d nodes", ErrBadEncoding, h.Count)
+		}
+		i++
+		err := dec.Decode(&n)
+		return n, err
+	}
+	return t.restore(h, next)
+}
+
+// IterateSnapshot calls f for each key and value of a tree encoded by
+// MarshalBinary, in ascending key order, until f returns false. It reads the
+// encoding from r as a stream and keeps only one path of the tree in memory,
+// so the tree is never rebuilt. The key order is the one the tree was
+// written with; it is not checked again, since r carries no comparator.
+func IterateSnapshot[K any, V any](r io.ReaderAt, f func(key K, value V) bool) error {
+	dec := gob.NewDecoder(io.NewSectionReader(r, 0, math.MaxInt64))
+	var h wireHeader
+	if err := dec.Decode(&h); err != nil {
+		return err
+	}
+	if h.Version != encodingVersion || h.Count < 0 {
+		return fmt.Errorf("%w: version %d, count %d", ErrBadEncoding, h.Version, h.Count)
+	}
+	if h.Count == 0 {
+		return nil
+	}
+	maxDepth := 2*bits.Len(uint(h.Count)) + depthSlack
+	// pending holds the nodes whose left subtree is being read, innermost
+	// last. Each is yielded once its left subtree is done.
+	var pending []SnapshotNode[K, V]
+	read := 0
+	for {
+		// Read down the left spine of the next subtree.
+		var n SnapshotNode[K, V]
+		for {
+			if read == h.Count {
+				return fmt.Errorf("%w: more than %d nodes", ErrBadEncoding, h.Count)
+			}
+			read++
+			n = SnapshotNode[K, V]{}
+			if err := dec.Decode(&n); err != nil {
+				return err
+			}
+			if !n.Left {
+				break
+			}
+			if len(pending)+1 >= maxDepth {
+				return fmt.Errorf("%w: too deep for %d nodes", ErrBadEncoding, h.Count)
+			}
+			pending = append(pending, n)
+		}
+		// Yield nodes until one has a right subtree to read next.
+		for {
+			if !f(n.Key, n.Value) {
+				return nil
+			}
+			if n.Right {
+				break
+			}
+			if len(pending) == 0 {
+				if read != h.Count {
+					return fmt.Errorf("%w: %d nodes, header says %d", ErrBadEncoding, read, h.Count)
+				}
+				return nil
+			}
+			n = pending[len(pending)-1]
+			pending = pending[:len(pending)-1]
+		}
+	}
+}
+
+// UnmarshalJSON replaces the tree's content with data produced by
+// MarshalJSON, see UnmarshalBinary.
+func (t *RBTree[K, V]) UnmarshalJSON(data []byte) error {
+	var w wireTree[K, V]
+	if err := json.Unmarshal(data, &w); err != nil {
+		return err
+	}
+	if w.Version != encodingVersion || w.Count != len(w.Nodes) {
+		return fmt.Errorf("%w: version %d, count %d", ErrBadEncoding, w.Version, w.Count)
+	}
+	return t.restoreNodes(w.Nodes)
+}
+
+// restoreNodes is restore for nodes decoded as a whole.
+func (t *RBTree[K, V]) restoreNodes(nodes []SnapshotNode[K, V]) error {
+	i := 0
+	next := func() (SnapshotNode[K, V], error) {
+		if i == len(nodes) {
+			return SnapshotNode[K, V]{}, fmt.Errorf("%w: more than %d nodes", ErrBadEncoding, len(nodes))
+		}
+		i++
+		return nodes[i-1], nil
+	}
+	return t.restore(wireHeader{Version: encodingVersion, Count: len(nodes)}, next)
+}
+
+// restore rebuilds the nodes produced by next, checks that they form a
+// valid red-black tree under t's comparator and installs them.
+func (t *RBTree[K, V]) restore(h wireHeader, next func() (SnapshotNode[K, V], error)) error {
+	if t.compare == nil {
+		return errors.New("rbtree: decoding into a tree not created by New or NewRBTreeFunc")
+	}
+	count := 0
+	var build func(parent *RBTreeNode[K, V], depth int) (*RBTreeNode[K, V], error)
+	build = func(parent *RBTreeNode[K, V], depth int) (*RBTreeNode[K, V], error) {
+		if depth <= 0 {
+			return nil, fmt.Errorf("%w: too deep for %d nodes", ErrBadEncoding, h.Count)
+		}
+		w, err := next()
+		if err != nil {
+			return nil, err
+		}
+		if err := t.checkKey(w.Key); err != nil {
+			return nil, err
+		}
+		count++
+		n := t.newNode(w.Key, w.Value, parent)
+		n.c = black
+		if w.Red {
+			n.c = red
+		}
+		if w.Left {
+			c, err := build(n, depth-1)
+			if err != nil {
+				return nil, err
+			}
+			n.left.Store(c)
+		}
+		if w.Right {
+			c, err := build(n, depth-1)
+			if err != nil {
+				return nil, err
+			}
+			n.right.Store(c)
+		}
+		n.resize()
+		return n, nil
+	}
+	var root *RBTreeNode[K, V]
+	if h.Count > 0 {
+		var err error
+		if root, err = build(nil, 2*bits.Len(uint(h.Count))+depthSlack); err != nil {
+			return err
+		}
+	}
+	if count != h.Count {
+		return fmt.Errorf("%w: %d nodes, header says %d", ErrBadEncoding, count, h.Count)
+	}
+	if err := t.checkOrder(root); err != nil {
+		return err
+	}
+	if _, err := t.check(root, 0, h.Count+1); err != nil {
+		return err
+	}
+	t.install(root, count)
+	return nil
+}
+
+// install replaces the tree's content with the count nodes below root while
+// writers are paused.
+func (t *RBTree[K, V]) install(root *RBTreeNode[K, V], count int) {
+	t.gate.Lock()
+	defer t.gate.Unlock()
+	t.root.Store(root)
+	t.count.Store(int64(count))
+	t.moved()
+	t.resync()
+}
+
+// checkOrder verifies that an in-order walk below n yields strictly
+// ascending keys.
+func (t *RBTree[K, V]) checkOrder(n *RBTreeNode[K, V]) error {
+	var prev *RBTreeNode[K, V]
+	var walk func(n *RBTreeNode[K, V]) error
+	walk = func(n *RBTreeNode[K, V]) error {
+		if n == nil {
+			return nil
+		}
+		if err := walk(n.left.Load()); err != nil {
+			return err
+		}
+		if prev != nil && t.compare(prev.key, n.key) >= 0 {
+			return fmt.Errorf("%w: key %v after %v", ErrUnsorted, n.key, prev.key)
+		}
+		prev = n
+		return walk(n.right.Load())
+	}
+	return walk(n)
+}
+
+// NewFromSorted builds a balanced tree from keys in strictly ascending
+// order and their values in O(n), without rebalancing.
+func NewFromSorted[K cmp.Ordered, V any](keys []K, values []V, opts ...Option) (*RBTree[K, V], error) {
+	return NewFromSortedFunc(cmp.Compare[K], keys, values, opts...)
+}
+
+// NewFromSortedFunc is NewFromSorted for keys ordered by compare, see
+// NewRBTreeFunc.
+func NewFromSortedFunc[K any, V any](compare func(a, b K) int, keys []K, values []V, opts ...Option) (*RBTree[K, V], error) {
+	t := newTree[K, V](compare, newOptions(opts))
+	if err := t.load(keys, values); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// load replaces the content of an unshared tree with a balanced tree built
+// from sorted keys and values.
+func (t *RBTree[K, V]) load(keys []K, values []V) error {
+	root, err := t.build(keys, values)
+	if err != nil {
+		return err
+	}
+	t.root.Store(root)
+	t.count.Store(int64(len(keys)))
+	return nil
+}
+
+// build returns a balanced tree of new nodes holding sorted keys and values.
+func (t *RBTree[K, V]) build(keys []K, values []V) (*RBTreeNode[K, V], error) {
+	if len(keys) != len(values) {
+		return nil, ErrLengthMismatch
+	}
+	for i := range keys {
+		if i > 0 && t.compare(keys[i-1], keys[i]) >= 0 {
+			return nil, fmt.Errorf("%w: key %v after %v", ErrUnsorted, keys[i], keys[i-1])
+		}
+		if err := t.checkKey(keys[i]); err != nil {
+			return nil, err
+		}
+	}
+	built := 0
+	return balanced(len(keys), func(i int, parent *RBTreeNode[K, V]) *RBTreeNode[K, V] {
+		if built++; t.progress != nil && (built%batchCheckpoint == 0 || built == len(keys)) {
+			t.progress(built, len(keys))
+		}
+		return t.newNode(keys[i], values[i], parent)
+	}), nil
+}
+
+// balanced links n nodes, created by node for their index in key order,
+// into a balanced tree and returns its root. The midpoint split fills every
+// level but the last, whose nodes are colored red unless the tree is
+// perfect. That keeps black heights equal.
+func balanced[K any, V any](n int, node func(i int, parent *RBTreeNode[K, V]) *RBTreeNode[K, V]) *RBTreeNode[K, V] {
+	rl := redLevel(n)
+	var build func(lo, hi, level int, parent *RBTreeNode[K, V]) *RBTreeNode[K, V]
+	build = func(lo, hi, level int, parent *RBTreeNode[K, V]) *RBTreeNode[K, V] {
+		if lo >= hi {
+			return nil
+		}
+		mid := int(uint(lo+hi) >> 1)
+		n := node(mid, parent)
+		n.c = black
+		if level == rl {
+			n.c = red
+		}
+		n.left.Store(build(lo, mid, level+1, n))
+		n.right.Store(build(mid+1, hi, level+1, n))
+		n.resize()
+		return n
+	}
+	return build(0, n, 0, nil)
+}
+
+// redLevel is the level balanced colors red in a tree of n nodes, or -1.
+func redLevel(n int) int {
+	if n&(n+1) == 0 {
+		return -1
+	}
+	return bits.Len(uint(n)) - 1
+}
+
+// SnapshotCodec is a wire format for snapshots, see Snapshot.Encode and
+// RBTree.Decode. Encode writes the nodes of a snapshot, which come in
+// preorder, and Decode reads them back in the same order. The nodes carry
+// the colors and shape, so the tree is rebuilt exactly. CBORCodec and
+// ProtobufCodec are built in, for consumers that are not written in Go,
+// unless the package is built with the rbtree_core tag. Codecs that need
+// other modules belong in packages of their own that implement this
+// interface.
+type SnapshotCodec[K any, V any] interface {
+	Encode(w io.Writer, nodes []SnapshotNode[K, V]) error
+	Decode(r io.Reader) ([]SnapshotNode[K, V], error)
+}
+
+// Encode writes the snapshot to w in c's format.
+func (s *Snapshot[K, V]) Encode(w io.Writer, c SnapshotCodec[K, V]) error {
+	return c.Encode(w, s.wire())
+}
+
+// Encode writes a snapshot of the tree, see Snapshot.Encode.
+func (t *RBTree[K, V]) Encode(w io.Writer, c SnapshotCodec[K, V]) error {
+	return t.Snapshot().Encode(w, c)
+}
+
+// Decode replaces the tree's content with a snapshot read from r in c's
+// format, see UnmarshalBinary.
+func (t *RBTree[K, V]) Decode(r io.Reader, c SnapshotCodec[K, V]) error {
+	nodes, err := c.Decode(r)
+	if err != nil {
+		return err
+	}
+	return t.restoreNodes(nodes)
+}
@@ -0,0 +1,125 @@
+package rbtree_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iku50/rbtree-go"
+)
+
+func TestNewFromSorted(t *testing.T) {
+	for n := 0; n < 300; n++ {
+		keys := make([]int, n)
+		values := make([]string, n)
+		for i := range keys {
+			keys[i] = i * 2
+			values[i] = fmt.Sprint(i)
+		}
+		tree, err := rbtree.NewFromSorted(keys, values)
+		if !assert.Nil(t, err) || !assert.Nil(t, tree.Check(), "n=%d", n) {
+			t.FailNow()
+		}
+		assert.Equal(t, n, tree.Len())
+		for i := range keys {
+			assert.Equal(t, values[i], *tree.Get(keys[i]))
+		}
+		tree.Insert(-1, "")
+		assert.Nil(t, tree.Check())
+	}
+
+	_, err := rbtree.NewFromSorted([]int{1, 3, 2}, []int{1, 2, 3})
+	assert.ErrorIs(t, err, rbtree.ErrUnsorted)
+	_, err = rbtree.NewFromSorted([]int{1, 1}, []int{1, 2})
+	assert.ErrorIs(t, err, rbtree.ErrUnsorted)
+	_, err = rbtree.NewFromSorted([]int{1}, []int{})
+	assert.ErrorIs(t, err, rbtree.ErrLengthMismatch)
+}
+
+func newSerializeTree() *rbtree.RBTree[int, string] {
+	tree := rbtree.New[int, string]()
+	for i := 0; i < 200; i++ {
+		tree.Insert(i*7%200, fmt.Sprint(i))
+	}
+	return tree
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	tree := newSerializeTree()
+	data, err := tree.MarshalBinary()
+	assert.Nil(t, err)
+
+	got := rbtree.New[int, string]()
+	assert.Nil(t, got.UnmarshalBinary(data))
+	assert.Nil(t, got.Check())
+	assert.Equal(t, tree.Snapshot().Tree().String(), got.String(), "the shape of the snapshot")
+	assert.Equal(t, tree.Len(), got.Len())
+
+	assert.NotNil(t, got.UnmarshalBinary(data[:len(data)/2]))
+	assert.Equal(t, tree.Len(), got.Len())
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	tree := newSerializeTree()
+	data, err := json.Marshal(tree)
+	assert.Nil(t, err)
+
+	got := rbtree.New[int, string]()
+	assert.Nil(t, json.Unmarshal(data, got))
+	assert.Nil(t, got.Check())
+	assert.Equal(t, tree.Snapshot().Tree().String(), got.String(), "the shape of the snapshot")
+
+	bad := `{"version":1,"count":2,"nodes":[{"key":1,"value":"a","right":true},{"key":0,"value":"b","red":true}]}`
+	assert.ErrorIs(t, json.Unmarshal([]byte(bad), got), rbtree.ErrUnsorted)
+	bad = `{"version":1,"count":2,"nodes":[{"key":1,"value":"a","right":true},{"key":2,"value":"b"}]}`
+	assert.ErrorIs(t, json.Unmarshal([]byte(bad), got), rbtree.ErrBlackHeightMisMatch)
+	assert.Equal(t, tree.Len(), got.Len())
+}
+
+func TestIterateSnapshot(t *testing.T) {
+	tree := newSerializeTree()
+	data, err := tree.MarshalBinary()
+	assert.Nil(t, err)
+	path := filepath.Join(t.TempDir(), "tree.gob")
+	assert.Nil(t, os.WriteFile(path, data, 0o600))
+	f, err := os.Open(path)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	var keys []int
+	err = rbtree.IterateSnapshot(f, func(key int, value string) bool {
+		assert.Equal(t, *tree.Get(key), value)
+		keys = append(keys, key)
+		return true
+	})
+	assert.Nil(t, err)
+	var want []int
+	tree.Range(func(key int, _ string) bool {
+		want = append(want, key)
+		return true
+	})
+	assert.Equal(t, want, keys)
+
+	n := 0
+	err = rbtree.IterateSnapshot(f, func(int, string) bool {
+		n++
+		return n < 3
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+
+	empty, err := rbtree.New[int, string]().MarshalBinary()
+	assert.Nil(t, err)
+	assert.Nil(t, rbtree.IterateSnapshot(bytes.NewReader(empty), func(int, string) bool {
+		t.Fatal("empty snapshot yielded a key")
+		return false
+	}))
+
+	err = rbtree.IterateSnapshot(bytes.NewReader(data[:len(data)/2]), func(int, string) bool { return true })
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,358 @@
+package rbtree
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Snapshot is an immutable point-in-time copy of a tree. Once taken it can
+// be read, iterated and serialized from any number of goroutines while the
+// tree it was taken from keeps changing.
+type Snapshot[K any, V any] struct {
+	root     *frozenNode[K, V]
+	count    int
+	compare  func(a, b K) int
+	expiring bool   // some keys have deadlines
+	gen      uint64 // changelog generation the copy was taken at
+}
+
+// frozenNode is a node of a snapshot. Nothing writes it once the copy is
+// made, so it does without the atomic links, the lock, pin and marker
+// flags and the fixup state of RBTreeNode.
+type frozenNode[K any, V any] struct {
+	left, right *frozenNode[K, V]
+	key         K
+	value       V
+	deadline    int64
+	c           color
+}
+
+func (n *frozenNode[K, V]) expired(now int64) bool {
+	return expiredAt(n.deadline, now)
+}
+
+// now is the time a read of the snapshot checks deadlines against, or 0 if
+// no key has one, like RBTree.now. Keys keep expiring after the copy.
+func (s *Snapshot[K, V]) now() int64 {
+	if !s.expiring {
+		return 0
+	}
+	return time.Now().UnixNano()
+}
+
+// Snapshot returns a consistent copy of the tree, as it was at some point
+// during the call. Writers keep going while it is taken: Snapshot walks
+// the keys one lookup at a time, as Range does, while the writes note the
+// keys they change, and then pauses writers only to read those keys again.
+// The pause grows with the writes made during the walk, not with the size
+// of the tree.
+//
+// If the tree is replaced as a whole meanwhile, by a load, Clear, Split or
+// Join, if a range tombstone is added, or if more keys are written than
+// the tree held, the walk is void and Snapshot copies the tree with
+// writers paused instead. Readers are never paused.
+func (t *RBTree[K, V]) Snapshot() *Snapshot[K, V] {
+	t.snapMu.Lock()
+	defer t.snapMu.Unlock()
+	c := &copyLog[K]{limit: max(t.Len(), copyLogMin)}
+	t.copying.Store(c)
+	defer t.copying.Store(nil)
+	walked, ok := t.walkFrozen(c)
+	t.gate.Lock()
+	defer t.gate.Unlock()
+	if !ok || c.whole.Load() {
+		return t.frozenCopy()
+	}
+	s := &Snapshot[K, V]{compare: t.compare, expiring: t.expiring.Load(), gen: t.Generation()}
+	nodes := t.catchUp(walked, c.keys)
+	s.root, s.count = balancedFrozen(nodes), len(nodes)
+	return s
+}
+
+// frozenCopy copies the tree node by node, keeping its shape and colors.
+// Writers must be paused.
+func (t *RBTree[K, V]) frozenCopy() *Snapshot[K, V] {
+	s := &Snapshot[K, V]{compare: t.compare, expiring: t.expiring.Load(), gen: t.Generation()}
+	s.root = t.freeze(t.root.Load(), &s.count, t.maxDepth())
+	return s
+}
+
+// Clone returns an independent tree with the same contents and options,
+// taken like Snapshot.
+func (t *RBTree[K, V]) Clone() *RBTree[K, V] {
+	c := newTree[K, V](t.compare, t.opts)
+	c.adopt(t.Snapshot())
+	return c
+}
+
+// copyLogMin is the number of writes a Snapshot of a small tree lets pass
+// before it gives up its walk.
+const copyLogMin = 1024
+
+// copyLog collects the keys written while Snapshot walks the tree.
+type copyLog[K any] struct {
+	mu    sync.Mutex
+	keys  []K
+	limit int         // keys to note at most
+	whole atomic.Bool // the walk is void, see Snapshot
+}
+
+func (c *copyLog[K]) note(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.keys) == c.limit {
+		c.void()
+		return
+	}
+	c.keys = append(c.keys, key)
+}
+
+func (c *copyLog[K]) void() {
+	c.whole.Store(true)
+}
+
+// walkFrozen copies the keys in ascending order, one lookup each, until
+// the walk is done or c is void. ok is false if it did not finish.
+func (t *RBTree[K, V]) walkFrozen(c *copyLog[K]) (nodes []*frozenNode[K, V], ok bool) {
+	ctx := context.Background()
+	var from *K
+	for !c.whole.Load() {
+		var f *frozenNode[K, V]
+		err := t.retry(ctx, func() error {
+			var err error
+			f, err = t.frozenAfter(from)
+			return err
+		})
+		if err != nil {
+			return nil, false
+		}
+		if f == nil {
+			return nodes, true
+		}
+		nodes = append(nodes, f)
+		from = &f.key
+	}
+	return nil, false
+}
+
+// frozenAfter copies the node with the smallest key after from, or the
+// smallest of all if from is nil. It returns nil if there is none.
+func (t *RBTree[K, V]) frozenAfter(from *K) (f *frozenNode[K, V], err error) {
+	var best frozenNode[K, V]
+	found := false
+	_, err = t.descend(OpSeek, func(n *RBTreeNode[K, V]) *RBTreeNode[K, V] {
+		if from != nil && t.compare(*from, n.key) >= 0 {
+			return n.right.Load()
+		}
+		// the candidate is copied while n is pinned
+		best, found = t.frozen(n), true
+		return n.left.Load()
+	})
+	if err != nil || !found {
+		return nil, err
+	}
+	return &best, nil
+}
+
+// catchUp reads the keys written during the walk again, with writers
+// paused, and merges them into walked: a key stored since takes its
+// current value, one deleted since is left out.
+func (t *RBTree[K, V]) catchUp(walked []*frozenNode[K, V], keys []K) []*frozenNode[K, V] {
+	if len(keys) == 0 {
+		return walked
+	}
+	slices.SortFunc(keys, t.compare)
+	keys = slices.CompactFunc(keys, func(a, b K) bool { return t.compare(a, b) == 0 })
+	nodes := make([]*frozenNode[K, V], 0, len(walked)+len(keys))
+	i := 0
+	for _, k := range keys {
+		for i < len(walked) && t.compare(walked[i].key, k) < 0 {
+			nodes = append(nodes, walked[i])
+			i++
+		}
+		if i < len(walked) && t.compare(walked[i].key, k) == 0 {
+			i++
+		}
+		if f := t.frozenAt(k); f != nil {
+			nodes = append(nodes, f)
+		}
+	}
+	return append(nodes, walked[i:]...)
+}
+
+// frozenAt copies the node holding key, or returns nil if there is none.
+// Writers must be paused.
+func (t *RBTree[K, V]) frozenAt(key K) *frozenNode[K, V] {
+	n := t.root.Load()
+	for depth := t.maxDepth(); n != nil; depth-- {
+		if depth <= 0 {
+			t.markCorrupted()
+			return nil
+		}
+		c := t.compare(key, n.key)
+		if c == 0 {
+			f := t.frozen(n)
+			return &f
+		}
+		if c < 0 {
+			n = n.left.Load()
+		} else {
+			n = n.right.Load()
+		}
+	}
+	return nil
+}
+
+// balancedFrozen links the sorted nodes into the tree balanced would build
+// from them, and returns its root.
+func balancedFrozen[K any, V any](sorted []*frozenNode[K, V]) *frozenNode[K, V] {
+	rl := redLevel(len(sorted))
+	var build func(lo, hi, level int) *frozenNode[K, V]
+	build = func(lo, hi, level int) *frozenNode[K, V] {
+		if lo >= hi {
+			return nil
+		}
+		mid := int(uint(lo+hi) >> 1)
+		n := sorted[mid]
+		n.c = black
+		if level == rl {
+			n.c = red
+		}
+		n.left, n.right = build(lo, mid, level+1), build(mid+1, hi, level+1)
+		return n
+	}
+	return build(0, len(sorted), 0)
+}
+
+// freeze copies the subtree below n into frozen nodes, counting them into
+// count.
+func (t *RBTree[K, V]) freeze(n *RBTreeNode[K, V], count *int, depth int) *frozenNode[K, V] {
+	if n == nil {
+		return nil
+	}
+	if depth <= 0 {
+		t.markCorrupted()
+		return nil
+	}
+	*count++
+	f := t.frozen(n)
+	f.left = t.freeze(n.left.Load(), count, depth-1)
+	f.right = t.freeze(n.right.Load(), count, depth-1)
+	return &f
+}
+
+// frozen copies n, which must be pinned or held, without its links. The
+// value is copied out of its box, and a key covered by a range tombstone
+// is frozen as an expired one.
+func (t *RBTree[K, V]) frozen(n *RBTreeNode[K, V]) frozenNode[K, V] {
+	deadline := n.deadline
+	if t.buried(n) {
+		deadline = 1
+	}
+	return frozenNode[K, V]{
+		key:      n.key,
+		value:    *n.valuePtr(),
+		deadline: deadline,
+		c:        n.c,
+	}
+}
+
+// thaw copies the frozen subtree below n into fresh tree nodes, counting
+// them into count.
+func thaw[K any, V any](n *frozenNode[K, V], parent *RBTreeNode[K, V], count *int) *RBTreeNode[K, V] {
+	if n == nil {
+		return nil
+	}
+	c := &RBTreeNode[K, V]{
+		c:        n.c,
+		key:      n.key,
+		value:    n.value,
+		deadline: n.deadline,
+	}
+	c.parent.Store(parent)
+	*count++
+	c.left.Store(thaw(n.left, c, count))
+	c.right.Store(thaw(n.right, c, count))
+	c.resize()
+	return c
+}
+
+// Tree returns a new live tree holding the snapshot's contents, built with
+// the given options the same way New is. The snapshot is not modified.
+func (s *Snapshot[K, V]) Tree(opts ...Option) *RBTree[K, V] {
+	t := newTree[K, V](s.compare, newOptions(opts))
+	t.adopt(s)
+	return t
+}
+
+// adopt installs a copy of s's nodes as t's content. t must be empty and
+// not yet shared.
+func (t *RBTree[K, V]) adopt(s *Snapshot[K, V]) {
+	var count int
+	root := thaw(s.root, nil, &count)
+	if t.stable {
+		boxValues(root)
+	}
+	t.root.Store(root)
+	t.count.Store(int64(count))
+	if s.expiring {
+		t.expiring.Store(true)
+	}
+}
+
+func boxValues[K any, V any](n *RBTreeNode[K, V]) {
+	if n == nil {
+		return
+	}
+	n.box = new(V)
+	*n.box = n.value
+	var zero V
+	n.value = zero
+	boxValues(n.left.Load())
+	boxValues(n.right.Load())
+}
+
+// Len returns the number of keys in the snapshot. Like RBTree.Len it
+// counts keys that have expired but were not removed yet.
+func (s *Snapshot[K, V]) Len() int {
+	return s.count
+}
+
+// Get returns a pointer to the value stored for key, or nil if key is not
+// present or has expired. The value must not be modified.
+func (s *Snapshot[K, V]) Get(key K) *V {
+	n := s.root
+	for n != nil {
+		c := s.compare(key, n.key)
+		if c == 0 {
+			if n.expired(s.now()) {
+				return nil
+			}
+			return &n.value
+		}
+		if c < 0 {
+			n = n.left
+		} else {
+			n = n.right
+		}
+	}
+	return nil
+}
+
+// Range calls f for each key and value in ascending key order until f
+// returns false. Keys that have expired are passed over.
+func (s *Snapshot[K, V]) Range(f func(key K, value V) bool) {
+	s.walk(s.root, s.now(), f)
+}
+
+// walk calls f for the keys below n in order, passing over those that had
+// expired by now.
+func (s *Snapshot[K, V]) walk(n *frozenNode[K, V], now int64, f func(key K, value V) bool) bool {
+	if n == nil {
+		return true
+	}
+	return s.walk(n.left, now, f) && (n.expired(now) || f(n.key, n.value)) && s.walk(n.right, now, f)
+}
@@ -0,0 +1,111 @@
+package rbtree_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iku50/rbtree-go"
+)
+
+func TestSnapshot(t *testing.T) {
+	tree := rbtree.New[int, int]()
+	for i := 0; i < 100; i++ {
+		tree.Insert(i, i)
+	}
+	snap := tree.Snapshot()
+	for i := 0; i < 100; i++ {
+		tree.Insert(i, -i)
+	}
+	tree.Insert(100, 100)
+
+	assert.Equal(t, 100, snap.Len())
+	assert.Equal(t, 7, *snap.Get(7))
+	assert.Nil(t, snap.Get(100))
+	next := 0
+	snap.Range(func(k, v int) bool {
+		assert.Equal(t, next, k)
+		assert.Equal(t, next, v)
+		next++
+		return true
+	})
+	assert.Equal(t, 100, next)
+}
+
+func TestSnapshotConcurrentWriters(t *testing.T) {
+	tree := rbtree.New[int, int]()
+	wg := sync.WaitGroup{}
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				tree.Insert(w*10000+i, i)
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		snap := tree.Snapshot()
+		n := 0
+		snap.Range(func(int, int) bool {
+			n++
+			return true
+		})
+		assert.Equal(t, snap.Len(), n)
+	}
+	wg.Wait()
+	assert.Equal(t, tree.Len(), tree.Snapshot().Len())
+}
+
+func TestSnapshotPointInTime(t *testing.T) {
+	// each writer bumps its low key and then its high key, which the walk
+	// reaches much later, so at any instant low is high or high+1
+	const writers, filler = 4, 50000
+	tree := rbtree.New[int, int]()
+	for k := 0; k < filler+2*writers; k++ {
+		tree.Insert(k, 0)
+	}
+	stop := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for gen := 1; ; gen++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				tree.Insert(w, gen)
+				tree.Insert(filler+writers+w, gen)
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		snap := tree.Snapshot()
+		assert.Equal(t, filler+2*writers, snap.Len())
+		for w := 0; w < writers; w++ {
+			lo, hi := *snap.Get(w), *snap.Get(filler + writers + w)
+			assert.Contains(t, []int{hi, hi + 1}, lo, "writer %d", w)
+		}
+		assert.NoError(t, snap.Tree().Verify())
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestClone(t *testing.T) {
+	tree := rbtree.New[int, int](rbtree.WithStableValuePointers())
+	for i := 0; i < 50; i++ {
+		tree.Insert(i, i)
+	}
+	c := tree.Clone()
+	tree.Delete(3)
+	c.Insert(3, 33)
+	assert.Nil(t, tree.Get(3))
+	assert.Equal(t, 33, *c.Get(3))
+	assert.Equal(t, 50, c.Len())
+	assert.Nil(t, c.Check())
+}
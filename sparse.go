@@ -0,0 +1,149 @@
+package rbtree
+
+import (
+	"cmp"
+	"errors"
+	"iter"
+	"sync"
+)
+
+var (
+	// ErrNoBlock is returned by the block maintenance of a SparseIndex
+	// when no block holds the key it is given.
+	ErrNoBlock = errors.New("no block holds the key")
+	// ErrBlockStart is returned by SplitBlock when the key to split at
+	// already starts a block.
+	ErrBlockStart = errors.New("key already starts a block")
+)
+
+// SparseIndex is a sparse index over sorted storage kept outside the tree,
+// such as the blocks of a sorted file. The tree holds only the first key
+// of every block, with a handle H the storage finds the block by, and a
+// key belongs to the block that starts at its Floor. Looking inside a
+// block is left to the search function, a binary search of the block or
+// an interpolation between its bounds, which returns the key's value V.
+//
+// Lookups run alongside everything. Block maintenance, AddBlock,
+// SplitBlock and MergeBlock, is serialized among itself and changes the
+// boundaries in an order that keeps every key in a block that holds it,
+// as long as the storage keeps the old blocks readable until the call
+// returns.
+type SparseIndex[K any, H any, V any] struct {
+	tree   *RBTree[K, H]
+	search func(block H, key K) (V, bool)
+
+	mu sync.Mutex // serializes block maintenance
+}
+
+// NewSparseIndex returns an empty sparse index whose blocks are searched
+// with search, on a tree configured by opts.
+func NewSparseIndex[K cmp.Ordered, H any, V any](search func(block H, key K) (V, bool), opts ...Option) *SparseIndex[K, H, V] {
+	return &SparseIndex[K, H, V]{tree: New[K, H](opts...), search: search}
+}
+
+// NewSparseIndexFunc is NewSparseIndex for keys ordered by compare, see
+// NewRBTreeFunc.
+func NewSparseIndexFunc[K any, H any, V any](compare func(a, b K) int, search func(block H, key K) (V, bool), opts ...Option) *SparseIndex[K, H, V] {
+	return &SparseIndex[K, H, V]{tree: NewRBTreeFunc[K, H](compare, opts...), search: search}
+}
+
+// Tree returns the tree of block boundaries backing x.
+func (x *SparseIndex[K, H, V]) Tree() *RBTree[K, H] {
+	return x.tree
+}
+
+// Len returns the number of blocks.
+func (x *SparseIndex[K, H, V]) Len() int {
+	return x.tree.Len()
+}
+
+// Sample indexes sorted storage from its keys in ascending order, keeping
+// every every-th of them, starting with the first, as a block boundary.
+// handle is called with the number and first key of each block and returns
+// its handle. Sample returns the number of blocks it added.
+func (x *SparseIndex[K, H, V]) Sample(keys iter.Seq[K], every int, handle func(block int, first K) H) int {
+	if every <= 0 {
+		panic("rbtree: sparse index sampling interval must be positive")
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	var batch []KV[K, H]
+	i := 0
+	for k := range keys {
+		if i%every == 0 {
+			batch = append(batch, KV[K, H]{k, handle(len(batch), k)})
+		}
+		i++
+	}
+	x.tree.InsertBatch(batch)
+	return len(batch)
+}
+
+// AddBlock indexes the block that starts at first, or gives that block a
+// new handle.
+func (x *SparseIndex[K, H, V]) AddBlock(first K, block H) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.tree.Insert(first, block)
+}
+
+// Block returns the block key belongs to and the key it starts at. ok is
+// false if key comes before every block.
+func (x *SparseIndex[K, H, V]) Block(key K) (first K, block H, ok bool) {
+	return x.tree.floorCopy(key)
+}
+
+// Lookup finds the block key belongs to and searches it for key.
+func (x *SparseIndex[K, H, V]) Lookup(key K) (value V, ok bool) {
+	_, block, ok := x.Block(key)
+	if !ok {
+		return value, false
+	}
+	return x.search(block, key)
+}
+
+// SplitBlock records that the block holding at was split in two at at:
+// lower holds the keys before at, upper at and those after it. It returns
+// ErrNoBlock if at comes before every block and ErrBlockStart if at starts
+// one already.
+func (x *SparseIndex[K, H, V]) SplitBlock(at K, lower, upper H) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	first, _, ok := x.tree.floorCopy(at)
+	if !ok {
+		return ErrNoBlock
+	}
+	if x.tree.compare(first, at) == 0 {
+		return ErrBlockStart
+	}
+	// the old block holds the keys before at until lower replaces it
+	x.tree.Insert(at, upper)
+	x.tree.Insert(first, lower)
+	return nil
+}
+
+// MergeBlock records that the block starting at first was merged into the
+// block before it, which merged now stands for. It returns ErrNoBlock if
+// no block starts at first or none comes before it.
+func (x *SparseIndex[K, H, V]) MergeBlock(first K, merged H) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if k, _, ok := x.tree.floorCopy(first); !ok || x.tree.compare(k, first) != 0 {
+		return ErrNoBlock
+	}
+	prev, v := x.tree.Predecessor(first)
+	if v == nil {
+		return ErrNoBlock
+	}
+	// the block at first holds its keys until merged covers them
+	x.tree.Insert(prev, merged)
+	x.tree.Delete(first)
+	return nil
+}
+
+// floorCopy is Floor that copies the value while its node is pinned, so
+// that the copy does not race with an insert overwriting it.
+func (t *RBTree[K, V]) floorCopy(key K) (k K, value V, ok bool) {
+	k, v := t.nearest(key, true, true, &value)
+	return k, value, v != nil
+}
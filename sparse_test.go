@@ -0,0 +1,104 @@
+package rbtree_test
+
+import (
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iku50/rbtree-go"
+)
+
+// span is a block of sortedStore, by index.
+type span struct{ lo, hi int }
+
+// sortedStore holds the even keys from 0 to 998, each with ten times the
+// key as its value.
+var sortedStore = func() []int {
+	keys := make([]int, 500)
+	for i := range keys {
+		keys[i] = 2 * i
+	}
+	return keys
+}()
+
+func searchSpan(b span, key int) (int, bool) {
+	i, found := slices.BinarySearch(sortedStore[b.lo:b.hi], key)
+	if !found {
+		return 0, false
+	}
+	return 10 * sortedStore[b.lo+i], true
+}
+
+func TestSparseIndex(t *testing.T) {
+	x := rbtree.NewSparseIndex[int, span, int](searchSpan)
+	_, ok := x.Lookup(0)
+	assert.False(t, ok)
+
+	n := x.Sample(slices.Values(sortedStore), 64, func(block int, first int) span {
+		lo := block * 64
+		return span{lo, min(lo+64, len(sortedStore))}
+	})
+	assert.Equal(t, 8, n)
+	assert.Equal(t, 8, x.Len())
+	check := func() {
+		for _, k := range sortedStore {
+			v, ok := x.Lookup(k)
+			assert.True(t, ok, k)
+			assert.Equal(t, 10*k, v)
+			_, ok = x.Lookup(k + 1)
+			assert.False(t, ok, k+1)
+		}
+		_, ok := x.Lookup(-1)
+		assert.False(t, ok)
+	}
+	check()
+
+	first, b, ok := x.Block(200)
+	assert.True(t, ok)
+	assert.Equal(t, 128, first)
+	assert.Equal(t, span{64, 128}, b)
+
+	// split the block starting at 128 (indexes 64 to 128) at 192
+	assert.Nil(t, x.SplitBlock(192, span{64, 96}, span{96, 128}))
+	assert.Equal(t, 9, x.Len())
+	check()
+	assert.Equal(t, rbtree.ErrBlockStart, x.SplitBlock(192, span{}, span{}))
+	assert.Equal(t, rbtree.ErrNoBlock, x.SplitBlock(-1, span{}, span{}))
+
+	assert.Nil(t, x.MergeBlock(192, span{64, 128}))
+	assert.Equal(t, 8, x.Len())
+	check()
+	assert.Equal(t, rbtree.ErrNoBlock, x.MergeBlock(0, span{}))
+	assert.Equal(t, rbtree.ErrNoBlock, x.MergeBlock(130, span{}))
+}
+
+func TestSparseIndexConcurrent(t *testing.T) {
+	x := rbtree.NewSparseIndex[int, span, int](searchSpan)
+	x.AddBlock(0, span{0, len(sortedStore)})
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for round := 0; round < 20; round++ {
+				for _, k := range sortedStore[g:] {
+					v, ok := x.Lookup(k)
+					assert.True(t, ok, k)
+					assert.Equal(t, 10*k, v)
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for round := 0; round < 50; round++ {
+			assert.Nil(t, x.SplitBlock(500, span{0, 250}, span{250, len(sortedStore)}))
+			assert.Nil(t, x.MergeBlock(500, span{0, len(sortedStore)}))
+		}
+	}()
+	wg.Wait()
+	assert.Equal(t, 1, x.Len())
+}
@@ -0,0 +1,432 @@
+package rbtree
+
+import (
+	"context"
+	"errors"
+	"runtime"
+)
+
+// ErrJoinOverlap is returned by Join when the other tree's keys do not all
+// come after the tree's own.
+var ErrJoinOverlap = errors.New("key ranges overlap")
+
+// surgery splits and joins subtrees in place while writers are paused.
+// Readers keep running, so a node is locked, which waits out the readers
+// pinned on it, before its child links change. It is taken top-down along
+// the paths the edit walks, so readers only ever move out of the way: a
+// reader below a locked node finishes in a subtree that is moved as a
+// whole, never rewired. Colors, sizes and parent pointers are not read by
+// readers, the sizes a node reports are guarded by its locked parent.
+type surgery[K any, V any] struct {
+	scratch RBTree[K, V] // holds the root of the subtree join rebalances
+	held    map[*RBTreeNode[K, V]]bool
+}
+
+func newSurgery[K any, V any]() *surgery[K, V] {
+	return &surgery[K, V]{held: make(map[*RBTreeNode[K, V]]bool)}
+}
+
+// hold locks n for the rest of the edit.
+func (s *surgery[K, V]) hold(n *RBTreeNode[K, V]) {
+	if n == nil || s.held[n] {
+		return
+	}
+	for !n.lock() {
+		runtime.Gosched()
+	}
+	s.held[n] = true
+}
+
+// release unlocks every node the edit held.
+func (s *surgery[K, V]) release() {
+	for n := range s.held {
+		n.unlock()
+	}
+	clear(s.held)
+}
+
+// link makes child p's child on side d. A detached root may have reported
+// a stale size to nobody, it now reports the settled one to p.
+func link[K any, V any](p *RBTreeNode[K, V], d direction, child *RBTreeNode[K, V]) {
+	if d == left {
+		p.left.Store(child)
+	} else {
+		p.right.Store(child)
+	}
+	if child != nil {
+		child.parent.Store(p)
+		if child.reported != child.size {
+			child.reported = child.size
+		}
+	}
+}
+
+// blackHeight counts the black nodes from n down to a leaf.
+func blackHeight[K any, V any](n *RBTreeNode[K, V]) int {
+	h := 0
+	for ; n != nil; n = n.left.Load() {
+		if n.isBlack() {
+			h++
+		}
+	}
+	return h
+}
+
+// join returns the tree of l's keys, x and r's keys, which must come in
+// that order. l and r are red-black trees with detached roots, x a held
+// node that no longer belongs to any tree. x is linked where the taller
+// tree's spine reaches the shorter's black height, and the red-red
+// violation this may cause is fixed above it.
+func (s *surgery[K, V]) join(l, x, r *RBTreeNode[K, V]) *RBTreeNode[K, V] {
+	// black roots keep x's children black wherever it is linked
+	if l.isRed() {
+		l.c = black
+	}
+	if r.isRed() {
+		r.c = black
+	}
+	bl, br := blackHeight(l), blackHeight(r)
+	x.parent.Store(nil)
+	if bl == br {
+		link(x, left, l)
+		link(x, right, r)
+		x.c = black
+		x.resize()
+		return x
+	}
+	// walk down the inner spine of the taller tree
+	top, tall, short, d := l, bl, br, right
+	if bl < br {
+		top, tall, short, d = r, br, bl, left
+	}
+	var p *RBTreeNode[K, V]
+	c, h := top, tall
+	for c != nil && (c.isRed() || h > short) {
+		s.hold(c)
+		if c.isBlack() {
+			h--
+		}
+		p, c = c, c.child(d)
+	}
+	if d == right {
+		link(x, left, c)
+		link(x, right, r)
+	} else {
+		link(x, left, l)
+		link(x, right, c)
+	}
+	x.c = red
+	x.resize()
+	link(p, d, x)
+	for q := p; q != nil; q = q.parent.Load() {
+		q.resize()
+	}
+	s.scratch.root.Store(top)
+	for y := x; y != nil; {
+		y = s.scratch.insertStep(y)
+	}
+	return s.scratch.root.Load()
+}
+
+// split divides the tree below n into the keys before key and the rest.
+// With inclusive, key itself goes to the first tree.
+func (s *surgery[K, V]) split(t *RBTree[K, V], n *RBTreeNode[K, V], key K, inclusive bool) (lo, hi *RBTreeNode[K, V]) {
+	if n == nil {
+		return nil, nil
+	}
+	s.hold(n)
+	a, b := n.left.Load(), n.right.Load()
+	n.left.Store(nil)
+	n.right.Store(nil)
+	if a != nil {
+		a.parent.Store(nil)
+	}
+	if b != nil {
+		b.parent.Store(nil)
+	}
+	if c := t.compare(key, n.key); c < 0 || c == 0 && !inclusive {
+		lo, hi = s.split(t, a, key, inclusive)
+		return lo, s.join(hi, n, b)
+	}
+	lo, hi = s.split(t, b, key, inclusive)
+	return s.join(a, n, lo), hi
+}
+
+// concat joins two trees whose keys are in order, using the first key of
+// hi as the middle node.
+func (s *surgery[K, V]) concat(t *RBTree[K, V], lo, hi *RBTreeNode[K, V]) *RBTreeNode[K, V] {
+	if hi == nil {
+		return lo
+	}
+	if lo == nil {
+		return hi
+	}
+	first := hi
+	for first.left.Load() != nil {
+		first = first.left.Load()
+	}
+	m, rest := s.split(t, hi, first.key, true)
+	return s.join(lo, m, rest)
+}
+
+// total counts the keys below n, a subtree that no operation can reach.
+// It reads n's size if the tree keeps order statistics, the sizes are
+// settled then, and walks the subtree otherwise.
+func (t *RBTree[K, V]) total(n *RBTreeNode[K, V]) int {
+	if n == nil {
+		return 0
+	}
+	if t.ordered {
+		return n.size
+	}
+	return 1 + t.total(n.left.Load()) + t.total(n.right.Load())
+}
+
+// settle recomputes the sizes below n, a subtree that no operation can
+// reach, from the bottom up.
+func settle[K any, V any](n *RBTreeNode[K, V]) {
+	if n == nil {
+		return
+	}
+	settle(n.left.Load())
+	settle(n.right.Load())
+	n.resize()
+}
+
+// DeleteRange removes the keys from lo up to but excluding hi and returns
+// how many it removed. It cuts the range out of the tree in O(log n),
+// pausing writers while readers go on; a reader that was
+// already past the cut may still find a removed key. Unless the tree was
+// built WithOrderStatistics it also walks the removed keys to count them,
+// and WithChangelog or WithNodePool it walks them to log a delete for each
+// or hand its node to the pool, so that then it takes O(log n + m) for m
+// removed keys.
+func (t *RBTree[K, V]) DeleteRange(lo, hi K) int {
+	if t.progress != nil {
+		sum, _ := t.DeleteRangeCtx(context.Background(), lo, hi)
+		return sum.Applied
+	}
+	return t.cut(lo, hi)
+}
+
+// cut removes the keys from lo up to hi in one piece.
+func (t *RBTree[K, V]) cut(lo, hi K) int {
+	if t.compare(lo, hi) >= 0 {
+		return 0
+	}
+	t.gate.Lock()
+	defer t.gate.Unlock()
+	s := newSurgery[K, V]()
+	defer s.release()
+	before, rest := s.split(t, t.root.Load(), lo, false)
+	cut, after := s.split(t, rest, hi, false)
+	t.root.Store(s.concat(t, before, after))
+	t.moved()
+	removed := t.total(cut)
+	t.count.Add(-int64(removed))
+	if t.log != nil || t.copying.Load() != nil {
+		t.recordDeletes(cut, removed+1)
+	}
+	if t.pool != nil {
+		t.retireAll(cut, removed+1)
+	}
+	return removed
+}
+
+// DeleteRangeCtx is DeleteRange in cuts of about batchCheckpoint keys,
+// with a look at ctx before each. Once ctx is done it stops with ctx's
+// error; the summary tells how many keys were removed and where the part
+// of the range left untouched begins. Writers resume between the cuts.
+func (t *RBTree[K, V]) DeleteRangeCtx(ctx context.Context, lo, hi K) (BatchSummary[K], error) {
+	var sum BatchSummary[K]
+	total := 0
+	if t.progress != nil && t.compare(lo, hi) < 0 {
+		total = t.countRange(lo, hi)
+	}
+	for from := lo; t.compare(from, hi) < 0; {
+		if err := ctx.Err(); err != nil {
+			sum.Resume = from
+			return sum, err
+		}
+		// the count only places the cut, which is exact wherever it falls
+		to := t.ahead(from, hi, batchCheckpoint)
+		sum.Applied += t.cut(from, to)
+		from = to
+		if t.progress != nil {
+			if t.compare(from, hi) >= 0 {
+				// the last cut ends the range, whatever was counted
+				total = sum.Applied
+			}
+			if total = max(total, sum.Applied); total > 0 {
+				t.progress(sum.Applied, total)
+			}
+		}
+	}
+	sum.Complete = true
+	return sum, nil
+}
+
+// countRange counts the keys from lo up to hi, by their ranks if the tree
+// keeps order statistics and one by one otherwise.
+func (t *RBTree[K, V]) countRange(lo, hi K) int {
+	if t.ordered {
+		return t.Rank(hi) - t.Rank(lo)
+	}
+	n := 0
+	if t.Contains(lo) {
+		n++
+	}
+	t.forward(&lo, nil, func(k K) bool {
+		if t.compare(k, hi) >= 0 {
+			return false
+		}
+		n++
+		return true
+	})
+	return n
+}
+
+// ahead returns the key about n keys after from, or hi if that is not
+// before hi.
+func (t *RBTree[K, V]) ahead(from, hi K, n int) K {
+	to := hi
+	if t.ordered {
+		if k, _, ok := t.Select(t.Rank(from) + n); ok && t.compare(from, k) < 0 && t.compare(k, hi) < 0 {
+			to = k
+		}
+		return to
+	}
+	t.forward(&from, nil, func(k K) bool {
+		if t.compare(k, hi) >= 0 {
+			return false
+		}
+		if n--; n == 0 {
+			to = k
+		}
+		return n > 0
+	})
+	return to
+}
+
+// recordDeletes logs the removal of the keys below n in order. depth
+// bounds the walk.
+func (t *RBTree[K, V]) recordDeletes(n *RBTreeNode[K, V], depth int) {
+	if n == nil || depth <= 0 {
+		return
+	}
+	t.recordDeletes(n.left.Load(), depth-1)
+	t.record(EventDelete, n.key, *n.valuePtr())
+	t.recordDeletes(n.right.Load(), depth-1)
+}
+
+// retireAll hands the nodes below n to the node pool. depth bounds the
+// walk.
+func (t *RBTree[K, V]) retireAll(n *RBTreeNode[K, V], depth int) {
+	if n == nil || depth <= 0 {
+		return
+	}
+	t.retireAll(n.left.Load(), depth-1)
+	t.retireAll(n.right.Load(), depth-1)
+	t.pool.retire(n)
+}
+
+// Split moves the tree's keys into two new trees, left with the keys
+// before key and right with key and those after it, and leaves the tree
+// empty. The new trees have the tree's options. Split takes O(log n) on a
+// tree built WithOrderStatistics and O(n) on others, which count the keys
+// of the new trees by walking them. It pauses writers while it runs. The
+// changelog gets a single EventResync rather than an event per key.
+func (t *RBTree[K, V]) Split(key K) (left, right *RBTree[K, V]) {
+	t.gate.Lock()
+	defer t.gate.Unlock()
+	s := newSurgery[K, V]()
+	lo, hi := s.split(t, t.root.Load(), key, false)
+	t.root.Store(nil)
+	t.count.Store(0)
+	t.moved()
+	t.resync()
+	s.release()
+	left, right = newTree[K, V](t.compare, t.opts), newTree[K, V](t.compare, t.opts)
+	left.root.Store(lo)
+	left.count.Store(int64(t.total(lo)))
+	right.root.Store(hi)
+	right.count.Store(int64(t.total(hi)))
+	if t.expiring.Load() {
+		left.expiring.Store(true)
+		right.expiring.Store(true)
+	}
+	if tombs := t.tombs.Load(); tombs != nil {
+		for _, h := range []*RBTree[K, V]{left, right} {
+			h.tombs.Store(tombs)
+			h.tombGen.Store(t.tombGen.Load())
+		}
+	}
+	return left, right
+}
+
+// Join moves the keys of other, which must all come after the tree's own,
+// to the end of the tree in O(log n) and leaves other empty. Both trees
+// must order keys the same way. Writers of both trees are paused while it
+// runs. It returns ErrJoinOverlap, changing neither tree, if the key
+// ranges overlap or other is the tree itself. Range tombstones of either
+// tree are compacted first, as the trees count their generations apart.
+// Both changelogs get a single EventResync.
+func (t *RBTree[K, V]) Join(other *RBTree[K, V]) error {
+	if other == t {
+		return ErrJoinOverlap
+	}
+	for {
+		t.gate.Lock()
+		if other.gate.TryLock() {
+			if t.tombs.Load() == nil && other.tombs.Load() == nil {
+				break
+			}
+			other.gate.Unlock()
+			t.gate.Unlock()
+			if _, err := t.compact(); err != nil {
+				return err
+			}
+			if _, err := other.compact(); err != nil {
+				return err
+			}
+			continue
+		}
+		t.gate.Unlock()
+		runtime.Gosched()
+	}
+	defer t.gate.Unlock()
+	defer other.gate.Unlock()
+	lo, hi := t.root.Load(), other.root.Load()
+	if lo != nil && hi != nil {
+		last, first := lo, hi
+		for last.right.Load() != nil {
+			last = last.right.Load()
+		}
+		for first.left.Load() != nil {
+			first = first.left.Load()
+		}
+		if t.compare(last.key, first.key) >= 0 {
+			return ErrJoinOverlap
+		}
+	}
+	if t.ordered && !other.ordered {
+		// other's size changes are still where they arose
+		settle(hi)
+	}
+	s := newSurgery[K, V]()
+	defer s.release()
+	s.hold(lo)
+	s.hold(hi)
+	t.root.Store(s.concat(t, lo, hi))
+	t.count.Add(other.count.Load())
+	if other.expiring.Load() {
+		t.expiring.Store(true)
+	}
+	other.root.Store(nil)
+	other.count.Store(0)
+	t.moved()
+	other.moved()
+	t.resync()
+	other.resync()
+	return nil
+}
@@ -0,0 +1,161 @@
+package rbtree_test
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iku50/rbtree-go"
+)
+
+func rangeTree(keys ...int) *rbtree.RBTree[int, int] {
+	tree := rbtree.New[int, int]()
+	for _, k := range keys {
+		tree.Insert(k, -k)
+	}
+	return tree
+}
+
+func treeKeys(tree *rbtree.RBTree[int, int]) []int {
+	keys := []int{}
+	tree.Range(func(key, value int) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+func TestDeleteRange(t *testing.T) {
+	for round := 0; round < 50; round++ {
+		n := rand.IntN(300)
+		tree := rangeTree(rand.Perm(n)...)
+		lo, hi := rand.IntN(n+10)-5, rand.IntN(n+10)-5
+		removed := tree.DeleteRange(lo, hi)
+		var want []int
+		for k := 0; k < n; k++ {
+			if k < lo || k >= hi || lo >= hi {
+				want = append(want, k)
+			}
+		}
+		assert.Equal(t, n-len(want), removed, "[%d, %d) of %d", lo, hi, n)
+		assert.Nil(t, tree.Verify(), "[%d, %d) of %d", lo, hi, n)
+		assert.Equal(t, len(want), tree.Len())
+		if want == nil {
+			want = []int{}
+		}
+		assert.Equal(t, want, treeKeys(tree))
+		for i, k := range want {
+			assert.Equal(t, i, tree.Rank(k))
+		}
+	}
+	tree := rangeTree(1, 2, 3)
+	assert.Equal(t, 0, tree.DeleteRange(3, 1))
+	assert.Equal(t, 3, tree.DeleteRange(0, 10))
+	assert.Nil(t, tree.Verify())
+	tree.Insert(5, 5)
+	assert.Equal(t, 1, tree.Len())
+}
+
+func TestSplitJoin(t *testing.T) {
+	for _, c := range []struct{ n, key int }{{0, 0}, {1, 0}, {1, 1}, {100, 0}, {100, 37}, {100, 99}, {100, 200}, {1000, 500}} {
+		tree := rangeTree(rand.Perm(c.n)...)
+		left, right := tree.Split(c.key)
+		assert.Equal(t, 0, tree.Len())
+		assert.Nil(t, tree.Verify())
+		assert.Nil(t, left.Verify(), "%v", c)
+		assert.Nil(t, right.Verify(), "%v", c)
+		split := min(max(c.key, 0), c.n)
+		assert.Equal(t, split, left.Len())
+		assert.Equal(t, c.n-split, right.Len())
+		if v := left.Get(split - 1); split > 0 {
+			assert.Equal(t, 1-split, *v)
+		}
+
+		assert.Nil(t, left.Join(right), "%v", c)
+		assert.Equal(t, 0, right.Len())
+		assert.Nil(t, left.Verify(), "%v", c)
+		assert.Equal(t, c.n, left.Len())
+		for k := 0; k < c.n; k++ {
+			assert.Equal(t, k, left.Rank(k))
+		}
+	}
+
+	a, b := rangeTree(1, 5), rangeTree(3, 8)
+	assert.ErrorIs(t, a.Join(b), rbtree.ErrJoinOverlap)
+	assert.ErrorIs(t, a.Join(a), rbtree.ErrJoinOverlap)
+	assert.Equal(t, []int{1, 5}, treeKeys(a))
+	assert.Equal(t, []int{3, 8}, treeKeys(b))
+
+	// trees of very different heights
+	small, big := rangeTree(-2, -1), rangeTree(rand.Perm(5000)...)
+	assert.Nil(t, small.Join(big))
+	assert.Nil(t, small.Verify())
+	big = rangeTree(10000)
+	assert.Nil(t, small.Join(big))
+	assert.Nil(t, small.Verify())
+	assert.Equal(t, 5003, small.Len())
+}
+
+func TestDeleteRangeJoinConcurrent(t *testing.T) {
+	tree := rangeTree(rand.Perm(4000)...)
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stop.Load() {
+				// keys below 1000 are never removed
+				k := rand.IntN(1000)
+				if v := tree.Get(k); assert.NotNil(t, v, "key %d", k) {
+					assert.Equal(t, -k, *v)
+				}
+				tree.Insert(4000+rand.IntN(1000), 0)
+			}
+		}()
+	}
+	for lo := 1000; lo < 4000; lo += 100 {
+		tree.DeleteRange(lo, lo+100)
+		assert.Nil(t, tree.Join(rangeTree(100000+lo, 100000+lo+1)))
+	}
+	stop.Store(true)
+	wg.Wait()
+	assert.Nil(t, tree.Verify())
+	for k := 1000; k < 4000; k++ {
+		assert.Nil(t, tree.Get(k))
+	}
+	assert.Equal(t, -100000-3901, *tree.Get(100000 + 3901))
+}
+
+func TestDeleteRangeCtx(t *testing.T) {
+	tree := rbtree.New[int, int]()
+	for i := 0; i < 5000; i++ {
+		tree.Insert(i, i)
+	}
+	sum, err := tree.DeleteRangeCtx(&stopAfter{context.Background(), 2}, 100, 4000)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.False(t, sum.Complete)
+	assert.Equal(t, 2048, sum.Applied)
+	assert.Equal(t, 100+2048, sum.Resume)
+	assert.Equal(t, 5000-2048, tree.Len())
+	assert.Nil(t, tree.Check())
+	assert.Equal(t, 100, tree.Rank(sum.Resume))
+
+	sum, err = tree.DeleteRangeCtx(context.Background(), sum.Resume, 4000)
+	assert.Nil(t, err)
+	assert.Equal(t, rbtree.BatchSummary[int]{Applied: 3900 - 2048, Complete: true}, sum)
+	assert.Equal(t, 1100, tree.Len())
+	assert.Nil(t, tree.Check())
+
+	// a range with fewer keys than a checkpoint goes in one cut
+	sum, err = tree.DeleteRangeCtx(&stopAfter{context.Background(), 1}, 0, 50)
+	assert.Nil(t, err)
+	assert.Equal(t, 50, sum.Applied)
+	sum, err = tree.DeleteRangeCtx(context.Background(), 10, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, rbtree.BatchSummary[int]{Complete: true}, sum)
+}
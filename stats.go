@@ -0,0 +1,225 @@
+package rbtree
+
+import (
+	"math/rand/v2"
+	"sync/atomic"
+)
+
+// DefaultGetSampling is the Get sampling rate of trees that are not given
+// WithGetSampling.
+const DefaultGetSampling = 64
+
+// Stats is a point-in-time copy of a tree's counters.
+//
+// The Get figures cover sampled calls only and measure read amplification:
+// every retry restarts the descent from the root, so nodes visited grows
+// with both tree height and contention.
+//
+// The insert figures cover inserts that linked a new key, sampled at the
+// Get rate. A fixup step recolors or rotates one area on the way up from
+// the new node; appends are inserts that took the append path, which
+// inserts switch to while they keep creating a new largest key. The key
+// sizes are those of the same inserts, measured as WithMaxKeySize
+// measures them.
+//
+// The node figures count node allocations and, for trees built
+// WithNodePool, the reuses that stood in for them.
+type Stats struct {
+	GetSamples         uint64 // Get calls that were sampled
+	GetNodesVisited    uint64 // nodes examined by sampled Gets, across all attempts
+	GetRetries         uint64 // retries of sampled Gets after hitting a locked node
+	MaxGetNodesVisited uint64 // most nodes examined by a single sampled Get
+	MaxGetRetries      uint64 // most retries of a single sampled Get
+	GetComparisons     uint64 // keys compared by sampled Gets, hint probes included
+	GetHintHits        uint64 // sampled Gets answered from the hint cache, see WithHintCache
+
+	InsertSamples       uint64 // inserts of new keys that were sampled
+	InsertFixupSteps    uint64 // rebalancing steps run by sampled inserts
+	MaxInsertFixupSteps uint64 // most rebalancing steps of a single sampled insert
+	InsertAppends       uint64 // sampled inserts that linked their key at the largest one
+
+	NodeAllocs uint64 // nodes allocated by inserts, loads and merges
+	NodeReuses uint64 // recycled nodes handed out instead of new ones
+	LiveNodes  int    // nodes holding a key, plus pooled ones waiting for reuse
+
+	KeySizes     [KeySizeBuckets]uint64 // sampled new keys by size, see KeySizeBuckets
+	MaxKeySize   int                    // largest sampled new key, in bytes
+	KeysTooLarge uint64                 // keys refused by WithMaxKeySize
+
+	Expired    uint64 // expired keys removed, by sweeps or by writes that met them
+	Panics     uint64 // callback panics recovered, see WithPanicRecovery
+	NoopWrites uint64 // writes skipped for storing the value already held, see WithSkipNoopWrites
+
+	ProtocolViolations uint64 // sampled writes that strayed from the locking protocol, see WithConformanceSampling
+}
+
+// NodesPerGet returns the average number of nodes examined per sampled Get.
+func (s Stats) NodesPerGet() float64 {
+	if s.GetSamples == 0 {
+		return 0
+	}
+	return float64(s.GetNodesVisited) / float64(s.GetSamples)
+}
+
+// ComparisonsPerGet returns the average number of key comparisons per
+// sampled Get.
+func (s Stats) ComparisonsPerGet() float64 {
+	if s.GetSamples == 0 {
+		return 0
+	}
+	return float64(s.GetComparisons) / float64(s.GetSamples)
+}
+
+// HintHitRate returns the fraction of sampled Gets answered from the hint
+// cache.
+func (s Stats) HintHitRate() float64 {
+	if s.GetSamples == 0 {
+		return 0
+	}
+	return float64(s.GetHintHits) / float64(s.GetSamples)
+}
+
+// FixupStepsPerInsert returns the average number of rebalancing steps per
+// sampled insert.
+func (s Stats) FixupStepsPerInsert() float64 {
+	if s.InsertSamples == 0 {
+		return 0
+	}
+	return float64(s.InsertFixupSteps) / float64(s.InsertSamples)
+}
+
+// AppendRate returns the fraction of sampled inserts that took the append
+// path.
+func (s Stats) AppendRate() float64 {
+	if s.InsertSamples == 0 {
+		return 0
+	}
+	return float64(s.InsertAppends) / float64(s.InsertSamples)
+}
+
+// RetriesPerGet returns the average number of retries per sampled Get.
+func (s Stats) RetriesPerGet() float64 {
+	if s.GetSamples == 0 {
+		return 0
+	}
+	return float64(s.GetRetries) / float64(s.GetSamples)
+}
+
+type stats struct {
+	getSamples    atomic.Uint64
+	getVisited    atomic.Uint64
+	getRetries    atomic.Uint64
+	getMaxVisited atomic.Uint64
+	getMaxRetries atomic.Uint64
+	getCompares   atomic.Uint64
+	getHintHits   atomic.Uint64
+	insSamples    atomic.Uint64
+	insSteps      atomic.Uint64
+	insMaxSteps   atomic.Uint64
+	insAppends    atomic.Uint64
+	keySizes      [KeySizeBuckets]atomic.Uint64
+	keyMax        atomic.Uint64
+	keysTooLarge  atomic.Uint64
+	nodeAllocs    atomic.Uint64
+	nodeReuses    atomic.Uint64
+	maxLockWait   atomic.Uint64 // nanoseconds, see DebugStats
+	expired       atomic.Uint64
+	panics        atomic.Uint64
+	noopWrites    atomic.Uint64
+	violations    atomic.Uint64
+}
+
+func storeMax(a *atomic.Uint64, v uint64) {
+	for {
+		old := a.Load()
+		if v <= old || a.CompareAndSwap(old, v) {
+			return
+		}
+	}
+}
+
+func (s *stats) recordGet(visited, retries, compares int, hit bool) {
+	s.getSamples.Add(1)
+	s.getVisited.Add(uint64(visited))
+	s.getRetries.Add(uint64(retries))
+	s.getCompares.Add(uint64(compares))
+	if hit {
+		s.getHintHits.Add(1)
+	}
+	storeMax(&s.getMaxVisited, uint64(visited))
+	storeMax(&s.getMaxRetries, uint64(retries))
+}
+
+func (t *RBTree[K, V]) sampleGet() bool {
+	return t.sample > 0 && (t.sample == 1 || rand.Uint32N(t.sample) == 0)
+}
+
+func (s *stats) recordInsert(steps int, appended bool, keySize int) {
+	s.insSamples.Add(1)
+	s.keySizes[keySizeBucket(keySize)].Add(1)
+	storeMax(&s.keyMax, uint64(max(keySize, 0)))
+	s.insSteps.Add(uint64(steps))
+	if appended {
+		s.insAppends.Add(1)
+	}
+	storeMax(&s.insMaxSteps, uint64(steps))
+}
+
+// Stats returns the tree's counters. The fields are read one by one, so
+// they may be mutually inconsistent while operations are running.
+func (t *RBTree[K, V]) Stats() Stats {
+	s := Stats{
+		GetSamples:          t.stats.getSamples.Load(),
+		GetNodesVisited:     t.stats.getVisited.Load(),
+		GetRetries:          t.stats.getRetries.Load(),
+		MaxGetNodesVisited:  t.stats.getMaxVisited.Load(),
+		MaxGetRetries:       t.stats.getMaxRetries.Load(),
+		GetComparisons:      t.stats.getCompares.Load(),
+		GetHintHits:         t.stats.getHintHits.Load(),
+		InsertSamples:       t.stats.insSamples.Load(),
+		InsertFixupSteps:    t.stats.insSteps.Load(),
+		MaxInsertFixupSteps: t.stats.insMaxSteps.Load(),
+		InsertAppends:       t.stats.insAppends.Load(),
+		NodeAllocs:          t.stats.nodeAllocs.Load(),
+		NodeReuses:          t.stats.nodeReuses.Load(),
+		LiveNodes:           t.Len(),
+		MaxKeySize:          int(t.stats.keyMax.Load()),
+		KeysTooLarge:        t.stats.keysTooLarge.Load(),
+		Expired:             t.stats.expired.Load(),
+		Panics:              t.stats.panics.Load(),
+		NoopWrites:          t.stats.noopWrites.Load(),
+		ProtocolViolations:  t.stats.violations.Load(),
+	}
+	for i := range s.KeySizes {
+		s.KeySizes[i] = t.stats.keySizes[i].Load()
+	}
+	if t.pool != nil {
+		s.LiveNodes += int(t.pool.pending.Load())
+	}
+	return s
+}
+
+// Delta returns the counters accumulated since prev was taken from the
+// same tree. The maxima and LiveNodes are levels, not counters, and are
+// kept as they are in s.
+func (s Stats) Delta(prev Stats) Stats {
+	s.GetSamples -= prev.GetSamples
+	s.GetNodesVisited -= prev.GetNodesVisited
+	s.GetRetries -= prev.GetRetries
+	s.GetComparisons -= prev.GetComparisons
+	s.GetHintHits -= prev.GetHintHits
+	s.InsertSamples -= prev.InsertSamples
+	s.InsertFixupSteps -= prev.InsertFixupSteps
+	s.InsertAppends -= prev.InsertAppends
+	for i := range s.KeySizes {
+		s.KeySizes[i] -= prev.KeySizes[i]
+	}
+	s.KeysTooLarge -= prev.KeysTooLarge
+	s.NodeAllocs -= prev.NodeAllocs
+	s.NodeReuses -= prev.NodeReuses
+	s.Expired -= prev.Expired
+	s.Panics -= prev.Panics
+	s.NoopWrites -= prev.NoopWrites
+	s.ProtocolViolations -= prev.ProtocolViolations
+	return s
+}
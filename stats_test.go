@@ -0,0 +1,77 @@
+package rbtree_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iku50/rbtree-go"
+)
+
+func TestGetStats(t *testing.T) {
+	tree := rbtree.New[int, int](rbtree.WithGetSampling(1))
+	for i := 0; i < 100; i++ {
+		tree.Insert(i, i)
+	}
+	for i := 0; i < 100; i++ {
+		tree.Get(i)
+	}
+	s := tree.Stats()
+	assert.Equal(t, uint64(100), s.GetSamples)
+	assert.Equal(t, uint64(0), s.GetRetries)
+	assert.GreaterOrEqual(t, s.NodesPerGet(), 1.0)
+	assert.LessOrEqual(t, s.MaxGetNodesVisited, uint64(2*7))
+
+	tree = rbtree.New[int, int](rbtree.WithGetSampling(0))
+	tree.Insert(1, 1)
+	tree.Get(1)
+	assert.Equal(t, uint64(0), tree.Stats().GetSamples)
+}
+
+func TestStatsDelta(t *testing.T) {
+	tree := rbtree.New[int, int](rbtree.WithGetSampling(1))
+	for i := 0; i < 10; i++ {
+		tree.Insert(i, i)
+	}
+	prev := tree.Stats()
+	for i := 0; i < 5; i++ {
+		tree.Get(i)
+	}
+	tree.Insert(10, 10)
+	d := tree.Stats().Delta(prev)
+	assert.Equal(t, uint64(5), d.GetSamples)
+	assert.Equal(t, uint64(1), d.InsertSamples)
+	assert.Equal(t, uint64(1), d.NodeAllocs)
+	assert.Equal(t, 11, d.LiveNodes)
+	assert.Zero(t, prev.MaxGetNodesVisited)
+	assert.NotZero(t, d.MaxGetNodesVisited)
+}
+
+func TestOpCounter(t *testing.T) {
+	tree := rbtree.New[int, int]()
+	for i := 0; i < 100; i++ {
+		tree.Insert(i, i)
+	}
+	var c rbtree.OpCounter
+	ctx := rbtree.WithOpCounter(context.Background(), &c)
+	_, err := tree.GetCtx(ctx, 50)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), c.Ops)
+	assert.GreaterOrEqual(t, c.NodesVisited, uint64(1))
+	visited := c.NodesVisited
+
+	assert.NoError(t, tree.InsertCtx(ctx, 200, 200))
+	_, err = tree.DeleteCtx(ctx, 10)
+	assert.NoError(t, err)
+	_, _, err = tree.UpdateCtx(ctx, 20, func(old int, ok bool) (int, bool) { return old + 1, true })
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), c.Ops)
+	assert.Equal(t, uint64(0), c.Retries)
+	assert.Greater(t, c.NodesVisited, visited+3, "writes count the nodes they lock on the way down")
+
+	// operations without the context count nothing
+	tree.Get(1)
+	tree.Insert(300, 300)
+	assert.Equal(t, uint64(4), c.Ops)
+}
@@ -0,0 +1,77 @@
+package rbtree
+
+import (
+	"fmt"
+)
+
+// SyncMap exposes an RBTree through the method set of sync.Map, so code
+// written against sync.Map can switch to an ordered map by changing the
+// declaration only. Range visits keys in ascending order.
+//
+// Keys and values are still typed: passing a key that is not a K to Load
+// or Delete reports a miss, passing a wrong type to Store or LoadOrStore
+// panics.
+type SyncMap[K any, V any] struct {
+	t *RBTree[K, V]
+}
+
+// AsSyncMap returns a sync.Map compatible view of t. The view shares
+// storage with t.
+func (t *RBTree[K, V]) AsSyncMap() *SyncMap[K, V] {
+	return &SyncMap[K, V]{t: t}
+}
+
+func (m *SyncMap[K, V]) key(key any) K {
+	k, ok := key.(K)
+	if !ok {
+		panic(fmt.Sprintf("rbtree: key of type %T is not %T", key, k))
+	}
+	return k
+}
+
+func (m *SyncMap[K, V]) value(value any) V {
+	v, ok := value.(V)
+	if !ok && value != nil {
+		panic(fmt.Sprintf("rbtree: value of type %T is not %T", value, v))
+	}
+	return v
+}
+
+// Load returns the value stored for key, or nil if no value is present.
+func (m *SyncMap[K, V]) Load(key any) (value any, ok bool) {
+	k, ok := key.(K)
+	if !ok {
+		return nil, false
+	}
+	v, ok := m.t.lookup(k)
+	if !ok {
+		return nil, false
+	}
+	return v, true
+}
+
+// Store sets the value for key.
+func (m *SyncMap[K, V]) Store(key, value any) {
+	m.t.Insert(m.key(key), m.value(value))
+}
+
+// LoadOrStore returns the existing value for key if present. Otherwise it
+// stores and returns value. loaded is true if the value was loaded.
+func (m *SyncMap[K, V]) LoadOrStore(key, value any) (actual any, loaded bool) {
+	return m.t.GetOrInsert(m.key(key), m.value(value))
+}
+
+// Delete deletes the value for key.
+func (m *SyncMap[K, V]) Delete(key any) {
+	if k, ok := key.(K); ok {
+		m.t.Delete(k)
+	}
+}
+
+// Range calls f for each key and value in ascending key order until f
+// returns false.
+func (m *SyncMap[K, V]) Range(f func(key, value any) bool) {
+	m.t.Range(func(k K, v V) bool {
+		return f(k, v)
+	})
+}
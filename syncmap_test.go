@@ -0,0 +1,43 @@
+package rbtree_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iku50/rbtree-go"
+)
+
+func TestSyncMap(t *testing.T) {
+	m := rbtree.NewRBTree(2, "two").AsSyncMap()
+	m.Store(3, "three")
+	m.Store(1, "one")
+
+	v, ok := m.Load(3)
+	assert.True(t, ok)
+	assert.Equal(t, "three", v)
+	_, ok = m.Load(4)
+	assert.False(t, ok)
+	_, ok = m.Load("3")
+	assert.False(t, ok)
+
+	actual, loaded := m.LoadOrStore(1, "uno")
+	assert.True(t, loaded)
+	assert.Equal(t, "one", actual)
+	actual, loaded = m.LoadOrStore(4, "four")
+	assert.False(t, loaded)
+	assert.Equal(t, "four", actual)
+
+	m.Delete(2)
+	_, ok = m.Load(2)
+	assert.False(t, ok)
+
+	var keys []any
+	m.Range(func(key, value any) bool {
+		keys = append(keys, key)
+		return true
+	})
+	assert.Equal(t, []any{1, 3, 4}, keys)
+
+	assert.Panics(t, func() { m.Store("5", "five") })
+}
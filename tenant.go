@@ -0,0 +1,211 @@
+package rbtree
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrQuotaExceeded is returned by a tenant's inserts that would take it
+// over its quota.
+var ErrQuotaExceeded = errors.New("tenant quota exceeded")
+
+// Quota limits what a tenant may store. Zero fields are unlimited.
+type Quota struct {
+	Keys  int64 // keys the tenant holds
+	Bytes int64 // bytes of the tenant's keys and values, see Tenants
+}
+
+// Tenants partitions a tree with string keys among tenants, which share
+// the tree but each see only their own keys through their Tenant view. A
+// tenant's keys are stored under a prefix made of its id, so they are
+// contiguous in the tree and do not collide with other tenants' keys
+// whatever the ids contain.
+//
+// A tenant's bytes are what the tree's WithSizeOf function reports for
+// each of its keys and values, or the length of the stored keys for a tree
+// built without one.
+type Tenants[V any] struct {
+	tree *RBTree[string, V]
+
+	mu   sync.Mutex // guards byID
+	byID map[string]*Tenant[V]
+}
+
+// Tenant is one tenant's view of a tree, see Tenants. Its usage is kept
+// up to date by the writes through the view. Writes to its keys that
+// bypass the view, a DeleteRange on the tree, or expiry, leave the usage
+// counting keys that are gone or missing ones that are there.
+type Tenant[V any] struct {
+	tree   *RBTree[string, V]
+	prefix string
+	quota  struct{ keys, bytes atomic.Int64 }
+	keys   atomic.Int64
+	bytes  atomic.Int64
+}
+
+// NewTenants returns the tenants of tree.
+func NewTenants[V any](tree *RBTree[string, V]) *Tenants[V] {
+	return &Tenants[V]{tree: tree, byID: make(map[string]*Tenant[V])}
+}
+
+// Tenant returns the view of tenant id. The first call for an id counts
+// the keys the tenant holds already.
+func (ts *Tenants[V]) Tenant(id string) *Tenant[V] {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if tn, ok := ts.byID[id]; ok {
+		return tn
+	}
+	tn := &Tenant[V]{tree: ts.tree, prefix: strconv.Itoa(len(id)) + ":" + id}
+	tn.scan(func(key string, value V) bool {
+		tn.keys.Add(1)
+		tn.bytes.Add(tn.size(key, value))
+		return true
+	})
+	ts.byID[id] = tn
+	return tn
+}
+
+// SetQuota sets the tenant's quota. A tenant over its new quota keeps its
+// keys, it only cannot add more.
+func (tn *Tenant[V]) SetQuota(q Quota) {
+	tn.quota.keys.Store(q.Keys)
+	tn.quota.bytes.Store(q.Bytes)
+}
+
+// Usage returns how many keys and bytes the tenant holds, in the units of
+// its Quota.
+func (tn *Tenant[V]) Usage() Quota {
+	return Quota{Keys: tn.keys.Load(), Bytes: tn.bytes.Load()}
+}
+
+// size is what a stored key and its value count against the byte quota.
+func (tn *Tenant[V]) size(stored string, value V) int64 {
+	if f := tn.tree.sizeOf; f != nil {
+		return int64(f(stored, value))
+	}
+	return int64(len(stored))
+}
+
+// reserve adds keys and bytes to the usage unless that takes it over the
+// quota. Decreases always succeed.
+func (tn *Tenant[V]) reserve(keys, bytes int64) bool {
+	if !claimQuota(&tn.keys, keys, tn.quota.keys.Load()) {
+		return false
+	}
+	if !claimQuota(&tn.bytes, bytes, tn.quota.bytes.Load()) {
+		tn.keys.Add(-keys)
+		return false
+	}
+	return true
+}
+
+func claimQuota(used *atomic.Int64, n, limit int64) bool {
+	for {
+		old := used.Load()
+		if n > 0 && limit > 0 && old+n > limit {
+			return false
+		}
+		if used.CompareAndSwap(old, old+n) {
+			return true
+		}
+	}
+}
+
+// Insert sets the value for key in the tenant, or returns
+// ErrQuotaExceeded if a new key or a larger value would take the tenant
+// over its quota. The quota is checked under the node lock of the insert.
+func (tn *Tenant[V]) Insert(key string, value V) error {
+	return tn.InsertCtx(context.Background(), key, value)
+}
+
+// InsertCtx is like Insert but stops retrying once ctx is done or the
+// backoff policy gives up, returning the reason.
+func (tn *Tenant[V]) InsertCtx(ctx context.Context, key string, value V) error {
+	stored := tn.prefix + key
+	size := tn.size(stored, value)
+	// the usage reserved by the last call of fn, the one that counts
+	var keys, bytes int64
+	refused := false
+	_, _, err := tn.tree.update(ctx, stored, func(old V, ok bool) (V, bool) {
+		tn.keys.Add(-keys)
+		tn.bytes.Add(-bytes)
+		keys, bytes = 1, size
+		if ok {
+			keys, bytes = 0, size-tn.size(stored, old)
+		}
+		if refused = !tn.reserve(keys, bytes); refused {
+			keys, bytes = 0, 0
+			return old, false
+		}
+		return value, true
+	}, 0)
+	if err != nil {
+		tn.keys.Add(-keys)
+		tn.bytes.Add(-bytes)
+		return err
+	}
+	if refused {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// Get returns a pointer to the value stored for key in the tenant, or nil
+// if key is not present.
+func (tn *Tenant[V]) Get(key string) *V {
+	return tn.tree.Get(tn.prefix + key)
+}
+
+// Delete removes key from the tenant and returns its value, or nil if key
+// was not present.
+func (tn *Tenant[V]) Delete(key string) *V {
+	v, _ := tn.DeleteCtx(context.Background(), key)
+	return v
+}
+
+// DeleteCtx is like Delete but stops retrying once ctx is done or the
+// backoff policy gives up, returning the reason.
+func (tn *Tenant[V]) DeleteCtx(ctx context.Context, key string) (*V, error) {
+	stored := tn.prefix + key
+	v, expired, err := tn.tree.deleteIf(ctx, stored, nil)
+	if v == nil {
+		return nil, err
+	}
+	// an expired key was counted against the quota like any other
+	tn.keys.Add(-1)
+	tn.bytes.Add(-tn.size(stored, *v))
+	if expired {
+		return nil, err
+	}
+	return v, err
+}
+
+// Range calls f for each key and value of the tenant in ascending key
+// order until f returns false, like RBTree.Range.
+func (tn *Tenant[V]) Range(f func(key string, value V) bool) {
+	tn.scan(func(stored string, value V) bool {
+		return f(stored[len(tn.prefix):], value)
+	})
+}
+
+// scan calls f with the stored keys of the tenant.
+func (tn *Tenant[V]) scan(f func(stored string, value V) bool) {
+	t := tn.tree
+	var value V
+	bucket := t.enter()
+	k, v := t.nearest(tn.prefix, false, true, &value)
+	for v != nil && strings.HasPrefix(k, tn.prefix) {
+		t.exit(bucket)
+		if !f(k, value) {
+			return
+		}
+		bucket = t.enter()
+		k, v = t.nearest(k, false, false, &value)
+	}
+	t.exit(bucket)
+}
@@ -0,0 +1,93 @@
+package rbtree_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iku50/rbtree-go"
+)
+
+func TestTenants(t *testing.T) {
+	tree := rbtree.New[string, int]()
+	tree.Insert("shared", 0)
+	tenants := rbtree.NewTenants(tree)
+	a, b := tenants.Tenant("a"), tenants.Tenant("a:b")
+	assert.Same(t, a, tenants.Tenant("a"))
+
+	assert.NoError(t, a.Insert("b:x", 1))
+	assert.NoError(t, b.Insert("x", 2))
+	assert.Equal(t, 1, *a.Get("b:x"), "ids and keys do not run into each other")
+	assert.Equal(t, 2, *b.Get("x"))
+	assert.Nil(t, a.Get("x"))
+	assert.Equal(t, 3, tree.Len())
+
+	a.SetQuota(rbtree.Quota{Keys: 2})
+	assert.NoError(t, a.Insert("c", 3))
+	assert.ErrorIs(t, a.Insert("d", 4), rbtree.ErrQuotaExceeded)
+	assert.Nil(t, a.Get("d"))
+	assert.NoError(t, a.Insert("c", 30), "replacing a value adds no key")
+	assert.Equal(t, rbtree.Quota{Keys: 2, Bytes: int64(len("1:ab:x") + len("1:ac"))}, a.Usage())
+	assert.NoError(t, b.Insert("y", 5), "other tenants are not limited")
+
+	var keys []string
+	a.Range(func(key string, value int) bool {
+		keys = append(keys, key)
+		return true
+	})
+	assert.Equal(t, []string{"b:x", "c"}, keys)
+
+	assert.Equal(t, 30, *a.Delete("c"))
+	assert.Nil(t, a.Delete("c"))
+	assert.NoError(t, a.Insert("d", 4))
+	assert.Equal(t, int64(2), a.Usage().Keys)
+
+	// a new registry counts what the tenants hold already
+	assert.Equal(t, rbtree.Quota{Keys: 2, Bytes: 12}, rbtree.NewTenants(tree).Tenant("a:b").Usage())
+}
+
+func TestTenantByteQuota(t *testing.T) {
+	tree := rbtree.New[string, []byte](rbtree.WithSizeOf(func(key string, value []byte) int {
+		return len(value)
+	}))
+	tn := rbtree.NewTenants(tree).Tenant("t")
+	tn.SetQuota(rbtree.Quota{Bytes: 100})
+	assert.NoError(t, tn.Insert("a", make([]byte, 60)))
+	assert.ErrorIs(t, tn.Insert("b", make([]byte, 60)), rbtree.ErrQuotaExceeded)
+	assert.ErrorIs(t, tn.Insert("a", make([]byte, 101)), rbtree.ErrQuotaExceeded)
+	assert.Len(t, *tn.Get("a"), 60)
+	assert.NoError(t, tn.Insert("a", make([]byte, 10)), "shrinking a value frees bytes")
+	assert.NoError(t, tn.Insert("b", make([]byte, 90)))
+	assert.Equal(t, rbtree.Quota{Keys: 2, Bytes: 100}, tn.Usage())
+
+	// deleting a key that has expired frees its bytes too
+	tree.InsertWithTTL("1:ta", make([]byte, 10), -1)
+	assert.Nil(t, tn.Delete("a"))
+	assert.Equal(t, rbtree.Quota{Keys: 1, Bytes: 90}, tn.Usage())
+}
+
+func TestTenantQuotaConcurrent(t *testing.T) {
+	tree := rbtree.New[string, int]()
+	tn := rbtree.NewTenants(tree).Tenant("t")
+	tn.SetQuota(rbtree.Quota{Keys: 50})
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				k := fmt.Sprint((g*7 + i) % 200)
+				if i%3 == 0 {
+					tn.Delete(k)
+				} else {
+					_ = tn.Insert(k, i)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.LessOrEqual(t, tree.Len(), 50)
+	assert.Equal(t, int64(tree.Len()), tn.Usage().Keys)
+}
@@ -0,0 +1,80 @@
+package rbtree
+
+import (
+	"context"
+)
+
+// maxTokenDepth bounds the depth given to WithWriteTokens, which needs
+// 2^(k+1) tokens.
+const maxTokenDepth = 12
+
+// writeTokens are the tokens of WithWriteTokens. A region is named by the
+// heap index of the path from the root to its depth-k ancestor: the root
+// is 1 and the children of region i are 2i and 2i+1. Targets shallower
+// than k share the token of the node they stop at.
+type writeTokens struct {
+	depth  int
+	tokens []chan struct{}
+}
+
+func newWriteTokens(depth int) *writeTokens {
+	w := &writeTokens{depth: depth, tokens: make([]chan struct{}, 2<<depth)}
+	for i := range w.tokens {
+		w.tokens[i] = make(chan struct{}, 1)
+	}
+	return w
+}
+
+// region follows key down at most depth levels and returns the heap index
+// of the path taken.
+func (t *RBTree[K, V]) region(ctx context.Context, op Op, key K) (int, error) {
+	var i int
+	err := t.retry(ctx, func() error {
+		i = 1
+		level := 0
+		_, err := t.descend(op, func(n *RBTreeNode[K, V]) *RBTreeNode[K, V] {
+			if level == t.tokens.depth {
+				return nil
+			}
+			level++
+			c := t.compare(key, n.key)
+			switch {
+			case c < 0:
+				if l := n.left.Load(); l != nil {
+					i = 2 * i
+					return l
+				}
+			case c > 0:
+				if r := n.right.Load(); r != nil {
+					i = 2*i + 1
+					return r
+				}
+			}
+			return nil
+		})
+		return err
+	})
+	return i, err
+}
+
+// claim takes the token of key's region for a write, waiting behind the
+// writers already holding it. The returned func gives the token back.
+// Rotations may move key to another region while the token is held; the
+// token only spaces writers out, the node locks keep them correct.
+func (t *RBTree[K, V]) claim(ctx context.Context, op Op, key K) (release func(), err error) {
+	i, err := t.region(ctx, op, key)
+	if err != nil {
+		return nil, err
+	}
+	token := t.tokens.tokens[i]
+	select {
+	case token <- struct{}{}:
+	default:
+		select {
+		case token <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return func() { <-token }, nil
+}
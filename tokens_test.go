@@ -0,0 +1,112 @@
+package rbtree
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteTokenRegion(t *testing.T) {
+	tree := New[int, int](WithWriteTokens(2))
+	ctx := context.Background()
+	i, err := tree.region(ctx, OpInsert, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, i)
+
+	for k := 0; k < 100; k++ {
+		tree.Insert(k, k)
+	}
+	root := tree.root.Load()
+	l, r := root.left.Load(), root.right.Load()
+	for _, c := range []struct {
+		key, region int
+	}{
+		{root.key, 1},
+		{l.key, 2},
+		{r.key, 3},
+		{l.left.Load().key, 4},
+		{0, 4},
+		{r.right.Load().key, 7},
+		{99, 7},
+	} {
+		i, err := tree.region(ctx, OpInsert, c.key)
+		assert.Nil(t, err)
+		assert.Equal(t, c.region, i, "key %d", c.key)
+	}
+
+	assert.Len(t, New[int, int](WithWriteTokens(0)).tokens.tokens, 2)
+	assert.Equal(t, maxTokenDepth, New[int, int](WithWriteTokens(100)).tokens.depth)
+	assert.Nil(t, New[int, int](WithWriteTokens(-1)).tokens)
+}
+
+func TestWriteTokenQueue(t *testing.T) {
+	tree := New[int, int](WithWriteTokens(1))
+	for k := 0; k < 100; k++ {
+		tree.Insert(k, k)
+	}
+	ctx := context.Background()
+	release, err := tree.claim(ctx, OpInsert, 0)
+	assert.Nil(t, err)
+
+	// A writer to the other side of the root is not held up.
+	tree.Insert(150, 150)
+	assert.Equal(t, 150, *tree.Get(150))
+
+	done := make(chan struct{})
+	go func() {
+		tree.Insert(-1, -1)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("insert ran while its region's token was held")
+	case <-time.After(10 * time.Millisecond):
+	}
+	short, cancel := context.WithTimeout(ctx, time.Millisecond)
+	defer cancel()
+	_, err = tree.DeleteCtx(short, 1)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 1, *tree.Get(1))
+
+	release()
+	<-done
+	assert.Equal(t, -1, *tree.Get(-1))
+	assert.Nil(t, tree.Check())
+}
+
+func TestWriteTokensConcurrent(t *testing.T) {
+	tree := New[int, int](WithWriteTokens(3))
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				k := (i*13 + g) % 500
+				if i%4 == 0 {
+					tree.Delete(k)
+				} else {
+					tree.Insert(k, i)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	assert.Nil(t, tree.Check())
+	n := 0
+	tree.Range(func(int, int) bool { n++; return true })
+	assert.Equal(t, n, tree.Len())
+}
+
+func BenchmarkInsertParallelWriteTokens(b *testing.B) {
+	tree := New[int, int](WithWriteTokens(4))
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			tree.Insert(rand.Int(), rand.Int())
+		}
+	})
+}
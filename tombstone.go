@@ -0,0 +1,158 @@
+package rbtree
+
+import (
+	"context"
+	"slices"
+)
+
+// rangeTombstone deletes the keys from lo up to but excluding hi that
+// were last written before generation gen.
+type rangeTombstone[K any] struct {
+	lo, hi K
+	gen    uint64
+}
+
+// TombstoneRange deletes the keys from lo up to but excluding hi in O(1):
+// it only records the range, however many keys it covers. It pauses
+// writers while it does, so that every write is either
+// before the tombstone, and covered by it, or after it and not.
+//
+// A covered key is treated like an expired one: Get, Range and the other
+// lookups pass it over and writes treat it as absent, so a key written
+// again after the tombstone is live. It stays in the tree, counted by Len,
+// Rank and Select, until Compact, a Sweep or a Delete of it removes it or
+// a write replaces it. Each lookup that lands on a key checks it against
+// every tombstone, so compact before they pile up.
+//
+// The changelog records no event for the tombstone itself; Compact logs
+// the deletes of the keys it removes. Snapshots and clones keep covered
+// keys as expired ones, which their reads, the encodings and LayeredIter
+// leave out. Split hands the tombstones to both halves and Join compacts
+// both trees first.
+func (t *RBTree[K, V]) TombstoneRange(lo, hi K) {
+	if t.compare(lo, hi) >= 0 {
+		return
+	}
+	// covered keys expire, so the clock is read from now on
+	t.expiring.Store(true)
+	t.tombMu.Lock()
+	defer t.tombMu.Unlock()
+	t.gate.Lock()
+	defer t.gate.Unlock()
+	var tombs []rangeTombstone[K]
+	if old := t.tombs.Load(); old != nil {
+		tombs = slices.Clone(*old)
+	}
+	tombs = append(tombs, rangeTombstone[K]{lo: lo, hi: hi, gen: t.tombGen.Add(1)})
+	t.tombs.Store(&tombs)
+	// the covered keys change without a write to note
+	if c := t.copying.Load(); c != nil {
+		c.void()
+	}
+}
+
+// buried reports whether a range tombstone covers n's key. n must be
+// pinned or held.
+func (t *RBTree[K, V]) buried(n *RBTreeNode[K, V]) bool {
+	return t.covered(n.key, n.seq)
+}
+
+// covered reports whether a range tombstone covers key written at
+// tombstone generation seq.
+func (t *RBTree[K, V]) covered(key K, seq uint64) bool {
+	tombs := t.tombs.Load()
+	if tombs == nil {
+		return false
+	}
+	for _, r := range *tombs {
+		if seq < r.gen && t.compare(key, r.lo) >= 0 && t.compare(key, r.hi) < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// expired reports whether n's key had expired by now or is covered by a
+// range tombstone, either of which makes it absent.
+func (t *RBTree[K, V]) expired(n *RBTreeNode[K, V], now int64) bool {
+	return n.expired(now) || t.buried(n)
+}
+
+// Compact removes the keys the range tombstones cover, and the expired
+// keys among them, and returns how many it removed. Like Sweep it visits
+// the keys of each range one by one and deletes through the delete
+// protocol, so it pauses no other operation. A tombstone is dropped once
+// its range was visited in full and every covered key in it deleted; a key
+// written after it is never covered again.
+func (t *RBTree[K, V]) Compact() int {
+	removed, _ := t.compact()
+	return removed
+}
+
+// compact is Compact that reports why a range could not be visited in
+// full, or a covered key in it deleted. Its tombstone is kept then.
+func (t *RBTree[K, V]) compact() (removed int, err error) {
+	tombs := t.tombs.Load()
+	if tombs == nil {
+		return 0, nil
+	}
+	ctx := context.Background()
+	now := t.now()
+	done := make(map[uint64]bool, len(*tombs))
+	for _, r := range *tombs {
+		k, inclusive := r.lo, true
+		// derr is the last delete of a covered key that failed
+		var rerr, derr error
+		for {
+			var (
+				v       *V
+				expired bool
+			)
+			from := k
+			rerr = t.retry(ctx, func() error {
+				var err error
+				k, v, expired, err = t.seek(from, false, inclusive, now, nil)
+				return err
+			})
+			if rerr == ErrCorrupted {
+				t.markCorrupted()
+			}
+			if rerr != nil || v == nil || t.compare(k, r.hi) >= 0 {
+				break
+			}
+			inclusive = false
+			if !expired {
+				continue
+			}
+			// a key written again meanwhile is live and stays
+			_, gone, err := t.deleteIf(ctx, k, func(V) bool { return false })
+			if err != nil {
+				derr = err
+			} else if gone {
+				removed++
+			}
+		}
+		if rerr == nil {
+			rerr = derr
+		}
+		if rerr != nil {
+			err = rerr
+			continue
+		}
+		done[r.gen] = true
+	}
+	t.tombMu.Lock()
+	defer t.tombMu.Unlock()
+	var rest []rangeTombstone[K]
+	if cur := t.tombs.Load(); cur != nil {
+		rest = slices.DeleteFunc(slices.Clone(*cur), func(r rangeTombstone[K]) bool {
+			return done[r.gen]
+		})
+	}
+	if len(rest) == 0 {
+		t.tombs.Store(nil)
+	} else {
+		t.tombs.Store(&rest)
+	}
+	return removed, err
+}
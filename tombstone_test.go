@@ -0,0 +1,157 @@
+package rbtree_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iku50/rbtree-go"
+)
+
+func TestTombstoneRange(t *testing.T) {
+	tree := rbtree.New[int, int]()
+	for i := 0; i < 10; i++ {
+		tree.Insert(i, i)
+	}
+	tree.TombstoneRange(3, 7)
+	tree.TombstoneRange(5, 5) // empty
+	assert.Nil(t, tree.Get(3))
+	assert.Nil(t, tree.Get(6))
+	assert.Equal(t, 7, *tree.Get(7))
+	assert.False(t, tree.Contains(4))
+	assert.Equal(t, []int{0, 1, 2, 7, 8, 9}, treeKeys(tree))
+	k, _ := tree.Ceiling(3)
+	assert.Equal(t, 7, k)
+	k, _ = tree.Floor(6)
+	assert.Equal(t, 2, k)
+	assert.Equal(t, 10, tree.Len(), "covered keys stay until compacted")
+
+	// writes treat a covered key as absent, and a key written after the
+	// tombstone is live
+	actual, loaded := tree.GetOrInsert(4, 40)
+	assert.False(t, loaded)
+	assert.Equal(t, 40, actual)
+	tree.Insert(5, 50)
+	assert.Equal(t, 50, *tree.Get(5))
+	assert.Nil(t, tree.Delete(6))
+	assert.Equal(t, []int{0, 1, 2, 4, 5, 7, 8, 9}, treeKeys(tree))
+
+	// a clone keeps covered keys as expired ones
+	clone := tree.Clone()
+	assert.Equal(t, []int{0, 1, 2, 4, 5, 7, 8, 9}, treeKeys(clone))
+
+	assert.Equal(t, 1, tree.Compact())
+	assert.Equal(t, 0, tree.Compact())
+	assert.Equal(t, 8, tree.Len())
+	assert.Equal(t, []int{0, 1, 2, 4, 5, 7, 8, 9}, treeKeys(tree))
+	assert.Nil(t, tree.Verify())
+}
+
+func TestTombstoneRangeSnapshots(t *testing.T) {
+	tree := rbtree.New[int, int]()
+	for i := 0; i < 10; i++ {
+		tree.Insert(i, i)
+	}
+	tree.TombstoneRange(0, 5)
+	want := []int{5, 6, 7, 8, 9}
+	s := tree.Snapshot()
+	var keys []int
+	s.Range(func(k, _ int) bool {
+		keys = append(keys, k)
+		return true
+	})
+	assert.Equal(t, want, keys)
+	assert.Nil(t, s.Get(2))
+
+	data, err := s.MarshalBinary()
+	assert.Nil(t, err)
+	back := rbtree.New[int, int]()
+	assert.Nil(t, back.UnmarshalBinary(data))
+	assert.Equal(t, want, treeKeys(back))
+	assert.Equal(t, len(want), back.Len())
+
+	keys, _ = collectLayered(rbtree.LayeredIter(s, rbtree.New[int, layeredEntry]()))
+	assert.Equal(t, want, keys)
+}
+
+// gateLimiter refuses writes while closed is set.
+type gateLimiter struct {
+	closed atomic.Bool
+}
+
+func (l *gateLimiter) Wait(ctx context.Context) error {
+	if l.closed.Load() {
+		return rbtree.ErrRetriesExhausted
+	}
+	return ctx.Err()
+}
+
+func TestCompactKeepsTombstone(t *testing.T) {
+	l := &gateLimiter{}
+	tree := rbtree.New[int, int](rbtree.WithWriteLimiter(l))
+	for i := 0; i < 10; i++ {
+		tree.Insert(i, i)
+	}
+	tree.TombstoneRange(2, 6)
+	// the deletes fail, so the tombstone stays to keep the keys covered
+	l.closed.Store(true)
+	assert.Equal(t, 0, tree.Compact())
+	assert.Nil(t, tree.Get(3))
+	assert.Equal(t, []int{0, 1, 6, 7, 8, 9}, treeKeys(tree))
+
+	l.closed.Store(false)
+	assert.Equal(t, 4, tree.Compact())
+	assert.Equal(t, 6, tree.Len())
+	assert.Nil(t, tree.Verify())
+}
+
+func TestTombstoneRangeSplitJoin(t *testing.T) {
+	tree := rbtree.New[int, int]()
+	for i := 0; i < 100; i++ {
+		tree.Insert(i, i)
+	}
+	tree.TombstoneRange(40, 60)
+	left, right := tree.Split(50)
+	assert.Len(t, treeKeys(left), 40)
+	assert.Len(t, treeKeys(right), 40)
+	right.Insert(55, 55)
+	assert.Equal(t, 55, *right.Get(55))
+
+	assert.Nil(t, left.Join(right))
+	assert.Equal(t, 81, left.Len())
+	assert.Equal(t, 81, len(treeKeys(left)))
+	assert.Nil(t, left.Verify())
+}
+
+func TestTombstoneRangeConcurrent(t *testing.T) {
+	tree := rbtree.New[int, int]()
+	for i := 0; i < 1000; i++ {
+		tree.Insert(i, i)
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 1000 + g; i < 2000; i += 4 {
+				tree.Insert(i, i)
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		tree.TombstoneRange(0, 1000)
+		tree.Compact()
+	}()
+	wg.Wait()
+	tree.Compact()
+	assert.Equal(t, 1000, tree.Len())
+	for _, k := range treeKeys(tree) {
+		assert.GreaterOrEqual(t, k, 1000)
+	}
+	assert.Nil(t, tree.Verify())
+}
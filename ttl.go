@@ -0,0 +1,142 @@
+package rbtree
+
+import (
+	"context"
+	"time"
+)
+
+// sweeper is the background goroutine started by StartSweeper.
+type sweeper struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// expired reports whether n's key had expired by now. A zero now expires
+// nothing.
+func (n *RBTreeNode[K, V]) expired(now int64) bool {
+	return expiredAt(n.deadline, now)
+}
+
+func expiredAt(deadline, now int64) bool {
+	return now != 0 && deadline != 0 && deadline <= now
+}
+
+// now is the time expiry is checked against, or 0 while no key of the
+// tree has ever been given a deadline, which spares the clock reads.
+func (t *RBTree[K, V]) now() int64 {
+	if !t.expiring.Load() {
+		return 0
+	}
+	return time.Now().UnixNano()
+}
+
+// InsertWithTTL sets the value for key, which expires once ttl has passed.
+// A ttl of zero or less stores the key already expired. Inserting the key
+// again replaces the deadline; Insert makes the key permanent, while
+// Update and GetOrInsert keep the deadline of a key that is present.
+//
+// An expired key is no longer returned by Get, Range or the other
+// lookups, and writes treat it as absent. It stays in the tree, counted by
+// Len, Rank and Select, until a Delete, a Sweep or the sweeper started by
+// StartSweeper removes it. Snapshots, clones, splits and joins keep the
+// deadlines, the batch operations do not. The serialized forms and exports
+// leave out the keys that have expired and drop the deadlines of the rest.
+func (t *RBTree[K, V]) InsertWithTTL(key K, value V, ttl time.Duration) {
+	_ = t.InsertWithTTLCtx(context.Background(), key, value, ttl)
+}
+
+// InsertWithTTLCtx is like InsertWithTTL but stops retrying once ctx is
+// done or the backoff policy gives up, returning the reason.
+func (t *RBTree[K, V]) InsertWithTTLCtx(ctx context.Context, key K, value V, ttl time.Duration) error {
+	t.expiring.Store(true)
+	deadline := max(time.Now().Add(ttl).UnixNano(), 1)
+	_, _, err := t.update(ctx, key, func(V, bool) (V, bool) {
+		return value, true
+	}, deadline)
+	return err
+}
+
+// Sweep removes the keys that have expired and returns how many it
+// removed. It visits the keys one by one with lookups and deletes each
+// expired one through the delete protocol, so it runs alongside other
+// operations and pauses none of them.
+func (t *RBTree[K, V]) Sweep() int {
+	now := t.now()
+	if now == 0 {
+		return 0
+	}
+	ctx := context.Background()
+	var (
+		k       K
+		v       *V
+		expired bool
+	)
+	// next moves k to the first key after it, or to the smallest key
+	next := func(first bool) bool {
+		from := k
+		err := t.retry(ctx, func() error {
+			var err error
+			if first {
+				k, v, expired, err = t.edge(true, now, nil)
+			} else {
+				k, v, expired, err = t.seek(from, false, false, now, nil)
+			}
+			return err
+		})
+		if err == ErrCorrupted {
+			t.markCorrupted()
+		}
+		return err == nil && v != nil
+	}
+	removed := 0
+	for ok := next(true); ok; ok = next(false) {
+		if !expired {
+			continue
+		}
+		// a key given a new value meanwhile is not expired anymore and
+		// stays, as the match refuses every live key
+		_, gone, err := t.deleteIf(ctx, k, func(V) bool { return false })
+		if err == nil && gone {
+			removed++
+		}
+	}
+	return removed
+}
+
+// StartSweeper starts a goroutine that calls Sweep every interval, unless
+// one is running already. interval must be positive. StopSweeper stops
+// it.
+func (t *RBTree[K, V]) StartSweeper(interval time.Duration) {
+	t.sweepMu.Lock()
+	defer t.sweepMu.Unlock()
+	if t.sweeper != nil {
+		return
+	}
+	tick := time.NewTicker(interval)
+	s := &sweeper{stop: make(chan struct{}), done: make(chan struct{})}
+	t.sweeper = s
+	go func() {
+		defer close(s.done)
+		defer tick.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-tick.C:
+				t.Sweep()
+			}
+		}
+	}()
+}
+
+// StopSweeper stops the goroutine started by StartSweeper and waits for it
+// to finish its current sweep. It does nothing if none is running.
+func (t *RBTree[K, V]) StopSweeper() {
+	t.sweepMu.Lock()
+	defer t.sweepMu.Unlock()
+	if s := t.sweeper; s != nil {
+		close(s.stop)
+		<-s.done
+		t.sweeper = nil
+	}
+}
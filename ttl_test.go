@@ -0,0 +1,220 @@
+package rbtree_test
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iku50/rbtree-go"
+)
+
+func TestInsertWithTTL(t *testing.T) {
+	tree := rbtree.New[int, int]()
+	tree.Insert(1, 1)
+	tree.InsertWithTTL(2, 2, time.Hour)
+	tree.InsertWithTTL(3, 3, -1) // expired right away
+	tree.InsertWithTTL(4, 4, -1)
+
+	assert.Equal(t, 2, *tree.Get(2))
+	assert.Nil(t, tree.Get(3))
+	assert.Equal(t, []int{1, 2}, treeKeys(tree))
+	k, v := tree.Ceiling(3)
+	assert.Nil(t, v, "ceiling %d", k)
+	k, _ = tree.Floor(4)
+	assert.Equal(t, 2, k)
+	k, _ = tree.Max()
+	assert.Equal(t, 2, k)
+	assert.Equal(t, 4, tree.Len(), "expired keys stay until removed")
+
+	// writes treat an expired key as absent
+	actual, loaded := tree.GetOrInsert(3, 30)
+	assert.False(t, loaded)
+	assert.Equal(t, 30, actual)
+	assert.Equal(t, 30, *tree.Get(3), "GetOrInsert makes the key permanent")
+	assert.Nil(t, tree.Delete(4))
+	assert.Equal(t, 3, tree.Len())
+
+	// Update keeps the deadline, Insert drops it
+	tree.InsertWithTTL(5, 5, -1)
+	tree.Update(2, func(old int, ok bool) (int, bool) { return old + 1, ok })
+	assert.Equal(t, 3, *tree.Get(2))
+	tree.Insert(5, 50)
+	assert.Equal(t, 50, *tree.Get(5))
+
+	tree.InsertWithTTL(1, 1, -1)
+	assert.Equal(t, 1, tree.Sweep())
+	assert.Equal(t, 0, tree.Sweep())
+	assert.Equal(t, []int{2, 3, 5}, treeKeys(tree))
+	assert.Equal(t, uint64(2), tree.Stats().Expired)
+	assert.Nil(t, tree.Verify())
+}
+
+func TestTTLSnapshots(t *testing.T) {
+	tree := rbtree.New[int, int]()
+	for k := 0; k < 10; k++ {
+		if k%3 == 0 {
+			tree.Insert(k, k)
+		} else {
+			tree.InsertWithTTL(k, k, -1)
+		}
+	}
+	want := []int{0, 3, 6, 9}
+	s := tree.Snapshot()
+	var keys []int
+	s.Range(func(k, _ int) bool {
+		keys = append(keys, k)
+		return true
+	})
+	assert.Equal(t, want, keys)
+	assert.Nil(t, s.Get(1))
+	assert.Equal(t, 3, *s.Get(3))
+	assert.Equal(t, want, treeKeys(s.Tree()))
+
+	// the encodings leave the expired keys out
+	data, err := s.MarshalBinary()
+	assert.Nil(t, err)
+	back := rbtree.New[int, int]()
+	assert.Nil(t, back.UnmarshalBinary(data))
+	assert.Nil(t, back.Get(1))
+	assert.Equal(t, want, treeKeys(back))
+	assert.Equal(t, len(want), back.Len())
+	assert.Nil(t, back.Verify())
+	data, err = s.MarshalJSON()
+	assert.Nil(t, err)
+	back = rbtree.New[int, int]()
+	assert.Nil(t, back.UnmarshalJSON(data))
+	assert.Equal(t, want, treeKeys(back))
+	assert.Nil(t, back.Verify())
+}
+
+func TestTTLBatchOverwrites(t *testing.T) {
+	// a small batch goes down the tree, a large one is merged
+	for _, size := range []int{1000, 10} {
+		tree := rbtree.New[int, int]()
+		for k := 0; k < size; k++ {
+			tree.InsertWithTTL(k, k, -1)
+		}
+		tree.InsertBatch([]rbtree.KV[int, int]{{Key: 5, Value: 50}, {Key: 7, Value: 70}})
+		assert.Equal(t, 50, *tree.Get(5), "size %d", size)
+		assert.Equal(t, 70, *tree.Get(7), "size %d", size)
+		assert.Nil(t, tree.Get(6), "size %d", size)
+
+		other := rbtree.New[int, int]()
+		other.Insert(6, 60)
+		tree.Merge(other)
+		assert.Equal(t, 60, *tree.Get(6), "size %d", size)
+		other.Insert(8, 80)
+		_, err := tree.MergeCtx(context.Background(), other)
+		assert.Nil(t, err)
+		assert.Equal(t, 80, *tree.Get(8), "size %d", size)
+		assert.Nil(t, tree.Verify())
+	}
+}
+
+func TestTTLLookupsSkipExpired(t *testing.T) {
+	for round := 0; round < 20; round++ {
+		tree := rbtree.New[int, int]()
+		var live []int
+		for _, k := range rand.Perm(200) {
+			// long runs of expired keys make the live neighbours sit in
+			// subtrees the first walk passes by
+			if k/20%2 == 0 && rand.IntN(4) > 0 {
+				tree.InsertWithTTL(k, k, -1)
+				continue
+			}
+			tree.Insert(k, k)
+			live = append(live, k)
+		}
+		sorted := treeKeys(tree)
+		assert.ElementsMatch(t, live, sorted)
+		for key := -1; key <= 200; key++ {
+			floor, ceiling := -1, -1
+			for _, k := range sorted {
+				if k <= key {
+					floor = k
+				}
+				if k >= key && ceiling < 0 {
+					ceiling = k
+				}
+			}
+			if k, v := tree.Floor(key); floor < 0 {
+				assert.Nil(t, v)
+			} else {
+				assert.Equal(t, floor, k, "floor %d", key)
+			}
+			if k, v := tree.Ceiling(key); ceiling < 0 {
+				assert.Nil(t, v)
+			} else {
+				assert.Equal(t, ceiling, k, "ceiling %d", key)
+			}
+		}
+		if len(sorted) > 0 {
+			k, _ := tree.Min()
+			assert.Equal(t, sorted[0], k)
+		}
+		assert.Equal(t, 200-len(live), tree.Sweep())
+		assert.Equal(t, len(live), tree.Len())
+		assert.Nil(t, tree.Verify())
+	}
+}
+
+func TestSweeper(t *testing.T) {
+	tree := rbtree.New[int, int]()
+	tree.StopSweeper() // not running
+	for k := 0; k < 100; k++ {
+		tree.InsertWithTTL(k, k, 10*time.Millisecond)
+	}
+	tree.Insert(100, 100)
+	tree.StartSweeper(time.Millisecond)
+	tree.StartSweeper(time.Millisecond) // running already
+	assert.Eventually(t, func() bool { return tree.Len() == 1 }, 5*time.Second, time.Millisecond)
+	tree.StopSweeper()
+	tree.StopSweeper()
+	assert.Equal(t, 100, *tree.Get(100))
+
+	// restarts after a stop
+	tree.InsertWithTTL(1, 1, -1)
+	tree.StartSweeper(time.Millisecond)
+	defer tree.StopSweeper()
+	assert.Eventually(t, func() bool { return tree.Len() == 1 }, 5*time.Second, time.Millisecond)
+}
+
+func TestSweeperConcurrent(t *testing.T) {
+	tree := rbtree.New[int, int](rbtree.WithNodePool())
+	tree.StartSweeper(100 * time.Microsecond)
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 3000; i++ {
+				k := rand.IntN(500)
+				switch rand.IntN(4) {
+				case 0:
+					tree.InsertWithTTL(k, k, time.Duration(rand.IntN(200))*time.Microsecond)
+				case 1:
+					tree.Insert(k+1000, k)
+				case 2:
+					if v := tree.Get(k + 1000); v != nil {
+						assert.Equal(t, k, *v)
+					}
+				default:
+					tree.Delete(k)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	time.Sleep(time.Millisecond)
+	tree.StopSweeper()
+	tree.Sweep()
+	assert.Nil(t, tree.Verify())
+	tree.Range(func(key, value int) bool {
+		assert.GreaterOrEqual(t, key, 1000)
+		return true
+	})
+}
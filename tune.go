@@ -0,0 +1,115 @@
+package rbtree
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Bounds and thresholds of the backoff tuner, see WithAutoTune.
+const (
+	tuneWindow  = 256 // retries observed between adjustments
+	tuneGood    = 0.8 // success rate above which waits are shortened
+	tuneBad     = 0.5 // success rate below which waits are lengthened
+	tuneMaxSpin = 64
+	tuneMinBase = 10 * time.Nanosecond
+	tuneMaxBase = 100 * time.Microsecond
+	tuneMinMax  = time.Microsecond
+	tuneMaxMax  = 10 * time.Millisecond
+)
+
+// tuner is a feedback controller for the spin and wait phases of a tree's
+// backoff. Retries report whether they found the node free; every
+// tuneWindow reports the success rate moves the policy one step.
+type tuner struct {
+	mu        sync.Mutex // held by the goroutine adjusting
+	spins     atomic.Int64
+	base, max atomic.Int64 // time.Duration
+	retries   atomic.Int64
+	successes atomic.Int64
+}
+
+func newTuner(b Backoff) *tuner {
+	u := &tuner{}
+	u.spins.Store(int64(min(max(b.Spins, 0), tuneMaxSpin)))
+	u.base.Store(int64(min(max(b.Base, tuneMinBase), tuneMaxBase)))
+	u.max.Store(int64(min(max(b.Max, tuneMinMax), tuneMaxMax)))
+	return u
+}
+
+// policy returns b with the tuned phases in place of its own.
+func (u *tuner) policy(b Backoff) Backoff {
+	b.Spins = int(u.spins.Load())
+	b.Base = time.Duration(u.base.Load())
+	b.Max = time.Duration(u.max.Load())
+	return b
+}
+
+// record reports the outcome of one retry.
+func (u *tuner) record(ok bool) {
+	if ok {
+		u.successes.Add(1)
+	}
+	if u.retries.Add(1) >= tuneWindow {
+		u.adjust()
+	}
+}
+
+// adjust consumes a window of reports and moves the policy. Retries that
+// mostly succeed were waiting longer than needed, so the wait shrinks and
+// more of it is spent spinning. Retries that mostly fail compete for the
+// same nodes, so spinning stops paying and the waits grow to spread the
+// competitors out.
+func (u *tuner) adjust() {
+	if !u.mu.TryLock() {
+		return
+	}
+	defer u.mu.Unlock()
+	n := u.retries.Load()
+	if n < tuneWindow {
+		return
+	}
+	u.retries.Add(-n)
+	rate := float64(u.successes.Swap(0)) / float64(n)
+	spins, base, limit := u.spins.Load(), time.Duration(u.base.Load()), time.Duration(u.max.Load())
+	switch {
+	case rate >= tuneGood:
+		spins = min(spins+1, tuneMaxSpin)
+		base = max(base/2, tuneMinBase)
+		limit = max(limit/2, tuneMinMax)
+	case rate < tuneBad:
+		spins /= 2
+		base = min(base*2, tuneMaxBase)
+		limit = min(limit*2, tuneMaxMax)
+	default:
+		return
+	}
+	u.spins.Store(spins)
+	u.base.Store(int64(base))
+	u.max.Store(int64(max(limit, base)))
+}
+
+// policy returns the backoff policy in effect.
+func (t *RBTree[K, V]) policy() Backoff {
+	if t.tune == nil {
+		return t.backoff
+	}
+	return t.tune.policy(t.backoff)
+}
+
+// pause waits before retry number attempt of a step that must not be
+// given up, see Backoff.pause.
+func (t *RBTree[K, V]) pause(attempt int) {
+	if t.yield {
+		runtime.Gosched()
+		return
+	}
+	t.policy().pause(attempt)
+}
+
+// Backoff returns the retry policy the tree currently uses. It is the one
+// given to WithBackoff unless the tree was built WithAutoTune.
+func (t *RBTree[K, V]) Backoff() Backoff {
+	return t.policy()
+}
@@ -0,0 +1,80 @@
+package rbtree
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoffSpins(t *testing.T) {
+	b := Backoff{Spins: 2, Base: time.Microsecond, Max: 8 * time.Microsecond}
+	assert.Equal(t, time.Duration(0), b.delay(0))
+	assert.Equal(t, time.Duration(0), b.delay(1))
+	assert.Equal(t, time.Microsecond, b.delay(2))
+	assert.Equal(t, 4*time.Microsecond, b.delay(4))
+}
+
+func TestTunerAdjust(t *testing.T) {
+	u := newTuner(DefaultBackoff)
+	start := u.policy(DefaultBackoff)
+	assert.Equal(t, 0, start.Spins)
+	assert.Equal(t, DefaultBackoff.Base, start.Base)
+	assert.Equal(t, DefaultBackoff.Max, start.Max)
+
+	// Failing retries spin less and wait longer, up to the bounds.
+	for i := 0; i < 100*tuneWindow; i++ {
+		u.record(false)
+	}
+	b := u.policy(DefaultBackoff)
+	assert.Equal(t, 0, b.Spins)
+	assert.Equal(t, tuneMaxBase, b.Base)
+	assert.Equal(t, tuneMaxMax, b.Max)
+	assert.Equal(t, DefaultBackoff.Jitter, b.Jitter)
+
+	// Succeeding retries spin more and wait less, down to the bounds.
+	for i := 0; i < 100*tuneWindow; i++ {
+		u.record(true)
+	}
+	b = u.policy(DefaultBackoff)
+	assert.Equal(t, tuneMaxSpin, b.Spins)
+	assert.Equal(t, tuneMinBase, b.Base)
+	assert.Equal(t, tuneMinMax, b.Max)
+
+	// A success rate between the thresholds holds the policy.
+	for i := 0; i < 10*tuneWindow; i++ {
+		u.record(i%3 != 0)
+	}
+	assert.Equal(t, b, u.policy(DefaultBackoff))
+}
+
+func TestAutoTuneContended(t *testing.T) {
+	tree := New[int, int](WithAutoTune(), WithBackoff(Backoff{Base: time.Microsecond, Max: time.Millisecond}))
+	assert.Equal(t, time.Microsecond, tree.Backoff().Base)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				k := (i*7 + g) % 64
+				if i%3 == 0 {
+					tree.Delete(k)
+				} else {
+					tree.Insert(k, i)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	assert.Nil(t, tree.Check())
+
+	b := tree.Backoff()
+	assert.GreaterOrEqual(t, b.Base, tuneMinBase)
+	assert.LessOrEqual(t, b.Base, tuneMaxBase)
+	assert.GreaterOrEqual(t, b.Max, b.Base)
+	assert.LessOrEqual(t, b.Spins, tuneMaxSpin)
+	assert.Equal(t, DefaultBackoff, New[int, int]().Backoff())
+}
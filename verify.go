@@ -0,0 +1,152 @@
+package rbtree
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrOrder         = errors.New("keys out of order")
+	ErrParentLink    = errors.New("parent pointer mismatch")
+	ErrCountMismatch = errors.New("key count mismatch")
+	ErrLeftLocked    = errors.New("node left locked")
+)
+
+// VerifyError tells where Verify found the tree broken.
+type VerifyError struct {
+	Path []any // keys from the root down to the offending node
+	Err  error // the broken invariant
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("%v at key path %v", e.Err, e.Path)
+}
+
+func (e *VerifyError) Unwrap() error {
+	return e.Err
+}
+
+// DebugStats describes the shape of a tree, see RBTree.DebugStats.
+type DebugStats struct {
+	Nodes       int
+	RedNodes    int
+	BlackNodes  int
+	Height      int           // nodes on the longest path from the root, 0 when empty
+	BlackHeight int           // black nodes on every path from the root
+	MaxLockWait time.Duration // longest an operation waited out locked nodes
+}
+
+// verifier walks a quiescent tree for Verify and DebugStats.
+type verifier[K any, V any] struct {
+	t     *RBTree[K, V]
+	path  []K
+	stats DebugStats
+}
+
+func (v *verifier[K, V]) fail(err error) error {
+	path := make([]any, len(v.path))
+	for i, k := range v.path {
+		path[i] = k
+	}
+	return &VerifyError{Path: path, Err: err}
+}
+
+// walk verifies the subtree below n, whose keys must lie between lo and hi
+// where those are not nil, and returns its black height.
+func (v *verifier[K, V]) walk(n, parent, lo, hi *RBTreeNode[K, V]) (int, error) {
+	if n == nil {
+		return 0, nil
+	}
+	v.path = append(v.path, n.key)
+	defer func() { v.path = v.path[:len(v.path)-1] }()
+	if len(v.path) > v.t.maxDepth() {
+		return 0, v.fail(ErrCorrupted)
+	}
+	v.stats.Nodes++
+	v.stats.Height = max(v.stats.Height, len(v.path))
+	switch {
+	case n.parent.Load() != parent:
+		return 0, v.fail(ErrParentLink)
+	case lo != nil && v.t.compare(lo.key, n.key) >= 0, hi != nil && v.t.compare(n.key, hi.key) >= 0:
+		return 0, v.fail(ErrOrder)
+	case n.flag.Load() || n.retired.Load() || n.marker.Load() || n.extra != 0:
+		return 0, v.fail(ErrLeftLocked)
+	case n.isRed() && (n.left.Load().isRed() || n.right.Load().isRed()):
+		return 0, v.fail(ErrParentChildDoublRed)
+	}
+	black := 0
+	if n.isRed() {
+		v.stats.RedNodes++
+	} else {
+		v.stats.BlackNodes++
+		black = 1
+	}
+	lb, err := v.walk(n.left.Load(), n, lo, n)
+	if err != nil {
+		return 0, err
+	}
+	rb, err := v.walk(n.right.Load(), n, n, hi)
+	if err != nil {
+		return 0, err
+	}
+	if lb != rb {
+		return 0, v.fail(ErrBlackHeightMisMatch)
+	}
+	if !v.t.ordered {
+		return lb + black, nil
+	}
+	size := 1 + n.left.Load().weight() + n.right.Load().weight()
+	if n.size != size || parent != nil && n.reported != size {
+		return 0, v.fail(ErrSizeMismatch)
+	}
+	return lb + black, nil
+}
+
+// verify pauses writers and walks the whole tree.
+func (t *RBTree[K, V]) verify() (DebugStats, error) {
+	t.gate.Lock()
+	defer t.gate.Unlock()
+	v := verifier[K, V]{t: t}
+	v.stats.MaxLockWait = time.Duration(t.stats.maxLockWait.Load())
+	r := t.root.Load()
+	if t.corrupt.Load() {
+		return v.stats, ErrCorrupted
+	}
+	bh, err := v.walk(r, nil, nil, nil)
+	if err != nil {
+		if t.hist != nil {
+			t.hist.push(capture[K]{muts: t.hist.muts.Load(), nodes: t.shape(r, nil, t.maxDepth())})
+		}
+		if errors.Is(err, ErrCorrupted) {
+			t.markCorrupted()
+		} else {
+			t.reportCorruption(err)
+		}
+		return v.stats, err
+	}
+	v.stats.BlackHeight = bh
+	if n := t.Len(); n != v.stats.Nodes {
+		return v.stats, fmt.Errorf("%w: %d keys counted, %d linked", ErrCountMismatch, n, v.stats.Nodes)
+	}
+	return v.stats, nil
+}
+
+// Verify is a thorough Check. It pauses writers, so that
+// the operations in flight finish first, and then checks every invariant
+// of the tree: key order, parent pointers, colors, black heights, the
+// subtree sizes of a tree built WithOrderStatistics, the key count, and
+// that no node is left locked or owing a fixup.
+// A violation at a node is reported as a *VerifyError holding the keys on
+// the path to it.
+func (t *RBTree[K, V]) Verify() error {
+	_, err := t.verify()
+	return err
+}
+
+// DebugStats pauses writers and reports the shape of the tree. It also
+// verifies the tree like Verify and returns the shape found up to where
+// verification failed, with the error.
+func (t *RBTree[K, V]) DebugStats() (DebugStats, error) {
+	return t.verify()
+}
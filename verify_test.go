@@ -0,0 +1,110 @@
+package rbtree
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func verifyTree(t *testing.T) *RBTree[int, int] {
+	tree := New[int, int](WithOrderStatistics())
+	for k := 0; k < 100; k++ {
+		tree.Insert(k, k)
+	}
+	assert.Nil(t, tree.Verify())
+	return tree
+}
+
+func TestVerifyFindings(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		corrupt func(tree *RBTree[int, int]) *RBTreeNode[int, int]
+		err     error
+	}{
+		{"order", func(tree *RBTree[int, int]) *RBTreeNode[int, int] {
+			n := tree.root.Load().left.Load()
+			n.key = 1000
+			return n
+		}, ErrOrder},
+		{"parent", func(tree *RBTree[int, int]) *RBTreeNode[int, int] {
+			n := tree.root.Load().right.Load().left.Load()
+			n.parent.Store(tree.root.Load())
+			return n
+		}, ErrParentLink},
+		{"locked", func(tree *RBTree[int, int]) *RBTreeNode[int, int] {
+			n := tree.root.Load().right.Load()
+			n.flag.Store(true)
+			return n
+		}, ErrLeftLocked},
+		{"size", func(tree *RBTree[int, int]) *RBTreeNode[int, int] {
+			n := tree.root.Load().left.Load()
+			n.size++
+			return n
+		}, ErrSizeMismatch},
+	} {
+		tree := verifyTree(t)
+		n := c.corrupt(tree)
+		err := tree.Verify()
+		assert.ErrorIs(t, err, c.err, c.name)
+		var ve *VerifyError
+		if assert.True(t, errors.As(err, &ve), c.name) {
+			assert.Equal(t, tree.root.Load().key, ve.Path[0], c.name)
+			assert.Equal(t, n.key, ve.Path[len(ve.Path)-1], c.name)
+		}
+	}
+
+	tree := verifyTree(t)
+	tree.count.Add(1)
+	assert.ErrorIs(t, tree.Verify(), ErrCountMismatch)
+}
+
+func TestDebugStats(t *testing.T) {
+	s, err := New[int, int]().DebugStats()
+	assert.Nil(t, err)
+	assert.Equal(t, DebugStats{}, s)
+
+	tree := verifyTree(t)
+	s, err = tree.DebugStats()
+	assert.Nil(t, err)
+	assert.Equal(t, 100, s.Nodes)
+	assert.Equal(t, 100, s.RedNodes+s.BlackNodes)
+	assert.GreaterOrEqual(t, s.Height, 7)
+	assert.LessOrEqual(t, s.Height, 2*s.BlackHeight+1)
+}
+
+func TestVerifyConcurrent(t *testing.T) {
+	tree := New[int, int]()
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 3000; i++ {
+				k := (i*7 + g) % 300
+				if i%3 == 0 {
+					tree.Delete(k)
+				} else {
+					tree.Insert(k, i)
+				}
+			}
+		}(g)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		assert.Nil(t, tree.Verify())
+	}
+	s, err := tree.DebugStats()
+	assert.Nil(t, err)
+	assert.Equal(t, tree.Len(), s.Nodes)
+}